@@ -0,0 +1,119 @@
+package tftpd
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"strings"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// ACLRule allows reading and/or writing the paths matching Path for the
+// clients in Clients, or any client if it's empty. Path is a slash separated
+// glob (see path.Match) where "**" matches any number of directories.
+type ACLRule struct {
+	Path    string         `json:"path"`
+	Clients []netip.Prefix `json:"clients,omitempty"`
+	Read    bool           `json:"read"`
+	Write   bool           `json:"write"`
+}
+
+// ACL is a list of rules, the first rule matching both the path and the
+// client decides. Requests without a matching rule are denied.
+type ACL []ACLRule
+
+// Validate checks the patterns of all rules.
+func (acl ACL) Validate() error {
+	for _, rule := range acl {
+		for _, part := range strings.Split(rule.Path, "/") {
+			if _, err := path.Match(part, ""); err != nil {
+				return fmt.Errorf("Incorrect ACL path '%v': %v", rule.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether the client may read (or write) the file. The
+// name is cleaned as it is before it's opened, so "pub/../secret" is
+// decided as "secret".
+func (acl ACL) Allowed(client net.Addr, filename string, write bool) bool {
+	filename = cleanName(filename)
+	ip := addrIP(client)
+
+	for _, rule := range acl {
+		if !matchGlob(rule.Path, filename) || !rule.matchClient(ip) {
+			continue
+		}
+		if write {
+			return rule.Write
+		}
+		return rule.Read
+	}
+	return false
+}
+
+func (rule *ACLRule) matchClient(ip netip.Addr) bool {
+	if len(rule.Clients) == 0 {
+		return true
+	}
+	for _, prefix := range rule.Clients {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of a UDP address, IPv4-mapped addresses as IPv4.
+func addrIP(addr net.Addr) netip.Addr {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		if ip, ok := netip.AddrFromSlice(udp.IP); ok {
+			return ip.Unmap()
+		}
+	}
+	return netip.Addr{}
+}
+
+// matchGlob matches a slash separated name against a pattern where "**"
+// matches any number of path elements and the others follow path.Match.
+func matchGlob(pattern, name string) bool {
+	return matchParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// checkACL rejects requests the ACL doesn't allow and uploads to a
+// read-only server.
+func (tftp *TFTPServer) checkACL(cli *client, req *request) error {
+	if (tftp.ReadOnly || tftp.ServeFile != "") && req.opcode == wire.OpWRQ {
+		cli.logf("Client '%v' can't upload '%v' to a read-only server\n", cli.tid.String(), req.filename)
+		return ErrAccessViolation
+	}
+	if tftp.ACL == nil || tftp.ACL.Allowed(cli.tid, req.filename, req.opcode == wire.OpWRQ) {
+		return nil
+	}
+	cli.logf("Client '%v' isn't allowed to access '%v'\n", cli.tid.String(), req.filename)
+	return ErrAccessViolation
+}
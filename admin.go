@@ -0,0 +1,157 @@
+package tftpd
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// number of failed transfers kept for RecentFailures
+const maxRecentFailures = 32
+
+var errCancelled = NewError(CodeNotDefined, "Transfer cancelled.")
+
+// SessionInfo describes a transfer in flight.
+type SessionInfo struct {
+	ID       string `json:"id"`
+	Client   string `json:"client"`
+	Filename string `json:"filename"`
+	// Direction is "read" for downloads and "write" for uploads.
+	Direction string `json:"direction"`
+	// Bytes transferred so far of Size, -1 if the size isn't known.
+	Bytes       int64     `json:"bytes"`
+	Size        int64     `json:"size"`
+	BlockSize   int       `json:"blksize"`
+	WindowSize  int       `json:"windowsize"`
+	Retransmits int       `json:"retransmits"`
+	Start       time.Time `json:"start"`
+}
+
+// Sessions returns the transfers in flight, the oldest first. It's safe to
+// call while the server is running, but not from its hooks.
+func (tftp *TFTPServer) Sessions() []SessionInfo {
+	var sessions []SessionInfo
+	tftp.inLoop(func() {
+		for _, cli := range tftp.connections {
+			sessions = append(sessions, cli.info())
+		}
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Start.Before(sessions[j].Start) })
+	return sessions
+}
+
+// CancelSession ends the transfer with the ID of the session, the client
+// gets an ERROR. It reports whether the session was found, and is safe to
+// call while the server is running, but not from its hooks.
+func (tftp *TFTPServer) CancelSession(id string) bool {
+	found := false
+	tftp.inLoop(func() {
+		for _, cli := range tftp.connections {
+			if cli.id == id {
+				cli.logf("Transfer of '%v' cancelled\n", cli.filename)
+				tftp.handleError(cli, errCancelled)
+				found = true
+				return
+			}
+		}
+	})
+	return found
+}
+
+func (cli *client) info() SessionInfo {
+	info := SessionInfo{
+		ID:          cli.id,
+		Client:      cli.tid.String(),
+		Filename:    cli.filename,
+		Direction:   "read",
+		Bytes:       cli.bytes,
+		Size:        -1,
+		BlockSize:   cli.blockSize,
+		WindowSize:  cli.window(),
+		Retransmits: cli.retransmits,
+		Start:       cli.start,
+	}
+	if cli.opcode == wire.OpWRQ {
+		info.Direction = "write"
+		if v, ok := cli.oack.Get("tsize"); ok {
+			if size, err := strconv.ParseInt(v, 10, 64); err == nil {
+				info.Size = size - cli.offset
+			}
+		}
+	} else if cli.bytesLeft >= 0 && cli.inited {
+		info.Size = cli.bytes + cli.bytesLeft
+	}
+	return info
+}
+
+// RecentFailures returns the last failed transfers, the latest first.
+func (tftp *TFTPServer) RecentFailures() []AuditRecord {
+	tftp.mu.Lock()
+	defer tftp.mu.Unlock()
+	failures := make([]AuditRecord, len(tftp.failures))
+	for i, rec := range tftp.failures {
+		failures[len(failures)-1-i] = rec
+	}
+	return failures
+}
+
+func (tftp *TFTPServer) recordFailure(rec AuditRecord) {
+	tftp.mu.Lock()
+	defer tftp.mu.Unlock()
+	if len(tftp.failures) >= maxRecentFailures {
+		tftp.failures = append(tftp.failures[:0], tftp.failures[1:]...)
+	}
+	tftp.failures = append(tftp.failures, rec)
+}
+
+// inLoop runs f in the packet loop and waits for it, or right away if the
+// server isn't running.
+func (tftp *TFTPServer) inLoop(f func()) {
+	tftp.mu.Lock()
+	if !tftp.running {
+		defer tftp.mu.Unlock()
+		f()
+		return
+	}
+	done := make(chan struct{})
+	tftp.reconfigure = append(tftp.reconfigure, func(*TFTPServer) {
+		f()
+		close(done)
+	})
+	tftp.mu.Unlock()
+	tftp.wake()
+	<-done
+}
+
+// wake interrupts the packet loop waiting for packets.
+func (tftp *TFTPServer) wake() {
+	tftp.mu.Lock()
+	listener := tftp.listener
+	tftp.mu.Unlock()
+	listener.SetReadDeadline(time.Now())
+}
+
+// pending reports whether there are changes for the packet loop, a wake up
+// may have been overwritten with the next read deadline.
+func (tftp *TFTPServer) pending() bool {
+	tftp.mu.Lock()
+	defer tftp.mu.Unlock()
+	return len(tftp.reconfigure) > 0
+}
+
+// startLoop and stopLoop mark the packet loop as running, changes queued
+// while it stops are applied on its way out.
+func (tftp *TFTPServer) startLoop() {
+	tftp.mu.Lock()
+	tftp.running = true
+	tftp.mu.Unlock()
+}
+
+func (tftp *TFTPServer) stopLoop() {
+	tftp.mu.Lock()
+	tftp.running = false
+	tftp.mu.Unlock()
+	tftp.applyReconfigure()
+}
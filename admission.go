@@ -0,0 +1,28 @@
+package tftpd
+
+var errBusy = NewError(CodeNotDefined, "Server busy, try again later.")
+
+// Descriptors kept free for the sockets, logs and the like, see admission.
+const fdReserve = 64
+
+// admission refuses new sessions while the server is saturated, rather
+// than letting them time out: with RejectWhenFull while all sessions are
+// in use, and while file descriptors are running out.
+func (tftp *TFTPServer) admission() error {
+	// every session holds a file at most, besides the cached ones
+	if limit := fdLimit(); limit > 0 && len(tftp.connections)+tftp.files.idleLen()+fdReserve >= limit {
+		return tftp.busy()
+	}
+	if tftp.RejectWhenFull && len(tftp.connections) >= tftp.maxSessions() {
+		return tftp.busy()
+	}
+	return nil
+}
+
+// busy is the answer to a request refused while the server is saturated.
+func (tftp *TFTPServer) busy() error {
+	if tftp.DropWhenBusy {
+		return errDropped
+	}
+	return errBusy
+}
@@ -0,0 +1,133 @@
+package tftpd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// Allowlist is the list of files which may be downloaded, optionally with
+// their SHA-256, so only vetted artifacts are ever served. It's only used
+// by the packet loop, replace it with Reconfigure.
+type Allowlist struct {
+	files map[string]string
+
+	// files whose hash matched, by size and modification time
+	verified map[string]fileVersion
+}
+
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+// ReadAllowlist reads a list with a filename and optionally its SHA-256 in
+// hex per line, like the output of sha256sum. Empty lines and lines
+// starting with # are ignored.
+func ReadAllowlist(r io.Reader) (*Allowlist, error) {
+	list := &Allowlist{files: make(map[string]string), verified: make(map[string]fileVersion)}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		// sha256sum writes the hash first
+		name, sum := fields[0], ""
+		if len(fields) == 2 && isSHA256(fields[0]) {
+			name, sum = strings.TrimPrefix(fields[1], "*"), fields[0]
+		} else if len(fields) == 2 && isSHA256(fields[1]) {
+			sum = fields[1]
+		} else if len(fields) != 1 {
+			return nil, fmt.Errorf("Incorrect allowlist line %d.", n)
+		}
+		list.files[cleanName(name)] = strings.ToLower(sum)
+	}
+	return list, scanner.Err()
+}
+
+// OpenAllowlist reads the allowlist at path.
+func OpenAllowlist(path string) (*Allowlist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadAllowlist(f)
+}
+
+// Allowed reports whether the file is listed.
+func (list *Allowlist) Allowed(filename string) bool {
+	_, ok := list.files[cleanName(filename)]
+	return ok
+}
+
+// verify checks the hash of the file at path if the list has one.
+func (list *Allowlist) verify(filename, path string) error {
+	sum := list.files[cleanName(filename)]
+	if sum == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fsError(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	version := fileVersion{fi.Size(), fi.ModTime()}
+	if list.verified[path] == version {
+		return nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != sum {
+		return fmt.Errorf("'%v' doesn't match its hash in the allowlist", filename)
+	}
+	list.verified[path] = version
+	return nil
+}
+
+// checkAllowlist rejects downloads of files which aren't listed or don't
+// match their hash.
+func (tftp *TFTPServer) checkAllowlist(cli *client, req *request) error {
+	if tftp.Allowlist == nil || req.opcode != wire.OpRRQ {
+		return nil
+	}
+	if !tftp.Allowlist.Allowed(req.filename) {
+		cli.logf("Client '%v' requested '%v', which isn't in the allowlist\n", cli.tid.String(), req.filename)
+		return ErrAccessViolation
+	}
+	if err := tftp.Allowlist.verify(req.filename, cli.path(req.filename)); errors.Is(err, ErrFileNotFound) {
+		return err
+	} else if err != nil {
+		cli.logf("error while verifying '%v': '%v'\n", req.filename, err)
+		return ErrAccessViolation
+	}
+	return nil
+}
+
+func cleanName(filename string) string {
+	return strings.TrimPrefix(path.Clean("/"+filename), "/")
+}
+
+func isSHA256(s string) bool {
+	_, err := hex.DecodeString(s)
+	return len(s) == 2*sha256.Size && err == nil
+}
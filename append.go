@@ -0,0 +1,64 @@
+package tftpd
+
+import (
+	"os"
+	"strconv"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// AppendOption is the vendor option with which a WRQ appends to the file
+// instead of failing if it exists, e.g. for log shipping from embedded
+// devices, see TFTPServer.Append. Its value is "1" or "0".
+const AppendOption = "x-append"
+
+func (tftp *TFTPServer) negotiateAppend(cli *client, req *request, opt wire.Option) error {
+	if !tftp.Append || req.opcode != wire.OpWRQ {
+		return nil
+	}
+	on, err := strconv.ParseBool(opt.Value)
+	if err != nil {
+		return optionError(opt)
+	}
+	cli.append = on
+	cli.oack.Set(opt.Name, opt.Value)
+	return nil
+}
+
+// openAppend opens the file of an appending upload, creating it if needed.
+func (cli *client) openAppend(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cli.offset = fi.Size()
+	return f, nil
+}
+
+// discardUpload closes and removes a rejected or failed upload, appending
+// and resumed uploads only remove what they wrote. The open file is
+// truncated, the name may be another file by now.
+func (cli *client) discardUpload() error {
+	if cli.sink != nil {
+		// aborted by closeFile, there's no file
+		cli.closeFile()
+		return nil
+	}
+	if cli.append || cli.resume {
+		// nothing may be written after the truncation
+		cli.flushWrites()
+		if cli.file == nil {
+			return os.Truncate(cli.path(cli.filename), cli.offset)
+		}
+		err := cli.file.Truncate(cli.offset)
+		cli.closeFile()
+		return err
+	}
+	cli.closeFile()
+	return os.Remove(cli.path(cli.filename))
+}
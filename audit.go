@@ -0,0 +1,148 @@
+package tftpd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// AuditRecord describes a completed or failed transfer.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Session  string    `json:"session"`
+	Client   string    `json:"client"`
+	Filename string    `json:"filename"`
+	// Direction is "read" for downloads (RRQ) and "write" for uploads (WRQ).
+	Direction string        `json:"direction"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"duration_ns"`
+	// Result is "ok" or "error".
+	Result string `json:"result"`
+	// ErrorCode is the code sent to or received from the client, Error
+	// describes the failure, e.g. timeouts which have no code.
+	ErrorCode ErrorCode `json:"error_code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	// Retransmits counts the packets sent again, Options are the
+	// negotiated options.
+	Retransmits int               `json:"retransmits"`
+	Options     map[string]string `json:"options,omitempty"`
+}
+
+// AuditLog writes one JSON record per line, separate from the diagnostic log.
+type AuditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// OpenAuditLog appends to the file at path, creating it if needed.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditLog(f), nil
+}
+
+// Write appends a record, every record is a single write.
+func (a *AuditLog) Write(rec AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the underlying writer if it's a file or another io.Closer.
+func (a *AuditLog) Close() error {
+	if c, ok := a.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// audit records the end of a session, failed ones have cli.failure set.
+func (tftp *TFTPServer) audit(cli *client) {
+	if cli.start.IsZero() {
+		return
+	}
+
+	rec := tftp.record(cli)
+	logSummary(rec, cli.oack)
+	if cli.failure != nil {
+		tftp.recordFailure(rec)
+	}
+	if tftp.OnTransfer != nil {
+		tftp.OnTransfer(rec)
+	}
+	tftp.publish(eventType(rec), rec)
+
+	if tftp.Audit == nil {
+		return
+	}
+	if err := tftp.Audit.Write(rec); err != nil {
+		log.Printf("error while writing audit record: '%v'\n", err)
+	}
+}
+
+// record describes the session so far.
+func (tftp *TFTPServer) record(cli *client) AuditRecord {
+	rec := AuditRecord{
+		Time:        tftp.now(),
+		Session:     cli.id,
+		Client:      cli.tid.String(),
+		Filename:    cli.filename,
+		Direction:   "read",
+		Bytes:       cli.bytes,
+		Duration:    tftp.now().Sub(cli.start),
+		Result:      "ok",
+		Retransmits: cli.retransmits,
+	}
+	if cli.opcode == wire.OpWRQ {
+		rec.Direction = "write"
+	}
+	if cli.failure != nil {
+		rec.Result = "error"
+		rec.Error = cli.failure.Error()
+		var tftpErr *Error
+		if errors.As(cli.failure, &tftpErr) {
+			rec.ErrorCode, rec.Error = tftpErr.Code, tftpErr.Message
+		}
+	}
+	if len(cli.oack) > 0 {
+		rec.Options = make(map[string]string, len(cli.oack))
+		for _, opt := range cli.oack {
+			rec.Options[strings.ToLower(opt.Name)] = opt.Value
+		}
+	}
+	return rec
+}
+
+// logSummary logs a single key=value line with the numbers of a transfer.
+func logSummary(rec AuditRecord, options wire.Options) {
+	secs := rec.Duration.Seconds()
+	if secs <= 0 {
+		secs = 1e-9
+	}
+	line := fmt.Sprintf("[%v] Transfer summary: client=%v direction=%v filename=%q bytes=%d duration=%v throughput=%.1fKiB/s retransmits=%d options=%q result=%v",
+		rec.Session, rec.Client, rec.Direction, rec.Filename, rec.Bytes, rec.Duration.Round(time.Millisecond), float64(rec.Bytes)/1024/secs, rec.Retransmits, options.String(), rec.Result)
+	if rec.Error != "" {
+		line += fmt.Sprintf(" error_code=%d error=%q", rec.ErrorCode, rec.Error)
+	}
+	log.Print(line + "\n")
+}
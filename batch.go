@@ -0,0 +1,136 @@
+package tftpd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Number of datagrams read or written with a single recvmmsg/sendmmsg call.
+const batchSize = 64
+
+// batchConn is implemented by both ipv4.PacketConn and ipv6.PacketConn.
+// On platforms without recvmmsg/sendmmsg they fall back to one datagram per call.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn net.PacketConn) batchConn {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return singleConn{conn}
+	}
+	if addr, ok := udp.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(udp)
+	}
+	return ipv6.NewPacketConn(udp)
+}
+
+// singleConn adapts connections which aren't sockets, one datagram per call.
+type singleConn struct {
+	net.PacketConn
+}
+
+func (c singleConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, addr, err := c.ReadFrom(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].Addr = n, addr
+	return 1, nil
+}
+
+func (c singleConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, err := c.WriteTo(ms[0].Buffers[0], ms[0].Addr)
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N = n
+	return 1, nil
+}
+
+func newMessages(n, size int) []ipv4.Message {
+	ms := make([]ipv4.Message, n)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{*getBuffer(size)}
+	}
+	return ms
+}
+
+// flush writes all queued responses, retrying on partial batch writes.
+func (tftp *TFTPServer) flush() error {
+	defer func() {
+		for i, buf := range tftp.outBufs {
+			putBuffer(buf)
+			tftp.outBufs[i] = nil
+		}
+		tftp.outBufs = tftp.outBufs[:0]
+		tftp.outgoing = tftp.outgoing[:0]
+	}()
+
+	for _, msg := range tftp.outgoing {
+		tftp.tracePacket("send", msg.Addr, msg.Buffers[0])
+	}
+
+	for pending := tftp.outgoing; len(pending) > 0; {
+		n, err := tftp.batch.WriteBatch(pending, 0)
+		if err != nil && n < len(pending) {
+			// only the datagram which couldn't be sent is dropped (e.g. the
+			// network of its client is unreachable), its session
+			// retransmits or times out on its own
+			tftp.sendFailed(pending[n].Addr, err)
+			pending = pending[n+1:]
+			continue
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		pending = pending[n:]
+	}
+	return nil
+}
+
+func (tftp *TFTPServer) sendFailed(addr net.Addr, err error) {
+	if cli, ok := tftp.connections[addr.String()]; ok {
+		cli.logf("error while sending packet to '%v': '%v'\n", addr, err)
+		return
+	}
+	log.Printf("error while sending packet to '%v': '%v'\n", addr, err)
+}
+
+// SetDSCP marks all outbound packets with the given DSCP value (0-63)
+// so TFTP traffic can be classified by network QoS policies. It's kept
+// when the socket is rebuilt. 0 resets a value set before and otherwise
+// leaves the ToS of the socket, e.g. an inherited one, as it is.
+func (tftp *TFTPServer) SetDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("Incorrect DSCP value %v", dscp)
+	}
+	if dscp == 0 && tftp.dscp == 0 {
+		return nil
+	}
+	tftp.dscp = dscp
+	return tftp.applyDSCP()
+}
+
+func (tftp *TFTPServer) applyDSCP() error {
+	tos := tftp.dscp << 2
+	switch conn := tftp.batch.(type) {
+	case *ipv4.PacketConn:
+		return conn.SetTOS(tos)
+	case *ipv6.PacketConn:
+		if err := conn.SetTrafficClass(tos); err != nil {
+			return err
+		}
+		// dual-stack sockets send IPv4 packets too, IPv6-only sockets reject this
+		ipv4.NewPacketConn(tftp.listener).SetTOS(tos)
+	default:
+		return fmt.Errorf("DSCP isn't supported by %T", tftp.listener)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package tftpd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	defaultBlockDuration = time.Minute
+	maxBlockDuration     = time.Hour
+	// clients tracked for violations, a flood of spoofed sources can't
+	// grow the table beyond this
+	maxOffenders = 10000
+)
+
+// offender tracks the protocol violations of a client host.
+type offender struct {
+	violations int
+	last       time.Time
+	// blocks is the number of times the client was blocked, each block
+	// lasts twice as long as the one before
+	blocks int
+	until  time.Time
+}
+
+func (tftp *TFTPServer) blockDuration() time.Duration {
+	if tftp.BlockDuration > 0 {
+		return tftp.BlockDuration
+	}
+	return defaultBlockDuration
+}
+
+// offenderKey returns the IP of the client, the source port changes with
+// every request.
+func offenderKey(addr net.Addr) string {
+	if ip := addrIP(addr); ip.IsValid() {
+		return ip.String()
+	}
+	return addr.String()
+}
+
+// blocked reports whether packets of the client are dropped.
+func (tftp *TFTPServer) blocked(addr net.Addr, now time.Time) bool {
+	if tftp.MaxViolations <= 0 {
+		return false
+	}
+	o := tftp.offenders[offenderKey(addr)]
+	return o != nil && now.Before(o.until)
+}
+
+// isViolation reports whether the error is caused by a malformed packet or
+// one sent to the wrong TID, which are answered with an ERROR and could
+// reflect floods or loop between two servers.
+func isViolation(err error) bool {
+	return errors.Is(err, ErrIllegalOperation) || errors.Is(err, ErrUnknownTID)
+}
+
+// violation counts a violation of the client and blocks it after
+// MaxViolations. Violations older than BlockDuration are forgotten, the
+// backoff once the client behaved for maxBlockDuration.
+func (tftp *TFTPServer) violation(addr net.Addr, now time.Time) {
+	if tftp.MaxViolations <= 0 {
+		return
+	}
+	if tftp.offenders == nil {
+		tftp.offenders = make(map[string]*offender)
+	}
+
+	key := offenderKey(addr)
+	o := tftp.offenders[key]
+	if o == nil {
+		if len(tftp.offenders) >= maxOffenders {
+			tftp.pruneOffenders(now)
+			if len(tftp.offenders) >= maxOffenders {
+				return
+			}
+		}
+		o = &offender{}
+		tftp.offenders[key] = o
+	}
+	if now.Sub(o.last) > tftp.blockDuration() {
+		o.violations = 0
+	}
+	if o.blocks > 0 && now.Sub(o.until) > maxBlockDuration {
+		o.blocks = 0
+	}
+	o.violations++
+	o.last = now
+	if o.violations < tftp.MaxViolations {
+		return
+	}
+
+	d := tftp.blockDuration() << o.blocks
+	if d > maxBlockDuration || d <= 0 {
+		d = maxBlockDuration
+	}
+	o.blocks++
+	o.violations = 0
+	o.until = now.Add(d)
+	tftp.counters.blocked.Add(1)
+	log.Printf("Blocking client '%v' for %v after repeated protocol violations.\n", key, d)
+	tftp.security("blocked", addr, "", fmt.Sprintf("Blocked for %v.", d))
+}
+
+// pruneOffenders forgets the clients which aren't blocked and whose
+// violations would be forgotten anyway.
+func (tftp *TFTPServer) pruneOffenders(now time.Time) {
+	for key, o := range tftp.offenders {
+		if !now.Before(o.until) && now.Sub(o.last) > tftp.blockDuration() && now.Sub(o.until) > maxBlockDuration {
+			delete(tftp.offenders, key)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package tftpd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+type checksum struct {
+	name string
+	hash hash.Hash
+}
+
+// newChecksums returns the hashes of an upload, unknown algorithms are skipped.
+func newChecksums(names []string) []checksum {
+	var sums []checksum
+	for _, name := range names {
+		newHash, ok := hashes[name]
+		if !ok {
+			log.Printf("Unknown checksum algorithm '%v'\n", name)
+			continue
+		}
+		sums = append(sums, checksum{name, newHash()})
+	}
+	return sums
+}
+
+// sums returns the hex encoded checksums by algorithm, nil if there are none.
+func (cli *client) sums() map[string]string {
+	if len(cli.checksums) == 0 {
+		return nil
+	}
+	sums := make(map[string]string, len(cli.checksums))
+	for _, c := range cli.checksums {
+		sums[c.name] = hex.EncodeToString(c.hash.Sum(nil))
+	}
+	return sums
+}
+
+// writeSidecars writes a file.<algorithm> file per checksum, in the format
+// of sha256sum and friends.
+func writeSidecars(path string, sums map[string]string) {
+	for name, sum := range sums {
+		line := fmt.Sprintf("%v  %v\n", sum, filepath.Base(path))
+		if err := os.WriteFile(path+"."+name, []byte(line), 0644); err != nil {
+			log.Printf("error while writing checksum: '%v'\n", err)
+		}
+	}
+}
+
+// DigestOption is the vendor option carrying the SHA-256 of the file as hex,
+// see TFTPServer.Digest. Clients send any value with RRQs and the digest
+// of the file with WRQs.
+const DigestOption = "x-sha256"
+
+var errDigestMismatch = NewError(CodeNotDefined, "SHA-256 mismatch.")
+
+// fillDigest puts the digest of a download in the OACK. Readers which can't
+// be rewound after hashing don't acknowledge the option.
+func (cli *client) fillDigest() error {
+	if _, ok := cli.oack.Get(DigestOption); !ok {
+		return nil
+	}
+
+	rs, ok := cli.reader.(io.ReadSeeker)
+	if !ok {
+		cli.oack.Del(DigestOption)
+		return nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, rs); err != nil {
+		return err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cli.oack.Set(DigestOption, hex.EncodeToString(h.Sum(nil)))
+	return nil
+}
+
+// verifyDigest compares a completed upload with the digest the client
+// declared, mismatching files are removed.
+func (cli *client) verifyDigest() error {
+	if cli.digest == nil {
+		return nil
+	}
+	if sum := hex.EncodeToString(cli.digest.Sum(nil)); sum != cli.wantDigest {
+		cli.logf("Upload of '%v' has SHA-256 %v, expected %v\n", cli.filename, sum, cli.wantDigest)
+		cli.discardUpload()
+		return errDigestMismatch
+	}
+	return nil
+}
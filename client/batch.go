@@ -0,0 +1,106 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Download is a single file of a batch download.
+type Download struct {
+	Remote string
+	// Local is the destination path, the base name of Remote if empty.
+	Local string
+}
+
+// DownloadResult is the outcome of a single download of a batch.
+type DownloadResult struct {
+	Download
+	Stats TransferStats
+	Err   error
+}
+
+// GetFiles downloads files concurrently to local files with at most workers
+// transfers running at once. Partially downloaded files are removed. The
+// results are in the order of downloads. Progress may be called concurrently.
+func (c *Client) GetFiles(downloads []Download, workers int) []DownloadResult {
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]DownloadResult, len(downloads))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = c.getFile(downloads[i])
+			}
+		}()
+	}
+
+	for i := range downloads {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+func (c *Client) getFile(d Download) DownloadResult {
+	if d.Local == "" {
+		d.Local = filepath.Base(d.Remote)
+	}
+	res := DownloadResult{Download: d}
+
+	if dir := filepath.Dir(d.Local); dir != "." {
+		if res.Err = os.MkdirAll(dir, 0755); res.Err != nil {
+			return res
+		}
+	}
+
+	f, err := os.Create(d.Local)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	res.Stats, res.Err = c.Get(d.Remote, f)
+	if err := f.Close(); res.Err == nil {
+		res.Err = err
+	}
+	if res.Err != nil {
+		os.Remove(d.Local)
+	}
+	return res
+}
+
+// ReadManifest reads a list of downloads, one per line as "remote [local]".
+// Empty lines and lines starting with # are skipped.
+func ReadManifest(r io.Reader) ([]Download, error) {
+	var downloads []Download
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("Incorrect manifest line %v: '%v'", line, scanner.Text())
+		}
+
+		d := Download{Remote: fields[0]}
+		if len(fields) == 2 {
+			d.Local = fields[1]
+		}
+		downloads = append(downloads, d)
+	}
+	return downloads, scanner.Err()
+}
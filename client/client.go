@@ -0,0 +1,674 @@
+// Package client implements a TFTP client (RFC 1350) with support for the
+// blksize option (RFC 2348).
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+const (
+	defaultBlockSize = 512
+	defaultTimeout   = 5 * time.Second
+	defaultRetries   = 5
+	// enough for the biggest blksize (RFC 2348)
+	maxPacketSize = 65464 + wire.HeaderSize
+)
+
+var (
+	ErrTimeout = errors.New("Transfer timed out.")
+	// ErrDigestMismatch is returned by Get if the downloaded data doesn't
+	// match the digest sent by the server.
+	ErrDigestMismatch = errors.New("SHA-256 mismatch.")
+	// ErrNoPSK is returned if the server doesn't encrypt a transfer with
+	// PreSharedKey set.
+	ErrNoPSK = errors.New("Server doesn't support x-psk.")
+)
+
+// Client transfers files from and to a single server.
+type Client struct {
+	// Addr is the host:port of the server.
+	Addr string
+	// Server, if set, is used instead of resolving Addr.
+	Server net.Addr
+	// ListenPacket, if set, creates the connection of every transfer
+	// instead of a UDP socket, e.g. an in-memory one from tftptest.
+	ListenPacket func() (net.PacketConn, error)
+	// ListenMulticast, if set, joins the group of a multicast download
+	// instead of a UDP socket.
+	ListenMulticast func(group *net.UDPAddr) (net.PacketConn, error)
+	// BlockSize is requested with the blksize option unless it's 512.
+	BlockSize int
+	// Timeout is the retransmission timeout. Timeouts below a second are
+	// requested from the server with the utimeout option.
+	Timeout time.Duration
+	// Retries is the number of retransmissions before giving up.
+	Retries int
+	// Digest requests the SHA-256 of downloads with the x-sha256 option
+	// and verifies them, uploads declare it if the reader is an
+	// io.ReadSeeker. Both need a server of this package with Digest set.
+	Digest bool
+	// Append makes uploads append to the file if it exists, with the
+	// x-append option of servers of this package with Append set.
+	Append bool
+	// PreSharedKey encrypts the payloads with the experimental x-psk
+	// option (tftpd.PSKOption) of servers of this package with the same
+	// key, transfers fail with servers which don't support it. Blocks
+	// carry tftpd.PSKOverhead bytes less of the file.
+	PreSharedKey []byte
+	// Progress is called after every block with the number of bytes
+	// transferred so far and the total size, or -1 if it's unknown.
+	Progress func(transferred, total int64)
+
+	// The hooks are called on the goroutine of the transfer, which waits
+	// for them. GetFiles calls them concurrently.
+
+	// OnNegotiate is called with the options requested from the server and
+	// those it acknowledged once it replied, acknowledged is nil if it
+	// ignored them.
+	OnNegotiate func(filename string, requested, acknowledged wire.Options)
+	// OnRetransmit is called before a packet is sent again, with the block
+	// it's about, 0 for the request. timeout is false if the server sent a
+	// packet again, i.e. the previous one was lost.
+	OnRetransmit func(filename string, block uint16, timeout bool)
+	// OnBlock is called after every block with its number, rolling over
+	// after 65535, and its size.
+	OnBlock func(filename string, block uint16, size int)
+}
+
+// TransferStats describes a finished (or failed) transfer.
+type TransferStats struct {
+	Filename string
+	// Bytes is the number of bytes written to or acknowledged by the server.
+	Bytes       int64
+	Duration    time.Duration
+	Retransmits int
+	BlockSize   int
+	// Options are the options acknowledged by the server.
+	Options wire.Options
+}
+
+// New returns a client for the server at addr with the default settings.
+func New(addr string) *Client {
+	return &Client{
+		Addr:      addr,
+		BlockSize: defaultBlockSize,
+		Timeout:   defaultTimeout,
+		Retries:   defaultRetries,
+	}
+}
+
+// Get downloads the remote file into w. The stats are returned even
+// if the transfer fails.
+func (c *Client) Get(filename string, w io.Writer) (TransferStats, error) {
+	return c.get(filename, w, 0)
+}
+
+// ResumeGet downloads the remote file from offset on into w, e.g. after
+// an interrupted Get. Servers without the x-offset option send the whole
+// file and the beginning is skipped. Digest is ignored.
+func (c *Client) ResumeGet(filename string, w io.Writer, offset int64) (TransferStats, error) {
+	return c.get(filename, w, offset)
+}
+
+func (c *Client) get(filename string, w io.Writer, offset int64) (TransferStats, error) {
+	t, err := c.newTransfer(filename)
+	if err != nil {
+		return TransferStats{}, err
+	}
+	defer t.conn.Close()
+
+	opts := c.options()
+	if c.Progress != nil {
+		opts.Set("tsize", "0")
+	}
+	if c.Digest && offset == 0 {
+		opts.Set(tftpd.DigestOption, "0")
+	}
+	if offset > 0 {
+		opts.Set(tftpd.ResumeOption, strconv.FormatInt(offset, 10))
+	}
+	var digest hash.Hash
+	var wantDigest string
+	// the bytes before the offset sent by servers which can't resume
+	skip := offset
+
+	t.requested = opts
+	err = t.send(&wire.ReadRequest{Filename: filename, Mode: "octet", Options: opts})
+	if err != nil {
+		return t.finish(), err
+	}
+
+	// block numbers roll over in transfers of more than 65535 blocks
+	expected := uint16(1)
+	started := false
+	for {
+		pkt, err := t.receive()
+		if err != nil {
+			return t.finish(), err
+		}
+
+		switch pkt := pkt.(type) {
+		case *wire.OptionAck:
+			if started {
+				continue
+			}
+			if err := t.accept(pkt.Options); err != nil {
+				return t.finish(), err
+			}
+			if v, ok := pkt.Options.Get(tftpd.DigestOption); ok && c.Digest && offset == 0 {
+				digest, wantDigest = sha256.New(), strings.ToLower(v)
+			}
+			if _, ok := pkt.Options.Get(tftpd.ResumeOption); ok {
+				skip = 0
+			}
+			err = t.send(&wire.Ack{Block: 0})
+
+		case *wire.Data:
+			if pkt.Block != expected {
+				// the previous ACK was lost, repeat it
+				if pkt.Block == expected-1 {
+					t.retransmit(false)
+					err = t.resend()
+				}
+				break
+			}
+
+			if !started {
+				t.negotiate(nil)
+				if err := t.checkPSK(); err != nil {
+					return t.finish(), err
+				}
+			}
+			started = true
+			data, err := t.open(pkt.Payload)
+			if err != nil {
+				t.abort(err)
+				return t.finish(), err
+			}
+			payload := data
+			if skip > 0 {
+				n := int64(len(payload))
+				if n > skip {
+					n = skip
+				}
+				payload, skip = payload[n:], skip-n
+			}
+
+			var n int
+			n, err = w.Write(payload)
+			t.progress(int64(n))
+			if err != nil {
+				t.abort(err)
+				return t.finish(), err
+			}
+
+			if digest != nil {
+				digest.Write(data)
+			}
+			t.blockDone(pkt.Block, len(data))
+
+			err = t.send(&wire.Ack{Block: pkt.Block})
+			if err != nil || len(pkt.Payload) < t.blockSize {
+				if err == nil && digest != nil && hex.EncodeToString(digest.Sum(nil)) != wantDigest {
+					err = ErrDigestMismatch
+				}
+				return t.finish(), err
+			}
+			expected++
+
+		default:
+			err = t.unexpected(pkt)
+		}
+
+		if err != nil {
+			return t.finish(), err
+		}
+	}
+}
+
+// ResumePut continues an interrupted upload of r, the server tells how
+// much of it it has. Servers without the x-offset option get all of r.
+func (c *Client) ResumePut(filename string, r io.ReadSeeker) (TransferStats, error) {
+	return c.put(filename, r, true)
+}
+
+// Put uploads everything read from r as the remote file. The length of r
+// doesn't need to be known upfront, if r has a Len or Stat method it's
+// announced with the tsize option. The stats are returned even if the
+// transfer fails.
+func (c *Client) Put(filename string, r io.Reader) (TransferStats, error) {
+	return c.put(filename, r, false)
+}
+
+func (c *Client) put(filename string, r io.Reader, resume bool) (TransferStats, error) {
+	t, err := c.newTransfer(filename)
+	if err != nil {
+		return TransferStats{}, err
+	}
+	defer t.conn.Close()
+
+	opts := c.options()
+	if t.total = readerSize(r); t.total >= 0 {
+		opts.Set("tsize", strconv.FormatInt(t.total, 10))
+	}
+	if rs, ok := r.(io.ReadSeeker); ok && c.Digest && !resume {
+		sum, err := readerDigest(rs)
+		if err != nil {
+			return t.finish(), err
+		}
+		opts.Set(tftpd.DigestOption, sum)
+	}
+	if c.Append {
+		opts.Set(tftpd.AppendOption, "1")
+	}
+	if resume {
+		size, err := r.(io.Seeker).Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = r.(io.Seeker).Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return t.finish(), err
+		}
+		opts.Set(tftpd.ResumeOption, strconv.FormatInt(size, 10))
+	}
+
+	t.requested = opts
+	err = t.send(&wire.WriteRequest{Filename: filename, Mode: "octet", Options: opts})
+	if err != nil {
+		return t.finish(), err
+	}
+
+	var block uint16
+	var n int
+	var started, last bool
+	buf := make([]byte, maxPacketSize)
+	for {
+		pkt, err := t.receive()
+		if err != nil {
+			return t.finish(), err
+		}
+
+		switch pkt := pkt.(type) {
+		case *wire.OptionAck:
+			if started {
+				continue
+			}
+			if err := t.accept(pkt.Options); err != nil {
+				return t.finish(), err
+			}
+			if v, ok := pkt.Options.Get(tftpd.ResumeOption); ok && resume {
+				offset, err := strconv.ParseInt(v, 10, 64)
+				if err == nil {
+					_, err = r.(io.Seeker).Seek(offset, io.SeekStart)
+				}
+				if err != nil {
+					t.abort(tftpd.ErrOptionNegotiation)
+					return t.finish(), err
+				}
+			}
+
+		case *wire.Ack:
+			// duplicate ACKs are ignored, resending would double the traffic
+			if pkt.Block != block {
+				continue
+			}
+			if !started {
+				t.negotiate(nil)
+				if err := t.checkPSK(); err != nil {
+					return t.finish(), err
+				}
+			} else {
+				t.blockDone(block, n)
+			}
+			t.progress(int64(n))
+
+		default:
+			if err := t.unexpected(pkt); err != nil {
+				return t.finish(), err
+			}
+			continue
+		}
+
+		if last {
+			return t.finish(), nil
+		}
+
+		n, err = io.ReadFull(r, buf[:t.dataSize()])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.abort(err)
+			return t.finish(), err
+		}
+
+		block++
+		started, last = true, n < t.dataSize()
+		err = t.send(&wire.Data{Block: block, Payload: t.seal(buf[:n])})
+		if err != nil {
+			return t.finish(), err
+		}
+	}
+}
+
+func (c *Client) options() wire.Options {
+	var opts wire.Options
+	if c.BlockSize != 0 && c.BlockSize != defaultBlockSize {
+		opts.Set("blksize", strconv.Itoa(c.BlockSize))
+	}
+	// sub-second timeouts are only understood by some servers
+	if c.Timeout >= 10*time.Millisecond && c.Timeout < time.Second {
+		opts.Set("utimeout", strconv.FormatInt(c.Timeout.Microseconds(), 10))
+	}
+	if c.PreSharedKey != nil {
+		opts.Set(tftpd.PSKOption, tftpd.NewPSKNonce())
+	}
+	return opts
+}
+
+// transfer is the state of a single lock-step transfer.
+type transfer struct {
+	start      time.Time
+	stats      TransferStats
+	total      int64
+	progressFn func(transferred, total int64)
+	hooks      *Client
+	requested  wire.Options
+	negotiated bool
+
+	conn    net.PacketConn
+	server  net.Addr
+	tid     net.Addr
+	timeout time.Duration
+	retries int
+
+	blockSize int
+	// encrypts the payloads, with the offset of the next block
+	psk       *tftpd.PSKCipher
+	pskOffset int64
+	last      []byte
+	// the block of the last packet
+	block uint16
+	buf   []byte
+}
+
+func (c *Client) newTransfer(filename string) (*transfer, error) {
+	server := c.Server
+	if server == nil {
+		addr, err := net.ResolveUDPAddr("udp", c.Addr)
+		if err != nil {
+			return nil, err
+		}
+		server = addr
+	}
+
+	listen := c.ListenPacket
+	if listen == nil {
+		listen = func() (net.PacketConn, error) {
+			return net.ListenPacket("udp", ":0")
+		}
+	}
+	conn, err := listen()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &transfer{
+		start:      time.Now(),
+		stats:      TransferStats{Filename: filename},
+		total:      -1,
+		progressFn: c.Progress,
+		hooks:      c,
+		conn:       conn,
+		server:     server,
+		timeout:    c.Timeout,
+		retries:    c.Retries,
+		blockSize:  defaultBlockSize,
+		buf:        make([]byte, maxPacketSize),
+	}
+	if t.timeout <= 0 {
+		t.timeout = defaultTimeout
+	}
+	if t.retries < 0 {
+		t.retries = 0
+	}
+	return t, nil
+}
+
+// send sends a packet and keeps it for retransmission.
+func (t *transfer) send(pkt wire.Packet) error {
+	raw, err := wire.Marshal(pkt)
+	if err != nil {
+		return err
+	}
+	t.last = raw
+	switch pkt := pkt.(type) {
+	case *wire.Data:
+		t.block = pkt.Block
+	case *wire.Ack:
+		t.block = pkt.Block
+	}
+	return t.resend()
+}
+
+func (t *transfer) resend() error {
+	addr := t.tid
+	if addr == nil {
+		addr = t.server
+	}
+	_, err := t.conn.WriteTo(t.last, addr)
+	return err
+}
+
+// receive waits for the next packet from the server, retransmitting the last
+// sent packet on timeouts. The first reply fixes the server's transfer ID.
+func (t *transfer) receive() (wire.Packet, error) {
+	for attempt := 0; ; {
+		t.conn.SetReadDeadline(time.Now().Add(t.timeout))
+		n, addr, err := t.conn.ReadFrom(t.buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if attempt >= t.retries {
+					return nil, ErrTimeout
+				}
+				attempt++
+				t.retransmit(true)
+				if err := t.resend(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return nil, err
+		}
+
+		if t.tid == nil {
+			t.tid = addr
+		} else if addr.String() != t.tid.String() {
+			t.sendError(addr, tftpd.ErrUnknownTID)
+			continue
+		}
+
+		pkt, err := wire.Unmarshal(t.buf[:n])
+		if err != nil {
+			t.abort(tftpd.ErrIllegalOperation)
+			return nil, err
+		}
+		if pkt, ok := pkt.(*wire.Error); ok {
+			return nil, tftpd.NewError(tftpd.ErrorCode(pkt.Code), pkt.Message)
+		}
+		return pkt, nil
+	}
+}
+
+// accept applies the options acknowledged by the server.
+func (t *transfer) accept(opts wire.Options) error {
+	t.stats.Options = opts
+	t.negotiate(opts)
+	if v, ok := opts.Get("tsize"); ok && t.total < 0 {
+		if size, err := strconv.ParseInt(v, 10, 64); err == nil && size >= 0 {
+			t.total = size
+		}
+	}
+
+	if v, ok := opts.Get("blksize"); ok {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 8 || size > maxPacketSize-wire.HeaderSize {
+			err := tftpd.NewError(tftpd.CodeOptionNegotiation, fmt.Sprintf("Incorrect blksize '%v'.", v))
+			t.abort(err)
+			return err
+		}
+		t.blockSize = size
+	}
+
+	if t.hooks.PreSharedKey != nil {
+		v, _ := opts.Get(tftpd.PSKOption)
+		nonce, _ := t.requested.Get(tftpd.PSKOption)
+		psk, err := tftpd.NewPSKCipher(t.hooks.PreSharedKey, nonce, v)
+		if err != nil || t.blockSize <= tftpd.PSKOverhead {
+			t.abort(ErrNoPSK)
+			return ErrNoPSK
+		}
+		t.psk = psk
+	}
+	return nil
+}
+
+// checkPSK fails transfers in the clear if PreSharedKey is set.
+func (t *transfer) checkPSK() error {
+	if t.hooks.PreSharedKey != nil && t.psk == nil {
+		t.abort(ErrNoPSK)
+		return ErrNoPSK
+	}
+	return nil
+}
+
+// dataSize returns how much of the file a block carries.
+func (t *transfer) dataSize() int {
+	if t.psk != nil {
+		return t.blockSize - tftpd.PSKOverhead
+	}
+	return t.blockSize
+}
+
+// seal encrypts the next block in place if the transfer is encrypted.
+func (t *transfer) seal(plaintext []byte) []byte {
+	if t.psk == nil {
+		return plaintext
+	}
+	b := t.psk.Seal(plaintext[:0], plaintext, t.pskOffset)
+	t.pskOffset += int64(len(plaintext))
+	return b
+}
+
+// open decrypts the next block in place if the transfer is encrypted.
+func (t *transfer) open(payload []byte) ([]byte, error) {
+	if t.psk == nil {
+		return payload, nil
+	}
+	b, err := t.psk.Open(payload[:0], payload, t.pskOffset)
+	if err != nil {
+		return nil, tftpd.NewError(tftpd.CodeAccessViolation, "Block failed authentication.")
+	}
+	t.pskOffset += int64(len(b))
+	return b, nil
+}
+
+func (t *transfer) unexpected(pkt wire.Packet) error {
+	err := fmt.Errorf("unexpected %v packet", pkt.Opcode())
+	t.abort(tftpd.ErrIllegalOperation)
+	return err
+}
+
+// abort tells the server the transfer is over because of err.
+func (t *transfer) abort(err error) {
+	var tftpErr *tftpd.Error
+	if !errors.As(err, &tftpErr) {
+		tftpErr = tftpd.NewError(tftpd.CodeNotDefined, err.Error())
+	}
+	addr := t.tid
+	if addr == nil {
+		addr = t.server
+	}
+	t.sendError(addr, tftpErr)
+}
+
+func (t *transfer) sendError(addr net.Addr, err *tftpd.Error) {
+	raw, _ := wire.Marshal(&wire.Error{Code: uint16(err.Code), Message: err.Message})
+	t.conn.WriteTo(raw, addr)
+}
+
+// negotiate passes the outcome of the option negotiation to the hook once.
+func (t *transfer) negotiate(acknowledged wire.Options) {
+	if t.negotiated {
+		return
+	}
+	t.negotiated = true
+	if t.hooks.OnNegotiate != nil {
+		t.hooks.OnNegotiate(t.stats.Filename, t.requested, acknowledged)
+	}
+}
+
+func (t *transfer) retransmit(timeout bool) {
+	t.stats.Retransmits++
+	if t.hooks.OnRetransmit != nil {
+		t.hooks.OnRetransmit(t.stats.Filename, t.block, timeout)
+	}
+}
+
+func (t *transfer) blockDone(block uint16, size int) {
+	if t.hooks.OnBlock != nil {
+		t.hooks.OnBlock(t.stats.Filename, block, size)
+	}
+}
+
+func (t *transfer) progress(n int64) {
+	t.stats.Bytes += n
+	if t.progressFn != nil {
+		t.progressFn(t.stats.Bytes, t.total)
+	}
+}
+
+func (t *transfer) finish() TransferStats {
+	t.stats.Duration = time.Since(t.start)
+	t.stats.BlockSize = t.blockSize
+	return t.stats
+}
+
+// readerDigest returns the hex SHA-256 of the rest of rs and rewinds it.
+func readerDigest(rs io.ReadSeeker) (string, error) {
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, rs); err != nil {
+		return "", err
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readerSize returns the size of r if it can be known without reading, or -1.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if stat, err := r.Stat(); err == nil && stat.Mode().IsRegular() {
+			return stat.Size()
+		}
+	}
+	return -1
+}
@@ -0,0 +1,633 @@
+package client_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+	"git.scarlet.house/oss/go-tftpd/client"
+	"git.scarlet.house/oss/go-tftpd/tftptest"
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// newTestClient serves dir on an in-memory network and returns a client for it.
+// The faults are injected on both sides, setup changes the server.
+func newTestClient(t *testing.T, dir string, faults tftptest.Faults, setup ...func(*tftpd.TFTPServer)) *client.Client {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	network := tftptest.NewNetwork()
+	conn, _ := network.ListenPacket("server")
+	server := tftpd.NewTFTPServerConn(tftptest.NewFaultyConn(conn, faults))
+	server.Timeout = 20 * time.Millisecond
+	server.Retries = 10
+	server.Digest = true
+	server.Resume = true
+	for _, f := range setup {
+		f(server)
+	}
+	go server.ListenAndServe()
+
+	t.Cleanup(func() {
+		server.Close()
+		os.Chdir(wd)
+	})
+
+	cli := client.New("")
+	cli.Server = conn.LocalAddr()
+	cli.Timeout = 20 * time.Millisecond
+	cli.Retries = 10
+	cli.ListenPacket = func() (net.PacketConn, error) {
+		conn, err := network.ListenPacket("")
+		if err != nil {
+			return nil, err
+		}
+		faults.Seed++
+		return tftptest.NewFaultyConn(conn, faults), nil
+	}
+	return cli
+}
+
+func TestGetPut(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	os.WriteFile(filepath.Join(dir, "file.bin"), data, 0644)
+	cli := newTestClient(t, dir, tftptest.Faults{})
+
+	for _, blockSize := range []int{512, 1000} {
+		cli.BlockSize = blockSize
+
+		var buf bytes.Buffer
+		stats, err := cli.Get("file.bin", &buf)
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) || stats.Bytes != int64(len(data)) || stats.BlockSize != blockSize {
+			t.Fatalf("Incorrect download of %v bytes with blksize %v\n", stats.Bytes, stats.BlockSize)
+		}
+		// the sub-second timeout is negotiated with utimeout
+		if v, _ := stats.Options.Get("utimeout"); v != "20000" {
+			t.Fatalf("Incorrect options %v\n", stats.Options)
+		}
+	}
+
+	_, err := cli.Put("upload.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	uploaded, _ := os.ReadFile(filepath.Join(dir, "upload.bin"))
+	if !bytes.Equal(uploaded, data) {
+		t.Fatalf("Incorrect upload of %v bytes\n", len(uploaded))
+	}
+
+	_, err = cli.Get("missing.bin", &bytes.Buffer{})
+	if !errors.Is(err, tftpd.ErrFileNotFound) {
+		t.Fatalf("Should be ErrFileNotFound, got: %v\n", err)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	os.WriteFile(filepath.Join(dir, "file.bin"), data, 0644)
+	cli := newTestClient(t, dir, tftptest.Faults{})
+
+	r, err := cli.Open("file.bin")
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Incorrect download of %v bytes: %v\n", len(got), err)
+	}
+	if _, err := cli.Open("missing.bin"); !errors.Is(err, tftpd.ErrFileNotFound) {
+		t.Fatalf("Should be ErrFileNotFound, got: %v\n", err)
+	}
+
+	w, err := cli.Create("upload.bin")
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	for i := 0; i < len(data); i += 700 {
+		end := i + 700
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := w.Write(data[i:end]); err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	uploaded, _ := os.ReadFile(filepath.Join(dir, "upload.bin"))
+	if !bytes.Equal(uploaded, data) {
+		t.Fatalf("Incorrect upload of %v bytes\n", len(uploaded))
+	}
+	if _, err := cli.Create("file.bin"); !errors.Is(err, tftpd.ErrFileExists) {
+		t.Fatalf("Should be ErrFileExists, got: %v\n", err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.bin"), make([]byte, 1300), 0644)
+	cli := newTestClient(t, dir, tftptest.Faults{})
+
+	var calls []int64
+	cli.Progress = func(transferred, total int64) {
+		if total != 1300 {
+			t.Fatalf("Incorrect total %v\n", total)
+		}
+		calls = append(calls, transferred)
+	}
+
+	_, err := cli.Get("file.bin", &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	if len(calls) != 3 || calls[2] != 1300 {
+		t.Fatalf("Incorrect progress calls %v\n", calls)
+	}
+}
+
+func TestGetFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+	cli := newTestClient(t, dir, tftptest.Faults{})
+
+	downloads, err := client.ReadManifest(bytes.NewBufferString("# firmware\na out/a\nb out/b\n\nc out/c\nd out/d\n"))
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+
+	results := cli.GetFiles(downloads, 2)
+	for i, res := range results[:3] {
+		if res.Err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", res.Err)
+		}
+		got, _ := os.ReadFile(filepath.Join(dir, "out", downloads[i].Remote))
+		if string(got) != downloads[i].Remote {
+			t.Fatalf("Incorrect content '%s' of %v\n", got, downloads[i].Remote)
+		}
+	}
+	if !errors.Is(results[3].Err, tftpd.ErrFileNotFound) {
+		t.Fatalf("Should be ErrFileNotFound, got: %v\n", results[3].Err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out", "d")); err == nil {
+		t.Fatalf("Failed download shouldn't be kept\n")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 20000)
+	os.WriteFile(filepath.Join(dir, "file.bin"), data, 0644)
+	cli := newTestClient(t, dir, tftptest.Faults{Loss: 0.1, Seed: 7})
+	cli.BlockSize = 1000
+
+	var acknowledged wire.Options
+	var retransmits, total, blocks int
+	cli.OnNegotiate = func(filename string, requested, ack wire.Options) {
+		if v, _ := requested.Get("blksize"); v != "1000" || !strings.HasPrefix(filename, "file.bin") {
+			t.Fatalf("Incorrect requested options %v for %v\n", requested, filename)
+		}
+		acknowledged = ack
+	}
+	cli.OnRetransmit = func(filename string, block uint16, timeout bool) {
+		retransmits++
+	}
+	cli.OnBlock = func(filename string, block uint16, size int) {
+		if int(block) != blocks+1 {
+			t.Fatalf("Incorrect block %v after %v\n", block, blocks)
+		}
+		blocks++
+		total += size
+	}
+
+	for _, put := range []bool{false, true} {
+		acknowledged, retransmits, total, blocks = nil, 0, 0, 0
+		var stats client.TransferStats
+		var err error
+		if put {
+			stats, err = cli.Put("file.bin.up", bytes.NewReader(data))
+		} else {
+			stats, err = cli.Get("file.bin", io.Discard)
+		}
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if v, _ := acknowledged.Get("blksize"); v != "1000" {
+			t.Fatalf("Incorrect acknowledged options %v\n", acknowledged)
+		}
+		if retransmits != stats.Retransmits || blocks != 21 || total != len(data) {
+			t.Fatalf("Incorrect hook calls: %v retransmits of %v, %v blocks, %v bytes\n", retransmits, stats.Retransmits, blocks, total)
+		}
+	}
+}
+
+func TestLossyTransfers(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 20000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	os.WriteFile(filepath.Join(dir, "file.bin"), data, 0644)
+
+	cli := newTestClient(t, dir, tftptest.Faults{
+		Loss:      0.1,
+		Duplicate: 0.1,
+		Reorder:   0.1,
+		Jitter:    2 * time.Millisecond,
+		Seed:      42,
+	})
+
+	var retransmits int
+	for i := 0; i < 5; i++ {
+		var buf bytes.Buffer
+		stats, err := cli.Get("file.bin", &buf)
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("Incorrect download of %v bytes\n", buf.Len())
+		}
+		retransmits += stats.Retransmits
+
+		name := fmt.Sprintf("upload-%d.bin", i)
+		stats, err = cli.Put(name, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		uploaded, _ := os.ReadFile(filepath.Join(dir, name))
+		if !bytes.Equal(uploaded, data) {
+			t.Fatalf("Incorrect upload of %v bytes\n", len(uploaded))
+		}
+		retransmits += stats.Retransmits
+	}
+
+	if retransmits == 0 {
+		t.Fatalf("Lost packets should be retransmitted\n")
+	}
+}
+
+// changingReader returns other data after it's rewound.
+type changingReader struct {
+	*bytes.Reader
+	seeks int
+}
+
+func (r *changingReader) Seek(offset int64, whence int) (int64, error) {
+	r.seeks++
+	if r.seeks == 2 {
+		r.Reader = bytes.NewReader([]byte("changed"))
+	}
+	return r.Reader.Seek(offset, whence)
+}
+
+func TestDigest(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.bin"), []byte("abc"), 0644)
+	cli := newTestClient(t, dir, tftptest.Faults{})
+	cli.Digest = true
+
+	var buf bytes.Buffer
+	stats, err := cli.Get("file.bin", &buf)
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	if v, _ := stats.Options.Get(tftpd.DigestOption); v != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Fatalf("Incorrect digest '%v'\n", v)
+	}
+
+	_, err = cli.Put("upload.bin", bytes.NewReader([]byte("abc")))
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+
+	_, err = cli.Put("changed.bin", &changingReader{Reader: bytes.NewReader([]byte("abc"))})
+	if err == nil || err.Error() != "TFTP Error (0): SHA-256 mismatch." {
+		t.Fatalf("Mismatching upload should fail, got: %v\n", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "changed.bin")); err == nil {
+		t.Fatalf("Mismatching upload shouldn't be kept\n")
+	}
+}
+
+func TestPSK(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	os.WriteFile(filepath.Join(dir, "file.bin"), data, 0644)
+
+	network := tftptest.NewNetwork()
+	serve := func(name string, key []byte, required bool) net.Addr {
+		conn, _ := network.ListenPacket(name)
+		server := tftpd.NewTFTPServerConn(tftptest.NewFaultyConn(conn, tftptest.Faults{Loss: 0.05}))
+		server.Root = dir
+		server.Timeout = 20 * time.Millisecond
+		server.Retries = 10
+		server.PreSharedKey, server.RequirePSK = key, required
+		go server.ListenAndServe()
+		t.Cleanup(server.Close)
+		return conn.LocalAddr()
+	}
+	newClient := func(server net.Addr, key []byte) *client.Client {
+		cli := client.New("")
+		cli.Server = server
+		cli.Timeout = 20 * time.Millisecond
+		cli.Retries = 10
+		cli.PreSharedKey = key
+		cli.ListenPacket = func() (net.PacketConn, error) { return network.ListenPacket("") }
+		return cli
+	}
+	key := []byte("correct horse battery staple")
+	encrypted := serve("encrypted", key, true)
+	plain := serve("plain", nil, false)
+
+	for _, blockSize := range []int{64, 512, 1000} {
+		cli := newClient(encrypted, key)
+		cli.BlockSize = blockSize
+		var buf bytes.Buffer
+		stats, err := cli.Get("file.bin", &buf)
+		if err != nil {
+			t.Fatalf("Error should be nil with blksize %v, got: %v\n", blockSize, err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) || stats.Bytes != int64(len(data)) {
+			t.Fatalf("Incorrect download of %v bytes with blksize %v\n", stats.Bytes, blockSize)
+		}
+
+		name := fmt.Sprintf("upload%d.bin", blockSize)
+		if _, err := cli.Put(name, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Error should be nil with blksize %v, got: %v\n", blockSize, err)
+		}
+		if uploaded, _ := os.ReadFile(filepath.Join(dir, name)); !bytes.Equal(uploaded, data) {
+			t.Fatalf("Incorrect upload of %v bytes with blksize %v\n", len(uploaded), blockSize)
+		}
+	}
+
+	for _, v := range []struct {
+		server net.Addr
+		key    []byte
+		err    string
+	}{
+		{encrypted, []byte("wrong"), "TFTP Error (2): Block failed authentication."},
+		{encrypted, nil, "TFTP Error (2): Encryption with x-psk required."},
+		{plain, key, "Server doesn't support x-psk."},
+	} {
+		_, err := newClient(v.server, v.key).Get("file.bin", io.Discard)
+		if err == nil || err.Error() != v.err {
+			t.Fatalf("Error should be '%v' with key '%s', got: %v\n", v.err, v.key, err)
+		}
+	}
+}
+
+func TestTransports(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		// listen returns the transport of the server and a function
+		// returning those of the clients
+		listen func(dir string) (net.PacketConn, func() (net.PacketConn, error), error)
+	}{
+		{
+			name: "unixgram",
+			listen: func(dir string) (net.PacketConn, func() (net.PacketConn, error), error) {
+				conn, err := net.ListenPacket("unixgram", filepath.Join(dir, "server.sock"))
+				n := 0
+				return conn, func() (net.PacketConn, error) {
+					// replies need a named socket
+					n++
+					return net.ListenPacket("unixgram", filepath.Join(dir, fmt.Sprintf("client%d.sock", n)))
+				}, err
+			},
+		},
+		{
+			name: "unixpacket",
+			listen: func(dir string) (net.PacketConn, func() (net.PacketConn, error), error) {
+				path := filepath.Join(dir, "server.sock")
+				l, err := net.Listen("unixpacket", path)
+				if err != nil {
+					return nil, nil, err
+				}
+				return tftpd.ListenerTransport(l), func() (net.PacketConn, error) {
+					c, err := net.Dial("unixpacket", path)
+					if err != nil {
+						return nil, err
+					}
+					return tftpd.ConnTransport(c), nil
+				}, nil
+			},
+		},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			dir := t.TempDir()
+			data := bytes.Repeat([]byte("0123456789"), 1000)
+			os.WriteFile(filepath.Join(dir, "file.bin"), data, 0644)
+
+			conn, listen, err := v.listen(dir)
+			if err != nil {
+				t.Skipf("%v isn't supported: %v\n", v.name, err)
+			}
+			server := tftpd.NewTFTPServerConn(conn)
+			server.Root = dir
+			go server.ListenAndServe()
+			defer server.Close()
+
+			cli := client.New("")
+			cli.Server = conn.LocalAddr()
+			cli.ListenPacket = listen
+			var buf bytes.Buffer
+			if _, err := cli.Get("file.bin", &buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+				t.Fatalf("Incorrect download of %v bytes: %v\n", buf.Len(), err)
+			}
+			if _, err := cli.Put("upload.bin", bytes.NewReader(data)); err != nil {
+				t.Fatalf("Error should be nil, got: %v\n", err)
+			}
+			if uploaded, _ := os.ReadFile(filepath.Join(dir, "upload.bin")); !bytes.Equal(uploaded, data) {
+				t.Fatalf("Incorrect upload of %v bytes\n", len(uploaded))
+			}
+		})
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	os.WriteFile(filepath.Join(dir, "file.bin"), data, 0644)
+	os.WriteFile(filepath.Join(dir, "upload.bin"), data[:3000], 0644)
+	// only uploads the journal knows of are resumed
+	journal := filepath.Join(t.TempDir(), "journal")
+	entry, _ := json.Marshal(tftpd.JournalEntry{Path: "upload.bin", Offset: 3000, Time: time.Now()})
+	os.WriteFile(journal, append(entry, '\n'), 0644)
+	cli := newTestClient(t, dir, tftptest.Faults{}, func(server *tftpd.TFTPServer) {
+		server.Journal, _ = tftpd.OpenJournal(journal, 24*time.Hour)
+	})
+
+	var buf bytes.Buffer
+	stats, err := cli.ResumeGet("file.bin", &buf, 4321)
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data[4321:]) || stats.Bytes != int64(len(data)-4321) {
+		t.Fatalf("Incorrect resumed download of %v bytes\n", stats.Bytes)
+	}
+
+	stats, err = cli.ResumePut("upload.bin", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	uploaded, _ := os.ReadFile(filepath.Join(dir, "upload.bin"))
+	if !bytes.Equal(uploaded, data) || stats.Bytes != int64(len(data)-3000) {
+		t.Fatalf("Incorrect resumed upload of %v bytes\n", stats.Bytes)
+	}
+}
+
+func TestSetURL(t *testing.T) {
+	tests := []struct {
+		url       string
+		addr      string
+		filename  string
+		blockSize int
+		timeout   time.Duration
+		digest    bool
+		err       bool
+	}{
+		{url: "tftp://host/pxelinux.0", addr: "host:69", filename: "pxelinux.0", blockSize: 512, timeout: 5 * time.Second},
+		{url: "tftp://10.0.0.1:6969/cfg/r1.cfg?blksize=1428&timeout=2", addr: "10.0.0.1:6969", filename: "cfg/r1.cfg", blockSize: 1428, timeout: 2 * time.Second},
+		{url: "tftp://[::1]/a%20b;mode=octet?timeout=500ms&x-sha256", addr: "[::1]:69", filename: "a b", blockSize: 512, timeout: 500 * time.Millisecond, digest: true},
+		{url: "tftp://host/file;mode=netascii", err: true},
+		{url: "tftp://host/file?blksize=4", err: true},
+		{url: "tftp://host/file?windowsize=8", err: true},
+		{url: "http://host/file", err: true},
+	}
+	for _, test := range tests {
+		cli := client.New("other:69")
+		filename, err := cli.SetURL(test.url)
+		if test.err {
+			if err == nil {
+				t.Fatalf("Error expected for %v\n", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if cli.Addr != test.addr || filename != test.filename || cli.BlockSize != test.blockSize || cli.Timeout != test.timeout || cli.Digest != test.digest {
+			t.Fatalf("Incorrect client %v %v %v %v %v for %v\n", cli.Addr, filename, cli.BlockSize, cli.Timeout, cli.Digest, test.url)
+		}
+	}
+}
+
+func TestGetMulticast(t *testing.T) {
+	data := make([]byte, 4*512+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	network := tftptest.NewNetwork()
+	server, _ := network.ListenPacket("server")
+	tid, _ := network.ListenPacket("tid")
+	group := tftptest.Addr("239.255.0.1:1758")
+	joined := make(chan struct{})
+
+	cli := client.New("")
+	cli.Server = server.LocalAddr()
+	cli.Timeout = time.Second
+	cli.ListenPacket = func() (net.PacketConn, error) {
+		return network.ListenPacket("")
+	}
+	cli.ListenMulticast = func(addr *net.UDPAddr) (net.PacketConn, error) {
+		defer close(joined)
+		return network.ListenPacket(addr.String())
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := cli.GetMulticast("file.bin", f)
+		errs <- err
+	}()
+
+	receive := func(conn net.PacketConn, timeout time.Duration) (wire.Packet, net.Addr) {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, nil
+		}
+		pkt, _ := wire.Unmarshal(buf[:n])
+		return pkt, addr
+	}
+	send := func(pkt wire.Packet, addr net.Addr) {
+		raw, _ := wire.Marshal(pkt)
+		tid.WriteTo(raw, addr)
+	}
+	sendBlock := func(block int) {
+		end := block * 512
+		if end > len(data) {
+			end = len(data)
+		}
+		send(&wire.Data{Block: uint16(block), Payload: data[(block-1)*512 : end]}, group)
+	}
+
+	rrq, addr := receive(server, time.Second)
+	if rrq, ok := rrq.(*wire.ReadRequest); !ok || rrq.Options.String() != "multicast=" {
+		t.Fatalf("Incorrect request %v\n", rrq)
+	}
+	// joining late, blocks 3 and 4 were sent to the group already
+	var opts wire.Options
+	opts.Set("multicast", "239.255.0.1,1758,0")
+	send(&wire.OptionAck{Options: opts}, addr)
+	<-joined
+	sendBlock(3)
+	sendBlock(4)
+	if pkt, _ := receive(tid, 50*time.Millisecond); pkt != nil {
+		t.Fatalf("Only the master client should acknowledge, got %v\n", pkt)
+	}
+
+	opts.Set("multicast", ",,1")
+	send(&wire.OptionAck{Options: opts}, addr)
+	var acks []uint16
+	for {
+		pkt, _ := receive(tid, time.Second)
+		ack, ok := pkt.(*wire.Ack)
+		if !ok {
+			t.Fatalf("Incorrect packet %v\n", pkt)
+		}
+		acks = append(acks, ack.Block)
+		if ack.Block == 5 {
+			break
+		}
+		sendBlock(int(ack.Block) + 1)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	if fmt.Sprint(acks) != "[0 1 4 5]" {
+		t.Fatalf("Incorrect ACKs %v\n", acks)
+	}
+	got, _ := os.ReadFile(f.Name())
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Incorrect download of %v bytes\n", len(got))
+	}
+}
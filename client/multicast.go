@@ -0,0 +1,258 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// multicastOption requests a multicast download (RFC 2090).
+const multicastOption = "multicast"
+
+// GetMulticast downloads the remote file into w with a multicast transfer
+// (RFC 2090), many clients receive the same blocks at once, e.g. when
+// imaging a room of machines. Blocks arrive out of order when joining a
+// transfer in progress, they're written at their offset. The client only
+// acknowledges blocks while the server designates it as the master client,
+// it asks for the blocks it misses then. Servers without multicast support
+// send the file to this client alone. Files are limited to 65535 blocks,
+// Digest and PreSharedKey aren't supported.
+func (c *Client) GetMulticast(filename string, w io.WriterAt) (TransferStats, error) {
+	if c.PreSharedKey != nil {
+		return TransferStats{}, errors.New("x-psk isn't supported with multicast")
+	}
+	t, err := c.newTransfer(filename)
+	if err != nil {
+		return TransferStats{}, err
+	}
+	defer t.conn.Close()
+
+	m := &multicast{
+		transfer: t,
+		listen:   c.ListenMulticast,
+		w:        w,
+		packets:  make(chan received, 64),
+		done:     make(chan struct{}),
+		next:     1,
+	}
+	if m.listen == nil {
+		m.listen = func(group *net.UDPAddr) (net.PacketConn, error) {
+			return net.ListenMulticastUDP("udp", nil, group)
+		}
+	}
+	defer m.leave()
+	go m.read(t.conn, false)
+
+	opts := c.options()
+	if c.Progress != nil {
+		opts.Set("tsize", "0")
+	}
+	opts.Set(multicastOption, "")
+	t.requested = opts
+	if err := t.send(&wire.ReadRequest{Filename: filename, Mode: "octet", Options: opts}); err != nil {
+		return t.finish(), err
+	}
+	err = m.run()
+	return t.finish(), err
+}
+
+// multicast is the state of a multicast download.
+type multicast struct {
+	*transfer
+	listen  func(group *net.UDPAddr) (net.PacketConn, error)
+	w       io.WriterAt
+	packets chan received
+	done    chan struct{}
+	group   net.PacketConn
+
+	master bool
+	// blocks received, the lowest missing one and the last one once known
+	have  [1 << 16]bool
+	next  int
+	final int
+}
+
+// received is a packet read from the unicast or the multicast connection.
+type received struct {
+	data  []byte
+	addr  net.Addr
+	group bool
+}
+
+func (m *multicast) read(conn net.PacketConn, group bool) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case m.packets <- received{append([]byte(nil), buf[:n]...), addr, group}:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// leave stops reading and leaves the group.
+func (m *multicast) leave() {
+	close(m.done)
+	if m.group != nil {
+		m.group.Close()
+	}
+}
+
+func (m *multicast) run() error {
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+	for attempt := 0; ; {
+		var p received
+		select {
+		case p = <-m.packets:
+		case <-timer.C:
+			// only the master client asks for blocks again, the others
+			// wait for the transfer to go on
+			if attempt >= m.retries {
+				return ErrTimeout
+			}
+			attempt++
+			if m.master || m.tid == nil {
+				m.retransmit(true)
+				if err := m.resend(); err != nil {
+					return err
+				}
+			}
+			timer.Reset(m.timeout)
+			continue
+		}
+
+		switch {
+		case m.tid == nil && !p.group:
+			m.tid = p.addr
+		case m.tid == nil || p.addr.String() != m.tid.String():
+			if !p.group {
+				m.sendError(p.addr, tftpd.ErrUnknownTID)
+			}
+			continue
+		}
+
+		pkt, err := wire.Unmarshal(p.data)
+		if err != nil {
+			m.abort(tftpd.ErrIllegalOperation)
+			return err
+		}
+		var done bool
+		switch pkt := pkt.(type) {
+		case *wire.Error:
+			return tftpd.NewError(tftpd.ErrorCode(pkt.Code), pkt.Message)
+		case *wire.OptionAck:
+			err = m.optionAck(pkt.Options)
+		case *wire.Data:
+			done, err = m.data(pkt)
+		default:
+			err = m.unexpected(pkt)
+		}
+		if err != nil || done {
+			return err
+		}
+
+		attempt = 0
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(m.timeout)
+	}
+}
+
+// optionAck joins the group with the first OACK, later ones only change
+// the master client.
+func (m *multicast) optionAck(opts wire.Options) error {
+	first := !m.negotiated
+	if first {
+		if err := m.accept(opts); err != nil {
+			return err
+		}
+	}
+	v, ok := opts.Get(multicastOption)
+	if !ok {
+		// a unicast transfer, the server talks to this client alone
+		if first {
+			m.master = true
+		}
+		return m.acknowledge()
+	}
+
+	fields := strings.Split(v, ",")
+	if len(fields) != 3 {
+		err := tftpd.NewError(tftpd.CodeOptionNegotiation, fmt.Sprintf("Incorrect multicast '%v'.", v))
+		m.abort(err)
+		return err
+	}
+	if m.group == nil && fields[0] != "" {
+		group, err := net.ResolveUDPAddr("udp", net.JoinHostPort(fields[0], fields[1]))
+		if err == nil {
+			m.group, err = m.listen(group)
+		}
+		if err != nil {
+			m.abort(err)
+			return err
+		}
+		go m.read(m.group, true)
+	}
+	m.master = fields[2] == "1"
+	return m.acknowledge()
+}
+
+// data writes a block at its offset and reports whether the file is
+// complete.
+func (m *multicast) data(pkt *wire.Data) (bool, error) {
+	if !m.negotiated {
+		// options ignored, a unicast transfer
+		m.negotiate(nil)
+		m.master = true
+	}
+	block := int(pkt.Block)
+	if block == 0 || m.have[block] || m.final != 0 && block > m.final {
+		// the previous ACK was lost
+		if m.master && block == m.next-1 {
+			m.retransmit(false)
+			return false, m.resend()
+		}
+		return false, nil
+	}
+
+	n, err := m.w.WriteAt(pkt.Payload, int64(block-1)*int64(m.blockSize))
+	m.progress(int64(n))
+	if err != nil {
+		m.abort(err)
+		return false, err
+	}
+	m.blockDone(pkt.Block, len(pkt.Payload))
+	m.have[block] = true
+	if len(pkt.Payload) < m.blockSize {
+		m.final = block
+	}
+	for m.next < len(m.have) && m.have[m.next] {
+		m.next++
+	}
+
+	if err := m.acknowledge(); err != nil {
+		return false, err
+	}
+	return m.final != 0 && m.next > m.final, nil
+}
+
+// acknowledge tells the server, if this is the master client, up to which
+// block the file is complete, it sends the next missing one then.
+func (m *multicast) acknowledge() error {
+	if !m.master {
+		return nil
+	}
+	return m.send(&wire.Ack{Block: uint16(m.next - 1)})
+}
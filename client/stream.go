@@ -0,0 +1,116 @@
+package client
+
+import (
+	"io"
+	"sync"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+// errCanceled is sent to the server when a download is closed early.
+var errCanceled = tftpd.NewError(tftpd.CodeNotDefined, "Transfer canceled.")
+
+// Open starts downloading the remote file and returns it as a stream,
+// nothing is buffered beyond the current block. Errors of the server
+// before the first block, e.g. file not found, are returned right away,
+// later ones by Read instead of io.EOF. Closing the stream before the end
+// cancels the transfer.
+func (c *Client) Open(filename string) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	s := newStarter()
+	var err error
+	go func() {
+		_, err = c.Get(filename, &startWriter{pw, s})
+		close(s.done)
+		pw.CloseWithError(err)
+	}()
+	if !s.wait() && err != nil {
+		return nil, err
+	}
+	return &download{pr}, nil
+}
+
+type download struct {
+	*io.PipeReader
+}
+
+func (d *download) Close() error {
+	return d.CloseWithError(errCanceled)
+}
+
+// starter tells when a transfer got going, before the pipe blocks on it,
+// or ended before.
+type starter struct {
+	once    sync.Once
+	started chan struct{}
+	done    chan struct{}
+}
+
+func newStarter() *starter {
+	return &starter{started: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (s *starter) start() {
+	s.once.Do(func() { close(s.started) })
+}
+
+// wait reports whether the transfer started.
+func (s *starter) wait() bool {
+	select {
+	case <-s.started:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+type startWriter struct {
+	io.Writer
+	*starter
+}
+
+func (w *startWriter) Write(p []byte) (int, error) {
+	w.start()
+	return w.Writer.Write(p)
+}
+
+type startReader struct {
+	io.Reader
+	*starter
+}
+
+func (r *startReader) Read(p []byte) (int, error) {
+	r.start()
+	return r.Reader.Read(p)
+}
+
+// Create starts uploading the remote file and returns a stream for its
+// contents, of a length not known upfront. Blocks are sent as they're
+// written, nothing more is buffered. Errors of the server before the
+// first block, e.g. file exists, are returned right away, later ones by
+// Write and Close. Close finishes the upload.
+func (c *Client) Create(filename string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	u := &upload{PipeWriter: pw, starter: newStarter()}
+	go func() {
+		_, u.err = c.Put(filename, &startReader{pr, u.starter})
+		close(u.done)
+		pr.CloseWithError(u.err)
+	}()
+	if !u.wait() && u.err != nil {
+		return nil, u.err
+	}
+	return u, nil
+}
+
+type upload struct {
+	*io.PipeWriter
+	*starter
+	err error
+}
+
+func (u *upload) Close() error {
+	u.PipeWriter.Close()
+	<-u.done
+	return u.err
+}
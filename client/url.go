@@ -0,0 +1,120 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// SetURL points the client at the server of a tftp:// URL (RFC 3617), e.g.
+// tftp://host:port/path?blksize=1428, and returns the filename. The port
+// defaults to 69, only the octet mode is supported. The query sets options
+// of the client: blksize, timeout (in seconds as in RFC 2349, or a
+// duration like 500ms), retries, x-sha256 and x-append.
+func (c *Client) SetURL(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "tftp" || u.Host == "" {
+		return "", fmt.Errorf("not a tftp:// URL: %v", rawurl)
+	}
+	if u.User != nil || u.Fragment != "" {
+		return "", fmt.Errorf("unsupported URL: %v", rawurl)
+	}
+
+	filename := strings.TrimPrefix(u.Path, "/")
+	if i := strings.LastIndexByte(filename, ';'); i >= 0 {
+		switch strings.ToLower(filename[i+1:]) {
+		case "mode=octet", "mode=binary":
+		default:
+			return "", fmt.Errorf("unsupported transfer mode in URL: %v", filename[i+1:])
+		}
+		filename = filename[:i]
+	}
+
+	for name, values := range u.Query() {
+		if err := c.setOption(name, values[len(values)-1]); err != nil {
+			return "", err
+		}
+	}
+
+	c.Addr, c.Server = u.Host, nil
+	if u.Port() == "" {
+		c.Addr = net.JoinHostPort(u.Hostname(), "69")
+	}
+	return filename, nil
+}
+
+func (c *Client) setOption(name, value string) error {
+	var err error
+	switch strings.ToLower(name) {
+	case "blksize":
+		c.BlockSize, err = strconv.Atoi(value)
+		if err == nil && (c.BlockSize < 8 || c.BlockSize > maxPacketSize-wire.HeaderSize) {
+			err = errors.New("out of range")
+		}
+	case "timeout":
+		var secs int
+		if secs, err = strconv.Atoi(value); err == nil {
+			c.Timeout = time.Duration(secs) * time.Second
+		} else {
+			c.Timeout, err = time.ParseDuration(value)
+		}
+		if err == nil && c.Timeout <= 0 {
+			err = errors.New("not positive")
+		}
+	case "retries":
+		c.Retries, err = strconv.Atoi(value)
+		if err == nil && c.Retries < 0 {
+			err = errors.New("negative")
+		}
+	case tftpd.DigestOption:
+		c.Digest, err = parseFlag(value)
+	case tftpd.AppendOption:
+		c.Append, err = parseFlag(value)
+	default:
+		return fmt.Errorf("unsupported option in URL: %v", name)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %v '%v' in URL: %v", name, value, err)
+	}
+	return nil
+}
+
+// parseFlag also takes an empty value, ?x-append is as good as ?x-append=1.
+func parseFlag(value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// GetURL downloads the file of a tftp:// URL into w, see Client.SetURL.
+func GetURL(rawurl string, w io.Writer) (TransferStats, error) {
+	c := New("")
+	filename, err := c.SetURL(rawurl)
+	if err != nil {
+		return TransferStats{}, err
+	}
+	return c.Get(filename, w)
+}
+
+// PutURL uploads everything read from r as the file of a tftp:// URL, see
+// Client.SetURL.
+func PutURL(rawurl string, r io.Reader) (TransferStats, error) {
+	c := New("")
+	filename, err := c.SetURL(rawurl)
+	if err != nil {
+		return TransferStats{}, err
+	}
+	return c.Put(filename, r)
+}
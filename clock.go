@@ -0,0 +1,41 @@
+package tftpd
+
+import "time"
+
+// Clock tells the time to the retransmission timers, the watchdog, token
+// expiry, the session records and the backoff of rebuilding the socket, so
+// tests can use a fake one.
+type Clock interface {
+	Now() time.Time
+}
+
+func (tftp *TFTPServer) now() time.Time {
+	if tftp.Clock != nil {
+		return tftp.Clock.Now()
+	}
+	return time.Now()
+}
+
+// sleep waits until the clock moved by d or the server is closed. A fake
+// clock is polled, it moves when it's advanced.
+func (tftp *TFTPServer) sleep(d time.Duration) {
+	if tftp.Clock == nil {
+		time.Sleep(d)
+		return
+	}
+	until := tftp.Clock.Now().Add(d)
+	for tftp.Clock.Now().Before(until) && !tftp.closed.Load() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// socketDeadline converts a deadline of the clock to the wall clock time
+// of the socket. A fake clock is looked at whenever the loop wakes up, so
+// advancing it past a deadline takes effect with the next packet or
+// deadline at the latest.
+func (tftp *TFTPServer) socketDeadline(deadline time.Time) time.Time {
+	if deadline.IsZero() || tftp.Clock == nil {
+		return deadline
+	}
+	return time.Now().Add(deadline.Sub(tftp.Clock.Now()))
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+// The dashboard keeps an hour of stats for its graphs.
+const (
+	historyInterval = 10 * time.Second
+	historySize     = 360
+)
+
+//go:embed dashboard.html
+var dashboard []byte
+
+// listenAdmin binds the admin API before privileges are dropped.
+func listenAdmin(conf config) (net.Listener, error) {
+	if conf.Admin == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", conf.Admin)
+}
+
+// admin serves the JSON API of the daemon for tftptop, for the server and
+// its virtual hosts together, and the dashboard if enabled.
+type admin struct {
+	servers []*tftpd.TFTPServer
+	// nil if there's no configuration file
+	reloader *reloader
+
+	mu      sync.Mutex
+	conf    config
+	history []sample
+}
+
+// sample is a snapshot of the stats for the graphs of the dashboard.
+type sample struct {
+	Time           time.Time `json:"time"`
+	BytesSent      uint64    `json:"bytes_sent"`
+	BytesReceived  uint64    `json:"bytes_received"`
+	ActiveSessions int       `json:"active_sessions"`
+	Failed         uint64    `json:"failed"`
+	Retransmits    uint64    `json:"retransmits"`
+	Rejected       uint64    `json:"rejected"`
+}
+
+func newAdmin(servers []*tftpd.TFTPServer, conf config, reloader *reloader) *admin {
+	return &admin{servers: servers, conf: conf, reloader: reloader}
+}
+
+func (a *admin) serveHTTP(l net.Listener, conf config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/stats", a.stats)
+	mux.HandleFunc("/api/sessions", a.sessions)
+	mux.HandleFunc("/api/failures", a.failures)
+	mux.HandleFunc("/api/cancel", a.cancelSession)
+	mux.HandleFunc("/api/reload", a.reloadConfig)
+	if conf.Dashboard {
+		mux.HandleFunc("/api/history", a.getHistory)
+		mux.HandleFunc("/api/config", a.getConfig)
+		mux.HandleFunc("/", a.dashboard)
+		go a.record()
+	}
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("error while serving the admin API: '%v'\n", err)
+		}
+	}()
+}
+
+var errNoConfig = errors.New("no configuration file to reload")
+
+// reload reads the configuration file again.
+func (a *admin) reload() error {
+	if a.reloader == nil {
+		return errNoConfig
+	}
+	return a.reloader.reload()
+}
+
+// cancel ends the session on whichever server has it.
+func (a *admin) cancel(id string) bool {
+	for _, server := range a.servers {
+		if server.CancelSession(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloaded shows the configuration after a reload.
+func (a *admin) reloaded(conf config) {
+	a.mu.Lock()
+	a.conf = conf
+	a.mu.Unlock()
+}
+
+// record samples the stats for the history.
+func (a *admin) record() {
+	for now := range time.Tick(historyInterval) {
+		stats := a.allStats()
+		a.mu.Lock()
+		if len(a.history) >= historySize {
+			a.history = append(a.history[:0], a.history[1:]...)
+		}
+		a.history = append(a.history, sample{now, stats.BytesSent, stats.BytesReceived, stats.ActiveSessions, stats.SessionsFailed, stats.Retransmits, stats.Rejected})
+		a.mu.Unlock()
+	}
+}
+
+func (a *admin) allStats() tftpd.Stats {
+	var stats tftpd.Stats
+	for _, server := range a.servers {
+		stats = addStats(stats, server.Stats())
+	}
+	return stats
+}
+
+func (a *admin) dashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboard)
+}
+
+func (a *admin) getHistory(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	history := append([]sample{}, a.history...)
+	a.mu.Unlock()
+	writeJSON(w, history)
+}
+
+func (a *admin) getConfig(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	conf := a.conf
+	a.mu.Unlock()
+	writeJSON(w, conf.redacted())
+}
+
+func (a *admin) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.allStats())
+}
+
+func (a *admin) sessions(w http.ResponseWriter, r *http.Request) {
+	sessions := []tftpd.SessionInfo{}
+	for _, server := range a.servers {
+		sessions = append(sessions, server.Sessions()...)
+	}
+	writeJSON(w, sessions)
+}
+
+func (a *admin) failures(w http.ResponseWriter, r *http.Request) {
+	failures := []tftpd.AuditRecord{}
+	for _, server := range a.servers {
+		failures = append(failures, server.RecentFailures()...)
+	}
+	writeJSON(w, failures)
+}
+
+// cancelSession ends the session of the id parameter.
+func (a *admin) cancelSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-site request", http.StatusForbidden)
+		return
+	}
+	id := r.FormValue("id")
+	if !a.cancel(id) {
+		http.Error(w, fmt.Sprintf("no session %v", id), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *admin) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-site request", http.StatusForbidden)
+		return
+	}
+	if err := a.reload(); errors.Is(err, errNoConfig) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sameOrigin refuses the requests another site can make a browser send to
+// the API: the Origin of a page on another host and the content types of
+// HTML forms, which older browsers send without an Origin.
+func sameOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return false
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+		return false
+	}
+	return true
+}
+
+// redacted returns the configuration without the webhook secret and the
+// passwords of the webhook URLs, the API isn't authenticated.
+func (conf config) redacted() config {
+	if conf.WebhookSecret != "" {
+		conf.WebhookSecret = "xxxxx"
+	}
+	conf.Webhooks = append([]string(nil), conf.Webhooks...)
+	for i, hook := range conf.Webhooks {
+		if u, err := url.Parse(hook); err == nil {
+			conf.Webhooks[i] = u.Redacted()
+		}
+	}
+	return conf
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error while writing admin response: '%v'\n", err)
+	}
+}
+
+func addStats(a, b tftpd.Stats) tftpd.Stats {
+	a.SessionsStarted += b.SessionsStarted
+	a.SessionsCompleted += b.SessionsCompleted
+	a.SessionsFailed += b.SessionsFailed
+	a.BytesReceived += b.BytesReceived
+	a.BytesSent += b.BytesSent
+	a.Retransmits += b.Retransmits
+	a.Blocks += b.Blocks
+	a.Dropped += b.Dropped
+	a.Rejected += b.Rejected
+	a.ActiveSessions += b.ActiveSessions
+	if a.Errors == nil {
+		a.Errors = make(map[tftpd.ErrorCode]uint64)
+	}
+	for code, n := range b.Errors {
+		a.Errors[code] += n
+	}
+	return a
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+const allowlistPoll = 2 * time.Second
+
+// allowlist is the allowlist file of the daemon, it's read before the
+// privileges are dropped.
+type allowlist struct {
+	path    string
+	list    *tftpd.Allowlist
+	modTime time.Time
+}
+
+func loadAllowlist(path string) (*allowlist, error) {
+	list, err := tftpd.OpenAllowlist(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &allowlist{path: path, list: list, modTime: fi.ModTime()}, nil
+}
+
+// watch reloads the allowlist of the servers, the main one and the virtual
+// hosts, whenever the file changes. A broken file keeps the last list in
+// place.
+func (a *allowlist) watch(servers []*tftpd.TFTPServer) {
+	go func() {
+		last := a.modTime
+		for range time.Tick(allowlistPoll) {
+			path := jailed(a.path)
+			fi, err := os.Stat(path)
+			if err != nil || fi.ModTime().Equal(last) {
+				continue
+			}
+			last = fi.ModTime()
+
+			list, err := tftpd.OpenAllowlist(path)
+			if err != nil {
+				log.Printf("Can't reload allowlist: '%v'\n", err)
+				continue
+			}
+			for _, server := range servers {
+				server.Reconfigure(func(server *tftpd.TFTPServer) {
+					server.Allowlist = list
+				})
+			}
+			log.Printf("Allowlist reloaded.\n")
+		}
+	}()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+// check validates the configuration without serving, it reports all
+// problems it finds and returns the exit status.
+func check(path string, flags []setting) int {
+	conf, err := parseConfig(path, flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "go-tftpd: %v\n", err)
+		return 1
+	}
+
+	problems := conf.check()
+	for _, err := range problems {
+		fmt.Fprintf(os.Stderr, "go-tftpd: %v\n", err)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Println("Configuration is valid.")
+	return 0
+}
+
+// check returns all problems of the configuration.
+func (conf *config) check() []error {
+	var problems []error
+	if conf.LogFormat != "text" && conf.LogFormat != "json" {
+		problems = append(problems, fmt.Errorf("unknown log format '%v'", conf.LogFormat))
+	}
+	if _, ok := conflicts[conf.OnConflict]; !ok {
+		problems = append(problems, fmt.Errorf("unknown upload conflict policy '%v'", conf.OnConflict))
+	}
+	if conf.Timeout < 0 || conf.MaxTimeout < 0 {
+		problems = append(problems, fmt.Errorf("negative timeout"))
+	}
+	if _, ok := profiles[conf.Profile]; !ok && conf.Profile != "" {
+		problems = append(problems, fmt.Errorf("unknown profile '%v'", conf.Profile))
+	}
+	if conf.Retries < 0 {
+		problems = append(problems, fmt.Errorf("negative number of retries"))
+	}
+	if conf.Backoff < 0 {
+		problems = append(problems, fmt.Errorf("negative backoff"))
+	}
+	if conf.Jitter < 0 || conf.Jitter >= 1 {
+		problems = append(problems, fmt.Errorf("jitter must be at least 0 and below 1"))
+	}
+	if conf.Count < 0 || conf.Duration < 0 {
+		problems = append(problems, fmt.Errorf("negative count or duration"))
+	}
+	if conf.MaxBlockSize < 0 {
+		problems = append(problems, fmt.Errorf("negative maximum block size"))
+	}
+	if conf.MaxDatagramSize < 0 {
+		problems = append(problems, fmt.Errorf("negative maximum datagram size"))
+	}
+	for _, hook := range conf.Webhooks {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, fmt.Errorf("webhook '%v' isn't an http or https URL", hook))
+		}
+	}
+	if conf.Dashboard && conf.Admin == "" {
+		problems = append(problems, fmt.Errorf("the dashboard needs an admin address"))
+	}
+	if conf.MaxWindowSize < 0 {
+		problems = append(problems, fmt.Errorf("negative maximum window size"))
+	}
+	if conf.FileCacheSize < 0 || conf.FileCacheTTL < 0 {
+		problems = append(problems, fmt.Errorf("negative file cache size or TTL"))
+	}
+	if conf.Prefetch < 0 {
+		problems = append(problems, fmt.Errorf("negative prefetch"))
+	}
+	if conf.Bandwidth < 0 || conf.SmallTransfer < 0 {
+		problems = append(problems, fmt.Errorf("negative bandwidth or small transfer size"))
+	}
+	if conf.Workers < 0 || conf.WorkQueue < 0 {
+		problems = append(problems, fmt.Errorf("negative number of workers or queue size"))
+	}
+	if conf.DSCP < 0 || conf.DSCP > 63 {
+		problems = append(problems, fmt.Errorf("DSCP must be between 0 and 63"))
+	}
+	if conf.MaxSessions < 0 {
+		problems = append(problems, fmt.Errorf("negative maximum number of sessions"))
+	}
+	if conf.MaxViolations < 0 || conf.BlockDuration < 0 {
+		problems = append(problems, fmt.Errorf("negative maximum number of violations or block duration"))
+	}
+	problems = append(problems, checkPolicies(conf.Policies)...)
+	problems = append(problems, conf.checkVHosts()...)
+	if _, err := net.ResolveUDPAddr("udp", conf.address()); err != nil {
+		problems = append(problems, fmt.Errorf("listen address: %w", err))
+	}
+	if conf.Root != "" {
+		if fi, err := os.Stat(conf.Root); err != nil {
+			problems = append(problems, fmt.Errorf("root: %w", err))
+		} else if !fi.IsDir() {
+			problems = append(problems, fmt.Errorf("root: %v isn't a directory", conf.Root))
+		}
+	}
+	if conf.File != "" {
+		// relative to the root
+		path := conf.File
+		if !filepath.IsAbs(path) && conf.Root != "" {
+			path = filepath.Join(conf.Root, path)
+		}
+		if fi, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Errorf("file: %w", err))
+		} else if !fi.Mode().IsRegular() {
+			problems = append(problems, fmt.Errorf("file: %v isn't a regular file", conf.File))
+		}
+	}
+	if conf.Allowlist != "" {
+		if _, err := tftpd.OpenAllowlist(conf.Allowlist); err != nil {
+			problems = append(problems, fmt.Errorf("allowlist: %w", err))
+		}
+	}
+	if conf.PSKFile != "" {
+		if _, err := tftpd.ReadPSK(conf.PSKFile); err != nil {
+			problems = append(problems, fmt.Errorf("psk file: %w", err))
+		}
+	} else if conf.RequirePSK {
+		problems = append(problems, fmt.Errorf("psk-required needs a psk-file"))
+	}
+	if conf.ProxyDHCP {
+		if len(conf.BootFile) > 127 || len(conf.BootFileEFI) > 127 {
+			problems = append(problems, fmt.Errorf("boot file names are limited to 127 bytes"))
+		}
+		if conf.ServerIP != "" && net.ParseIP(conf.ServerIP).To4() == nil {
+			problems = append(problems, fmt.Errorf("server IP '%v' isn't an IPv4 address", conf.ServerIP))
+		}
+	}
+	if conf.Chroot && conf.Root == "" {
+		problems = append(problems, fmt.Errorf("chroot needs a root directory"))
+	}
+	if conf.User != "" {
+		if _, _, err := lookupUser(conf.User, conf.Group); err != nil {
+			problems = append(problems, fmt.Errorf("user: %w", err))
+		}
+	} else if conf.Group != "" {
+		problems = append(problems, fmt.Errorf("group is set without a user"))
+	}
+	for i, rule := range conf.ACL {
+		if err := (tftpd.ACL{rule}).Validate(); err != nil {
+			problems = append(problems, fmt.Errorf("acl rule %d: %w", i+1, err))
+		}
+	}
+	return problems
+}
+
+// checkPolicies returns the problems of the policies.
+func checkPolicies(policies []policy) []error {
+	var problems []error
+	for _, p := range policies {
+		if _, ok := conflicts[p.OnConflict]; p.OnConflict != "" && !ok {
+			problems = append(problems, fmt.Errorf("policy '%v': unknown upload conflict policy '%v'", p.Prefix, p.OnConflict))
+		}
+		if p.MaxSize < 0 || p.MaxBlockSize < 0 || p.Timeout < 0 || p.Retries < 0 || p.Bandwidth < 0 || p.Weight < 0 {
+			problems = append(problems, fmt.Errorf("policy '%v': negative limit", p.Prefix))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+// config is the JSON configuration file of the daemon.
+type config struct {
+	Port string `json:"port"`
+	// Listen is the address to listen on, it overrides Port.
+	Listen string `json:"listen"`
+	Root   string `json:"root"`
+	// Chroot confines the daemon to Root once the socket is bound.
+	Chroot bool `json:"chroot"`
+	// Sandbox restricts the daemon with Landlock and seccomp (Linux only).
+	Sandbox  bool `json:"sandbox"`
+	ReadOnly bool `json:"read_only"`
+	// Gzip serves compressed variants of files.
+	Gzip bool `json:"gzip"`
+	// DirList serves listings of .dirlist/prefix.
+	DirList bool `json:"dirlist"`
+	// ServerInfo serves .server-info.
+	ServerInfo bool `json:"server_info"`
+	// FirstBlockCache keeps the beginning of popular files in memory.
+	FirstBlockCache bool `json:"first_block_cache"`
+	// FileCacheSize files are kept open for FileCacheTTL after their last
+	// download.
+	FileCacheSize int      `json:"file_cache_size"`
+	FileCacheTTL  duration `json:"file_cache_ttl"`
+	// Prefetch is the number of blocks read ahead.
+	Prefetch int `json:"prefetch"`
+	// IOUring reads downloads and writes uploads through io_uring on
+	// Linux.
+	IOUring bool `json:"io_uring"`
+	// Bandwidth limits all transfers together, in bytes per second,
+	// SmallTransfer is the size up to which transfers go first.
+	Bandwidth     int64 `json:"bandwidth"`
+	SmallTransfer int64 `json:"small_transfer"`
+	// Append and Resume enable the x-append and x-offset options.
+	Append bool `json:"append"`
+	Resume bool `json:"resume"`
+	// OnConflict is "reject", "number" or "timestamp", see conflicts.
+	OnConflict string `json:"on_conflict"`
+	// RemovePartial deletes the files of failed uploads.
+	RemovePartial bool `json:"remove_partial"`
+	// Allowlist is a file listing the files which may be downloaded.
+	Allowlist string `json:"allowlist"`
+	// PSKFile holds the key of the x-psk option, RequirePSK rejects
+	// transfers in the clear.
+	PSKFile    string `json:"psk_file"`
+	RequirePSK bool   `json:"psk_required"`
+	// SecurityLog is a file getting access denials and protocol violations.
+	SecurityLog string `json:"security_log"`
+	// Journal is a file recording uploads in progress.
+	Journal string `json:"journal"`
+	// File is served for every download if set.
+	File         string   `json:"file"`
+	Timeout      duration `json:"timeout"`
+	Retries      int      `json:"retries"`
+	MaxBlockSize int      `json:"blksize_max"`
+	// MaxDatagramSize is the size of the packet buffers.
+	MaxDatagramSize int `json:"datagram_max"`
+	MaxSessions     int `json:"max_sessions"`
+	MTU             int `json:"mtu"`
+	// DSCP marks the outbound packets for QoS, 0 leaves the socket as it is.
+	DSCP int `json:"dscp"`
+	// RejectWhenFull rejects sessions beyond MaxSessions.
+	RejectWhenFull bool `json:"reject_when_full"`
+	// Workers run the background work of sessions, see tftpd.TFTPServer.
+	Workers      int  `json:"workers"`
+	WorkQueue    int  `json:"work_queue"`
+	DropWhenBusy bool `json:"drop_when_busy"`
+	// Profile fills in the retransmission and window settings left unset,
+	// see profiles.
+	Profile string `json:"profile"`
+	// MaxWindowSize limits the windowsize option.
+	MaxWindowSize int `json:"windowsize_max"`
+	// Backoff and Jitter vary the retransmission timeouts.
+	Backoff    float64  `json:"backoff"`
+	MaxTimeout duration `json:"max_timeout"`
+	Jitter     float64  `json:"jitter"`
+	// MaxViolations blocks clients sending that many malformed packets or
+	// packets with unknown TIDs for BlockDuration.
+	MaxViolations int      `json:"max_violations"`
+	BlockDuration duration `json:"block_duration"`
+	// Lenient accepts malformed requests of buggy clients.
+	Lenient   bool   `json:"lenient"`
+	LogFormat string `json:"log_format"`
+	// Count and Duration stop the daemon after that many successful
+	// transfers or that long.
+	Count    int      `json:"count"`
+	Duration duration `json:"duration"`
+	// Admin is the address of the HTTP API for tftptop, without
+	// authentication.
+	Admin string `json:"admin"`
+	// Dashboard serves a web UI on the admin address.
+	Dashboard bool `json:"dashboard"`
+	// GRPC is the address of the control API of adminpb, without
+	// authentication.
+	GRPC string `json:"grpc"`
+	// Webhooks get a JSON event after every transfer, signed with
+	// WebhookSecret if set.
+	Webhooks      []string `json:"webhooks"`
+	WebhookSecret string   `json:"webhook_secret"`
+	// MDNS advertises the server as _tftp._udp on the local network,
+	// as MDNSName or the host name.
+	MDNS     bool   `json:"mdns"`
+	MDNSName string `json:"mdns_name"`
+	// ProxyDHCP answers PXE clients with BootFile (BootFileEFI for UEFI
+	// clients) on this server, at ServerIP or the address of the interface
+	// the request came in on.
+	ProxyDHCP   bool   `json:"proxy_dhcp"`
+	BootFile    string `json:"boot_file"`
+	BootFileEFI string `json:"boot_file_efi"`
+	ServerIP    string `json:"server_ip"`
+	// User and Group to run as once the socket is bound.
+	User  string    `json:"user"`
+	Group string    `json:"group"`
+	ACL   tftpd.ACL `json:"acl"`
+	// Policies override limits for files below some paths.
+	Policies []policy `json:"policies"`
+	// VHosts serve other roots on other addresses.
+	VHosts []vhost `json:"vhosts"`
+}
+
+// policy is a tftpd.Policy in the configuration file.
+type policy struct {
+	Prefix       string   `json:"prefix"`
+	MaxSize      int64    `json:"max_size"`
+	MaxBlockSize int      `json:"blksize_max"`
+	Timeout      duration `json:"timeout"`
+	Retries      int      `json:"retries"`
+	// Bandwidth is in bytes per second per transfer, Weight the share of
+	// the bandwidth of the server.
+	Bandwidth  int64  `json:"bandwidth"`
+	Weight     int    `json:"weight"`
+	OnConflict string `json:"on_conflict"`
+}
+
+func defaultConfig() config {
+	return config{Port: "8000", LogFormat: "text", BootFile: "pxelinux.0", OnConflict: "reject"}
+}
+
+// readConfig builds the configuration from the environment, the file at
+// path (if any) and the flags, later ones taking precedence.
+func readConfig(path string, flags []setting) (config, error) {
+	conf, err := parseConfig(path, flags)
+	if err != nil {
+		return conf, err
+	}
+	if problems := conf.check(); len(problems) > 0 {
+		return conf, problems[0]
+	}
+	return conf, nil
+}
+
+// parseConfig is readConfig without validating the values.
+func parseConfig(path string, flags []setting) (config, error) {
+	conf := defaultConfig()
+	if err := conf.setEnv(); err != nil {
+		return conf, err
+	}
+	if path != "" {
+		if err := conf.load(path); err != nil {
+			return conf, err
+		}
+	}
+	for _, s := range flags {
+		if err := s.set(&conf, s.value); err != nil {
+			return conf, fmt.Errorf("-%v: %w", s.name, err)
+		}
+	}
+	conf.applyProfile()
+	conf.resolvePaths()
+	return conf, nil
+}
+
+// workDir is the directory the daemon was started in, it's never changed so
+// sessions in flight keep their files when the root is reloaded.
+var workDir, _ = os.Getwd()
+
+// resolvePaths makes the root, the roots of the virtual hosts and the
+// allowlist, which is watched, absolute. An empty root is the working
+// directory.
+func (conf *config) resolvePaths() {
+	if conf.Root != "" && !filepath.IsAbs(conf.Root) {
+		conf.Root = filepath.Join(workDir, conf.Root)
+	}
+	if conf.Allowlist != "" && !filepath.IsAbs(conf.Allowlist) {
+		conf.Allowlist = filepath.Join(workDir, conf.Allowlist)
+	}
+	for i := range conf.VHosts {
+		if !filepath.IsAbs(conf.VHosts[i].Root) {
+			conf.VHosts[i].Root = filepath.Join(conf.rootDir(), conf.VHosts[i].Root)
+		}
+	}
+}
+
+// rootDir returns the absolute root directory.
+func (conf *config) rootDir() string {
+	if conf.Root == "" {
+		return workDir
+	}
+	return conf.Root
+}
+
+// load reads the file at path over conf, unknown fields are rejected to
+// catch typos.
+func (conf *config) load(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(conf); err != nil {
+		// point to the line of the error where possible
+		var syntax *json.SyntaxError
+		var typ *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntax):
+			return fmt.Errorf("%v:%d: %w", path, lineOf(b, syntax.Offset), err)
+		case errors.As(err, &typ):
+			return fmt.Errorf("%v:%d: %w", path, lineOf(b, typ.Offset), err)
+		}
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	return nil
+}
+
+func lineOf(b []byte, offset int64) int {
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	return bytes.Count(b[:offset], []byte("\n")) + 1
+}
+
+// address returns the address to listen on.
+func (conf *config) address() string {
+	if conf.Listen != "" {
+		return conf.Listen
+	}
+	return net.JoinHostPort("", conf.Port)
+}
+
+// confined is set once the daemon is chrooted or sandboxed into the root
+// directory, which can't change anymore then.
+var confined bool
+
+// chroot is the directory the daemon is chrooted into, if it is.
+var chroot string
+
+// jailed returns an absolute path as it's seen inside the chroot, paths
+// outside of it are left alone and can't be opened.
+func jailed(path string) string {
+	if chroot == "" {
+		return path
+	}
+	rel, err := filepath.Rel(chroot, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
+
+// apply configures the server.
+func (conf *config) apply(server *tftpd.TFTPServer) {
+	server.Root = jailed(conf.rootDir())
+	conf.applySettings(server)
+	server.ACL = conf.ACL
+	server.Policies = newPolicies(conf.Policies)
+}
+
+// applySettings configures everything but the root, the ACL and the
+// policies, which virtual hosts have their own of.
+func (conf *config) applySettings(server *tftpd.TFTPServer) {
+	server.ReadOnly = conf.ReadOnly
+	server.Gzip = conf.Gzip
+	server.DirList = conf.DirList
+	server.ServerInfo = conf.ServerInfo
+	server.FirstBlockCache = conf.FirstBlockCache
+	server.FileCacheSize = conf.FileCacheSize
+	server.FileCacheTTL = time.Duration(conf.FileCacheTTL)
+	server.Prefetch = conf.Prefetch
+	server.IOUring = conf.IOUring
+	server.Bandwidth = conf.Bandwidth
+	server.SmallTransfer = conf.SmallTransfer
+	server.Append = conf.Append
+	server.Resume = conf.Resume
+	server.OnConflict = conflicts[conf.OnConflict]
+	server.RemovePartialUploads = conf.RemovePartial
+	server.ServeFile = jailed(conf.File)
+	server.MaxTransfers = conf.Count
+	server.Timeout = time.Duration(conf.Timeout)
+	server.Retries = conf.Retries
+	server.Backoff = conf.Backoff
+	server.MaxTimeout = time.Duration(conf.MaxTimeout)
+	server.Jitter = conf.Jitter
+	server.MaxBlockSize = conf.MaxBlockSize
+	server.MaxDatagramSize = conf.MaxDatagramSize
+	server.MaxWindowSize = conf.MaxWindowSize
+	server.MaxSessions = conf.MaxSessions
+	server.RejectWhenFull = conf.RejectWhenFull
+	server.Workers = conf.Workers
+	server.WorkQueue = conf.WorkQueue
+	server.DropWhenBusy = conf.DropWhenBusy
+	server.MTU = conf.MTU
+	if err := server.SetDSCP(conf.DSCP); err != nil {
+		log.Printf("error while setting the DSCP: '%v'\n", err)
+	}
+	server.MaxViolations = conf.MaxViolations
+	server.BlockDuration = time.Duration(conf.BlockDuration)
+	server.Lenient = conf.Lenient
+	server.RequirePSK = conf.RequirePSK
+}
+
+func newPolicies(config []policy) tftpd.Policies {
+	var policies tftpd.Policies
+	for _, p := range config {
+		policy := tftpd.Policy{
+			Prefix:       p.Prefix,
+			MaxSize:      p.MaxSize,
+			MaxBlockSize: p.MaxBlockSize,
+			Timeout:      time.Duration(p.Timeout),
+			Retries:      p.Retries,
+			Bandwidth:    p.Bandwidth,
+			Weight:       p.Weight,
+		}
+		if onConflict, ok := conflicts[p.OnConflict]; ok {
+			policy.OnConflict = &onConflict
+		}
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
+// duration is a time.Duration written as a string like "1.5s" in JSON.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+// conflicts maps the names of the OnConflict setting to the policies.
+var conflicts = map[string]tftpd.ConflictPolicy{
+	"reject":    tftpd.RejectConflicts,
+	"number":    tftpd.NumberConflicts,
+	"timestamp": tftpd.TimestampConflicts,
+}
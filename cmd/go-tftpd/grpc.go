@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+// The control API of adminpb/admin.proto is served without the gRPC and
+// protobuf modules: its messages are small enough to be encoded by hand,
+// over HTTP/2 without TLS, like gRPC clients connecting with insecure
+// credentials. The tests compare the encoding with messages encoded by
+// the protobuf module.
+const (
+	grpcService = "/tftpd.admin.v1.Admin/"
+	// requests have at most a session ID
+	maxGRPCRequest = 4096
+)
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+)
+
+var errMalformedProto = errors.New("malformed protobuf message")
+
+// listenGRPC binds the control API before privileges are dropped.
+func listenGRPC(conf config) (net.Listener, error) {
+	if conf.GRPC == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", conf.GRPC)
+}
+
+func (a *admin) serveGRPC(l net.Listener) {
+	handler := h2c.NewHandler(http.HandlerFunc(a.grpc), &http2.Server{})
+	go func() {
+		if err := http.Serve(l, handler); err != nil {
+			log.Printf("error while serving the gRPC API: '%v'\n", err)
+		}
+	}()
+}
+
+func (a *admin) grpc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	var resp []byte
+	switch strings.TrimPrefix(r.URL.Path, grpcService) {
+	case "ListSessions":
+		for _, server := range a.servers {
+			for _, session := range server.Sessions() {
+				resp = appendMessage(resp, 1, encodeSession(session))
+			}
+		}
+	case "CancelSession":
+		id, err := decodeCancelSession(req)
+		if err != nil {
+			grpcStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		if !a.cancel(id) {
+			grpcStatus(w, grpcNotFound, fmt.Sprintf("no session %v", id))
+			return
+		}
+	case "GetStats":
+		resp = encodeStats(a.allStats())
+	case "ReloadConfig":
+		if err := a.reload(); errors.Is(err, errNoConfig) {
+			grpcStatus(w, grpcFailedPrecondition, err.Error())
+			return
+		} else if err != nil {
+			grpcStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+	default:
+		grpcStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+		return
+	}
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(resp)))
+	if _, err := w.Write(append(header, resp...)); err != nil {
+		log.Printf("error while writing gRPC response: '%v'\n", err)
+	}
+	grpcStatus(w, grpcOK, "")
+}
+
+// grpcStatus ends the response with the status in the trailers.
+func grpcStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+// readGRPCMessage reads the single, uncompressed, message of a unary call.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("can't read request: %v", err)
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed requests are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxGRPCRequest {
+		return nil, errors.New("request too large")
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("can't read request: %v", err)
+	}
+	return msg, nil
+}
+
+func encodeSession(s tftpd.SessionInfo) []byte {
+	var b []byte
+	b = appendString(b, 1, s.ID)
+	b = appendString(b, 2, s.Client)
+	b = appendString(b, 3, s.Filename)
+	b = appendString(b, 4, s.Direction)
+	b = appendVarintField(b, 5, uint64(s.Bytes))
+	b = appendVarintField(b, 6, uint64(s.Size))
+	b = appendVarintField(b, 7, uint64(s.BlockSize))
+	b = appendVarintField(b, 8, uint64(s.WindowSize))
+	b = appendVarintField(b, 9, uint64(s.Retransmits))
+	var start []byte
+	start = appendVarintField(start, 1, uint64(s.Start.Unix()))
+	start = appendVarintField(start, 2, uint64(s.Start.Nanosecond()))
+	return appendMessage(b, 10, start)
+}
+
+func encodeStats(stats tftpd.Stats) []byte {
+	var b []byte
+	b = appendVarintField(b, 1, stats.SessionsStarted)
+	b = appendVarintField(b, 2, stats.SessionsCompleted)
+	b = appendVarintField(b, 3, stats.SessionsFailed)
+	b = appendVarintField(b, 4, stats.BytesReceived)
+	b = appendVarintField(b, 5, stats.BytesSent)
+	b = appendVarintField(b, 6, stats.Retransmits)
+	b = appendVarintField(b, 7, stats.Blocks)
+	b = appendVarintField(b, 8, stats.Dropped)
+	for code, n := range stats.Errors {
+		var entry []byte
+		entry = appendVarintField(entry, 1, uint64(code))
+		entry = appendVarintField(entry, 2, n)
+		b = appendMessage(b, 9, entry)
+	}
+	b = appendVarintField(b, 10, uint64(stats.ActiveSessions))
+	return appendVarintField(b, 11, stats.Rejected)
+}
+
+// decodeCancelSession returns the id of a CancelSessionRequest, skipping
+// unknown fields.
+func decodeCancelSession(b []byte) (string, error) {
+	id := ""
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return "", errMalformedProto
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return "", errMalformedProto
+			}
+		case 1:
+			n = 8
+		case 2:
+			size, m := binary.Uvarint(b)
+			if m <= 0 || size > uint64(len(b)-m) {
+				return "", errMalformedProto
+			}
+			if tag>>3 == 1 {
+				id = string(b[m : m+int(size)])
+			}
+			n = m + int(size)
+		case 5:
+			n = 4
+		default:
+			return "", errMalformedProto
+		}
+		if n > len(b) {
+			return "", errMalformedProto
+		}
+		b = b[n:]
+	}
+	return id, nil
+}
+
+// Fields with the default value are left out, like protobuf does.
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendMessage(b, field, []byte(s))
+}
+
+func appendMessage(b []byte, field int, msg []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+	"git.scarlet.house/oss/go-tftpd/tftptest"
+)
+
+// The golden messages were encoded by google.golang.org/protobuf from the
+// messages of adminpb/admin.proto.
+const (
+	goldenSession = "\n\x044f2a\x12\x0e192.0.2.1:1024\x1a\npxelinux.0\"\x04read(\x80\b0\xff\xff\xff\xff\xff\xff\xff\xff\xff\x018\xbc\v@\x01R\t\b\x80\xe2\xcf\xaa\x06\x10\xf4\x03"
+	goldenStats   = "\b\x03\x10\x02(\xac\x02J\x04\b\x01\x10\aP\x01X\x05"
+	goldenCancel  = "\n\x044f2a"
+)
+
+func TestGRPCEncoding(t *testing.T) {
+	session := tftpd.SessionInfo{
+		ID:         "4f2a",
+		Client:     "192.0.2.1:1024",
+		Filename:   "pxelinux.0",
+		Direction:  "read",
+		Bytes:      1024,
+		Size:       -1,
+		BlockSize:  1468,
+		WindowSize: 1,
+		Start:      time.Unix(1700000000, 500),
+	}
+	if b := encodeSession(session); string(b) != goldenSession {
+		t.Fatalf("Incorrect Session %q, should be %q\n", b, goldenSession)
+	}
+	if b := appendMessage(nil, 1, encodeSession(session)); string(b) != "\nF"+goldenSession {
+		t.Fatalf("Incorrect ListSessionsResponse %q\n", b)
+	}
+
+	stats := tftpd.Stats{SessionsStarted: 3, SessionsCompleted: 2, BytesSent: 300, ActiveSessions: 1, Rejected: 5, Errors: map[tftpd.ErrorCode]uint64{1: 7}}
+	if b := encodeStats(stats); string(b) != goldenStats {
+		t.Fatalf("Incorrect Stats %q, should be %q\n", b, goldenStats)
+	}
+
+	for _, v := range []struct {
+		msg string
+		id  string
+		err bool
+	}{
+		{goldenCancel, "4f2a", false},
+		{"", "", false},
+		// unknown fields are skipped
+		{"\x10\x05" + goldenCancel + "\x1d\x01\x02\x03\x04", "4f2a", false},
+		{"\n\x10abc", "", true},
+		{"\x0f", "", true},
+	} {
+		id, err := decodeCancelSession([]byte(v.msg))
+		if id != v.id || (err != nil) != v.err {
+			t.Fatalf("Incorrect decoding of %q: '%v' %v\n", v.msg, id, err)
+		}
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	conn, _ := tftptest.Pipe()
+	defer conn.Close()
+	a := newAdmin([]*tftpd.TFTPServer{tftpd.NewTFTPServerConn(conn)}, config{}, nil)
+
+	frame := func(msg string) string {
+		return string([]byte{0, 0, 0, 0, byte(len(msg))}) + msg
+	}
+	for _, v := range []struct {
+		method  string
+		request string
+		status  string
+		reply   string
+	}{
+		{"GetStats", frame(""), "0", frame("")},
+		{"ListSessions", frame(""), "0", frame("")},
+		{"CancelSession", frame(goldenCancel), "5", ""},
+		{"CancelSession", frame("\n\x10abc"), "3", ""},
+		{"ReloadConfig", frame(""), "9", ""},
+		{"Unknown", frame(""), "12", ""},
+		// compressed
+		{"GetStats", "\x01" + frame("")[1:], "3", ""},
+	} {
+		req := httptest.NewRequest(http.MethodPost, grpcService+v.method, bytes.NewBufferString(v.request))
+		req.Header.Set("Content-Type", "application/grpc")
+		rec := httptest.NewRecorder()
+		a.grpc(rec, req)
+
+		resp := rec.Result()
+		if status := resp.Trailer.Get("Grpc-Status"); status != v.status {
+			t.Fatalf("Incorrect status of %v %v, should be %v\n", v.method, status, v.status)
+		}
+		if body := rec.Body.String(); body != v.reply {
+			t.Fatalf("Incorrect reply to %v %q, should be %q\n", v.method, body, v.reply)
+		}
+	}
+}
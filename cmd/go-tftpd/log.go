@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// jsonLog writes every log line as a JSON object, for log collectors.
+type jsonLog struct {
+	w io.Writer
+}
+
+func (l jsonLog) Write(b []byte) (int, error) {
+	line, err := json.Marshal(struct {
+		Time    time.Time `json:"time"`
+		Message string    `json:"msg"`
+	}{time.Now(), strings.TrimSuffix(string(b), "\n")})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func setLogFormat(format string) {
+	if format == "json" {
+		log.SetFlags(0)
+		log.SetOutput(jsonLog{os.Stderr})
+		return
+	}
+	log.SetFlags(log.LstdFlags)
+	log.SetOutput(os.Stderr)
+}
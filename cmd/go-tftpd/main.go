@@ -1,12 +1,340 @@
 package main
 
-import "git.scarlet.house/oss/go-tftpd"
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+// Uploads which aren't resumed within a day are dropped from the journal.
+const journalMaxAge = 24 * time.Hour
+
+const usage = `Usage:
+  go-tftpd [flags]
+  go-tftpd check [flags]
+
+Flags:
+`
 
 func main() {
-	server, err := tftpd.NewTFTPServer("8000")
+	configPath := flag.String("config", os.Getenv(envName("config")), "JSON configuration `file` ("+envName("config")+")")
+	flag.StringVar(configPath, "c", *configPath, "shorthand for -config")
+	flags := settingFlags()
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+
+	// "check" validates the configuration and exits
+	args := os.Args[1:]
+	checkOnly := len(args) > 0 && args[0] == "check"
+	if checkOnly {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	// it's read again on reloads and allowed by the sandbox
+	if *configPath != "" {
+		if path, err := filepath.Abs(*configPath); err == nil {
+			*configPath = path
+		}
+	}
+	if checkOnly {
+		os.Exit(check(*configPath, *flags))
+	}
+
+	conf, err := readConfig(*configPath, *flags)
+	if err != nil {
+		log.Fatalf("Can't load configuration: %v\n", err)
+	}
+	setLogFormat(conf.LogFormat)
+
+	conn, err := listen(conf)
 	if err != nil {
 		panic(err)
 	}
+	vhostConns, err := listenVHosts(conf)
+	if err != nil {
+		log.Fatalf("Can't listen for virtual hosts: %v\n", err)
+	}
+	adminListener, err := listenAdmin(conf)
+	if err != nil {
+		log.Fatalf("Can't listen for the admin API: %v\n", err)
+	}
+	grpcListener, err := listenGRPC(conf)
+	if err != nil {
+		log.Fatalf("Can't listen for the gRPC API: %v\n", err)
+	}
+	if conf.MDNS {
+		addr, _ := conn.LocalAddr().(*net.UDPAddr)
+		if addr == nil {
+			log.Fatalf("Can't advertise a socket which isn't UDP\n")
+		}
+		stop, err := advertise(conf.MDNSName, addr.Port)
+		if err != nil {
+			log.Fatalf("Can't advertise the server: %v\n", err)
+		}
+		defer stop()
+	}
+	if conf.ProxyDHCP {
+		stop, err := serveProxyDHCP(conf)
+		if err != nil {
+			log.Fatalf("Can't start ProxyDHCP: %v\n", err)
+		}
+		defer stop()
+	}
+	// opened before dropping privileges, it's usually in /var/log
+	var secLog *tftpd.SecurityLog
+	if conf.SecurityLog != "" {
+		secLog, err = tftpd.OpenSecurityLog(conf.SecurityLog)
+		if err != nil {
+			log.Fatalf("Can't open security log: %v\n", err)
+		}
+		defer secLog.Close()
+	}
+	var journal *tftpd.Journal
+	if conf.Journal != "" {
+		journal, err = tftpd.OpenJournal(conf.Journal, journalMaxAge)
+		if err != nil {
+			log.Fatalf("Can't open journal: %v\n", err)
+		}
+		defer journal.Close()
+	}
+	// only root may read the key, and it's usually outside of the root
+	var psk []byte
+	if conf.PSKFile != "" {
+		psk, err = tftpd.ReadPSK(conf.PSKFile)
+		if err != nil {
+			log.Fatalf("Can't load pre-shared key: %v\n", err)
+		}
+	}
+	var allow *allowlist
+	if conf.Allowlist != "" {
+		allow, err = loadAllowlist(conf.Allowlist)
+		if err != nil {
+			log.Fatalf("Can't load allowlist: %v\n", err)
+		}
+	}
+	if err := dropPrivileges(conf); err != nil {
+		log.Fatalf("Can't drop privileges: %v\n", err)
+	}
+	server := tftpd.NewTFTPServerConn(conn)
+	server.SecurityLog = secLog
+	server.Journal = journal
+	if allow != nil {
+		server.Allowlist = allow.list
+	}
+	server.PreSharedKey = psk
+	conf.apply(server)
 	defer server.Close()
-	server.ListenAndServe()
+	vhosts := serveVHosts(vhostConns, conf, server)
+	for _, vhost := range vhosts {
+		defer vhost.Close()
+	}
+	if allow != nil {
+		allow.watch(append([]*tftpd.TFTPServer{server}, vhosts...))
+	}
+	if len(conf.Webhooks) > 0 {
+		// loaded before the sandbox hides them
+		x509.SystemCertPool()
+		hook := tftpd.NewWebhook(conf.Webhooks, []byte(conf.WebhookSecret))
+		defer hook.Close()
+		server.OnTransfer = hook.Notify
+		for _, vhost := range vhosts {
+			vhost.OnTransfer = hook.Notify
+		}
+	}
+	var reloads *reloader
+	if *configPath != "" {
+		reloads = &reloader{server: server, vhosts: vhosts, path: *configPath, flags: *flags, running: conf}
+	}
+	var adminAPI *admin
+	if adminListener != nil || grpcListener != nil {
+		adminAPI = newAdmin(append([]*tftpd.TFTPServer{server}, vhosts...), conf, reloads)
+	}
+	if adminListener != nil {
+		adminAPI.serveHTTP(adminListener, conf)
+	}
+	if grpcListener != nil {
+		adminAPI.serveGRPC(grpcListener)
+	}
+	if conf.Sandbox {
+		if err := sandbox(conf, *configPath); err != nil {
+			log.Fatalf("Can't sandbox the daemon: %v\n", err)
+		}
+	}
+
+	if reloads != nil {
+		reloads.mu.Lock()
+		reloads.adminAPI = adminAPI
+		reloads.mu.Unlock()
+		go reloads.watch()
+	}
+
+	// systemd restarts the daemon if the packet loop stops pinging
+	if interval := watchdogInterval(); interval > 0 {
+		server.WatchdogInterval = interval / 2
+		server.Watchdog = func() {
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Printf("error while notifying systemd: '%v'\n", err)
+			}
+		}
+	}
+	if conf.Duration > 0 {
+		time.AfterFunc(time.Duration(conf.Duration), func() {
+			log.Printf("Served for %v, stopping.\n", time.Duration(conf.Duration))
+			server.Close()
+		})
+	}
+	go func() {
+		// deferred cleanups like the mDNS goodbye have to run
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
+		<-term
+		server.Close()
+	}()
+	go handleUpgrades(server, conn)
+	upgradeReady()
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("error while notifying systemd: '%v'\n", err)
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("Stopped serving: %v\n", err)
+	}
+}
+
+// listen uses the socket from the old process of an upgrade or from systemd
+// if the daemon was socket activated, the configured port is ignored then.
+func listen(conf config) (net.PacketConn, error) {
+	conn, err := inheritedConn()
+	if conn != nil || err != nil {
+		return conn, err
+	}
+	conn, err = activationConn()
+	if err != nil {
+		return nil, err
+	}
+	if conn != nil {
+		log.Printf("Using socket %v from systemd\n", conn.LocalAddr())
+		return conn, nil
+	}
+	return net.ListenPacket("udp", conf.address())
+}
+
+// reloader reads the configuration again on SIGHUP or from the admin API.
+// Sessions in flight keep going, a broken file leaves the running
+// configuration alone.
+type reloader struct {
+	server   *tftpd.TFTPServer
+	vhosts   []*tftpd.TFTPServer
+	adminAPI *admin
+	path     string
+	flags    []setting
+
+	mu      sync.Mutex
+	running config
+}
+
+func (r *reloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := r.reload(); err != nil {
+			log.Printf("Can't reload configuration: '%v'\n", err)
+		}
+	}
+}
+
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	running := r.running
+	conf, err := readConfig(jailed(r.path), r.flags)
+	if err != nil {
+		return err
+	}
+	// settings which need a restart keep their running values, so they're
+	// neither applied nor taken as running by the next reload
+	if conf.address() != running.address() {
+		log.Printf("Address change to '%v' needs a restart.\n", conf.address())
+		conf.Listen, conf.Port = running.Listen, running.Port
+	}
+	if conf.Allowlist != running.Allowlist {
+		log.Printf("Allowlist change to '%v' needs a restart.\n", conf.Allowlist)
+		conf.Allowlist = running.Allowlist
+	}
+	if conf.PSKFile != running.PSKFile {
+		log.Printf("Pre-shared key change to '%v' needs a restart.\n", conf.PSKFile)
+		conf.PSKFile = running.PSKFile
+	}
+	if conf.SecurityLog != running.SecurityLog {
+		log.Printf("Security log change to '%v' needs a restart.\n", conf.SecurityLog)
+		conf.SecurityLog = running.SecurityLog
+	}
+	if conf.Admin != running.Admin {
+		log.Printf("Admin API address change to '%v' needs a restart.\n", conf.Admin)
+		conf.Admin = running.Admin
+	}
+	if strings.Join(conf.Webhooks, ",") != strings.Join(running.Webhooks, ",") || conf.WebhookSecret != running.WebhookSecret {
+		log.Printf("Webhook changes need a restart.\n")
+		conf.Webhooks, conf.WebhookSecret = running.Webhooks, running.WebhookSecret
+	}
+	if conf.GRPC != running.GRPC {
+		log.Printf("gRPC API address change to '%v' needs a restart.\n", conf.GRPC)
+		conf.GRPC = running.GRPC
+	}
+	if conf.Workers != running.Workers || conf.WorkQueue != running.WorkQueue {
+		log.Printf("Worker pool changes need a restart.\n")
+		conf.Workers, conf.WorkQueue = running.Workers, running.WorkQueue
+	}
+	// the buffers are sized when the server starts
+	if conf.MaxDatagramSize != running.MaxDatagramSize {
+		log.Printf("Datagram size changes need a restart.\n")
+		conf.MaxDatagramSize = running.MaxDatagramSize
+	}
+	if conf.MaxDatagramSize == 0 && conf.MaxBlockSize > 2044 && conf.MaxBlockSize > running.MaxBlockSize {
+		log.Printf("Block sizes beyond the packet buffers need a restart.\n")
+	}
+	if conf.Journal != running.Journal {
+		log.Printf("Journal change to '%v' needs a restart.\n", conf.Journal)
+		conf.Journal = running.Journal
+	}
+	if confined && conf.Root != running.Root {
+		log.Printf("Root change to '%v' needs a restart.\n", conf.Root)
+		conf.Root = running.Root
+	}
+	if !sameListeners(conf.VHosts, running.VHosts) {
+		log.Printf("Virtual host address changes need a restart.\n")
+		conf.VHosts = keepListeners(conf.VHosts, running.VHosts)
+	}
+	for i := range conf.VHosts {
+		if confined && i < len(running.VHosts) && conf.VHosts[i].Root != running.VHosts[i].Root {
+			log.Printf("Virtual host root change to '%v' needs a restart.\n", conf.VHosts[i].Root)
+			conf.VHosts[i].Root = running.VHosts[i].Root
+		}
+	}
+	setLogFormat(conf.LogFormat)
+	r.server.Reconfigure(conf.apply)
+	for i, vhost := range r.vhosts {
+		if i < len(conf.VHosts) {
+			i, conf := i, conf
+			vhost.Reconfigure(func(server *tftpd.TFTPServer) { conf.applyVHost(server, i) })
+		}
+	}
+	if r.adminAPI != nil {
+		r.adminAPI.reloaded(conf)
+	}
+	r.running = conf
+	log.Printf("Configuration reloaded.\n")
+	return nil
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mDNS (RFC 6762) and DNS-SD (RFC 6763) advertisement of the server as
+// _tftp._udp, IPv4 only.
+
+const (
+	mdnsService  = "_tftp._udp.local."
+	mdnsServices = "_services._dns-sd._udp.local."
+	mdnsPort     = 5353
+
+	// set in the class of records only this host announces
+	mdnsCacheFlush = 0x8000
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+type advertiser struct {
+	conn     *net.UDPConn
+	instance dnsmessage.Name
+	service  dnsmessage.Name
+	meta     dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+}
+
+// advertise announces the server on the local network until stop is called,
+// which sends a goodbye. name is the instance name, the host name if empty.
+func advertise(name string, port int) (stop func(), err error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	if name == "" {
+		name = hostname
+	}
+
+	instance, err := dnsmessage.NewName(escapeLabel(name) + "." + mdnsService)
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(hostname + ".local.")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, err
+	}
+	a := &advertiser{
+		conn:     conn,
+		instance: instance,
+		service:  dnsmessage.MustNewName(mdnsService),
+		meta:     dnsmessage.MustNewName(mdnsServices),
+		host:     host,
+		port:     uint16(port),
+	}
+
+	done := make(chan struct{})
+	go a.serve()
+	go func() {
+		// announced twice, a second apart (RFC 6762 section 8.3)
+		for i := 0; i < 2; i++ {
+			a.announce(false)
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		a.announce(true)
+		a.conn.Close()
+	}, nil
+}
+
+func (a *advertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, addr, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || msg.Header.Response {
+			continue
+		}
+
+		var answers []dnsmessage.Resource
+		for _, q := range msg.Questions {
+			answers = append(answers, a.answer(q)...)
+		}
+		if len(answers) == 0 {
+			continue
+		}
+
+		resp := dnsmessage.Message{
+			Header:      dnsmessage.Header{Response: true, Authoritative: true},
+			Answers:     answers,
+			Additionals: a.additionals(answers),
+		}
+		dst := mdnsGroup
+		if addr.Port != mdnsPort {
+			// legacy unicast queries get a conventional DNS answer
+			resp.Header.ID, resp.Questions, dst = msg.Header.ID, msg.Questions, addr
+		}
+		a.send(resp, dst)
+	}
+}
+
+func (a *advertiser) answer(q dnsmessage.Question) []dnsmessage.Resource {
+	is := func(name dnsmessage.Name, t dnsmessage.Type) bool {
+		return strings.EqualFold(q.Name.String(), name.String()) && (q.Type == t || q.Type == dnsmessage.TypeALL)
+	}
+
+	var rs []dnsmessage.Resource
+	if is(a.meta, dnsmessage.TypePTR) {
+		rs = append(rs, record(a.meta, dnsmessage.TypePTR, 4500, false, &dnsmessage.PTRResource{PTR: a.service}))
+	}
+	if is(a.service, dnsmessage.TypePTR) {
+		rs = append(rs, a.ptr(4500))
+	}
+	if is(a.instance, dnsmessage.TypeSRV) {
+		rs = append(rs, a.srv(120))
+	}
+	if is(a.instance, dnsmessage.TypeTXT) {
+		rs = append(rs, a.txt(4500))
+	}
+	if is(a.host, dnsmessage.TypeA) {
+		rs = append(rs, a.addresses(120)...)
+	}
+	return rs
+}
+
+// additionals returns the records a client needs next, DNS-SD section 12.
+func (a *advertiser) additionals(answers []dnsmessage.Resource) []dnsmessage.Resource {
+	var rs []dnsmessage.Resource
+	for _, r := range answers {
+		switch r.Header.Type {
+		case dnsmessage.TypePTR:
+			if r.Header.Name.String() == a.service.String() {
+				rs = append(rs, a.srv(120), a.txt(4500))
+				rs = append(rs, a.addresses(120)...)
+			}
+		case dnsmessage.TypeSRV:
+			rs = append(rs, a.addresses(120)...)
+		}
+	}
+	return rs
+}
+
+// announce sends all records unsolicited, with a TTL of zero as goodbye.
+func (a *advertiser) announce(goodbye bool) {
+	ttl := func(t uint32) uint32 {
+		if goodbye {
+			return 0
+		}
+		return t
+	}
+	answers := []dnsmessage.Resource{a.ptr(ttl(4500)), a.srv(ttl(120)), a.txt(ttl(4500))}
+	answers = append(answers, a.addresses(ttl(120))...)
+	a.send(dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: answers,
+	}, mdnsGroup)
+}
+
+func (a *advertiser) send(msg dnsmessage.Message, dst *net.UDPAddr) {
+	b, err := msg.Pack()
+	if err == nil {
+		_, err = a.conn.WriteToUDP(b, dst)
+	}
+	if err != nil {
+		log.Printf("error while sending mDNS response: '%v'\n", err)
+	}
+}
+
+func (a *advertiser) ptr(ttl uint32) dnsmessage.Resource {
+	return record(a.service, dnsmessage.TypePTR, ttl, false, &dnsmessage.PTRResource{PTR: a.instance})
+}
+
+func (a *advertiser) srv(ttl uint32) dnsmessage.Resource {
+	return record(a.instance, dnsmessage.TypeSRV, ttl, true, &dnsmessage.SRVResource{Target: a.host, Port: a.port})
+}
+
+func (a *advertiser) txt(ttl uint32) dnsmessage.Resource {
+	// DNS-SD needs a TXT record, even if there's nothing to say
+	return record(a.instance, dnsmessage.TypeTXT, ttl, true, &dnsmessage.TXTResource{TXT: []string{""}})
+}
+
+func (a *advertiser) addresses(ttl uint32) []dnsmessage.Resource {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var rs []dnsmessage.Resource
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+			continue
+		}
+		var a4 [4]byte
+		copy(a4[:], ipnet.IP.To4())
+		rs = append(rs, record(a.host, dnsmessage.TypeA, ttl, true, &dnsmessage.AResource{A: a4}))
+	}
+	return rs
+}
+
+func record(name dnsmessage.Name, typ dnsmessage.Type, ttl uint32, unique bool, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	class := dnsmessage.ClassINET
+	if unique {
+		class |= mdnsCacheFlush
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Type: typ, Class: class, TTL: ttl},
+		Body:   body,
+	}
+}
+
+// escapeLabel keeps dots in instance names from splitting the label, the
+// dnsmessage package has no escaping.
+func escapeLabel(s string) string {
+	return strings.ReplaceAll(s, ".", "-")
+}
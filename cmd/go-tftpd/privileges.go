@@ -0,0 +1,86 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges chroots into the root directory if configured and switches
+// to the configured user and group once the socket is bound, the
+// supplementary groups are cleared. It doesn't change the user without a
+// configured one or if the daemon already runs as it, e.g. after an upgrade.
+func dropPrivileges(conf config) error {
+	// users are looked up before /etc/passwd is out of reach
+	uid, gid := -1, -1
+	if conf.User != "" {
+		var err error
+		if uid, gid, err = lookupUser(conf.User, conf.Group); err != nil {
+			return err
+		}
+	}
+
+	if conf.Chroot {
+		if err := syscall.Chroot(conf.Root); err != nil {
+			return fmt.Errorf("chroot: %w", err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+		confined, chroot = true, conf.Root
+		log.Printf("Confined to '%v'.\n", conf.Root)
+	}
+
+	if uid < 0 || (os.Getuid() == uid && os.Getgid() == gid) {
+		return nil
+	}
+
+	// the group has to go first, it can't be changed without root anymore
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("clearing supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	log.Printf("Running as user %d, group %d.\n", uid, gid)
+	return nil
+}
+
+// lookupUser resolves names or numeric IDs, without a group the primary
+// group of the user is used.
+func lookupUser(name, group string) (int, int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return 0, 0, err
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %v has no numeric ID", name)
+	}
+
+	gidStr := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return 0, 0, err
+			}
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group %v has no numeric ID", group)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func dropPrivileges(conf config) error {
+	if conf.User != "" || conf.Chroot {
+		return errors.New("changing the user and chroot are only supported on Unix")
+	}
+	return nil
+}
+
+func lookupUser(name, group string) (int, int, error) {
+	return 0, 0, errors.New("users are only supported on Unix")
+}
@@ -0,0 +1,52 @@
+package main
+
+import "time"
+
+// profiles tune retransmissions and windows for a kind of link, so remote
+// sites work without knowing the protocol. Settings given explicitly are
+// kept.
+var profiles = map[string]config{
+	"lan": {},
+	// a few hundred milliseconds and some loss
+	"wan": {
+		Timeout:       duration(2 * time.Second),
+		Retries:       8,
+		Backoff:       1.5,
+		MaxTimeout:    duration(15 * time.Second),
+		Jitter:        0.1,
+		MaxWindowSize: 32,
+	},
+	// around a second of round trip, full windows keep the link busy
+	"satellite": {
+		Timeout:       duration(4 * time.Second),
+		Retries:       10,
+		Backoff:       1.5,
+		MaxTimeout:    duration(30 * time.Second),
+		Jitter:        0.1,
+		MaxWindowSize: 128,
+	},
+}
+
+// applyProfile fills the settings left unset with the ones of the profile,
+// unknown profiles are reported by check.
+func (conf *config) applyProfile() {
+	p := profiles[conf.Profile]
+	if conf.Timeout == 0 {
+		conf.Timeout = p.Timeout
+	}
+	if conf.Retries == 0 {
+		conf.Retries = p.Retries
+	}
+	if conf.Backoff == 0 {
+		conf.Backoff = p.Backoff
+	}
+	if conf.MaxTimeout == 0 {
+		conf.MaxTimeout = p.MaxTimeout
+	}
+	if conf.Jitter == 0 {
+		conf.Jitter = p.Jitter
+	}
+	if conf.MaxWindowSize == 0 {
+		conf.MaxWindowSize = p.MaxWindowSize
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// ProxyDHCP (PXE specification 2.1) tells PXE clients where to boot from
+// while another DHCP server hands out the addresses, so a PXE lab needs
+// nothing but this daemon next to an existing DHCP server.
+
+const (
+	bootpHeaderSize = 236
+	dhcpMagic       = 0x63825363
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+
+	optMessageType = 53
+	optServerID    = 54
+	optVendorClass = 60
+	optVendorInfo  = 43
+	optClientArch  = 93
+	optClientGUID  = 97
+	optEnd         = 255
+)
+
+type proxyDHCP struct {
+	bootFile    string
+	bootFileEFI string
+	serverIP    net.IP
+}
+
+// serveProxyDHCP answers PXE clients on the DHCP port and the PXE boot server
+// port until the connections are closed.
+func serveProxyDHCP(conf config) (stop func(), err error) {
+	p := &proxyDHCP{bootFile: conf.BootFile, bootFileEFI: conf.BootFileEFI}
+	if conf.ServerIP != "" {
+		if p.serverIP = net.ParseIP(conf.ServerIP).To4(); p.serverIP == nil {
+			return nil, errors.New("server IP isn't an IPv4 address")
+		}
+	}
+
+	dhcp, err := net.ListenPacket("udp4", ":67")
+	if err != nil {
+		return nil, err
+	}
+	pxe, err := net.ListenPacket("udp4", ":4011")
+	if err != nil {
+		dhcp.Close()
+		return nil, err
+	}
+	go p.serve(dhcp, dhcpDiscover)
+	go p.serve(pxe, dhcpRequest)
+	return func() {
+		dhcp.Close()
+		pxe.Close()
+	}, nil
+}
+
+func (p *proxyDHCP) serve(c net.PacketConn, msgType byte) {
+	conn := ipv4.NewPacketConn(c)
+	// the interface tells which address to offer
+	if err := conn.SetControlMessage(ipv4.FlagInterface, true); err != nil && p.serverIP == nil {
+		log.Printf("error while reading the interface of DHCP packets: '%v'\n", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, cm, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		opts, ok := dhcpOptions(req)
+		if !ok || !bytes.HasPrefix(opts[optVendorClass], []byte("PXEClient")) {
+			continue
+		}
+		if t := opts[optMessageType]; len(t) != 1 || t[0] != msgType {
+			continue
+		}
+
+		serverIP := p.serverIP
+		if serverIP == nil && cm != nil {
+			serverIP = interfaceIP(cm.IfIndex)
+		}
+		if serverIP == nil {
+			log.Printf("Don't know which address to offer to PXE client %v.\n", addr)
+			continue
+		}
+
+		reply := p.reply(req, opts, serverIP)
+		dst := addr
+		if msgType == dhcpDiscover {
+			// the client has no address yet, unless a relay forwarded it
+			dst = &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+			if giaddr := net.IP(req[24:28]); !giaddr.Equal(net.IPv4zero) {
+				dst = &net.UDPAddr{IP: giaddr, Port: 67}
+			}
+		}
+		if _, err := c.WriteTo(reply, dst); err != nil {
+			log.Printf("error while answering PXE client: '%v'\n", err)
+			continue
+		}
+		hlen := int(req[2])
+		if hlen > 16 {
+			hlen = 16
+		}
+		log.Printf("Sent boot file to PXE client %v.\n", net.HardwareAddr(req[28:28+hlen]))
+	}
+}
+
+// reply builds the offer for a DISCOVER or the ACK for a REQUEST.
+func (p *proxyDHCP) reply(req []byte, opts map[byte][]byte, serverIP net.IP) []byte {
+	msgType := byte(dhcpOffer)
+	if opts[optMessageType][0] == dhcpRequest {
+		msgType = dhcpAck
+	}
+
+	bootFile := p.bootFile
+	// client architectures 6 and up are UEFI (RFC 4578)
+	if arch := opts[optClientArch]; len(arch) == 2 && binary.BigEndian.Uint16(arch) >= 6 && p.bootFileEFI != "" {
+		bootFile = p.bootFileEFI
+	}
+
+	b := make([]byte, bootpHeaderSize, 300)
+	b[0] = 2 // BOOTREPLY
+	// htype, hlen, xid, flags, ciaddr, giaddr and chaddr are the client's
+	copy(b[1:3], req[1:3])
+	copy(b[4:8], req[4:8])
+	copy(b[10:16], req[10:16])
+	copy(b[20:24], serverIP)
+	copy(b[24:44], req[24:44])
+	copy(b[108:236], bootFile)
+
+	b = binary.BigEndian.AppendUint32(b, dhcpMagic)
+	b = append(b, optMessageType, 1, msgType)
+	b = append(b, optServerID, 4)
+	b = append(b, serverIP...)
+	b = append(b, optVendorClass, 9)
+	b = append(b, "PXEClient"...)
+	if guid := opts[optClientGUID]; guid != nil {
+		b = append(b, optClientGUID, byte(len(guid)))
+		b = append(b, guid...)
+	}
+	// PXE_DISCOVERY_CONTROL: boot the file given without boot servers menu
+	b = append(b, optVendorInfo, 4, 6, 1, 8, optEnd)
+	return append(b, optEnd)
+}
+
+// dhcpOptions parses the options of a DHCP packet.
+func dhcpOptions(b []byte) (map[byte][]byte, bool) {
+	if len(b) < bootpHeaderSize+4 || b[0] != 1 || binary.BigEndian.Uint32(b[bootpHeaderSize:]) != dhcpMagic {
+		return nil, false
+	}
+
+	opts := make(map[byte][]byte)
+	b = b[bootpHeaderSize+4:]
+	for len(b) > 0 && b[0] != optEnd {
+		if b[0] == 0 {
+			// padding
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, false
+		}
+		opts[b[0]] = b[2 : 2+b[1]]
+		b = b[2+b[1]:]
+	}
+	return opts, true
+}
+
+func interfaceIP(index int) net.IP {
+	ifi, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4()
+		}
+	}
+	return nil
+}
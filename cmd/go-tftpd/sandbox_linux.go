@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// not in x/sys/unix yet
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetKillProcess  = 0x80000000
+	seccompRetErrno        = 0x00050000
+	seccompRetTrap         = 0x00030000
+	seccompRetAllow        = 0x7fff0000
+
+	// offsets in struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// allowedSyscalls are the system calls of the runtime, the file and socket
+// access of the daemon and its listeners, the admin API and webhooks.
+// Everything else fails with EPERM in the sandbox, e.g. exec, ptrace,
+// mount and module loading, which an attacker taking it over would use.
+// archSyscalls adds the ones only some architectures have.
+var allowedSyscalls = []uintptr{
+	// runtime
+	unix.SYS_BRK, unix.SYS_MMAP, unix.SYS_MUNMAP, unix.SYS_MREMAP, unix.SYS_MPROTECT,
+	unix.SYS_MADVISE, unix.SYS_MINCORE, unix.SYS_MEMBARRIER, unix.SYS_FUTEX,
+	unix.SYS_CLONE, unix.SYS_CLONE3, unix.SYS_EXIT, unix.SYS_EXIT_GROUP, unix.SYS_RSEQ,
+	unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK, unix.SYS_RT_SIGRETURN, unix.SYS_SIGALTSTACK,
+	unix.SYS_RESTART_SYSCALL, unix.SYS_GETPID, unix.SYS_GETPPID, unix.SYS_GETTID, unix.SYS_KILL,
+	unix.SYS_TGKILL, unix.SYS_TKILL, unix.SYS_SCHED_YIELD, unix.SYS_SCHED_GETAFFINITY,
+	unix.SYS_NANOSLEEP, unix.SYS_CLOCK_NANOSLEEP, unix.SYS_CLOCK_GETTIME, unix.SYS_CLOCK_GETRES,
+	unix.SYS_GETTIMEOFDAY, unix.SYS_SETITIMER, unix.SYS_GETITIMER, unix.SYS_TIMER_CREATE,
+	unix.SYS_TIMER_SETTIME, unix.SYS_TIMER_GETTIME, unix.SYS_TIMER_DELETE, unix.SYS_GETRLIMIT,
+	unix.SYS_PRLIMIT64, unix.SYS_PRCTL, unix.SYS_UNAME, unix.SYS_GETRANDOM,
+	unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID, unix.SYS_GETEGID, unix.SYS_GETGROUPS,
+	unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_PWAIT, unix.SYS_EPOLL_PWAIT2,
+	unix.SYS_EVENTFD2, unix.SYS_PIPE2, unix.SYS_PPOLL, unix.SYS_PSELECT6,
+	// files
+	unix.SYS_OPENAT, unix.SYS_CLOSE, unix.SYS_CLOSE_RANGE, unix.SYS_READ, unix.SYS_WRITE,
+	unix.SYS_READV, unix.SYS_WRITEV, unix.SYS_PREAD64, unix.SYS_PWRITE64, unix.SYS_PREADV,
+	unix.SYS_PWRITEV, unix.SYS_LSEEK, unix.SYS_FSTAT, unix.SYS_STATX, unix.SYS_FSTATFS,
+	unix.SYS_STATFS, unix.SYS_GETDENTS64, unix.SYS_READLINKAT, unix.SYS_FACCESSAT,
+	unix.SYS_FACCESSAT2, unix.SYS_FCNTL, unix.SYS_IOCTL, unix.SYS_DUP, unix.SYS_DUP3,
+	unix.SYS_FLOCK, unix.SYS_FTRUNCATE, unix.SYS_FSYNC, unix.SYS_FDATASYNC, unix.SYS_FALLOCATE,
+	unix.SYS_FADVISE64, unix.SYS_UNLINKAT, unix.SYS_RENAMEAT, unix.SYS_RENAMEAT2,
+	unix.SYS_SENDFILE, unix.SYS_SPLICE, unix.SYS_COPY_FILE_RANGE,
+	// sockets
+	unix.SYS_SOCKET, unix.SYS_SOCKETPAIR, unix.SYS_BIND, unix.SYS_CONNECT, unix.SYS_LISTEN,
+	unix.SYS_ACCEPT4, unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME, unix.SYS_SETSOCKOPT,
+	unix.SYS_GETSOCKOPT, unix.SYS_SENDTO, unix.SYS_RECVFROM, unix.SYS_SENDMSG, unix.SYS_RECVMSG,
+	unix.SYS_SENDMMSG, unix.SYS_RECVMMSG, unix.SYS_SHUTDOWN,
+}
+
+// uringSyscalls are allowed with -io-uring only, io_uring is a big
+// part of the kernel to expose.
+var uringSyscalls = []uintptr{unix.SYS_IO_URING_SETUP, unix.SYS_IO_URING_ENTER, unix.SYS_IO_URING_REGISTER}
+
+// sandbox restricts the file access of the daemon to the root, the roots of
+// the virtual hosts, reading the directories of the config and the
+// allowlist and, with webhooks, the resolver configuration with Landlock,
+// and the system calls to allowedSyscalls with seccomp. Neither can be lifted again, so upgrades and root changes need
+// a restart.
+func sandbox(conf config, configPath string) error {
+	// the local time zone is loaded lazily from /etc
+	time.Now().Zone()
+
+	// every thread has to be restricted, which the runtime can't do when
+	// cgo is used
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0)
+	if errno == syscall.ENOTSUP {
+		return errors.New("needs a build without cgo (CGO_ENABLED=0)")
+	} else if errno != 0 {
+		return fmt.Errorf("no_new_privs: %w", errno)
+	}
+
+	dirs := []string{jailed(conf.rootDir())}
+	for _, v := range conf.VHosts {
+		dirs = append(dirs, jailed(v.Root))
+	}
+	// rules are bound to the inode, and editors replace files
+	var reloaded []string
+	for _, name := range []string{configPath, conf.Allowlist} {
+		if name != "" {
+			reloaded = append(reloaded, jailed(filepath.Dir(name)))
+		}
+	}
+	// webhooks to hostnames need the resolver configuration
+	var files []string
+	if len(conf.Webhooks) > 0 {
+		files = resolverFiles
+	}
+	if err := landlock(dirs, reloaded, files, conf.ReadOnly); err != nil {
+		return fmt.Errorf("landlock: %w", err)
+	}
+	syscalls := append(allowedSyscalls, archSyscalls...)
+	if conf.IOUring {
+		syscalls = append(syscalls, uringSyscalls...)
+	}
+	if err := seccomp(syscalls); err != nil {
+		return fmt.Errorf("seccomp: %w", err)
+	}
+	confined = true
+	log.Printf("Sandboxed.\n")
+	return nil
+}
+
+// resolverFiles are read by the resolver of the Go runtime.
+var resolverFiles = []string{"/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf"}
+
+// landlock allows reading and, unless readOnly, writing below the dirs and
+// reading the files below readDirs and the readFiles which exist.
+func landlock(dirs, readDirs, readFiles []string, readOnly bool) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("not supported by the kernel: %w", errno)
+	}
+
+	// everything of the first ABI, the later ones added rights
+	handled := uint64(unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO | unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM)
+	if abi >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+
+	allowed := uint64(unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR)
+	if !readOnly {
+		allowed |= unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+			unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer unix.Close(int(fd))
+
+	for _, dir := range dirs {
+		if err := landlockRule(int(fd), dir, allowed&handled); err != nil {
+			return err
+		}
+	}
+	for _, dir := range readDirs {
+		if err := landlockRule(int(fd), dir, unix.LANDLOCK_ACCESS_FS_READ_FILE); err != nil {
+			return err
+		}
+	}
+	for _, file := range readFiles {
+		err := landlockRule(int(fd), file, unix.LANDLOCK_ACCESS_FS_READ_FILE)
+		if err != nil && !errors.Is(err, unix.ENOENT) {
+			return err
+		}
+	}
+
+	_, _, errno = syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// landlockRule allows access to path and everything below it.
+func landlockRule(ruleset int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("%v: %w", path, errno)
+	}
+	return nil
+}
+
+// seccomp allows only the syscalls, the others fail with EPERM.
+func seccomp(syscalls []uintptr) error {
+	if auditArch == 0 {
+		return fmt.Errorf("not supported on %v", runtime.GOARCH)
+	}
+
+	n := len(syscalls)
+	filter := []unix.SockFilter{
+		// other ABIs have other syscall numbers
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArch},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: auditArch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetKillProcess},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNr},
+	}
+	if runtime.GOARCH == "amd64" {
+		// x32 syscalls share the architecture
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: uint8(n), K: 0x40000000})
+	}
+	// jump offsets are 8 bits
+	if n > 255 {
+		return fmt.Errorf("too many syscalls: %d", n)
+	}
+	for i, nr := range syscalls {
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: uint8(n - i), K: uint32(nr)})
+	}
+	filter = append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow},
+	)
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const auditArch = unix.AUDIT_ARCH_X86_64
+
+// the runtime and the standard library still use some of the older calls
+var archSyscalls = []uintptr{
+	unix.SYS_ARCH_PRCTL, unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_NEWFSTATAT,
+	unix.SYS_EPOLL_CREATE, unix.SYS_EPOLL_WAIT, unix.SYS_PIPE, unix.SYS_POLL, unix.SYS_SELECT,
+	unix.SYS_ACCEPT, unix.SYS_DUP2,
+}
@@ -0,0 +1,9 @@
+//go:build linux && !amd64 && !arm64
+
+package main
+
+// The syscall allowlist is only maintained for amd64 and arm64, seccomp
+// fails elsewhere.
+const auditArch = 0
+
+var archSyscalls []uintptr
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func sandbox(conf config, configPath string) error {
+	return errors.New("only supported on Linux")
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const envPrefix = "GO_TFTPD_"
+
+// settings can be given as flags or as environment variables, named
+// GO_TFTPD_ and the flag name in upper case with underscores, e.g.
+// GO_TFTPD_READ_ONLY=true.
+var settings = []struct {
+	name    string
+	usage   string
+	boolean bool
+	set     func(conf *config, value string) error
+}{
+	{"listen", "`address` to listen on, e.g. :69", false, func(conf *config, v string) error {
+		conf.Listen = v
+		return nil
+	}},
+	{"root", "serve files from `dir`", false, func(conf *config, v string) error {
+		conf.Root = v
+		return nil
+	}},
+	{"allowlist", "only serve the files listed in `file` (\"name [sha256]\" per line), reloaded on changes", false, func(conf *config, v string) error {
+		conf.Allowlist = v
+		return nil
+	}},
+	{"psk-file", "encrypt transfers of clients with the experimental x-psk option and the pre-shared key in `file`", false, func(conf *config, v string) error {
+		conf.PSKFile = v
+		return nil
+	}},
+	{"psk-required", "reject transfers which aren't encrypted with x-psk", true, func(conf *config, v string) (err error) {
+		conf.RequirePSK, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"file", "serve this `file` for every download, whatever the name requested", false, func(conf *config, v string) error {
+		conf.File = v
+		return nil
+	}},
+	{"chroot", "chroot into -root once the socket is bound", true, func(conf *config, v string) (err error) {
+		conf.Chroot, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"sandbox", "restrict file access to -root and dangerous system calls (Linux only)", true, func(conf *config, v string) (err error) {
+		conf.Sandbox, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"read-only", "reject uploads", true, func(conf *config, v string) (err error) {
+		conf.ReadOnly, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"dirlist", "list the files starting with prefix for downloads of .dirlist/prefix", true, func(conf *config, v string) (err error) {
+		conf.DirList, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"server-info", "serve the version, options and limits of the server as .server-info", true, func(conf *config, v string) (err error) {
+		conf.ServerInfo, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"first-block-cache", "keep the first 64 KiB of the files downloaded last in memory, for bursts of PXE clients", true, func(conf *config, v string) (err error) {
+		conf.FirstBlockCache, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"file-cache-size", "keep up to `n` files open after their last download, for a small set of popular files", false, func(conf *config, v string) (err error) {
+		conf.FileCacheSize, err = strconv.Atoi(v)
+		return err
+	}},
+	{"file-cache-ttl", "close cached files idle for `duration` and check them for changes as often (default 5s)", false, func(conf *config, v string) error {
+		d, err := time.ParseDuration(v)
+		conf.FileCacheTTL = duration(d)
+		return err
+	}},
+	{"prefetch", "read `n` blocks of downloads ahead while waiting for ACKs, for slow storage", false, func(conf *config, v string) (err error) {
+		conf.Prefetch, err = strconv.Atoi(v)
+		return err
+	}},
+	{"io-uring", "read downloads ahead and write uploads through io_uring on Linux, for many concurrent large transfers", true, func(conf *config, v string) (err error) {
+		conf.IOUring, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"bandwidth", "limit all transfers together to `bytes` per second, small transfers go first", false, func(conf *config, v string) (err error) {
+		conf.Bandwidth, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}},
+	{"small-transfer", "size in `bytes` up to which transfers are prioritized by -bandwidth (default 1048576)", false, func(conf *config, v string) (err error) {
+		conf.SmallTransfer, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}},
+	{"gzip", "serve file.gz decompressed for file, and compressed with the x-gzip option", true, func(conf *config, v string) (err error) {
+		conf.Gzip, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"resume", "let clients resume interrupted transfers with the x-offset option", true, func(conf *config, v string) (err error) {
+		conf.Resume, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"append", "let clients append uploads to existing files with the x-append option", true, func(conf *config, v string) (err error) {
+		conf.Append, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"on-conflict", "what to do with uploads of existing files: reject, number (name.1, ...) or timestamp", false, func(conf *config, v string) error {
+		conf.OnConflict = v
+		return nil
+	}},
+	{"remove-partial", "delete the files of failed uploads", true, func(conf *config, v string) (err error) {
+		conf.RemovePartial, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"timeout", "retransmission `timeout` unless negotiated by the client", false, func(conf *config, v string) error {
+		d, err := time.ParseDuration(v)
+		conf.Timeout = duration(d)
+		return err
+	}},
+	{"retries", "number of retransmissions before giving up (default 5)", false, func(conf *config, v string) (err error) {
+		conf.Retries, err = strconv.Atoi(v)
+		return err
+	}},
+	{"profile", "tune timeouts, retries and windows for a link: lan, wan or satellite", false, func(conf *config, v string) error {
+		conf.Profile = v
+		return nil
+	}},
+	{"backoff", "multiply the retransmission timeout by `factor` with every retransmission", false, func(conf *config, v string) (err error) {
+		conf.Backoff, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+	{"max-timeout", "limit of the retransmission `timeout` growing with -backoff (default 1m)", false, func(conf *config, v string) error {
+		d, err := time.ParseDuration(v)
+		conf.MaxTimeout = duration(d)
+		return err
+	}},
+	{"jitter", "vary retransmission timeouts randomly by up to this `fraction`, e.g. 0.1", false, func(conf *config, v string) (err error) {
+		conf.Jitter, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+	{"blksize-max", "largest block `size` to negotiate", false, func(conf *config, v string) (err error) {
+		conf.MaxBlockSize, err = strconv.Atoi(v)
+		return err
+	}},
+	{"datagram-max", "size of the packet buffers in `bytes`, up to 65468 for blksize beyond 2044 (default 2048 or enough for -blksize-max)", false, func(conf *config, v string) (err error) {
+		conf.MaxDatagramSize, err = strconv.Atoi(v)
+		return err
+	}},
+	{"windowsize-max", "largest `number` of blocks sent per ACK to negotiate (default 64)", false, func(conf *config, v string) (err error) {
+		conf.MaxWindowSize, err = strconv.Atoi(v)
+		return err
+	}},
+	{"mtu", "`MTU` of the path to clients limiting the block size, 0 detects it from the interface, -1 disables the limit", false, func(conf *config, v string) (err error) {
+		conf.MTU, err = strconv.Atoi(v)
+		return err
+	}},
+	{"dscp", "DSCP `value` (0-63) marking outbound packets for QoS, e.g. 46 for expedited forwarding", false, func(conf *config, v string) (err error) {
+		conf.DSCP, err = strconv.Atoi(v)
+		return err
+	}},
+	{"max-sessions", "limit of concurrent `sessions`, the least recently active are ended (default 10000)", false, func(conf *config, v string) (err error) {
+		conf.MaxSessions, err = strconv.Atoi(v)
+		return err
+	}},
+	{"reject-when-full", "reject new sessions with \"Server busy\" beyond -max-sessions instead of ending the least recently active", true, func(conf *config, v string) (err error) {
+		conf.RejectWhenFull, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"workers", "run the background work of sessions, e.g. streams and prefetching, on `n` goroutines instead of one each", false, func(conf *config, v string) (err error) {
+		conf.Workers, err = strconv.Atoi(v)
+		return err
+	}},
+	{"work-queue", "number of `sessions` waiting for a worker, further ones are rejected (default -workers)", false, func(conf *config, v string) (err error) {
+		conf.WorkQueue, err = strconv.Atoi(v)
+		return err
+	}},
+	{"drop-when-busy", "ignore requests while the workers are saturated instead of rejecting them, clients retry them", true, func(conf *config, v string) (err error) {
+		conf.DropWhenBusy, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"max-violations", "block clients after `n` malformed packets or packets with unknown TIDs", false, func(conf *config, v string) (err error) {
+		conf.MaxViolations, err = strconv.Atoi(v)
+		return err
+	}},
+	{"block-duration", "how long clients are blocked at first, doubled with every repeat (default 1m)", false, func(conf *config, v string) error {
+		d, err := time.ParseDuration(v)
+		conf.BlockDuration = duration(d)
+		return err
+	}},
+	{"lenient", "accept requests of buggy clients with garbage after the mode or the mode in upper case", true, func(conf *config, v string) (err error) {
+		conf.Lenient, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"security-log", "append access denials and protocol violations to `file`, e.g. for fail2ban", false, func(conf *config, v string) error {
+		conf.SecurityLog = v
+		return nil
+	}},
+	{"journal", "record uploads in progress in `file`, so they can be resumed after a restart", false, func(conf *config, v string) error {
+		conf.Journal = v
+		return nil
+	}},
+	{"count", "exit after `n` successful transfers", false, func(conf *config, v string) (err error) {
+		conf.Count, err = strconv.Atoi(v)
+		return err
+	}},
+	{"duration", "exit after `duration`", false, func(conf *config, v string) error {
+		d, err := time.ParseDuration(v)
+		conf.Duration = duration(d)
+		return err
+	}},
+	{"admin", "serve the admin API for tftptop on `address`, e.g. localhost:6970 (no authentication, keep it local)", false, func(conf *config, v string) error {
+		conf.Admin = v
+		return nil
+	}},
+	{"dashboard", "serve a web dashboard with transfers, graphs and the configuration on the -admin address", true, func(conf *config, v string) (err error) {
+		conf.Dashboard, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"webhook", "POST an event to the `urls` (comma separated) after every transfer", false, func(conf *config, v string) error {
+		conf.Webhooks = strings.Split(v, ",")
+		return nil
+	}},
+	{"webhook-secret", "sign webhook events with HMAC-SHA256 and this `secret`", false, func(conf *config, v string) error {
+		conf.WebhookSecret = v
+		return nil
+	}},
+	{"grpc", "serve the gRPC control API of adminpb/admin.proto on `address` (no TLS or authentication, keep it local)", false, func(conf *config, v string) error {
+		conf.GRPC = v
+		return nil
+	}},
+	{"mdns", "advertise the server with mDNS/DNS-SD", true, func(conf *config, v string) (err error) {
+		conf.MDNS, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"mdns-name", "mDNS instance `name`, the host name by default", false, func(conf *config, v string) error {
+		conf.MDNSName = v
+		return nil
+	}},
+	{"proxy-dhcp", "answer PXE clients with ProxyDHCP, next to another DHCP server", true, func(conf *config, v string) (err error) {
+		conf.ProxyDHCP, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"boot-file", "boot `file` offered to PXE clients (default pxelinux.0)", false, func(conf *config, v string) error {
+		conf.BootFile = v
+		return nil
+	}},
+	{"boot-file-efi", "boot `file` offered to UEFI PXE clients, -boot-file if empty", false, func(conf *config, v string) error {
+		conf.BootFileEFI = v
+		return nil
+	}},
+	{"server-ip", "IPv4 `address` offered to PXE clients, the one of the receiving interface by default", false, func(conf *config, v string) error {
+		conf.ServerIP = v
+		return nil
+	}},
+	{"user", "run as `user` once the socket is bound", false, func(conf *config, v string) error {
+		conf.User = v
+		return nil
+	}},
+	{"group", "run as `group` instead of the primary group of -user", false, func(conf *config, v string) error {
+		conf.Group = v
+		return nil
+	}},
+	{"log-format", "log `format`, text or json", false, func(conf *config, v string) error {
+		conf.LogFormat = v
+		return nil
+	}},
+}
+
+// setting is a value given for one of the settings.
+type setting struct {
+	name  string
+	value string
+	set   func(conf *config, value string) error
+}
+
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// setEnv applies the settings given in the environment.
+func (conf *config) setEnv() error {
+	for _, s := range settings {
+		v, ok := os.LookupEnv(envName(s.name))
+		if !ok {
+			continue
+		}
+		if err := s.set(conf, v); err != nil {
+			return fmt.Errorf("%v: %w", envName(s.name), err)
+		}
+	}
+	return nil
+}
+
+// settingFlag records the flags given on the command line, they're applied
+// after the configuration file.
+type settingFlag struct {
+	name    string
+	boolean bool
+	set     func(conf *config, value string) error
+	given   *[]setting
+}
+
+func (f *settingFlag) String() string   { return "" }
+func (f *settingFlag) IsBoolFlag() bool { return f.boolean }
+
+func (f *settingFlag) Set(v string) error {
+	*f.given = append(*f.given, setting{f.name, v, f.set})
+	return nil
+}
+
+// settingFlags defines the flags of the settings, the returned slice is
+// filled once the flags are parsed.
+func settingFlags() *[]setting {
+	given := new([]setting)
+	for _, s := range settings {
+		usage := fmt.Sprintf("%v (%v)", s.usage, envName(s.name))
+		flag.Var(&settingFlag{s.name, s.boolean, s.set, given}, s.name, usage)
+	}
+	return given
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation.
+const listenFdsStart = 3
+
+// activationConn returns the UDP socket passed by systemd socket activation
+// (sd_listen_fds(3)), nil if the daemon wasn't socket activated.
+func activationConn() (net.PacketConn, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// children mustn't think the sockets are meant for them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if n != 1 {
+		return nil, fmt.Errorf("expected a single socket from systemd, got %d", n)
+	}
+	f := os.NewFile(listenFdsStart, "systemd socket")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+// sdNotify sends a state change to systemd (sd_notify(3)), it does nothing
+// if the daemon isn't run by systemd.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+
+	// abstract socket names starting with @ are handled by the net package
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the systemd watchdog timeout (WatchdogSec=),
+// zero if the watchdog isn't enabled for this process.
+func watchdogInterval() time.Duration {
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,126 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+const (
+	// set for the new process of an upgrade, the socket is passed as fd 3
+	// and a pipe to report readiness on as fd 4
+	upgradeEnv     = "GO_TFTPD_UPGRADE"
+	upgradeReadyFd = 4
+
+	upgradeTimeout = 10 * time.Second
+)
+
+// readyPipe is the pipe to the old process of an upgrade.
+var readyPipe *os.File
+
+// inheritedConn returns the socket passed by the old process of an
+// upgrade, nil if the daemon wasn't started for one.
+func inheritedConn() (net.PacketConn, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeEnv)
+
+	readyPipe = os.NewFile(upgradeReadyFd, "upgrade pipe")
+	f := os.NewFile(listenFdsStart, "inherited socket")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+// upgradeReady tells the old process to stop serving.
+func upgradeReady() {
+	if readyPipe == nil {
+		return
+	}
+	readyPipe.Write([]byte{1})
+	readyPipe.Close()
+	readyPipe = nil
+}
+
+// handleUpgrades starts the binary again with the socket of the server on
+// SIGUSR2 and closes the server once the new process is serving, so
+// requests queue up in the socket instead of being dropped. Transfers in
+// flight are cut off, their clients get errors from the new process.
+func handleUpgrades(server *tftpd.TFTPServer, conn net.PacketConn) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	for range usr2 {
+		proc, err := upgrade(conn)
+		if err != nil {
+			log.Printf("error while upgrading: '%v'\n", err)
+			continue
+		}
+
+		log.Printf("Handed over to process %d.\n", proc.Pid)
+		if err := sdNotify(fmt.Sprintf("MAINPID=%d", proc.Pid)); err != nil {
+			log.Printf("error while notifying systemd: '%v'\n", err)
+		}
+		proc.Release()
+		server.Close()
+		return
+	}
+}
+
+// upgrade starts the new process and waits until it's ready.
+func upgrade(conn net.PacketConn) (*os.Process, error) {
+	filer, ok := conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("socket can't be passed on")
+	}
+	sock, err := filer.File()
+	if err != nil {
+		return nil, err
+	}
+	defer sock.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// the watchdog follows the main PID, which is handed over too
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, upgradeEnv+"=1")
+
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, sock, w},
+	})
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		proc.Kill()
+		proc.Wait()
+		return nil, fmt.Errorf("new process isn't ready: %w", err)
+	}
+	return proc, nil
+}
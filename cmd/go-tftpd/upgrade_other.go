@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"net"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+// Upgrades need the socket to be inherited, only done on Unix.
+
+func inheritedConn() (net.PacketConn, error) { return nil, nil }
+
+func upgradeReady() {}
+
+func handleUpgrades(server *tftpd.TFTPServer, conn net.PacketConn) {}
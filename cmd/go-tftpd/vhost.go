@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+// vhost serves its own root with its own ACL and policies on another
+// address, e.g. different content to different VLANs.
+type vhost struct {
+	Listen string `json:"listen"`
+	// Root is relative to the root of the daemon, so it's confined by
+	// chroot and the sandbox too.
+	Root     string    `json:"root"`
+	ACL      tftpd.ACL `json:"acl"`
+	Policies []policy  `json:"policies"`
+}
+
+// listenVHosts binds the sockets of the virtual hosts, before the
+// privileges are dropped.
+func listenVHosts(conf config) ([]net.PacketConn, error) {
+	var conns []net.PacketConn
+	for _, v := range conf.VHosts {
+		conn, err := net.ListenPacket("udp", v.Listen)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// serveVHosts starts a server per virtual host, sharing the allowlist, the
+// security log and the journal of the main one.
+func serveVHosts(conns []net.PacketConn, conf config, main *tftpd.TFTPServer) []*tftpd.TFTPServer {
+	var servers []*tftpd.TFTPServer
+	for i, conn := range conns {
+		server := tftpd.NewTFTPServerConn(conn)
+		server.Allowlist, server.SecurityLog, server.Journal = main.Allowlist, main.SecurityLog, main.Journal
+		server.PreSharedKey = main.PreSharedKey
+		conf.applyVHost(server, i)
+		log.Printf("Serving '%v' on %v\n", server.Root, conn.LocalAddr())
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				log.Fatalf("Virtual host '%v' stopped: %v\n", server.Root, err)
+			}
+		}()
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// applyVHost configures the server of the i-th virtual host like the main
+// one, with its own root, ACL and policies.
+func (conf *config) applyVHost(server *tftpd.TFTPServer, i int) {
+	v := conf.VHosts[i]
+	conf.applySettings(server)
+	server.Root = jailed(v.Root)
+	server.ACL = v.ACL
+	server.Policies = newPolicies(v.Policies)
+}
+
+func sameListeners(a, b []vhost) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Listen != b[i].Listen {
+			return false
+		}
+	}
+	return true
+}
+
+// keepListeners returns the running virtual hosts with the settings of the
+// new ones, only the servers which are running can be reconfigured.
+func keepListeners(vhosts, running []vhost) []vhost {
+	kept := append([]vhost(nil), running...)
+	for i := range kept {
+		if i < len(vhosts) {
+			kept[i] = vhosts[i]
+			kept[i].Listen = running[i].Listen
+		}
+	}
+	return kept
+}
+
+// checkVHosts returns the problems of the virtual hosts.
+func (conf *config) checkVHosts() []error {
+	var problems []error
+	for _, v := range conf.VHosts {
+		if _, err := net.ResolveUDPAddr("udp", v.Listen); err != nil {
+			problems = append(problems, fmt.Errorf("vhost '%v': %w", v.Listen, err))
+		}
+		root := v.Root
+		if !filepath.IsAbs(root) && conf.Root != "" {
+			root = filepath.Join(conf.Root, root)
+		}
+		if fi, err := os.Stat(root); err != nil {
+			problems = append(problems, fmt.Errorf("vhost '%v': root: %w", v.Listen, err))
+		} else if !fi.IsDir() {
+			problems = append(problems, fmt.Errorf("vhost '%v': root: %v isn't a directory", v.Listen, v.Root))
+		}
+		for i, rule := range v.ACL {
+			if err := (tftpd.ACL{rule}).Validate(); err != nil {
+				problems = append(problems, fmt.Errorf("vhost '%v': acl rule %d: %w", v.Listen, i+1, err))
+			}
+		}
+		problems = append(problems, checkPolicies(v.Policies)...)
+	}
+	return problems
+}
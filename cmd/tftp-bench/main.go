@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/client"
+	"git.scarlet.house/oss/go-tftpd/tftptest"
+)
+
+const usage = `Usage:
+  tftp-bench [flags] get host[:port] remote
+  tftp-bench [flags] put host[:port] remote-prefix
+
+Every client repeatedly downloads the remote file or uploads -size bytes
+as remote-prefix.<client>.<n>, the server has to allow new files.
+
+With -soak the clients upload random data of up to -size bytes instead
+and download it again, and all files are downloaded once more at the end.
+The SHA-256 of every download has to match, so a long run with -duration
+and faults finds data corruption. Truncated packets look like the last
+block of a transfer, only servers verifying the x-sha256 option notice.
+
+Flags:
+`
+
+type result struct {
+	stats client.TransferStats
+	err   error
+}
+
+func main() {
+	clients := flag.Int("clients", 10, "number of concurrent clients")
+	count := flag.Int("count", 10, "number of transfers per client")
+	duration := flag.Duration("duration", 0, "keep transferring for this long instead of -count transfers")
+	size := flag.Int64("size", 1<<20, "number of bytes per upload")
+	blockSize := flag.Int("blksize", 512, "block size to negotiate")
+	timeout := flag.Duration("timeout", time.Second, "retransmission timeout")
+	retries := flag.Int("retries", 5, "number of retransmissions before giving up")
+	loss := flag.Float64("loss", 0, "probability of dropping a packet sent by the clients")
+	duplicate := flag.Float64("duplicate", 0, "probability of sending a packet of the clients twice")
+	reorder := flag.Float64("reorder", 0, "probability of swapping a packet of the clients with the next one")
+	truncate := flag.Float64("truncate", 0, "probability of truncating a packet of the clients")
+	soak := flag.Bool("soak", false, "upload random data and verify it by downloading it again, see above")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) != 3 || (args[0] != "get" && args[0] != "put") || *clients < 1 || *soak && args[0] != "put" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var seed int64
+	cli := client.New(withPort(args[1]))
+	cli.BlockSize = *blockSize
+	cli.Timeout = *timeout
+	cli.Retries = *retries
+	faults := tftptest.Faults{Loss: *loss, Duplicate: *duplicate, Reorder: *reorder, Truncate: *truncate}
+	if faults != (tftptest.Faults{}) {
+		cli.ListenPacket = func() (net.PacketConn, error) {
+			conn, err := net.ListenPacket("udp", ":0")
+			if err != nil {
+				return nil, err
+			}
+			faults := faults
+			faults.Seed = atomic.AddInt64(&seed, 1)
+			return tftptest.NewFaultyConn(conn, faults), nil
+		}
+	}
+	files := &soakFiles{digests: make(map[string][]byte)}
+	if *soak {
+		cli.Digest = true
+	}
+
+	var deadline time.Time
+	if *duration > 0 {
+		deadline = time.Now().Add(*duration)
+	}
+	payload := make([]byte, *size)
+
+	results := make(chan result)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(id) + 1))
+			for n := 0; ; n++ {
+				if deadline.IsZero() && n >= *count || !deadline.IsZero() && time.Now().After(deadline) {
+					return
+				}
+
+				name := fmt.Sprintf("%v.%d.%d", args[2], id, n)
+				var res result
+				switch {
+				case *soak:
+					files.round(cli, name, rng, *size, results)
+					continue
+				case args[0] == "get":
+					res.stats, res.err = cli.Get(args[2], io.Discard)
+				default:
+					res.stats, res.err = cli.Put(name, bytes.NewReader(payload))
+				}
+				results <- res
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var durations []time.Duration
+	var transferred int64
+	var retransmits, failed, corrupted int
+	errs := make(map[string]int)
+	for res := range results {
+		retransmits += res.stats.Retransmits
+		if res.err != nil {
+			failed++
+			errs[res.err.Error()]++
+			if errors.Is(res.err, errCorrupted) {
+				corrupted++
+			}
+			continue
+		}
+		transferred += res.stats.Bytes
+		durations = append(durations, res.stats.Duration)
+	}
+
+	report(time.Since(start), transferred, durations, retransmits, failed, errs)
+	if *soak {
+		// transfers failing because of the faults are expected, only
+		// corrupted data is an error
+		verified, lost, bad := files.verifyAll(cli)
+		corrupted += bad
+		fmt.Printf("%d files verified at the end, %d corrupted, %d couldn't be downloaded\n", verified, bad, lost)
+		if corrupted > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func report(elapsed time.Duration, transferred int64, durations []time.Duration, retransmits, failed int, errs map[string]int) {
+	total := len(durations) + failed
+	if total == 0 {
+		fmt.Println("no transfers")
+		return
+	}
+
+	fmt.Printf("%d transfers in %v, %d failed (%.2f%%)\n", total, elapsed.Round(time.Millisecond), failed, float64(failed)*100/float64(total))
+	fmt.Printf("%d bytes, %.2f MiB/s, %d retransmits\n", transferred, float64(transferred)/(1<<20)/elapsed.Seconds(), retransmits)
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		percentile := func(p int) time.Duration {
+			return durations[(len(durations)-1)*p/100].Round(time.Microsecond)
+		}
+		fmt.Printf("transfer time: min %v, p50 %v, p99 %v, max %v\n", percentile(0), percentile(50), percentile(99), percentile(100))
+	}
+
+	for msg, n := range errs {
+		fmt.Printf("%6d  %v\n", n, msg)
+	}
+}
+
+func withPort(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "69")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"git.scarlet.house/oss/go-tftpd/client"
+)
+
+var errCorrupted = errors.New("data corrupted, SHA-256 mismatch")
+
+// soakFiles are the digests of the files uploaded by -soak.
+type soakFiles struct {
+	mu      sync.Mutex
+	digests map[string][]byte
+}
+
+// round uploads random data of up to size bytes as name and downloads it
+// again.
+func (f *soakFiles) round(cli *client.Client, name string, rng *rand.Rand, size int64, results chan<- result) {
+	payload := make([]byte, rng.Int63n(size+1))
+	rng.Read(payload)
+	sum := sha256.Sum256(payload)
+
+	var res result
+	res.stats, res.err = cli.Put(name, bytes.NewReader(payload))
+	results <- res
+	if res.err != nil {
+		return
+	}
+	f.mu.Lock()
+	f.digests[name] = sum[:]
+	f.mu.Unlock()
+	results <- verify(cli, name, sum[:])
+}
+
+// verifyAll downloads all uploaded files once more, with a few attempts
+// if the transfers fail.
+func (f *soakFiles) verifyAll(cli *client.Client) (verified, lost, corrupted int) {
+	names := make([]string, 0, len(f.digests))
+	for name := range f.digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var res result
+		for attempt := 0; attempt < 3; attempt++ {
+			if res = verify(cli, name, f.digests[name]); res.err == nil || errors.Is(res.err, errCorrupted) {
+				break
+			}
+		}
+		switch {
+		case res.err == nil:
+			verified++
+		case errors.Is(res.err, errCorrupted):
+			corrupted++
+		default:
+			lost++
+		}
+	}
+	return verified, lost, corrupted
+}
+
+func verify(cli *client.Client, name string, sum []byte) result {
+	h := sha256.New()
+	var res result
+	res.stats, res.err = cli.Get(name, h)
+	if res.err == nil && !bytes.Equal(h.Sum(nil), sum) {
+		res.err = errCorrupted
+	}
+	return res
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+const usage = `Usage:
+  tftp-replay [flags] capture.pcap [host[:port]]
+
+Replays the packets a client sent in a captured session, with their timing,
+against the server at host:port, or against a server of this package
+serving -root on a free local port. The packets are printed as they're sent
+and received, the log of the local server goes to stderr.
+
+Flags:
+`
+
+func main() {
+	clientAddr := flag.String("client", "", "replay the session of the client with this `ip[:port]` instead of the first one in the capture")
+	port := flag.Int("port", 69, "port of the server in the capture")
+	root := flag.String("root", ".", "directory served by the local server")
+	speed := flag.Float64("speed", 1, "replay this many times faster than captured, 0 sends the packets without delays")
+	wait := flag.Duration("wait", 2*time.Second, "how long to wait for replies after the last packet")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 || len(args) > 2 || *speed < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		fail(err)
+	}
+	datagrams, err := readPcap(f)
+	f.Close()
+	if err != nil {
+		fail(fmt.Errorf("%v: %v", args[0], err))
+	}
+	session, err := findSession(datagrams, *clientAddr, *port)
+	if err != nil {
+		fail(err)
+	}
+
+	var target net.Addr
+	if len(args) == 2 {
+		if target, err = net.ResolveUDPAddr("udp", withPort(args[1])); err != nil {
+			fail(err)
+		}
+	} else {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			fail(err)
+		}
+		server := tftpd.NewTFTPServerConn(listener)
+		server.Root = *root
+		go server.ListenAndServe()
+		defer server.Close()
+		target = listener.LocalAddr()
+	}
+
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		fail(err)
+	}
+	defer conn.Close()
+	r := &replay{conn: conn, start: time.Now()}
+	go r.receive()
+
+	fmt.Printf("Replaying %d packets of %v against %v\n", len(session), session[0].src, target)
+	first := session[0].ts
+	for _, d := range session {
+		if *speed > 0 {
+			at := time.Duration(float64(d.ts.Sub(first)) / *speed)
+			time.Sleep(time.Until(r.start.Add(at)))
+		}
+		// packets to the transfer ID of the server go to the new one
+		dst := target
+		if d.dst.Port != *port {
+			if dst = r.serverTID(); dst == nil {
+				r.print("!", fmt.Sprintf("%v skipped, no reply from the server yet", describe(d.payload)))
+				continue
+			}
+		}
+		if _, err := conn.WriteTo(d.payload, dst); err != nil {
+			fail(err)
+		}
+		r.print(">", describe(d.payload))
+	}
+	time.Sleep(*wait)
+}
+
+// findSession returns the packets sent by the client, the first one is
+// its request.
+func findSession(datagrams []datagram, clientAddr string, port int) ([]datagram, error) {
+	var client *net.UDPAddr
+	for _, d := range datagrams {
+		if d.dst.Port != port || !isRequest(d.payload) || !matches(d.src, clientAddr) {
+			continue
+		}
+		client = d.src
+		break
+	}
+	if client == nil {
+		return nil, fmt.Errorf("no request to port %d in the capture", port)
+	}
+
+	var session []datagram
+	for _, d := range datagrams {
+		if d.src.IP.Equal(client.IP) && d.src.Port == client.Port {
+			session = append(session, d)
+		}
+	}
+	// packets sent before the request belong to an earlier session
+	for !isRequest(session[0].payload) {
+		session = session[1:]
+	}
+	return session, nil
+}
+
+func isRequest(payload []byte) bool {
+	return len(payload) >= 2 && payload[0] == 0 && (payload[1] == 1 || payload[1] == 2)
+}
+
+// matches reports whether addr is the ip[:port] of -client, an empty one
+// matches every address.
+func matches(addr *net.UDPAddr, clientAddr string) bool {
+	if clientAddr == "" {
+		return true
+	}
+	host, port, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		host, port = clientAddr, ""
+	}
+	if !addr.IP.Equal(net.ParseIP(host)) {
+		return false
+	}
+	return port == "" || port == strconv.Itoa(addr.Port)
+}
+
+type replay struct {
+	conn  net.PacketConn
+	start time.Time
+
+	mu  sync.Mutex
+	tid net.Addr
+}
+
+// receive prints the packets of the server, the first one fixes its
+// transfer ID.
+func (r *replay) receive() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		if r.tid == nil {
+			r.tid = addr
+		}
+		r.mu.Unlock()
+		r.print("<", describe(buf[:n]))
+	}
+}
+
+func (r *replay) serverTID() net.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tid
+}
+
+func (r *replay) print(direction, msg string) {
+	fmt.Printf("%8.3fs %v %v\n", time.Since(r.start).Seconds(), direction, msg)
+}
+
+func describe(payload []byte) string {
+	pkt, err := wire.Unmarshal(payload)
+	if err != nil {
+		if len(payload) > 32 {
+			payload = payload[:32]
+		}
+		return fmt.Sprintf("%v: % x", err, payload)
+	}
+	return fmt.Sprint(pkt)
+}
+
+func withPort(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "69")
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "tftp-replay: %v\n", err)
+	os.Exit(1)
+}
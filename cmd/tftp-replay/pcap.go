@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Link types of pcap files.
+const (
+	linkNull  = 0
+	linkEther = 1
+	linkRaw   = 101
+	linkSLL   = 113
+	linkIPv4  = 228
+	linkIPv6  = 229
+	linkSLL2  = 276
+)
+
+// datagram is a UDP datagram of a capture.
+type datagram struct {
+	ts       time.Time
+	src, dst *net.UDPAddr
+	payload  []byte
+}
+
+// readPcap returns the UDP datagrams of a pcap file, other packets and IP
+// fragments are skipped.
+func readPcap(r io.Reader) ([]datagram, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	nano := false
+	switch binary.LittleEndian.Uint32(hdr) {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0xa1b23c4d:
+		order, nano = binary.LittleEndian, true
+	case 0x4d3cb2a1:
+		order, nano = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, errors.New("pcapng isn't supported, convert the file with 'editcap -F pcap'")
+	default:
+		return nil, errors.New("not a pcap file")
+	}
+	link := order.Uint32(hdr[20:]) & 0xffff
+
+	var datagrams []datagram
+	rec := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(br, rec); err == io.EOF {
+			return datagrams, nil
+		} else if err != nil {
+			return nil, err
+		}
+		n := order.Uint32(rec[8:])
+		if n > 1<<20 {
+			return nil, fmt.Errorf("packet of %v bytes", n)
+		}
+		pkt := make([]byte, n)
+		if _, err := io.ReadFull(br, pkt); err != nil {
+			return nil, err
+		}
+
+		frac := time.Duration(order.Uint32(rec[4:]))
+		if !nano {
+			frac *= time.Microsecond
+		}
+		ts := time.Unix(int64(order.Uint32(rec[0:])), int64(frac))
+		if d, ok := parsePacket(link, pkt); ok {
+			d.ts = ts
+			datagrams = append(datagrams, d)
+		}
+	}
+}
+
+// parsePacket unwraps the UDP datagram of a captured packet.
+func parsePacket(link uint32, pkt []byte) (datagram, bool) {
+	var proto uint16
+	switch link {
+	case linkNull:
+		if len(pkt) < 4 {
+			return datagram{}, false
+		}
+		// the address family in host order, 2 is AF_INET everywhere
+		if pkt[0] == 2 || pkt[3] == 2 {
+			proto = 0x0800
+		} else {
+			proto = 0x86dd
+		}
+		pkt = pkt[4:]
+	case linkEther:
+		if len(pkt) < 14 {
+			return datagram{}, false
+		}
+		proto, pkt = binary.BigEndian.Uint16(pkt[12:]), pkt[14:]
+		for proto == 0x8100 && len(pkt) >= 4 {
+			proto, pkt = binary.BigEndian.Uint16(pkt[2:]), pkt[4:]
+		}
+	case linkSLL:
+		if len(pkt) < 16 {
+			return datagram{}, false
+		}
+		proto, pkt = binary.BigEndian.Uint16(pkt[14:]), pkt[16:]
+	case linkSLL2:
+		if len(pkt) < 20 {
+			return datagram{}, false
+		}
+		proto, pkt = binary.BigEndian.Uint16(pkt[0:]), pkt[20:]
+	case linkRaw, linkIPv4, linkIPv6:
+		if len(pkt) == 0 {
+			return datagram{}, false
+		}
+		proto = 0x0800
+		if pkt[0]>>4 == 6 {
+			proto = 0x86dd
+		}
+	default:
+		return datagram{}, false
+	}
+
+	var src, dst net.IP
+	switch proto {
+	case 0x0800:
+		if len(pkt) < 20 || pkt[9] != 17 {
+			return datagram{}, false
+		}
+		// fragments aren't reassembled
+		if binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+			return datagram{}, false
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		if len(pkt) < ihl {
+			return datagram{}, false
+		}
+		src, dst, pkt = net.IP(pkt[12:16]), net.IP(pkt[16:20]), pkt[ihl:]
+	case 0x86dd:
+		// extension headers aren't followed
+		if len(pkt) < 40 || pkt[6] != 17 {
+			return datagram{}, false
+		}
+		src, dst, pkt = net.IP(pkt[8:24]), net.IP(pkt[24:40]), pkt[40:]
+	default:
+		return datagram{}, false
+	}
+
+	if len(pkt) < 8 {
+		return datagram{}, false
+	}
+	length := int(binary.BigEndian.Uint16(pkt[4:]))
+	if length < 8 || length > len(pkt) {
+		return datagram{}, false
+	}
+	return datagram{
+		src:     &net.UDPAddr{IP: src, Port: int(binary.BigEndian.Uint16(pkt[0:]))},
+		dst:     &net.UDPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(pkt[2:]))},
+		payload: pkt[8:length],
+	}, true
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+	"git.scarlet.house/oss/go-tftpd/client"
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+const usage = `Usage:
+  tftp [flags] get host[:port] remote [local]
+  tftp [flags] put host[:port] local [remote]
+  tftp [flags] get tftp://host[:port]/remote[?option=value&...] [local]
+  tftp [flags] put tftp://host[:port]/remote[?option=value&...] [local]
+  tftp [flags] -manifest file get host[:port]|tftp://host[:port][?option=value&...]
+
+Options in URLs (blksize, timeout, retries, x-sha256, x-append) override
+the flags.
+
+Flags:
+`
+
+func main() {
+	blockSize := flag.Int("blksize", 512, "block size to negotiate")
+	timeout := flag.Duration("timeout", 5*time.Second, "retransmission timeout")
+	retries := flag.Int("retries", 5, "number of retransmissions before giving up")
+	quiet := flag.Bool("q", false, "don't print progress")
+	verbose := flag.Bool("v", false, "print the negotiated options and retransmissions")
+	digest := flag.Bool("sha256", false, "verify the transfer with the x-sha256 option (servers of this package only)")
+	appendFile := flag.Bool("append", false, "append uploads to existing files with the x-append option (servers of this package only)")
+	resume := flag.Bool("resume", false, "resume an interrupted transfer with the x-offset option, downloads continue at the end of the local file")
+	pskFile := flag.String("psk-file", "", "encrypt the transfer with the pre-shared key in `file` and the experimental x-psk option (servers of this package only)")
+	multicast := flag.Bool("multicast", false, "download with a multicast transfer (RFC 2090) if the server supports it")
+	manifest := flag.String("manifest", "", "download the files listed in the `file` (\"remote [local]\" per line)")
+	parallel := flag.Int("parallel", 4, "number of concurrent downloads with -manifest")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 || len(args) > 4 || (args[0] != "get" && args[0] != "put") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cli := client.New(withPort(args[1]))
+	cli.BlockSize = *blockSize
+	cli.Timeout = *timeout
+	cli.Retries = *retries
+	cli.Digest = *digest
+	cli.Append = *appendFile
+	if *pskFile != "" {
+		key, err := tftpd.ReadPSK(*pskFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tftp: %v\n", err)
+			os.Exit(2)
+		}
+		cli.PreSharedKey = key
+	}
+	if *verbose {
+		cli.OnNegotiate = printNegotiation
+		cli.OnRetransmit = printRetransmit
+	}
+
+	// a URL names the remote file, the local one follows it
+	remote := ""
+	if isURL(args[1]) {
+		var err error
+		if remote, err = cli.SetURL(args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "tftp: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if *manifest != "" {
+		if len(args) != 2 || args[0] != "get" || remote != "" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(getManifest(cli, *manifest, *parallel, *quiet))
+	}
+
+	if isURL(args[1]) {
+		if len(args) == 4 || remote == "" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		local := filepath.Base(remote)
+		if len(args) == 3 {
+			local = args[2]
+		}
+		if args[0] == "get" {
+			args = []string{"get", args[1], remote, local}
+		} else {
+			args = []string{"put", args[1], local, remote}
+		}
+	} else if len(args) < 3 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if !*quiet {
+		cli.Progress = printProgress
+	}
+
+	var stats client.TransferStats
+	var err error
+	switch args[0] {
+	case "get":
+		remote, local := args[2], filepath.Base(args[2])
+		if len(args) == 4 {
+			local = args[3]
+		}
+		stats, err = get(cli, remote, local, *resume, *multicast)
+	case "put":
+		local, remote := args[2], filepath.Base(args[2])
+		if len(args) == 4 {
+			remote = args[3]
+		}
+		stats, err = put(cli, local, remote, *resume)
+	}
+
+	if !*quiet {
+		// clear the progress line
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+		printStats(stats)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tftp: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func get(cli *client.Client, remote, local string, resume, multicast bool) (client.TransferStats, error) {
+	if multicast {
+		// blocks arrive out of order, they're written at their offset
+		if local == "-" {
+			return client.TransferStats{}, errors.New("multicast downloads need a local file")
+		}
+		f, err := os.Create(local)
+		if err != nil {
+			return client.TransferStats{}, err
+		}
+		defer f.Close()
+		stats, err := cli.GetMulticast(remote, f)
+		if err != nil {
+			os.Remove(local)
+		}
+		return stats, err
+	}
+
+	if resume && local != "-" {
+		// what's there already is kept, also if the transfer fails again
+		f, err := os.OpenFile(local, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return client.TransferStats{}, err
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return client.TransferStats{}, err
+		}
+		return cli.ResumeGet(remote, f, stat.Size())
+	}
+
+	var w io.Writer = os.Stdout
+	if local != "-" {
+		f, err := os.Create(local)
+		if err != nil {
+			return client.TransferStats{}, err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	stats, err := cli.Get(remote, w)
+	if err != nil && local != "-" {
+		os.Remove(local)
+	}
+	return stats, err
+}
+
+func put(cli *client.Client, local, remote string, resume bool) (client.TransferStats, error) {
+	var r io.Reader = os.Stdin
+	if local != "-" {
+		f, err := os.Open(local)
+		if err != nil {
+			return client.TransferStats{}, err
+		}
+		defer f.Close()
+		if resume {
+			return cli.ResumePut(remote, f)
+		}
+		r = f
+	}
+
+	return cli.Put(remote, r)
+}
+
+func getManifest(cli *client.Client, manifest string, parallel int, quiet bool) int {
+	f, err := os.Open(manifest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tftp: %v\n", err)
+		return 1
+	}
+	downloads, err := client.ReadManifest(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tftp: %v\n", err)
+		return 1
+	}
+
+	status := 0
+	for _, res := range cli.GetFiles(downloads, parallel) {
+		if res.Err != nil {
+			fmt.Fprintf(os.Stderr, "tftp: %v: %v\n", res.Remote, res.Err)
+			status = 1
+		} else if !quiet {
+			fmt.Fprintf(os.Stderr, "%v: ", res.Remote)
+			printStats(res.Stats)
+		}
+	}
+	return status
+}
+
+func isURL(arg string) bool {
+	return strings.HasPrefix(strings.ToLower(arg), "tftp://")
+}
+
+func withPort(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "69")
+}
+
+func printNegotiation(filename string, requested, acknowledged wire.Options) {
+	if acknowledged == nil && len(requested) > 0 {
+		fmt.Fprintf(os.Stderr, "\r\x1b[K%v: options %v ignored by the server\n", filename, requested)
+	} else if acknowledged != nil {
+		fmt.Fprintf(os.Stderr, "\r\x1b[K%v: options %v acknowledged\n", filename, acknowledged)
+	}
+}
+
+func printRetransmit(filename string, block uint16, timeout bool) {
+	cause := "packet lost"
+	if timeout {
+		cause = "timeout"
+	}
+	fmt.Fprintf(os.Stderr, "\r\x1b[K%v: retransmitting block %d (%v)\n", filename, block, cause)
+}
+
+var lastProgress time.Time
+
+func printProgress(transferred, total int64) {
+	if time.Since(lastProgress) < 200*time.Millisecond {
+		return
+	}
+	lastProgress = time.Now()
+
+	if total > 0 {
+		fmt.Fprintf(os.Stderr, "\r%d/%d bytes (%d%%)", transferred, total, transferred*100/total)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%d bytes", transferred)
+	}
+}
+
+func printStats(stats client.TransferStats) {
+	secs := stats.Duration.Seconds()
+	if secs <= 0 {
+		secs = 1e-9
+	}
+	fmt.Fprintf(os.Stderr, "%d bytes in %v (%.1f KiB/s), blksize %d, %d retransmits\n",
+		stats.Bytes, stats.Duration.Round(time.Millisecond), float64(stats.Bytes)/1024/secs, stats.BlockSize, stats.Retransmits)
+}
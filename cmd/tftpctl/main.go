@@ -0,0 +1,152 @@
+// tftpctl controls a go-tftpd daemon through its admin API (go-tftpd
+// -admin localhost:6970).
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+const usage = `Usage:
+  tftpctl [flags] list
+  tftpctl [flags] cancel session
+  tftpctl [flags] stats
+  tftpctl [flags] reload
+
+Flags:
+`
+
+func main() {
+	addr := flag.String("admin", "localhost:6970", "`address` of the admin API of the daemon")
+	asJSON := flag.Bool("json", false, "print the responses of list and stats as JSON")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	// only cancel takes an argument
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2) != (args[0] == "cancel") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	api := &apiClient{base: "http://" + *addr, http: &http.Client{Timeout: 10 * time.Second}}
+	var err error
+	switch args[0] {
+	case "list":
+		err = list(api, *asJSON)
+	case "cancel":
+		err = api.post("/api/cancel?id=" + url.QueryEscape(args[1]))
+	case "stats":
+		err = stats(api, *asJSON)
+	case "reload":
+		err = api.post("/api/reload")
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tftpctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func list(api *apiClient, asJSON bool) error {
+	var sessions []tftpd.SessionInfo
+	if err := api.get("/api/sessions", &sessions); err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(sessions)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "SESSION\tCLIENT\tDIR\tFILE\tBYTES\tSIZE\tRETX\tAGE\n")
+	for _, s := range sessions {
+		total := "?"
+		if s.Size >= 0 {
+			total = fmt.Sprint(s.Size)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			s.ID, s.Client, s.Direction, s.Filename, s.Bytes, total, s.Retransmits, time.Since(s.Start).Round(time.Second))
+	}
+	return w.Flush()
+}
+
+func stats(api *apiClient, asJSON bool) error {
+	var stats tftpd.Stats
+	if err := api.get("/api/stats", &stats); err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(stats)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "active sessions\t%v\n", stats.ActiveSessions)
+	fmt.Fprintf(w, "sessions started\t%v\n", stats.SessionsStarted)
+	fmt.Fprintf(w, "sessions completed\t%v\n", stats.SessionsCompleted)
+	fmt.Fprintf(w, "sessions failed\t%v\n", stats.SessionsFailed)
+	fmt.Fprintf(w, "bytes sent\t%v\n", stats.BytesSent)
+	fmt.Fprintf(w, "bytes received\t%v\n", stats.BytesReceived)
+	fmt.Fprintf(w, "blocks\t%v\n", stats.Blocks)
+	fmt.Fprintf(w, "retransmits\t%v\n", stats.Retransmits)
+	fmt.Fprintf(w, "dropped\t%v\n", stats.Dropped)
+	fmt.Fprintf(w, "rejected\t%v\n", stats.Rejected)
+	codes := make([]tftpd.ErrorCode, 0, len(stats.Errors))
+	for code := range stats.Errors {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	for _, code := range codes {
+		fmt.Fprintf(w, "errors (%d)\t%v\n", code, stats.Errors[code])
+	}
+	return w.Flush()
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+type apiClient struct {
+	base string
+	http *http.Client
+}
+
+func (c *apiClient) get(path string, v interface{}) error {
+	resp, err := c.http.Get(c.base + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// post sends a command, errors carry the message of the daemon.
+func (c *apiClient) post(path string) error {
+	resp, err := c.http.Post(c.base+path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%v", strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
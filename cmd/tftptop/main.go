@@ -0,0 +1,140 @@
+// tftptop shows the transfers of a go-tftpd daemon in real time, from its
+// admin API (go-tftpd -admin localhost:6970).
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+)
+
+// number of failed transfers shown
+const maxFailures = 5
+
+func main() {
+	addr := flag.String("admin", "localhost:6970", "`address` of the admin API of the daemon")
+	interval := flag.Duration("interval", time.Second, "refresh `interval`")
+	flag.Parse()
+
+	api := &apiClient{base: "http://" + *addr, http: &http.Client{Timeout: 5 * time.Second}}
+	top := &top{rates: make(map[string]int64)}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	// the alternate screen keeps the terminal as it was
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+	for {
+		frame, err := top.update(api, time.Now())
+		if err != nil {
+			frame = fmt.Sprintf("tftptop: %v\n", err)
+		}
+		fmt.Print("\x1b[H\x1b[2J" + frame)
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+type apiClient struct {
+	base string
+	http *http.Client
+}
+
+func (c *apiClient) get(path string, v interface{}) error {
+	resp, err := c.http.Get(c.base + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// top keeps what's needed for rates between frames.
+type top struct {
+	last  time.Time
+	bytes uint64
+	// bytes of the sessions in the last frame
+	rates map[string]int64
+}
+
+func (t *top) update(api *apiClient, now time.Time) (string, error) {
+	var stats tftpd.Stats
+	var sessions []tftpd.SessionInfo
+	var failures []tftpd.AuditRecord
+	for path, v := range map[string]interface{}{"/api/stats": &stats, "/api/sessions": &sessions, "/api/failures": &failures} {
+		if err := api.get(path, v); err != nil {
+			return "", err
+		}
+	}
+
+	secs := now.Sub(t.last).Seconds()
+	bytes := stats.BytesSent + stats.BytesReceived
+	var rate float64
+	if !t.last.IsZero() && secs > 0 && bytes >= t.bytes {
+		rate = float64(bytes-t.bytes) / secs
+	}
+	t.last, t.bytes = now, bytes
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "go-tftpd %v  sessions %d  completed %d  failed %d  rejected %d  retransmits %d  %v/s\n\n",
+		now.Format("15:04:05"), stats.ActiveSessions, stats.SessionsCompleted, stats.SessionsFailed, stats.Rejected, stats.Retransmits, size(rate))
+	fmt.Fprintf(&b, "\x1b[7m%-12s %-21s %-5s %-30s %8s %9s %10s %6s\x1b[0m\n", "SESSION", "CLIENT", "DIR", "FILE", "DONE", "SIZE", "RATE", "RETX")
+	rates := make(map[string]int64, len(sessions))
+	for _, s := range sessions {
+		var rate float64
+		if last, ok := t.rates[s.ID]; ok && secs > 0 {
+			rate = float64(s.Bytes-last) / secs
+		}
+		rates[s.ID] = s.Bytes
+		done, total := "", "?"
+		if s.Size > 0 {
+			done, total = fmt.Sprintf("%d%%", s.Bytes*100/s.Size), size(float64(s.Size))
+		}
+		fmt.Fprintf(&b, "%-12s %-21s %-5s %-30s %8s %9s %8s/s %6d\n",
+			s.ID, s.Client, s.Direction, trim(s.Filename, 30), done, total, size(rate), s.Retransmits)
+	}
+	t.rates = rates
+
+	fmt.Fprintf(&b, "\nRecent failures\n")
+	for i, f := range failures {
+		if i == maxFailures {
+			break
+		}
+		fmt.Fprintf(&b, "%v %-21s %-5s %-30s %v\n", f.Time.Local().Format("15:04:05"), f.Client, f.Direction, trim(f.Filename, 30), f.Error)
+	}
+	return b.String(), nil
+}
+
+func size(bytes float64) string {
+	for _, unit := range []string{"B", "KiB", "MiB"} {
+		if bytes < 1024 {
+			return fmt.Sprintf("%.0f%v", bytes, unit)
+		}
+		bytes /= 1024
+	}
+	return fmt.Sprintf("%.1fGiB", bytes)
+}
+
+func trim(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return "…" + s[len(s)-n+1:]
+}
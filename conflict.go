@@ -0,0 +1,56 @@
+package tftpd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// ConflictPolicy decides what happens to uploads of files which exist
+// already. The client isn't told the name written.
+type ConflictPolicy int
+
+const (
+	// RejectConflicts answers with a File already exists error.
+	RejectConflicts ConflictPolicy = iota
+	// NumberConflicts writes to name.1, name.2, ... instead, e.g. for
+	// periodic config backups of network devices.
+	NumberConflicts
+	// TimestampConflicts writes to name.20060102-150405 (UTC) instead,
+	// numbered too if that exists.
+	TimestampConflicts
+)
+
+// Attempts to find a free name before giving up with File already exists.
+const maxConflictNumber = 10000
+
+// resolveConflict changes the name of an upload to a free one according
+// to OnConflict.
+func (tftp *TFTPServer) resolveConflict(cli *client, req *request) error {
+	policy := tftp.onConflict(cli)
+	if policy == RejectConflicts || cli.append || cli.resume || cli.sink != nil || cli.partial != nil || !exists(cli.path(req.filename)) {
+		return nil
+	}
+
+	base := req.filename
+	if policy == TimestampConflicts {
+		base += "." + tftp.now().UTC().Format("20060102-150405")
+	}
+	name := base
+	for i := 1; exists(cli.path(name)); i++ {
+		if i > maxConflictNumber {
+			return ErrFileExists
+		}
+		name = fmt.Sprintf("%v.%d", base, i)
+	}
+
+	cli.logf("Upload of '%v' is written to '%v'.\n", req.filename, name)
+	req.filename, cli.filename = name, name
+	return nil
+}
+
+func exists(name string) bool {
+	_, err := os.Lstat(name)
+	return !errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,308 @@
+package tftpd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/tftptest"
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+var block512 = strings.Repeat("x", 512)
+
+func rrq(filename string) *wire.ReadRequest {
+	return &wire.ReadRequest{Filename: filename, Mode: "octet"}
+}
+
+func wrq(filename string) *wire.WriteRequest {
+	return &wire.WriteRequest{Filename: filename, Mode: "octet"}
+}
+
+func data(block uint16, payload string) *wire.Data {
+	return &wire.Data{Block: block, Payload: []byte(payload)}
+}
+
+func ack(block uint16) *wire.Ack { return &wire.Ack{Block: block} }
+
+func errCode(code ErrorCode) *wire.Error { return &wire.Error{Code: uint16(code)} }
+
+// TestConformance drives the server through RFC 1350 exchanges packet by packet.
+func TestConformance(t *testing.T) {
+	for _, v := range []struct {
+		name  string
+		files map[string]string
+		// server retransmission timeout, long enough to never fire by default
+		timeout time.Duration
+		steps   []tftptest.Step
+		// files expected after the exchange
+		want map[string]string
+	}{
+		{
+			name:  "read",
+			files: map[string]string{"f": "abc"},
+			steps: []tftptest.Step{
+				{Send: rrq("f"), Expect: data(1, "abc")},
+				{Send: ack(1)},
+			},
+		},
+		{
+			name:  "read block size multiple",
+			files: map[string]string{"f": block512},
+			steps: []tftptest.Step{
+				{Send: rrq("f"), Expect: data(1, block512)},
+				{Send: ack(1), Expect: data(2, "")},
+				{Send: ack(2)},
+			},
+		},
+		{
+			name:  "read empty file",
+			files: map[string]string{"f": ""},
+			steps: []tftptest.Step{
+				{Send: rrq("f"), Expect: data(1, "")},
+				{Send: ack(1)},
+			},
+		},
+		{
+			name: "read missing file",
+			steps: []tftptest.Step{
+				{Send: rrq("missing"), Expect: errCode(CodeFileNotFound)},
+			},
+		},
+		{
+			name: "write",
+			steps: []tftptest.Step{
+				{Send: wrq("f"), Expect: ack(0)},
+				{Send: data(1, block512), Expect: ack(1)},
+				{Send: data(2, "abc"), Expect: ack(2)},
+			},
+			want: map[string]string{"f": block512 + "abc"},
+		},
+		{
+			name: "write empty file",
+			steps: []tftptest.Step{
+				{Send: wrq("f"), Expect: ack(0)},
+				{Send: data(1, ""), Expect: ack(1)},
+			},
+			want: map[string]string{"f": ""},
+		},
+		{
+			name:  "write existing file",
+			files: map[string]string{"f": "abc"},
+			steps: []tftptest.Step{
+				{Send: wrq("f"), Expect: errCode(CodeFileExists)},
+			},
+			want: map[string]string{"f": "abc"},
+		},
+		{
+			name: "unsupported mode",
+			steps: []tftptest.Step{
+				{Send: &wire.ReadRequest{Filename: "f", Mode: "mail"}, Expect: errCode(CodeNotDefined)},
+			},
+		},
+		{
+			name: "unknown opcode",
+			steps: []tftptest.Step{
+				{Raw: []byte{0, 9, 0, 1}, Expect: errCode(CodeIllegalOperation)},
+			},
+		},
+		{
+			name: "malformed request",
+			steps: []tftptest.Step{
+				{Raw: []byte{0, 1, 'f', 0, 'o', 'c', 't'}, Expect: errCode(CodeIllegalOperation)},
+			},
+		},
+		{
+			name: "unknown transfer ID",
+			steps: []tftptest.Step{
+				{Send: ack(1), Expect: errCode(CodeUnknownTID)},
+				{Send: data(1, "abc"), Expect: errCode(CodeUnknownTID)},
+				// errors are never answered
+				{Send: errCode(CodeNotDefined)},
+			},
+		},
+		{
+			name: "ACK during a write",
+			steps: []tftptest.Step{
+				{Send: wrq("f"), Expect: ack(0)},
+				{Send: ack(0), Expect: errCode(CodeIllegalOperation)},
+				{Send: data(1, "abc"), Expect: errCode(CodeUnknownTID)},
+			},
+			want: map[string]string{"f": ""},
+		},
+		{
+			name:  "DATA during a read",
+			files: map[string]string{"f": block512},
+			steps: []tftptest.Step{
+				{Send: rrq("f"), Expect: data(1, block512)},
+				{Send: data(1, "abc"), Expect: errCode(CodeIllegalOperation)},
+				{Send: ack(1), Expect: errCode(CodeUnknownTID)},
+			},
+		},
+		{
+			name:  "read terminated by the client",
+			files: map[string]string{"f": block512 + "abc"},
+			steps: []tftptest.Step{
+				{Send: rrq("f"), Expect: data(1, block512)},
+				{Send: errCode(CodeDiskFull)},
+				{Send: ack(1), Expect: errCode(CodeUnknownTID)},
+			},
+		},
+		{
+			name: "write terminated by the client",
+			steps: []tftptest.Step{
+				{Send: wrq("f"), Expect: ack(0)},
+				{Send: data(1, block512), Expect: ack(1)},
+				{Send: errCode(CodeNotDefined)},
+				{Send: data(2, "abc"), Expect: errCode(CodeUnknownTID)},
+			},
+			want: map[string]string{"f": block512},
+		},
+		{
+			name:  "duplicate RRQ",
+			files: map[string]string{"f": block512 + "abc"},
+			steps: []tftptest.Step{
+				{Send: rrq("f"), Expect: data(1, block512)},
+				{Send: rrq("f"), Expect: data(1, block512)},
+				{Send: ack(1), Expect: data(2, "abc")},
+			},
+		},
+		{
+			name:  "duplicate ACK",
+			files: map[string]string{"f": block512 + block512 + "abc"},
+			steps: []tftptest.Step{
+				{Send: rrq("f"), Expect: data(1, block512)},
+				{Send: ack(1), Expect: data(2, block512)},
+				// answering it would double every following packet
+				{Send: ack(1)},
+				{Send: ack(2), Expect: data(3, "abc")},
+			},
+		},
+		{
+			name: "duplicate WRQ",
+			steps: []tftptest.Step{
+				{Send: wrq("f"), Expect: ack(0)},
+				{Send: wrq("f"), Expect: ack(0)},
+				{Send: data(1, "abc"), Expect: ack(1)},
+			},
+			want: map[string]string{"f": "abc"},
+		},
+		{
+			name: "duplicate DATA",
+			steps: []tftptest.Step{
+				{Send: wrq("f"), Expect: ack(0)},
+				{Send: data(1, block512), Expect: ack(1)},
+				{Send: data(1, block512), Expect: ack(1)},
+				{Send: data(2, "abc"), Expect: ack(2)},
+			},
+			want: map[string]string{"f": block512 + "abc"},
+		},
+		{
+			name: "out of order DATA",
+			steps: []tftptest.Step{
+				{Send: wrq("f"), Expect: ack(0)},
+				{Send: data(2, "abc")},
+				{Send: data(1, "abc"), Expect: ack(1)},
+			},
+			want: map[string]string{"f": "abc"},
+		},
+		{
+			name:  "final ACK ends a read",
+			files: map[string]string{"f": "abc"},
+			steps: []tftptest.Step{
+				{Send: rrq("f"), Expect: data(1, "abc")},
+				{Send: ack(1)},
+				{Send: ack(1), Expect: errCode(CodeUnknownTID)},
+			},
+		},
+		{
+			name: "final ACK is repeated after a write",
+			steps: []tftptest.Step{
+				{Send: wrq("f"), Expect: ack(0)},
+				{Send: data(1, "abc"), Expect: ack(1)},
+				{Send: data(1, "abc"), Expect: ack(1)},
+				// nothing is written after the last block
+				{Send: data(2, "def")},
+			},
+			want: map[string]string{"f": "abc"},
+		},
+		{
+			name:    "DATA retransmitted on timeout",
+			files:   map[string]string{"f": "abc"},
+			timeout: 100 * time.Millisecond,
+			steps: []tftptest.Step{
+				{Send: rrq("f"), Expect: data(1, "abc")},
+				{Expect: data(1, "abc")},
+				{Send: ack(1)},
+			},
+		},
+		{
+			name:    "ACK retransmitted on timeout",
+			timeout: 100 * time.Millisecond,
+			steps: []tftptest.Step{
+				{Send: wrq("f"), Expect: ack(0)},
+				{Expect: ack(0)},
+				{Send: data(1, "abc"), Expect: ack(1)},
+			},
+			want: map[string]string{"f": "abc"},
+		},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range v.files {
+				os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+			}
+
+			timeout := v.timeout
+			if timeout == 0 {
+				timeout = time.Minute
+			}
+			conn := newTestServer(t, dir, timeout)
+			mock := tftptest.NewMockClient(conn, tftptest.Addr("server"))
+			if err := mock.Run(v.steps...); err != nil {
+				t.Fatalf("%v\n", err)
+			}
+
+			for name, want := range v.want {
+				got, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil || string(got) != want {
+					t.Fatalf("Incorrect content of '%v' (%v bytes, %v)\n", name, len(got), err)
+				}
+			}
+		})
+	}
+}
+
+// newTestServer serves dir on an in-memory network and returns the
+// connection of a client talking to it.
+func newTestServer(t testing.TB, dir string, timeout time.Duration) *tftptest.Conn {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	conn, _ := network.ListenPacket("client")
+
+	server := NewTFTPServerConn(listener)
+	server.Timeout = timeout
+	done := make(chan struct{})
+	go func() {
+		server.ListenAndServe()
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		server.Close()
+		<-done
+		conn.Close()
+		os.Chdir(wd)
+	})
+	return conn
+}
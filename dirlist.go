@@ -0,0 +1,97 @@
+package tftpd
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DirListName is the magic file whose downloads list the files, see
+// TFTPServer.DirList.
+const DirListName = ".dirlist"
+
+// limits of the files listed and of the entries looked at, so a listing of
+// a huge tree stays small and doesn't hold up the packet loop, even if most
+// of the tree isn't listable
+const (
+	maxDirList    = 10000
+	maxDirVisited = 100000
+)
+
+var errDirListFull = errors.New("listing full")
+
+// dirList serves the listing of a download of .dirlist/prefix: the names of
+// the files starting with prefix which the client may read, one per line.
+// It reports whether the request was one.
+func (tftp *TFTPServer) dirList(cli *client, req *request) (bool, error) {
+	name := cleanName(req.filename)
+	if !tftp.DirList || tftp.ServeFile != "" || (name != DirListName && !strings.HasPrefix(name, DirListName+"/")) {
+		return false, nil
+	}
+	prefix := strings.TrimPrefix(strings.TrimPrefix(name, DirListName), "/")
+	// cleaning drops it, images/ mustn't list images2/
+	if prefix != "" && strings.HasSuffix(req.filename, "/") {
+		prefix += "/"
+	}
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+	root := cli.path(dir)
+	if root == "" {
+		root = "."
+	}
+
+	var listing strings.Builder
+	n, visited := 0, 0
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		// only a missing or unreadable prefix fails, the rest is skipped
+		if err != nil && p == root {
+			return err
+		} else if err != nil && d != nil && d.IsDir() {
+			return fs.SkipDir
+		} else if err != nil {
+			return nil
+		}
+		visited++
+		if n >= maxDirList || visited > maxDirVisited {
+			return errDirListFull
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		file := path.Join(dir, filepath.ToSlash(rel))
+		if d.IsDir() && p != root && !strings.HasPrefix(file+"/", prefix) && !strings.HasPrefix(prefix, file+"/") {
+			// nothing below can start with the prefix
+			return fs.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if !strings.HasPrefix(file, prefix) || !tftp.listable(cli, file) {
+			return nil
+		}
+		listing.WriteString(file + "\n")
+		n++
+		return nil
+	})
+	if err != nil && err != errDirListFull {
+		return true, fsError(err)
+	}
+
+	cli.logf("Client '%v' listed %v files of '%v'\n", cli.tid.String(), n, prefix)
+	cli.reader = strings.NewReader(listing.String())
+	cli.setSize(int64(listing.Len()))
+	return true, nil
+}
+
+// listable reports whether the client may download the file.
+func (tftp *TFTPServer) listable(cli *client, file string) bool {
+	if tftp.ACL != nil && !tftp.ACL.Allowed(cli.tid, file, false) {
+		return false
+	}
+	return tftp.Allowlist == nil || tftp.Allowlist.Allowed(file)
+}
@@ -0,0 +1,95 @@
+package tftpd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorCode is the error code of an ERROR packet (RFC 1350).
+type ErrorCode uint16
+
+const (
+	CodeNotDefined ErrorCode = iota
+	CodeFileNotFound
+	CodeAccessViolation
+	CodeDiskFull
+	CodeIllegalOperation
+	CodeUnknownTID
+	CodeFileExists
+	CodeNoSuchUser
+	// RFC 2347
+	CodeOptionNegotiation
+)
+
+var errorMessages = [...]string{
+	CodeNotDefined:        "",
+	CodeFileNotFound:      "File not found.",
+	CodeAccessViolation:   "Access violation.",
+	CodeDiskFull:          "Disk full or allocation exceeded.",
+	CodeIllegalOperation:  "Illegal TFTP operation.",
+	CodeUnknownTID:        "Unknown transfer ID.",
+	CodeFileExists:        "File already exists.",
+	CodeNoSuchUser:        "No such user.",
+	CodeOptionNegotiation: "Option negotiation failed.",
+}
+
+// Error is sent to the client as an ERROR packet. Any error returned to the
+// server that wraps an *Error controls the code and message of the packet,
+// other errors are sent as "Unexpected error.".
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+// NewError returns an error with the given code. Without a message the
+// standard message of the code is used.
+func NewError(code ErrorCode, message ...string) *Error {
+	if int(code) >= len(errorMessages) {
+		code = CodeNotDefined
+	}
+
+	msg := strings.Join(message, " ")
+	if msg == "" {
+		msg = errorMessages[code]
+	}
+
+	return &Error{
+		Code:    code,
+		Message: msg,
+	}
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("TFTP Error (%v): %v", err.Code, err.Message)
+}
+
+// Is reports whether target is an *Error with the same code, so
+// errors.Is(err, ErrFileNotFound) matches regardless of the message.
+func (err *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == err.Code
+}
+
+var (
+	ErrFileNotFound      = NewError(CodeFileNotFound)
+	ErrAccessViolation   = NewError(CodeAccessViolation)
+	ErrDiskFull          = NewError(CodeDiskFull)
+	ErrIllegalOperation  = NewError(CodeIllegalOperation)
+	ErrUnknownTID        = NewError(CodeUnknownTID)
+	ErrFileExists        = NewError(CodeFileExists)
+	ErrNoSuchUser        = NewError(CodeNoSuchUser)
+	ErrOptionNegotiation = NewError(CodeOptionNegotiation)
+)
+
+var (
+	endOfSession = errors.New("End of session.")
+	// duplicate or stale packets which aren't answered
+	errIgnored = errors.New("Packet ignored.")
+	// failures of sessions without an ERROR packet
+	errTimedOut     = errors.New("Transfer timed out.")
+	errServerClosed = errors.New("Server closed.")
+	errEvicted      = errors.New("Session evicted.")
+	// requests refused without an answer, see TFTPServer.DropWhenBusy
+	errDropped = errors.New("Request dropped, server busy.")
+)
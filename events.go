@@ -0,0 +1,128 @@
+package tftpd
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// events waiting for a slow broker beyond brokerQueue are dropped
+const brokerQueue = 1024
+
+// Event is a transfer event passed to an EventPublisher, with the audit
+// record of the transfer so far. Started transfers have no Result.
+type Event struct {
+	// Type is "transfer.started", "transfer.completed" or
+	// "transfer.failed".
+	Type string `json:"event"`
+	AuditRecord
+}
+
+// EventPublisher gets the transfer events of a server, e.g. to aggregate
+// the telemetry of a fleet. Publish is called on the server goroutine and
+// mustn't block, errors are logged.
+type EventPublisher interface {
+	Publish(Event) error
+}
+
+// Publishers sends the events to all of them.
+type Publishers []EventPublisher
+
+func (p Publishers) Publish(ev Event) error {
+	var first error
+	for _, publisher := range p {
+		if err := publisher.Publish(ev); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func eventType(rec AuditRecord) string {
+	if rec.Result != "ok" {
+		return "transfer.failed"
+	}
+	return "transfer.completed"
+}
+
+// publish passes an event to the EventPublisher if there is one.
+func (tftp *TFTPServer) publish(typ string, rec AuditRecord) {
+	if tftp.Events == nil {
+		return
+	}
+	if err := tftp.Events.Publish(Event{Type: typ, AuditRecord: rec}); err != nil {
+		log.Printf("[%v] error while publishing %v event: '%v'\n", rec.Session, typ, err)
+	}
+}
+
+// started publishes the start of a session once it's accepted.
+func (tftp *TFTPServer) started(cli *client) {
+	if tftp.Events == nil {
+		return
+	}
+	rec := tftp.record(cli)
+	rec.Result = ""
+	tftp.publish("transfer.started", rec)
+}
+
+// BrokerPublisher is an EventPublisher sending the events as JSON to a
+// message broker in another goroutine, to the topic (or subject, routing
+// key) prefix.transfer.completed etc. Send is the publish function of the
+// broker client, e.g. the Publish method of a NATS connection:
+//
+//	server.Events = tftpd.NewBrokerPublisher(nc.Publish, "tftpd")
+//
+// or a closure around a Kafka or AMQP producer:
+//
+//	tftpd.NewBrokerPublisher(func(topic string, payload []byte) error {
+//		return w.WriteMessages(ctx, kafka.Message{Topic: topic, Value: payload})
+//	}, "tftpd")
+type BrokerPublisher struct {
+	send   func(topic string, payload []byte) error
+	prefix string
+	queue  chan Event
+	done   chan struct{}
+	once   sync.Once
+}
+
+func NewBrokerPublisher(send func(topic string, payload []byte) error, prefix string) *BrokerPublisher {
+	p := &BrokerPublisher{send: send, prefix: prefix, queue: make(chan Event, brokerQueue), done: make(chan struct{})}
+	go p.run()
+	return p
+}
+
+// Publish queues the event without blocking.
+func (p *BrokerPublisher) Publish(ev Event) error {
+	select {
+	case p.queue <- ev:
+	default:
+		log.Printf("[%v] Broker queue full, event dropped\n", ev.Session)
+	}
+	return nil
+}
+
+// Close sends the queued events and stops. Publish mustn't be called
+// anymore.
+func (p *BrokerPublisher) Close() error {
+	p.once.Do(func() { close(p.queue) })
+	<-p.done
+	return nil
+}
+
+func (p *BrokerPublisher) run() {
+	defer close(p.done)
+	for ev := range p.queue {
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("error while encoding event: '%v'\n", err)
+			continue
+		}
+		topic := ev.Type
+		if p.prefix != "" {
+			topic = p.prefix + "." + topic
+		}
+		if err := p.send(topic, payload); err != nil {
+			log.Printf("[%v] error while publishing %v event: '%v'\n", ev.Session, ev.Type, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package tftpd
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// The beginning of up to maxHeads recently downloaded files is kept, see
+// TFTPServer.FirstBlockCache.
+const (
+	headSize = 64 << 10
+	maxHeads = 64
+	headTTL  = time.Second
+)
+
+var errFileChanged = NewError(CodeNotDefined, "File changed during transfer.")
+
+// head is the beginning of a file, or all of it. It's shared by the
+// sessions and never changed.
+type head struct {
+	path    string
+	data    []byte
+	size    int64
+	modTime time.Time
+	// last time the file was found unchanged, only used by the server
+	// goroutine
+	checked time.Time
+}
+
+func (h *head) matches(fi fs.FileInfo) bool {
+	return fi.Mode().IsRegular() && fi.Size() == h.size && fi.ModTime().Equal(h.modTime)
+}
+
+// openHead serves a download from the cached head of the file, which is
+// checked for changes with stat at most every headTTL. Files which aren't
+// cached yet are read and cached.
+func (tftp *TFTPServer) openHead(cli *client, req *request) error {
+	name := cli.path(req.filename)
+	now := tftp.now()
+	h := tftp.heads[name]
+	if h != nil && now.Sub(h.checked) >= headTTL {
+		if fi, err := os.Stat(name); err == nil && h.matches(fi) {
+			h.checked = now
+		} else {
+			delete(tftp.heads, name)
+			h = nil
+		}
+	}
+	if h != nil {
+		cli.reader = &headReader{head: h, files: &tftp.files}
+		cli.setSize(h.size)
+		return nil
+	}
+
+	if err := tftp.openRead(cli, name); err != nil {
+		return err
+	}
+	r, ok := cli.reader.(*sharedReader)
+	if !ok {
+		return nil
+	}
+	fi := r.file.fi
+	size := fi.Size()
+	if size > headSize {
+		size = headSize
+	}
+	data := make([]byte, size)
+	if n, err := r.file.f.ReadAt(data, 0); n < len(data) {
+		// shrinking, it's served as it is
+		if err != nil && err != io.EOF {
+			cli.logf("Can't cache '%v': '%v'\n", name, err)
+		}
+		return nil
+	}
+	h = &head{path: name, data: data, size: fi.Size(), modTime: fi.ModTime(), checked: now}
+	tftp.cacheHead(h)
+	cli.reader = &headReader{head: h, files: &tftp.files, file: r.file}
+	return nil
+}
+
+// cacheHead adds the head, replacing the one checked the longest ago if
+// the cache is full.
+func (tftp *TFTPServer) cacheHead(h *head) {
+	if tftp.heads == nil {
+		tftp.heads = make(map[string]*head)
+	}
+	if len(tftp.heads) >= maxHeads {
+		var oldest *head
+		for _, v := range tftp.heads {
+			if oldest == nil || v.checked.Before(oldest.checked) {
+				oldest = v
+			}
+		}
+		delete(tftp.heads, oldest.path)
+	}
+	tftp.heads[h.path] = h
+}
+
+// forgetHead drops the head of a file being uploaded.
+func (tftp *TFTPServer) forgetHead(cli *client) {
+	delete(tftp.heads, cli.path(cli.filename))
+}
+
+// headReader reads the head from memory and the rest from the shared
+// file, which is only opened if needed.
+type headReader struct {
+	head  *head
+	files *sharedFiles
+	file  *sharedFile
+	off   int64
+}
+
+func (r *headReader) Read(p []byte) (int, error) {
+	if r.off >= r.head.size {
+		return 0, io.EOF
+	}
+	if r.off < int64(len(r.head.data)) {
+		n := copy(p, r.head.data[r.off:])
+		r.off += int64(n)
+		return n, nil
+	}
+
+	if r.file == nil {
+		sf, err := r.files.open(r.head.path)
+		if err != nil {
+			return 0, fsError(err)
+		}
+		if !r.head.matches(sf.fi) {
+			r.files.release(sf)
+			return 0, errFileChanged
+		}
+		r.file = sf
+	}
+	n, err := r.file.f.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *headReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.head.size
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *headReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.files.release(r.file)
+	r.file = nil
+	return err
+}
@@ -0,0 +1,27 @@
+package tftpd
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// fsError turns errors of file operations into the ERROR packet the client
+// gets, the platform specific part is in isDiskFull, isReadOnly and
+// isTooManyFiles.
+func fsError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrFileNotFound
+	case errors.Is(err, fs.ErrExist):
+		return ErrFileExists
+	case errors.Is(err, fs.ErrPermission), isReadOnly(err):
+		return ErrAccessViolation
+	case isDiskFull(err):
+		return ErrDiskFull
+	case isTooManyFiles(err):
+		return errBusy
+	}
+	return err
+}
@@ -0,0 +1,22 @@
+//go:build !unix && !windows
+
+package tftpd
+
+import "strings"
+
+// other ports have no portable error numbers, their messages are matched
+func isDiskFull(err error) bool {
+	return strings.Contains(err.Error(), "no space")
+}
+
+func isReadOnly(err error) bool {
+	return strings.Contains(err.Error(), "read-only")
+}
+
+func isTooManyFiles(err error) bool {
+	return strings.Contains(err.Error(), "too many open files")
+}
+
+func fdLimit() int {
+	return 0
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package tftpd
+
+import (
+	"errors"
+	"syscall"
+)
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+func isReadOnly(err error) bool {
+	return errors.Is(err, syscall.EROFS)
+}
+
+func isTooManyFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// fdLimit returns the limit of open file descriptors.
+func fdLimit() int {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil || rlim.Cur > 1<<30 {
+		return 0
+	}
+	return int(rlim.Cur)
+}
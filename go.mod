@@ -1,3 +1,11 @@
 module git.scarlet.house/oss/go-tftpd
 
 go 1.19
+
+require (
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.13.0
+)
+
+require golang.org/x/text v0.13.0 // indirect
@@ -0,0 +1,132 @@
+package tftpd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// GzipOption is the vendor option with which clients ask for downloads
+// compressed with gzip, see TFTPServer.Gzip. Its value is "1" or "0".
+const GzipOption = "x-gzip"
+
+// Ways a compressed variant of a file is served, see gzipVariant.
+const (
+	gzipNone = iota
+	// the file only exists as file.gz
+	gzipDecompress
+	// the client asked for gzip and the file only exists uncompressed
+	gzipCompress
+)
+
+func (tftp *TFTPServer) negotiateGzip(cli *client, req *request, opt wire.Option) error {
+	if !tftp.Gzip || req.opcode != wire.OpRRQ {
+		return nil
+	}
+	on, err := strconv.ParseBool(opt.Value)
+	if err != nil {
+		return optionError(opt)
+	}
+	if on {
+		cli.oack.Set(opt.Name, opt.Value)
+	}
+	return nil
+}
+
+// gzipVariant serves file.gz if a download of file is requested and only
+// file.gz exists, and the other way around if the client asked for gzip.
+// The name is changed to the file read, e.g. for the allowlist.
+func (tftp *TFTPServer) gzipVariant(cli *client, req *request) {
+	if !tftp.Gzip {
+		return
+	}
+
+	_, compressed := cli.oack.Get(GzipOption)
+	switch {
+	case compressed && strings.HasSuffix(req.filename, ".gz"):
+	case compressed && exists(cli.path(req.filename+".gz")):
+		req.filename += ".gz"
+	case compressed:
+		cli.gzip = gzipCompress
+	case !exists(cli.path(req.filename)) && exists(cli.path(req.filename+".gz")):
+		req.filename += ".gz"
+		cli.gzip = gzipDecompress
+	}
+}
+
+// wrapGzip compresses or decompresses a download on the fly, the size isn't
+// known then.
+func (cli *client) wrapGzip() error {
+	src := cli.reader
+	switch cli.gzip {
+	case gzipNone:
+		return nil
+
+	case gzipDecompress:
+		zr, err := gzip.NewReader(src)
+		if err != nil {
+			return err
+		}
+		cli.reader = &gunzipReader{zr, src}
+
+	case gzipCompress:
+		r := &gzipReader{src: src}
+		r.zw = gzip.NewWriter(&r.out)
+		cli.reader = r
+	}
+	cli.setSize(-1)
+	return nil
+}
+
+// gzipReader compresses its source as it's read, without a goroutine of
+// its own.
+type gzipReader struct {
+	src   io.Reader
+	zw    *gzip.Writer
+	out   bytes.Buffer
+	chunk []byte
+	err   error
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	if r.chunk == nil {
+		r.chunk = make([]byte, 32<<10)
+	}
+	// the compressor holds back its output until it has enough input
+	for r.out.Len() < len(p) && r.err == nil {
+		n, err := r.src.Read(r.chunk)
+		r.zw.Write(r.chunk[:n])
+		if err == io.EOF {
+			r.zw.Close()
+		}
+		r.err = err
+	}
+	if r.out.Len() > 0 {
+		return r.out.Read(p)
+	}
+	return 0, r.err
+}
+
+func (r *gzipReader) Close() error {
+	if c, ok := r.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type gunzipReader struct {
+	*gzip.Reader
+	src io.Reader
+}
+
+func (r *gunzipReader) Close() error {
+	r.Reader.Close()
+	if c, ok := r.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
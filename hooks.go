@@ -0,0 +1,175 @@
+package tftpd
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// UploadInfo describes a completed upload.
+type UploadInfo struct {
+	// Session is the ID of the session in the log and the audit records.
+	Session string
+	// Path is the path of the written file, empty for uploads to the
+	// Writer of the OnWrite hook.
+	Path     string
+	Client   net.Addr
+	Bytes    int64
+	Duration time.Duration
+	// Checksums are the hex encoded checksums by algorithm, see
+	// TFTPServer.Checksums.
+	Checksums map[string]string
+}
+
+// UploadCommand returns an OnUpload hook running the command with the path
+// of the file as the last argument. The session ID, the client address and
+// the size are passed in the TFTP_SESSION, TFTP_CLIENT and TFTP_BYTES
+// environment variables, the checksums in TFTP_SHA256 etc.
+func UploadCommand(name string, args ...string) func(UploadInfo) {
+	return func(info UploadInfo) {
+		cmd := exec.Command(name, append(args, info.Path)...)
+		cmd.Env = append(os.Environ(),
+			"TFTP_SESSION="+info.Session,
+			"TFTP_CLIENT="+info.Client.String(),
+			"TFTP_BYTES="+strconv.FormatInt(info.Bytes, 10),
+		)
+		for name, sum := range info.Checksums {
+			cmd.Env = append(cmd.Env, "TFTP_"+strings.ToUpper(name)+"="+sum)
+		}
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Printf("[%v] Upload hook for '%v' failed: '%v' %s\n", info.Session, info.Path, err, out)
+		}
+	}
+}
+
+// uploaded writes the checksums of a completed upload and runs the OnUpload
+// hook without blocking the server.
+func (tftp *TFTPServer) uploaded(cli *client) {
+	tftp.forgetHead(cli)
+	sums := cli.sums()
+	if tftp.ChecksumSidecar && cli.sink == nil {
+		writeSidecars(cli.path(cli.filename), sums)
+	}
+	if tftp.OnUpload == nil {
+		return
+	}
+
+	path := cli.path(cli.filename)
+	if cli.sink != nil {
+		path = ""
+	}
+	info := UploadInfo{
+		Session:   cli.id,
+		Path:      path,
+		Client:    cli.tid,
+		Bytes:     cli.bytes,
+		Duration:  tftp.now().Sub(cli.start),
+		Checksums: sums,
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("[%v] Upload hook for '%v' panicked: %v\n", info.Session, info.Path, r)
+			}
+		}()
+		tftp.OnUpload(info)
+	}()
+}
+
+// ReadRequest is passed to the OnRead hook before a download starts.
+type ReadRequest struct {
+	// Session is the ID of the session in the log and the audit records.
+	Session string
+	Client  net.Addr
+	Options wire.Options
+	// Filename can be changed to serve another file.
+	Filename string
+	// Reader, if set by the hook, is served instead of a file and closed
+	// afterwards if it's an io.Closer. Size is its length, -1 if unknown:
+	// the tsize option isn't acknowledged then and the reader is read
+	// ahead in another goroutine until EOF, so it may block, e.g. a pipe.
+	Reader io.Reader
+	Size   int64
+}
+
+// preRead runs the OnRead hook, an error rejects the download.
+func (tftp *TFTPServer) preRead(cli *client, req *request) error {
+	if tftp.OnRead == nil {
+		return nil
+	}
+
+	rr := &ReadRequest{
+		Session:  cli.id,
+		Client:   cli.tid,
+		Options:  req.options,
+		Filename: req.filename,
+		Size:     -1,
+	}
+	err := tftp.OnRead(rr)
+	if err != nil {
+		var tftpErr *Error
+		if !errors.As(err, &tftpErr) {
+			cli.logf("Read of '%v' rejected: '%v'\n", req.filename, err)
+			tftpErr = ErrAccessViolation
+		}
+		return tftpErr
+	}
+
+	req.filename = rr.Filename
+	if rr.Reader != nil {
+		cli.reader = rr.Reader
+		cli.setSize(rr.Size)
+		// sources of unknown length may block, e.g. pipes
+		if rr.Size < 0 {
+			s := newStreamReader(rr.Reader, 2*cli.blockSize)
+			cli.reader = s
+			return tftp.spawn(s.fill)
+		}
+	}
+	return nil
+}
+
+// startScan creates the scanner of an upload, see TFTPServer.Scan.
+func (tftp *TFTPServer) startScan(cli *client, req *request) error {
+	if tftp.Scan == nil {
+		return nil
+	}
+
+	scanner, err := tftp.Scan(cli.tid, req.filename)
+	if err != nil {
+		cli.logf("Upload of '%v' rejected: '%v'\n", req.filename, err)
+		return ErrAccessViolation
+	}
+	cli.scanner = scanner
+	return nil
+}
+
+// scan passes a written block to the scanner, which gives its verdict when
+// it's closed after the last one. Rejected uploads are removed.
+func (cli *client) scan(block []byte, last bool) error {
+	if cli.scanner == nil {
+		return nil
+	}
+
+	_, err := cli.scanner.Write(block)
+	if err == nil && last {
+		err = cli.scanner.Close()
+		cli.scanner = nil
+	}
+	if err == nil {
+		return nil
+	}
+
+	cli.logf("Upload of '%v' rejected: '%v'\n", cli.filename, err)
+	cli.discardUpload()
+	return ErrAccessViolation
+}
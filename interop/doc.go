@@ -0,0 +1,7 @@
+// Package interop tests the server and the client against other TFTP
+// implementations, tftp-hpa, atftp, dnsmasq and the busybox client, run in
+// Docker containers. It needs a Linux host with Docker and is behind the
+// interop build tag:
+//
+//	go test -tags interop ./interop
+package interop
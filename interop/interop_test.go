@@ -0,0 +1,240 @@
+//go:build interop
+
+package interop
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd"
+	"git.scarlet.house/oss/go-tftpd/client"
+)
+
+const image = "go-tftpd-interop"
+
+// Sizes around the block boundaries, and a file of more than 2048 blocks
+// of 512 bytes.
+var sizes = map[string]int{
+	"empty": 0,
+	"one":   1,
+	"block": 512,
+	"odd":   513,
+	"big":   1<<20 + 7,
+}
+
+func TestMain(m *testing.M) {
+	out, err := exec.Command("docker", "build", "-q", "-t", image, "testdata").CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Building the image failed: %v %s\n", err, out)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// writeFiles writes the test files to dir and returns their contents.
+func writeFiles(t *testing.T, dir string) map[string][]byte {
+	files := make(map[string][]byte)
+	for name, size := range sizes {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i*7 + size)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = data
+	}
+	// the containers run the servers and clients as other users
+	os.Chmod(dir, 0777)
+	return files
+}
+
+// freePort returns a UDP port which was free a moment ago.
+func freePort(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func compare(t *testing.T, path string, want []byte) {
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Incorrect content of %v, %v bytes instead of %v\n", filepath.Base(path), len(got), len(want))
+	}
+}
+
+// TestClients transfers the files between the server and the clients of
+// the other implementations.
+func TestClients(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// the commands download remote to local and upload local to remote
+		get, put func(port, remote, local string) []string
+	}{
+		{
+			name: "tftp-hpa",
+			get: func(port, remote, local string) []string {
+				return []string{"tftp", "-m", "binary", "127.0.0.1", port, "-c", "get", remote, local}
+			},
+			put: func(port, remote, local string) []string {
+				return []string{"tftp", "-m", "binary", "127.0.0.1", port, "-c", "put", local, remote}
+			},
+		},
+		{
+			name: "atftp",
+			get: func(port, remote, local string) []string {
+				return []string{"atftp", "--get", "-r", remote, "-l", local, "--option", "blksize 1428", "--option", "tsize", "127.0.0.1", port}
+			},
+			put: func(port, remote, local string) []string {
+				return []string{"atftp", "--put", "-r", remote, "-l", local, "--option", "blksize 1428", "127.0.0.1", port}
+			},
+		},
+		{
+			name: "busybox",
+			get: func(port, remote, local string) []string {
+				return []string{"busybox", "tftp", "-g", "-r", remote, "-l", local, "-b", "1428", "127.0.0.1", port}
+			},
+			put: func(port, remote, local string) []string {
+				return []string{"busybox", "tftp", "-p", "-r", remote, "-l", local, "-b", "1428", "127.0.0.1", port}
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			root, out := t.TempDir(), t.TempDir()
+			files := writeFiles(t, root)
+			os.Chmod(out, 0777)
+
+			port := freePort(t)
+			server, err := tftpd.NewTFTPServer(port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server.Root = root
+			go server.ListenAndServe()
+			defer server.Close()
+
+			for name, data := range files {
+				run(t, out, c.get(port, name, "/out/"+name))
+				compare(t, filepath.Join(out, name), data)
+
+				remote := name + "." + c.name
+				run(t, out, c.put(port, remote, "/out/"+name))
+				compare(t, filepath.Join(root, remote), data)
+			}
+		})
+	}
+}
+
+// run runs a client command in a container, out is mounted as /out.
+func run(t *testing.T, out string, command []string) {
+	args := append([]string{"run", "--rm", "--network", "host", "-v", out + ":/out", image}, command...)
+	if output, err := exec.Command("docker", args...).CombinedOutput(); err != nil {
+		t.Fatalf("%v failed: %v %s\n", strings.Join(command, " "), err, output)
+	}
+}
+
+// TestServers transfers the files between the client and the servers of
+// the other implementations.
+func TestServers(t *testing.T) {
+	for _, s := range []struct {
+		name string
+		// the command serves /srv on the port
+		command func(port string) []string
+		// dnsmasq only listens on port 69
+		port string
+		// dnsmasq doesn't take uploads
+		readOnly bool
+	}{
+		{
+			name: "tftp-hpa",
+			command: func(port string) []string {
+				return []string{"in.tftpd", "-L", "-c", "-u", "root", "-a", "127.0.0.1:" + port, "-s", "/srv"}
+			},
+		},
+		{
+			name: "atftpd",
+			command: func(port string) []string {
+				return []string{"atftpd", "--daemon", "--no-fork", "--user", "root.root", "--bind-address", "127.0.0.1", "--port", port, "/srv"}
+			},
+		},
+		{
+			name: "dnsmasq",
+			command: func(port string) []string {
+				return []string{"dnsmasq", "--keep-in-foreground", "--port=0", "--user=root", "--enable-tftp", "--tftp-root=/srv", "--listen-address=127.0.0.1", "--bind-interfaces"}
+			},
+			port:     "69",
+			readOnly: true,
+		},
+	} {
+		t.Run(s.name, func(t *testing.T) {
+			root := t.TempDir()
+			files := writeFiles(t, root)
+
+			port := s.port
+			if port == "" {
+				port = freePort(t)
+			}
+			args := append([]string{"run", "-d", "--rm", "--network", "host", "-v", root + ":/srv", image}, s.command(port)...)
+			id, err := exec.Command("docker", args...).Output()
+			if err != nil {
+				t.Fatalf("Starting %v failed: %v\n", s.name, err)
+			}
+			defer exec.Command("docker", "rm", "-f", strings.TrimSpace(string(id))).Run()
+
+			cli := client.New("127.0.0.1:" + port)
+			cli.Timeout = time.Second
+			waitForServer(t, cli)
+
+			for _, blockSize := range []int{512, 1428} {
+				cli.BlockSize = blockSize
+				for name, data := range files {
+					var buf bytes.Buffer
+					if _, err := cli.Get(name, &buf); err != nil {
+						t.Fatalf("Get of %v with blksize %v failed: %v\n", name, blockSize, err)
+					}
+					if !bytes.Equal(buf.Bytes(), data) {
+						t.Fatalf("Incorrect download of %v with blksize %v, %v bytes instead of %v\n", name, blockSize, buf.Len(), len(data))
+					}
+					if s.readOnly {
+						continue
+					}
+
+					remote := fmt.Sprintf("%v.%d", name, blockSize)
+					if _, err := cli.Put(remote, bytes.NewReader(data)); err != nil {
+						t.Fatalf("Put of %v with blksize %v failed: %v\n", remote, blockSize, err)
+					}
+					compare(t, filepath.Join(root, remote), data)
+				}
+			}
+		})
+	}
+}
+
+// waitForServer waits until the container serves files.
+func waitForServer(t *testing.T, cli *client.Client) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, err := cli.Get("one", &bytes.Buffer{})
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server not ready: %v\n", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,338 @@
+package tftpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// Bytes received between two records of an upload in the journal.
+const journalInterval = 1 << 20
+
+// JournalEntry is an upload in progress, Offset is how much of it is on
+// disk for sure.
+type JournalEntry struct {
+	Client netip.Addr `json:"client"`
+	Path   string     `json:"path"`
+	Offset int64      `json:"offset"`
+	Time   time.Time  `json:"time"`
+}
+
+type journalKey struct {
+	client netip.Addr
+	path   string
+}
+
+// Journal keeps track of uploads in progress across restarts, see
+// TFTPServer.Journal. It's safe to share between servers.
+//
+// The file is a log of JSON lines, entries and removals, which the last
+// line of an upload wins. It's appended to by a goroutine of its own, so
+// the packet loop never waits for the disk, and compacted once it's
+// mostly outdated. A compaction truncates the file before writing it
+// again, a crash can lose entries then but never bring removed ones back.
+// The file is written in place, so it works in a chroot too.
+type Journal struct {
+	mu      sync.Mutex
+	maxAge  time.Duration
+	entries map[journalKey]JournalEntry
+	pending []journalJob
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+
+	// only used by the writer
+	f     *os.File
+	size  int64
+	lines int
+}
+
+// journalLine is a line of the journal file.
+type journalLine struct {
+	JournalEntry
+	Removed bool `json:"removed,omitempty"`
+}
+
+// journalJob appends a line once file, if set, is synced, so the journal
+// never claims more than what's on disk. The file is closed after if the
+// job owns it.
+type journalJob struct {
+	line  []byte
+	file  *os.File
+	close bool
+}
+
+// Lines appended beyond twice the entries before the journal is compacted.
+const journalSlack = 64
+
+// OpenJournal reads the journal at path, creating it if needed. Entries
+// older than maxAge are dropped, now and whenever it's written.
+func OpenJournal(path string, maxAge time.Duration) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		f:       f,
+		maxAge:  maxAge,
+		entries: make(map[journalKey]JournalEntry),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var l journalLine
+		// a line torn by a crash is skipped
+		if json.Unmarshal(scanner.Bytes(), &l) != nil || l.Path == "" {
+			continue
+		}
+		key := journalKey{l.Client, l.Path}
+		if l.Removed {
+			delete(j.entries, key)
+		} else {
+			j.entries[key] = l.JournalEntry
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.prune(time.Now())
+	if err := j.compact(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	go j.write()
+	return j, nil
+}
+
+// Entries returns the uploads in progress.
+func (j *Journal) Entries() []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := make([]JournalEntry, 0, len(j.entries))
+	for _, e := range j.entries {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (j *Journal) lookup(client netip.Addr, path string) (JournalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e, ok := j.entries[journalKey{client, path}]
+	return e, ok
+}
+
+// record adds or updates the entry, it's written once file is synced.
+func (j *Journal) record(e JournalEntry, file *os.File, close bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries[journalKey{e.Client, e.Path}] = e
+	j.prune(e.Time)
+	j.queue(journalLine{JournalEntry: e}, file, close)
+}
+
+func (j *Journal) remove(client netip.Addr, path string, now time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.entries, journalKey{client, path})
+	j.prune(now)
+	j.queue(journalLine{JournalEntry: JournalEntry{Client: client, Path: path, Time: now}, Removed: true}, nil, false)
+}
+
+// prune drops the entries older than maxAge, the file forgets them on the
+// next compaction.
+func (j *Journal) prune(now time.Time) {
+	for key, e := range j.entries {
+		if j.maxAge > 0 && now.Sub(e.Time) > j.maxAge {
+			delete(j.entries, key)
+		}
+	}
+}
+
+// queue passes a line to the writer, j.mu is held.
+func (j *Journal) queue(l journalLine, file *os.File, close bool) {
+	if j.closed {
+		if close {
+			file.Close()
+		}
+		return
+	}
+	line, _ := json.Marshal(l)
+	j.pending = append(j.pending, journalJob{line: append(line, '\n'), file: file, close: close})
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// write appends the queued lines until the journal is closed.
+func (j *Journal) write() {
+	defer close(j.done)
+	for range j.wake {
+		j.mu.Lock()
+		jobs := j.pending
+		j.pending = nil
+		j.mu.Unlock()
+		if err := j.flush(jobs); err != nil {
+			log.Printf("error while writing journal: '%v'\n", err)
+		}
+	}
+}
+
+// flush syncs the files of the jobs and then appends their lines with a
+// single sync of the journal.
+func (j *Journal) flush(jobs []journalJob) error {
+	var b bytes.Buffer
+	lines := 0
+	for _, job := range jobs {
+		if job.file != nil {
+			err := job.file.Sync()
+			if job.close {
+				job.file.Close()
+			}
+			// the upload ended meanwhile, its last entry follows
+			if errors.Is(err, os.ErrClosed) {
+				continue
+			} else if err != nil {
+				log.Printf("error while syncing upload for the journal: '%v'\n", err)
+				continue
+			}
+		}
+		b.Write(job.line)
+		lines++
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	if _, err := j.f.WriteAt(b.Bytes(), j.size); err != nil {
+		return err
+	}
+	j.size += int64(b.Len())
+	j.lines += lines
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	outdated := j.lines > 2*len(j.entries)+journalSlack
+	j.mu.Unlock()
+	if outdated {
+		return j.compact()
+	}
+	return nil
+}
+
+// compact writes the entries over the file, it's empty or a part of them
+// if that's interrupted.
+func (j *Journal) compact() error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	j.mu.Lock()
+	for _, e := range j.entries {
+		enc.Encode(journalLine{JournalEntry: e})
+	}
+	lines := len(j.entries)
+	j.mu.Unlock()
+
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.f.WriteAt(b.Bytes(), 0); err != nil {
+		return err
+	}
+	j.size, j.lines = int64(b.Len()), lines
+	return j.f.Sync()
+}
+
+// Close writes the queued lines and closes the file.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	j.closed = true
+	j.mu.Unlock()
+	close(j.wake)
+	<-j.done
+	return j.f.Close()
+}
+
+// checkJournal looks for an upload of the file by the client which was
+// interrupted, e.g. by a restart. It can be resumed from the offset in the
+// journal, or restarted by a plain WRQ instead of being a conflict.
+func (tftp *TFTPServer) checkJournal(cli *client, req *request) {
+	if tftp.Journal == nil || cli.sink != nil {
+		return
+	}
+	path := cli.path(req.filename)
+	e, ok := tftp.Journal.lookup(addrIP(cli.tid), path)
+	if !ok {
+		return
+	}
+	if !exists(path) {
+		tftp.Journal.remove(e.Client, path, tftp.now())
+		return
+	}
+	cli.logf("Continuing interrupted upload of '%v' at %d bytes\n", req.filename, e.Offset)
+	cli.partial = &e
+}
+
+// journal records how much of an upload is on disk, every journalInterval
+// bytes unless forced. The file is synced by the writer of the journal
+// before the entry is written.
+func (tftp *TFTPServer) journal(cli *client, force bool) {
+	tftp.journalFile(cli, force, false)
+}
+
+// journalFile is journal, with handOver the file is closed by the writer
+// of the journal instead of the session.
+func (tftp *TFTPServer) journalFile(cli *client, force, handOver bool) {
+	if tftp.Journal == nil || cli.file == nil {
+		return
+	}
+	offset := cli.offset + cli.bytes
+	if !force && offset-cli.journaled < journalInterval {
+		return
+	}
+	// the blocks written through io_uring have to reach the file first
+	if err := cli.flushWrites(); err != nil {
+		return
+	}
+	cli.journaled = offset
+	tftp.Journal.record(JournalEntry{
+		Client: addrIP(cli.tid),
+		Path:   cli.path(cli.filename),
+		Offset: offset,
+		Time:   tftp.now(),
+	}, cli.file, handOver)
+	if handOver {
+		cli.file = nil
+	}
+}
+
+// journalEnd drops completed uploads from the journal and records where
+// failed ones can be resumed, before the file is closed.
+func (tftp *TFTPServer) journalEnd(cli *client) {
+	if tftp.Journal == nil || !cli.inited || cli.opcode != wire.OpWRQ || cli.sink != nil {
+		return
+	}
+	path := cli.path(cli.filename)
+	switch {
+	case cli.failure == nil, tftp.RemovePartialUploads && !cli.append && !cli.resume:
+		tftp.Journal.remove(addrIP(cli.tid), path, tftp.now())
+	case tftp.RemovePartialUploads:
+		// truncated to where the session started
+		tftp.Journal.record(JournalEntry{Client: addrIP(cli.tid), Path: path, Offset: cli.offset, Time: tftp.now()}, nil, false)
+	default:
+		// the file has to be synced after the session ends
+		tftp.journalFile(cli, true, true)
+	}
+}
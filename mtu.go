@@ -0,0 +1,64 @@
+package tftpd
+
+import "net"
+
+// Headers in front of the block of a DATA packet: IP, UDP and TFTP.
+const (
+	dataOverheadIPv4 = 20 + 8 + 4
+	dataOverheadIPv6 = 40 + 8 + 4
+)
+
+// mtuBlockSize returns the biggest block size which isn't fragmented on
+// the way to the client, zero if it's unknown.
+func (tftp *TFTPServer) mtuBlockSize(addr net.Addr) int {
+	udp, ok := addr.(*net.UDPAddr)
+	if tftp.MTU < 0 || !ok {
+		return 0
+	}
+	mtu := tftp.MTU
+	if mtu == 0 {
+		mtu = interfaceMTU(udp)
+	}
+	if mtu == 0 {
+		return 0
+	}
+
+	size := mtu - dataOverheadIPv6
+	if udp.IP.To4() != nil {
+		size = mtu - dataOverheadIPv4
+	}
+	// every client copes with the default
+	if size < defaultBlockSize {
+		size = defaultBlockSize
+	}
+	return size
+}
+
+// interfaceMTU returns the MTU of the interface packets to the client are
+// sent from, zero if it can't be found. Connecting a UDP socket picks the
+// route without sending anything.
+func interfaceMTU(client *net.UDPAddr) int {
+	conn, err := net.DialUDP("udp", nil, client)
+	if err != nil {
+		return 0
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(local) {
+				return iface.MTU
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+package tftpd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+const (
+	defaultBlockSize = 512
+	// limits of the blksize option (RFC 2348)
+	minBlockSize = 8
+	maxBlockSize = 65464
+	// limits of the utimeout option in microseconds, 10ms to 255s
+	minUTimeout = 10000
+	maxUTimeout = 255000000
+)
+
+// maxBlockSize returns the biggest block size the server agrees to with
+// the client.
+func (tftp *TFTPServer) maxBlockSize(cli *client) int {
+	buffers := tftp.datagramSize() - wire.HeaderSize
+	limit := buffers
+	if tftp.MaxBlockSize > 0 && tftp.MaxBlockSize < limit {
+		limit = tftp.MaxBlockSize
+	}
+	if cli.policy != nil && cli.policy.MaxBlockSize > 0 && cli.policy.MaxBlockSize < buffers {
+		limit = cli.policy.MaxBlockSize
+	}
+	if mtu := tftp.mtuBlockSize(cli.tid); mtu > 0 && mtu < limit {
+		limit = mtu
+	}
+	return limit
+}
+
+// negotiate handles the options of a RRQ or WRQ (RFC 2347) and prepares the
+// OACK. Values the server can lower (blksize) are lowered, values it can't
+// satisfy fail the negotiation. Unknown options are ignored.
+func (tftp *TFTPServer) negotiate(cli *client, req *request) error {
+	for _, opt := range req.options {
+		switch strings.ToLower(opt.Name) {
+		case "blksize":
+			size, err := strconv.Atoi(opt.Value)
+			if err != nil || size < minBlockSize || size > maxBlockSize {
+				return optionError(opt)
+			}
+			if limit := tftp.maxBlockSize(cli); size > limit {
+				size = limit
+			}
+			cli.blockSize = size
+			cli.oack.Set(opt.Name, strconv.Itoa(size))
+
+		case "tsize":
+			size, err := strconv.ParseInt(opt.Value, 10, 64)
+			if err != nil || size < 0 {
+				return optionError(opt)
+			}
+			if req.opcode == wire.OpWRQ {
+				if err := cli.checkSize(cli.offset + size); err != nil {
+					return err
+				}
+			}
+			// the size of a RRQ is filled in once the file is opened
+			cli.oack.Set(opt.Name, strconv.FormatInt(size, 10))
+
+		case "timeout":
+			secs, err := strconv.Atoi(opt.Value)
+			if err != nil || secs < 1 || secs > 255 {
+				return optionError(opt)
+			}
+			// utimeout is more precise, whatever the order
+			if _, ok := req.options.Get("utimeout"); !ok {
+				cli.timeout = time.Duration(secs) * time.Second
+			}
+			cli.oack.Set(opt.Name, opt.Value)
+
+		case "utimeout":
+			// microseconds, a de-facto extension (tftp-hpa) for fast LANs
+			usecs, err := strconv.ParseInt(opt.Value, 10, 64)
+			if err != nil || usecs < minUTimeout || usecs > maxUTimeout {
+				return optionError(opt)
+			}
+			cli.timeout = time.Duration(usecs) * time.Microsecond
+			cli.oack.Set(opt.Name, opt.Value)
+
+		case "windowsize":
+			size, err := strconv.Atoi(opt.Value)
+			if err != nil || size < 1 || size > maxWindowSize {
+				return optionError(opt)
+			}
+			if limit := tftp.maxWindowSize(); size > limit {
+				size = limit
+			}
+			cli.windowSize, cli.cwnd = size, size
+			cli.oack.Set(opt.Name, strconv.Itoa(size))
+
+		case AppendOption:
+			if err := tftp.negotiateAppend(cli, req, opt); err != nil {
+				return err
+			}
+
+		case ResumeOption:
+			if err := tftp.negotiateResume(cli, opt); err != nil {
+				return err
+			}
+
+		case GzipOption:
+			if err := tftp.negotiateGzip(cli, req, opt); err != nil {
+				return err
+			}
+
+		case PSKOption:
+			if err := tftp.negotiatePSK(cli, opt); err != nil {
+				return err
+			}
+
+		case DigestOption:
+			if !tftp.Digest {
+				continue
+			}
+			if req.opcode == wire.OpWRQ {
+				sum, err := hex.DecodeString(opt.Value)
+				if err != nil || len(sum) != sha256.Size {
+					return optionError(opt)
+				}
+				cli.digest, cli.wantDigest = sha256.New(), hex.EncodeToString(sum)
+			}
+			// the digest of a RRQ is filled in once the file is opened
+			cli.oack.Set(opt.Name, opt.Value)
+		}
+	}
+
+	return tftp.checkPSK(cli)
+}
+
+func optionError(opt wire.Option) error {
+	return NewError(CodeOptionNegotiation, fmt.Sprintf("Incorrect value '%v' of option '%v'.", opt.Value, opt.Name))
+}
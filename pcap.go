@@ -0,0 +1,198 @@
+package tftpd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pcapMagic   = 0xa1b2c3d4
+	pcapSnapLen = 65535
+	// LINKTYPE_RAW, packets start with the IP header
+	pcapLinkRaw = 101
+)
+
+// PcapWriter writes datagrams in the pcap format, with made up IP and UDP
+// headers around them, so captures can be opened in Wireshark. It's safe
+// to share between servers.
+type PcapWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+// NewPcapWriter writes the pcap file header to w.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkRaw)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WritePacket records a datagram sent from src to dst. Addresses which
+// aren't UDP addresses are recorded as 0.0.0.0:0.
+func (p *PcapWriter) WritePacket(ts time.Time, src, dst net.Addr, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	srcIP, srcPort := udpAddr(src)
+	dstIP, dstPort := udpAddr(dst)
+	v4 := dstIP.To4() != nil || srcIP.To4() != nil
+	if v4 {
+		srcIP, dstIP = to4(srcIP), to4(dstIP)
+	} else {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	b := p.buf[:0]
+	b = append(b, make([]byte, 16)...)
+	if v4 {
+		b = appendIPv4Header(b, srcIP, dstIP, 8+len(payload))
+	} else {
+		b = appendIPv6Header(b, srcIP, dstIP, 8+len(payload))
+	}
+	udp := len(b)
+	b = binary.BigEndian.AppendUint16(b, uint16(srcPort))
+	b = binary.BigEndian.AppendUint16(b, uint16(dstPort))
+	b = binary.BigEndian.AppendUint16(b, uint16(8+len(payload)))
+	b = append(b, 0, 0)
+	b = append(b, payload...)
+	binary.BigEndian.PutUint16(b[udp+6:], udpChecksum(srcIP, dstIP, b[udp:]))
+
+	n := len(b) - 16
+	binary.LittleEndian.PutUint32(b[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(b[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(b[8:], uint32(n))
+	binary.LittleEndian.PutUint32(b[12:], uint32(n))
+	p.buf = b
+
+	_, err := p.w.Write(b)
+	return err
+}
+
+func udpAddr(addr net.Addr) (net.IP, int) {
+	if udp, ok := addr.(*net.UDPAddr); ok && udp.IP != nil {
+		return udp.IP, udp.Port
+	}
+	return net.IPv4zero, 0
+}
+
+// to4 maps unspecified IPv6 addresses (e.g. of dual-stack listeners) to 0.0.0.0.
+func to4(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return net.IPv4zero.To4()
+}
+
+func appendIPv4Header(b []byte, src, dst net.IP, length int) []byte {
+	start := len(b)
+	b = append(b, 0x45, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(20+length))
+	// no fragmentation, TTL 64, UDP
+	b = append(b, 0, 0, 0x40, 0, 64, 17, 0, 0)
+	b = append(b, src...)
+	b = append(b, dst...)
+	binary.BigEndian.PutUint16(b[start+10:], ^uint16(sum16(0, b[start:])))
+	return b
+}
+
+func appendIPv6Header(b []byte, src, dst net.IP, length int) []byte {
+	b = append(b, 0x60, 0, 0, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(length))
+	// UDP, hop limit 64
+	b = append(b, 17, 64)
+	b = append(b, src...)
+	return append(b, dst...)
+}
+
+func udpChecksum(src, dst net.IP, udp []byte) uint16 {
+	sum := sum16(0, src)
+	sum = sum16(sum, dst)
+	sum += 17 + uint32(len(udp))
+	checksum := ^uint16(sum16(sum, udp))
+	if checksum == 0 {
+		// zero means no checksum
+		return 0xffff
+	}
+	return checksum
+}
+
+// sum16 adds b as big-endian 16 bit words in one's complement arithmetic.
+func sum16(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return sum
+}
+
+var captureNameReplacer = strings.NewReplacer(":", "_", "[", "", "]", "", "/", "_")
+
+// startCapture creates the capture file of a new session in CaptureDir,
+// starting with the request which opened the session.
+func (tftp *TFTPServer) startCapture(cli *client, request []byte) {
+	if tftp.CaptureDir == "" {
+		return
+	}
+
+	name := fmt.Sprintf("%v-%v.pcap", time.Now().Format("20060102-150405.000000"), captureNameReplacer.Replace(cli.tid.String()))
+	f, err := os.Create(filepath.Join(tftp.CaptureDir, name))
+	if err != nil {
+		cli.logf("error while creating capture: '%v'\n", err)
+		return
+	}
+	w, err := NewPcapWriter(f)
+	if err != nil {
+		cli.logf("error while creating capture: '%v'\n", err)
+		f.Close()
+		return
+	}
+
+	cli.capture, cli.captureFile = w, f
+	writeCapture(w, cli.tid, tftp.listener.LocalAddr(), request)
+}
+
+// capture records a packet received from or sent to the client in the
+// global capture and the one of the session.
+func (tftp *TFTPServer) capture(cli *client, b []byte, received bool) {
+	if tftp.Capture == nil && cli.capture == nil {
+		return
+	}
+
+	src, dst := tftp.listener.LocalAddr(), cli.tid
+	if received {
+		src, dst = dst, src
+	}
+	if tftp.Capture != nil {
+		writeCapture(tftp.Capture, src, dst, b)
+	}
+	if cli.capture != nil {
+		writeCapture(cli.capture, src, dst, b)
+	}
+}
+
+func writeCapture(w *PcapWriter, src, dst net.Addr, b []byte) {
+	if err := w.WritePacket(time.Now(), src, dst, b); err != nil {
+		log.Printf("error while writing capture: '%v'\n", err)
+	}
+}
@@ -0,0 +1,85 @@
+package tftpd
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// Policy overrides the limits of the server for the files whose cleaned
+// name starts with Prefix, e.g. "images/". Zero values keep the setting of
+// the server.
+type Policy struct {
+	Prefix string
+	// MaxSize limits the size of the files uploaded or downloaded.
+	MaxSize int64
+	// MaxBlockSize, Timeout and Retries replace the ones of the server.
+	MaxBlockSize int
+	Timeout      time.Duration
+	Retries      int
+	// Bandwidth limits every transfer to that many bytes per second.
+	// Weight is the share of the Bandwidth of the server transfers get
+	// relative to the others, 1 by default.
+	Bandwidth int64
+	Weight    int
+	// OnConflict, if set, replaces the one of the server.
+	OnConflict *ConflictPolicy
+}
+
+// Policies are matched by the longest prefix.
+type Policies []Policy
+
+// Match returns the policy of the file, nil if none matches.
+func (policies Policies) Match(filename string) *Policy {
+	filename = cleanName(filename)
+
+	var match *Policy
+	for i := range policies {
+		p := &policies[i]
+		if strings.HasPrefix(filename, p.Prefix) && (match == nil || len(p.Prefix) > len(match.Prefix)) {
+			match = p
+		}
+	}
+	return match
+}
+
+var errTooBig = NewError(CodeDiskFull, "File exceeds the size limit.")
+
+// checkSize rejects transfers growing the file beyond the MaxSize of the
+// policy.
+func (cli *client) checkSize(size int64) error {
+	if cli.policy == nil || cli.policy.MaxSize <= 0 || size <= cli.policy.MaxSize {
+		return nil
+	}
+	cli.logf("'%v' exceeds the size limit of %d bytes\n", cli.filename, cli.policy.MaxSize)
+	return errTooBig
+}
+
+func (tftp *TFTPServer) onConflict(cli *client) ConflictPolicy {
+	if cli.policy != nil && cli.policy.OnConflict != nil {
+		return *cli.policy.OnConflict
+	}
+	return tftp.OnConflict
+}
+
+// paceUntil returns when the packet may be sent to stay within the
+// Bandwidth of the policy, zero if it can go now.
+func (tftp *TFTPServer) paceUntil(cli *client, packet []byte) time.Time {
+	if cli.policy == nil || cli.policy.Bandwidth <= 0 || cli.start.IsZero() || !isPaced(cli, packet) {
+		return time.Time{}
+	}
+	due := cli.start.Add(time.Duration(float64(cli.bytes) / float64(cli.policy.Bandwidth) * float64(time.Second)))
+	if !due.After(tftp.now()) {
+		return time.Time{}
+	}
+	return due
+}
+
+// isPaced reports whether the packet is held back by the bandwidth limit,
+// errors and the ACK ending an upload never are.
+func isPaced(cli *client, packet []byte) bool {
+	op := wire.Opcode(binary.BigEndian.Uint16(packet))
+	return op == wire.OpDATA || (op == wire.OpACK && !cli.lastPkt)
+}
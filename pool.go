@@ -0,0 +1,58 @@
+package tftpd
+
+import (
+	"sync"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+const (
+	// Default size of the packet buffers, big enough for requests, errors
+	// and blocks fitting an Ethernet frame.
+	bodyMaxSize = 2048
+	// Size of the biggest packet, a DATA packet with the largest blksize.
+	maxDatagramSize = maxBlockSize + wire.HeaderSize
+)
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, bodyMaxSize)
+		return &buf
+	},
+}
+
+// getBuffer returns a buffer of size bytes from the pool, buffers too
+// small are replaced with bigger ones.
+func getBuffer(size int) *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	if buf != nil {
+		bufferPool.Put(buf)
+	}
+}
+
+// datagramSize returns the size of the packet buffers, fixed when the
+// server starts: MaxDatagramSize or, if unset, enough for MaxBlockSize.
+func (tftp *TFTPServer) datagramSize() int {
+	if tftp.bufferSize == 0 {
+		size := tftp.MaxDatagramSize
+		if size <= 0 {
+			size = bodyMaxSize
+			if tftp.MaxBlockSize+wire.HeaderSize > size {
+				size = tftp.MaxBlockSize + wire.HeaderSize
+			}
+		}
+		if size > maxDatagramSize {
+			size = maxDatagramSize
+		}
+		tftp.bufferSize = size
+	}
+	return tftp.bufferSize
+}
@@ -0,0 +1,135 @@
+package tftpd
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// PSKOption is the experimental vendor option which encrypts the DATA
+// payloads with a pre-shared key, see TFTPServer.PreSharedKey. The client
+// sends a random nonce of 16 bytes in hex, the server answers with its own.
+const PSKOption = "x-psk"
+
+// PSKOverhead is what the authentication tag adds to every block, blocks
+// carry that much less of the file.
+const PSKOverhead = chacha20poly1305.Overhead
+
+const pskNonceSize = 16
+
+var errPSKAuth = NewError(CodeAccessViolation, "Block failed authentication.")
+
+// PSKCipher encrypts the payloads of a transfer with XChaCha20-Poly1305.
+// The key is derived from the pre-shared key and the nonces of both ends,
+// so it's new for every transfer, the nonce of a block is its offset in
+// the transfer.
+type PSKCipher struct {
+	aead cipher.AEAD
+}
+
+// ReadPSK reads a pre-shared key from a file, surrounding whitespace is
+// trimmed so a line of random text works, e.g. from
+// "head -c 32 /dev/urandom | base64".
+func ReadPSK(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) < 16 {
+		return nil, fmt.Errorf("%v: key shorter than 16 bytes", path)
+	}
+	return b, nil
+}
+
+// NewPSKNonce returns a random nonce for the x-psk option.
+func NewPSKNonce() string {
+	b := make([]byte, pskNonceSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// NewPSKCipher returns the cipher of a transfer from the nonces of the
+// client and the server.
+func NewPSKCipher(psk []byte, clientNonce, serverNonce string) (*PSKCipher, error) {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write([]byte("go-tftpd x-psk v1"))
+	for _, v := range []string{clientNonce, serverNonce} {
+		nonce, err := hex.DecodeString(v)
+		if err != nil || len(nonce) != pskNonceSize {
+			return nil, errors.New("incorrect x-psk nonce")
+		}
+		mac.Write(nonce)
+	}
+	aead, err := chacha20poly1305.NewX(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return &PSKCipher{aead: aead}, nil
+}
+
+func (c *PSKCipher) nonce(offset int64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(offset))
+	return nonce
+}
+
+// Seal appends the encrypted block at offset to dst, plaintext and dst may
+// overlap exactly.
+func (c *PSKCipher) Seal(dst, plaintext []byte, offset int64) []byte {
+	return c.aead.Seal(dst, c.nonce(offset), plaintext, nil)
+}
+
+// Open appends the decrypted block at offset to dst, ciphertext and dst
+// may overlap exactly.
+func (c *PSKCipher) Open(dst, ciphertext []byte, offset int64) ([]byte, error) {
+	return c.aead.Open(dst, c.nonce(offset), ciphertext, nil)
+}
+
+// negotiatePSK sets up the encryption of a transfer, the option is
+// ignored without a pre-shared key.
+func (tftp *TFTPServer) negotiatePSK(cli *client, opt wire.Option) error {
+	if tftp.PreSharedKey == nil {
+		return nil
+	}
+	nonce := NewPSKNonce()
+	psk, err := NewPSKCipher(tftp.PreSharedKey, opt.Value, nonce)
+	if err != nil {
+		return optionError(opt)
+	}
+	cli.psk = psk
+	cli.oack.Set(opt.Name, nonce)
+	return nil
+}
+
+// checkPSK rejects transfers in the clear if encryption is required, and
+// blocks too small for the tag.
+func (tftp *TFTPServer) checkPSK(cli *client) error {
+	if cli.psk == nil && tftp.RequirePSK {
+		return NewError(CodeAccessViolation, "Encryption with x-psk required.")
+	}
+	if cli.psk != nil && cli.blockSize <= PSKOverhead {
+		return NewError(CodeOptionNegotiation, "Block size too small for x-psk.")
+	}
+	return nil
+}
+
+// dataSize returns how much of the file a block carries.
+func (cli *client) dataSize() int {
+	if cli.psk != nil {
+		return cli.blockSize - PSKOverhead
+	}
+	return cli.blockSize
+}
@@ -0,0 +1,74 @@
+package tftpd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// consecutive read errors after which the socket is rebuilt
+	maxReadErrors          = 3
+	defaultRelistenRetries = 10
+	minRelistenDelay       = 100 * time.Millisecond
+	maxRelistenDelay       = 30 * time.Second
+)
+
+var errNoRelisten = errors.New("Socket can't be rebuilt.")
+
+func (tftp *TFTPServer) relistenRetries() int {
+	if tftp.RelistenRetries > 0 {
+		return tftp.RelistenRetries
+	}
+	return defaultRelistenRetries
+}
+
+// newListener binds a new socket, by default to the address of the old one.
+func (tftp *TFTPServer) newListener() (net.PacketConn, error) {
+	if tftp.Relisten != nil {
+		return tftp.Relisten()
+	}
+	addr, ok := tftp.listener.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, errNoRelisten
+	}
+	return net.ListenPacket("udp", addr.String())
+}
+
+// relisten replaces the socket which failed with cause, backing off between
+// attempts. Sessions in flight keep going on the new socket if it's bound
+// to the same address, the DSCP is set on it again.
+func (tftp *TFTPServer) relisten(cause error) error {
+	tftp.listener.Close()
+
+	delay := minRelistenDelay
+	for i := 1; ; i++ {
+		conn, err := tftp.newListener()
+		if err == nil {
+			tftp.mu.Lock()
+			tftp.listener, tftp.batch = conn, newBatchConn(conn)
+			tftp.mu.Unlock()
+			log.Printf("Socket rebuilt on %v after '%v'\n", conn.LocalAddr(), cause)
+			if tftp.dscp != 0 {
+				if err := tftp.applyDSCP(); err != nil {
+					log.Printf("error while setting the DSCP: '%v'\n", err)
+				}
+			}
+			return nil
+		}
+		if errors.Is(err, errNoRelisten) || i >= tftp.relistenRetries() {
+			return fmt.Errorf("Can't rebuild the socket after '%v': %w", cause, err)
+		}
+		log.Printf("error while rebuilding the socket: '%v'\n", err)
+
+		tftp.sleep(delay)
+		if tftp.closed.Load() {
+			return nil
+		}
+		if delay *= 2; delay > maxRelistenDelay {
+			delay = maxRelistenDelay
+		}
+	}
+}
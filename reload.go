@@ -0,0 +1,23 @@
+package tftpd
+
+// Reconfigure changes the configuration of a running server. f is called
+// from the packet loop before the packets received next are handled, so it
+// may change any exported field: new sessions see all of the changes at once,
+// sessions in flight keep going.
+func (tftp *TFTPServer) Reconfigure(f func(*TFTPServer)) {
+	tftp.mu.Lock()
+	tftp.reconfigure = append(tftp.reconfigure, f)
+	tftp.mu.Unlock()
+	tftp.wake()
+}
+
+func (tftp *TFTPServer) applyReconfigure() {
+	tftp.mu.Lock()
+	pending := tftp.reconfigure
+	tftp.reconfigure = nil
+	tftp.mu.Unlock()
+
+	for _, f := range pending {
+		f(tftp)
+	}
+}
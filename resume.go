@@ -0,0 +1,96 @@
+package tftpd
+
+import (
+	"io"
+	"os"
+	"strconv"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// ResumeOption is the vendor option with which clients resume interrupted
+// transfers, see TFTPServer.Resume. With a RRQ its value is the byte
+// offset the download starts at, the blocks are numbered from 1 as usual.
+// With a WRQ it's the number of bytes the client could skip, the server
+// acknowledges how many of them it has and the upload continues there. Only
+// uploads recorded in the Journal are continued, others start at zero.
+const ResumeOption = "x-offset"
+
+func (tftp *TFTPServer) negotiateResume(cli *client, opt wire.Option) error {
+	if !tftp.Resume {
+		return nil
+	}
+	offset, err := strconv.ParseInt(opt.Value, 10, 64)
+	if err != nil || offset < 0 {
+		return optionError(opt)
+	}
+	cli.resume, cli.offset = true, offset
+	cli.oack.Set(opt.Name, opt.Value)
+	return nil
+}
+
+// checkResume only lets uploads continue which the journal has a record
+// of for the client, others start from the beginning and follow the rules
+// for files which exist like any upload, so x-offset can't overwrite them.
+func (tftp *TFTPServer) checkResume(cli *client, req *request) {
+	if !cli.resume || cli.partial != nil {
+		return
+	}
+	cli.logf("Client '%v' can't resume '%v' without a journal record\n", cli.tid.String(), req.filename)
+	cli.resume, cli.offset = false, 0
+	cli.oack.Set(ResumeOption, "0")
+}
+
+// openResume opens the file of a resumed upload, creating it if needed,
+// and continues after the bytes both sides have and the journal recorded.
+func (cli *client) openResume(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// what's written after the last journal record may not have hit the disk
+	if cli.partial.Offset < cli.offset {
+		cli.offset = cli.partial.Offset
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		if fi.Size() < cli.offset {
+			cli.offset = fi.Size()
+		}
+		err = f.Truncate(cli.offset)
+	}
+	if err == nil {
+		_, err = f.Seek(cli.offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cli.oack.Set(ResumeOption, strconv.FormatInt(cli.offset, 10))
+	return f, nil
+}
+
+// skip moves a resumed download to its offset.
+func (cli *client) skip() error {
+	if !cli.resume || cli.offset == 0 {
+		return nil
+	}
+	opt := wire.Option{Name: ResumeOption, Value: strconv.FormatInt(cli.offset, 10)}
+	if cli.bytesLeft >= 0 && cli.offset > cli.bytesLeft {
+		return optionError(opt)
+	}
+
+	if s, ok := cli.reader.(io.Seeker); ok {
+		if _, err := s.Seek(cli.offset, io.SeekStart); err != nil {
+			return err
+		}
+	} else if _, err := io.CopyN(io.Discard, cli.reader, cli.offset); err == io.EOF {
+		return optionError(opt)
+	} else if err != nil {
+		return err
+	}
+	if cli.bytesLeft >= 0 {
+		cli.bytesLeft -= cli.offset
+	}
+	return nil
+}
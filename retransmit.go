@@ -0,0 +1,172 @@
+package tftpd
+
+import (
+	"math/rand"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	defaultTimeout = time.Second
+	defaultRetries = 5
+	// limit of the timeout growing with Backoff
+	defaultMaxTimeout = time.Minute
+)
+
+func (tftp *TFTPServer) timeout(cli *client) time.Duration {
+	switch {
+	case cli.timeout > 0:
+		return cli.timeout
+	case cli.policy != nil && cli.policy.Timeout > 0:
+		return cli.policy.Timeout
+	case tftp.Timeout > 0:
+		return tftp.Timeout
+	}
+	return defaultTimeout
+}
+
+// retryDeadline returns when the packet just sent is retransmitted. The
+// timeout of the server grows with every retransmission by Backoff, a
+// timeout negotiated by the client is used as is. Jitter spreads out the
+// retransmissions of clients which hit loss at the same moment.
+func (tftp *TFTPServer) retryDeadline(cli *client, now time.Time) time.Time {
+	timeout := tftp.timeout(cli)
+	if cli.timeout == 0 && tftp.Backoff > 1 {
+		limit := tftp.MaxTimeout
+		if limit <= 0 {
+			limit = defaultMaxTimeout
+		}
+		for i := 0; i < cli.tries && timeout < limit; i++ {
+			timeout = time.Duration(float64(timeout) * tftp.Backoff)
+		}
+		if timeout > limit {
+			timeout = limit
+		}
+	}
+	if tftp.Jitter > 0 {
+		timeout += time.Duration((2*rand.Float64() - 1) * tftp.Jitter * float64(timeout))
+	}
+	return now.Add(timeout)
+}
+
+func (tftp *TFTPServer) retries(cli *client) int {
+	if cli.policy != nil && cli.policy.Retries > 0 {
+		return cli.policy.Retries
+	}
+	if tftp.Retries > 0 {
+		return tftp.Retries
+	}
+	return defaultRetries
+}
+
+// nextDeadline returns the earliest retransmission deadline of all sessions,
+// zero if there is nothing to wait for.
+func (tftp *TFTPServer) nextDeadline() time.Time {
+	var next time.Time
+	for _, cli := range tftp.connections {
+		if !cli.deadline.IsZero() && (next.IsZero() || cli.deadline.Before(next)) {
+			next = cli.deadline
+		}
+	}
+	if len(tftp.fair) > 0 && (next.IsZero() || tftp.fairDue.Before(next)) {
+		next = tftp.fairDue
+	}
+	return next
+}
+
+// retransmit resends the last packet of sessions which haven't heard from
+// their client in time and ends the ones which ran out of retries.
+func (tftp *TFTPServer) retransmit(now time.Time) {
+	tftp.releaseFair(now)
+	for _, cli := range tftp.connections {
+		if cli.deadline.IsZero() || now.Before(cli.deadline) {
+			continue
+		}
+		if cli.held {
+			tftp.sendHeld(cli)
+			continue
+		}
+		if cli.waiting {
+			tftp.pollStream(cli, now)
+			continue
+		}
+
+		// after the final ACK of an upload the session only waits for
+		// retransmissions of the last DATA, it's done once they stop
+		dallying := cli.lastPkt && cli.opcode == wire.OpWRQ
+
+		if cli.tries >= tftp.retries(cli) {
+			if !dallying {
+				cli.logf("Client '%v' timed out.\n", cli.tid.String())
+				cli.failure = errTimedOut
+			}
+			tftp.endSession(cli)
+			continue
+		}
+
+		cli.tries++
+		if dallying {
+			cli.deadline = tftp.retryDeadline(cli, now)
+			continue
+		}
+		// every timeout of a window shrinks it
+		cli.shrinkWindow(cli.block)
+		tftp.resend(cli)
+	}
+}
+
+// resend queues the last packet of the session again, or the DATA of the
+// window from the first one not acknowledged.
+func (tftp *TFTPServer) resend(cli *client) {
+	packets := cli.unacked
+	if len(packets) > cli.sendWindow() {
+		packets = packets[:cli.sendWindow()]
+	}
+	if len(packets) == 0 {
+		packets = []sentPacket{{packet: cli.sent}}
+	}
+	if packets[0].packet == nil || cli.held {
+		return
+	}
+
+	for _, p := range packets {
+		tftp.counters.retransmits.Add(1)
+		cli.retransmits++
+		tftp.outgoing = append(tftp.outgoing, ipv4.Message{
+			Buffers: [][]byte{p.packet},
+			Addr:    cli.tid,
+		})
+		tftp.capture(cli, p.packet, false)
+	}
+	cli.deadline = tftp.retryDeadline(cli, tftp.now())
+}
+
+// sendHeld queues the packet held back by the bandwidth limit of the
+// policy, unless the one of the server holds it back too.
+func (tftp *TFTPServer) sendHeld(cli *client) {
+	if !tftp.shape(cli, cli.lastSent()) {
+		cli.deadline = time.Time{}
+		return
+	}
+	tftp.sendPaced(cli)
+}
+
+// sendPaced queues the packet held back by the bandwidth limits, and fills
+// the rest of the window.
+func (tftp *TFTPServer) sendPaced(cli *client) {
+	cli.held = false
+	packet := cli.lastSent()
+	tftp.outgoing = append(tftp.outgoing, ipv4.Message{
+		Buffers: [][]byte{packet},
+		Addr:    cli.tid,
+	})
+	tftp.capture(cli, packet, false)
+	cli.deadline = tftp.retryDeadline(cli, tftp.now())
+	if cli.windowSize > 1 && cli.opcode == wire.OpRRQ {
+		if err := tftp.fillWindow(cli); err != nil {
+			tftp.handleError(cli, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package tftpd
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/tftptest"
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// TestResendUnacknowledged checks that a DATA which isn't acknowledged is sent again
+// Retries times and that the session ends then.
+func TestResendUnacknowledged(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.WriteFile(dir+"/f", []byte("abc"), 0644)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	conn, _ := network.ListenPacket("client")
+	server := NewTFTPServerConn(listener)
+	server.Timeout = 20 * time.Millisecond
+	server.Retries = 2
+	go server.ListenAndServe()
+	defer server.Close()
+
+	rrq, _ := wire.Marshal(&wire.ReadRequest{Filename: "f", Mode: "octet"})
+	conn.WriteTo(rrq, listener.LocalAddr())
+
+	buf := make([]byte, 2048)
+	read := func(timeout time.Duration) (wire.Packet, error) {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		return wire.Unmarshal(buf[:n])
+	}
+
+	want := &wire.Data{Block: 1, Payload: []byte("abc")}
+	for i := 0; i <= server.Retries; i++ {
+		pkt, err := read(time.Second)
+		if err != nil {
+			t.Fatalf("Transmission %v of DATA missing: %v\n", i+1, err)
+		}
+		if !reflect.DeepEqual(pkt, want) {
+			t.Fatalf("Incorrect packet %v, should be %v\n", pkt, want)
+		}
+	}
+	if pkt, err := read(500 * time.Millisecond); err == nil {
+		t.Fatalf("Session should have ended, got %v\n", pkt)
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Should be a timeout, got: %v\n", err)
+	}
+}
@@ -0,0 +1,101 @@
+package tftpd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// SecurityEvent is an access denied to a client or a protocol violation.
+type SecurityEvent struct {
+	Time time.Time
+	// Event is "access-denied", "protocol-violation" or "blocked".
+	Event    string
+	Client   net.Addr
+	Filename string
+	Reason   string
+}
+
+// SecurityLog writes security events one per line in a fixed format for
+// tools like fail2ban or CrowdSec, e.g.
+//
+//	2023-11-14T22:13:20Z event=access-denied client=192.0.2.1 port=1024 filename="secret" reason="Access violation."
+//
+// The fields always come in this order, the client is an IP address.
+// A fail2ban filter could use
+//
+//	failregex = ^\S+ event=(access-denied|protocol-violation) client=<HOST> port=
+type SecurityLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewSecurityLog(w io.Writer) *SecurityLog {
+	return &SecurityLog{w: w}
+}
+
+// OpenSecurityLog appends to the file at path, creating it if needed.
+func OpenSecurityLog(path string) (*SecurityLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return NewSecurityLog(f), nil
+}
+
+// Write appends an event, every event is a single write.
+func (s *SecurityLog) Write(ev SecurityEvent) error {
+	_, port := udpAddr(ev.Client)
+	line := fmt.Sprintf("%v event=%v client=%v port=%d filename=%q reason=%q\n",
+		ev.Time.UTC().Format(time.RFC3339), ev.Event, offenderKey(ev.Client), port, ev.Filename, ev.Reason)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := io.WriteString(s.w, line)
+	return err
+}
+
+// Close closes the underlying writer if it's a file or another io.Closer.
+func (s *SecurityLog) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// security writes an event to the SecurityLog if there is one.
+func (tftp *TFTPServer) security(event string, addr net.Addr, filename, reason string) {
+	if tftp.SecurityLog == nil {
+		return
+	}
+	ev := SecurityEvent{Time: tftp.now(), Event: event, Client: addr, Filename: filename, Reason: reason}
+	if err := tftp.SecurityLog.Write(ev); err != nil {
+		log.Printf("error while writing security event: '%v'\n", err)
+	}
+}
+
+// securityError records errors of a session which are security events.
+func (tftp *TFTPServer) securityError(cli *client, err error) {
+	reason := err.Error()
+	var tftpErr *Error
+	var malformed *malformedError
+	if errors.As(err, &malformed) {
+		// the decoding error is kept, floods of bad datagrams end up here
+		// instead of the log
+		reason = malformed.Error()
+	} else if errors.As(err, &tftpErr) {
+		reason = tftpErr.Message
+	}
+
+	switch {
+	case errors.Is(err, ErrAccessViolation):
+		tftp.security("access-denied", cli.tid, cli.filename, reason)
+	case isViolation(err):
+		tftp.security("protocol-violation", cli.tid, cli.filename, reason)
+	}
+}
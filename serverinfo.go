@@ -0,0 +1,69 @@
+package tftpd
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// ServerInfoName is the magic file describing the server, see
+// TFTPServer.ServerInfo.
+const ServerInfoName = ".server-info"
+
+const modulePath = "git.scarlet.house/oss/go-tftpd"
+
+// serverInfo serves the version, options and limits of the server as they
+// apply to the client, one "name: value" per line. It reports whether the
+// request was for ServerInfoName.
+func (tftp *TFTPServer) serverInfo(cli *client, req *request) bool {
+	if !tftp.ServerInfo || cleanName(req.filename) != ServerInfoName {
+		return false
+	}
+
+	options := []string{"blksize", "tsize", "timeout", "utimeout", "windowsize"}
+	for _, v := range []struct {
+		name    string
+		enabled bool
+	}{
+		{DigestOption, tftp.Digest},
+		{AppendOption, tftp.Append},
+		{ResumeOption, tftp.Resume},
+		{GzipOption, tftp.Gzip},
+	} {
+		if v.enabled {
+			options = append(options, v.name)
+		}
+	}
+
+	var info strings.Builder
+	fmt.Fprintf(&info, "version: %v\n", version())
+	fmt.Fprintf(&info, "options: %v\n", strings.Join(options, " "))
+	fmt.Fprintf(&info, "blksize max: %v\n", tftp.maxBlockSize(cli))
+	fmt.Fprintf(&info, "windowsize max: %v\n", tftp.maxWindowSize())
+	fmt.Fprintf(&info, "timeout: %v\n", tftp.timeout(cli))
+	fmt.Fprintf(&info, "retries: %v\n", tftp.retries(cli))
+	fmt.Fprintf(&info, "read only: %v\n", tftp.ReadOnly || tftp.ServeFile != "")
+	fmt.Fprintf(&info, "sessions max: %v\n", tftp.maxSessions())
+
+	cli.logf("Client '%v' requested the server info\n", cli.tid.String())
+	cli.reader = strings.NewReader(info.String())
+	cli.setSize(int64(info.Len()))
+	return true
+}
+
+// version returns the version of this module in the binary.
+func version() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if bi.Main.Path == modulePath {
+		return bi.Main.Version
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	return "(devel)"
+}
@@ -0,0 +1,68 @@
+package tftpd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+)
+
+// newSessionID returns a random ID which tells the log lines, records and
+// hook calls of one session apart from the others.
+func newSessionID() string {
+	var b [6]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// logf logs with the session ID in front, packets of unknown clients have
+// none.
+func (cli *client) logf(format string, args ...interface{}) {
+	if cli.id == "" {
+		log.Printf(format, args...)
+		return
+	}
+	log.Printf("[%v] "+format, append([]interface{}{cli.id}, args...)...)
+}
+
+// Default limit of concurrent sessions, see TFTPServer.MaxSessions.
+const defaultMaxSessions = 10000
+
+func (tftp *TFTPServer) maxSessions() int {
+	if tftp.MaxSessions > 0 {
+		return tftp.MaxSessions
+	}
+	return defaultMaxSessions
+}
+
+// register adds a new session, evicting the least recently active ones if
+// the table is full. Evicted clients aren't sent an ERROR, the source of a
+// flood is likely spoofed.
+func (tftp *TFTPServer) register(cli *client) {
+	for len(tftp.connections) >= tftp.maxSessions() {
+		old := tftp.lru.Back().Value.(*client)
+		old.logf("Evicting session of '%v'.\n", old.tid.String())
+		old.failure = errEvicted
+		tftp.endSession(old)
+	}
+
+	tftp.connections[cli.tid.String()] = cli
+	cli.lru = tftp.lru.PushFront(cli)
+	cli.id = newSessionID()
+	tftp.counters.started.Add(1)
+	tftp.counters.active.Add(1)
+}
+
+// unregister removes the session from the table if it's still there.
+func (tftp *TFTPServer) unregister(cli *client) {
+	if tftp.connections[cli.tid.String()] != cli {
+		return
+	}
+	delete(tftp.connections, cli.tid.String())
+	tftp.lru.Remove(cli.lru)
+	tftp.counters.active.Add(-1)
+}
+
+// touch marks the session as the most recently active one.
+func (tftp *TFTPServer) touch(cli *client) {
+	tftp.lru.MoveToFront(cli.lru)
+}
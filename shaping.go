@@ -0,0 +1,175 @@
+package tftpd
+
+import (
+	"container/heap"
+	"strconv"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// Transfers up to defaultSmallTransfer are small unless
+// TFTPServer.SmallTransfer says otherwise.
+const defaultSmallTransfer = 1 << 20
+
+// transferSize returns the size of a transfer, -1 if it's unknown.
+func (cli *client) transferSize() int64 {
+	if cli.opcode == wire.OpWRQ {
+		if v, ok := cli.oack.Get("tsize"); ok {
+			if size, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return size - cli.offset
+			}
+		}
+		return -1
+	}
+	if cli.bytesLeft < 0 {
+		return -1
+	}
+	return cli.bytes + cli.bytesLeft
+}
+
+// isSmall reports whether the transfer is prioritized by the global
+// Bandwidth limit, transfers of unknown size never are.
+func (tftp *TFTPServer) isSmall(cli *client) bool {
+	limit := tftp.SmallTransfer
+	if limit == 0 {
+		limit = defaultSmallTransfer
+	}
+	size := cli.transferSize()
+	return size >= 0 && size <= limit
+}
+
+// fairQueue holds the sessions waiting for the global Bandwidth, small
+// transfers first and the others by the virtual time their packet starts
+// at, so they take turns in proportion to their weight (start-time fair
+// queueing).
+type fairQueue []*client
+
+func (q fairQueue) Len() int { return len(q) }
+
+func (q fairQueue) Less(i, j int) bool {
+	if q[i].small != q[j].small {
+		return q[i].small
+	}
+	return q[i].vstart < q[j].vstart
+}
+
+func (q fairQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].fairIndex, q[j].fairIndex = i, j
+}
+
+func (q *fairQueue) Push(x any) {
+	cli := x.(*client)
+	cli.fairIndex = len(*q)
+	*q = append(*q, cli)
+}
+
+func (q *fairQueue) Pop() any {
+	old := *q
+	cli := old[len(old)-1]
+	old[len(old)-1] = nil
+	cli.fairIndex = -1
+	*q = old[:len(old)-1]
+	return cli
+}
+
+// shape reports whether the packet may be sent now within the global
+// Bandwidth, and uses up its share then. Otherwise the session waits in
+// the fair queue for releaseFair, behind the others waiting already, so a
+// client acknowledging fast can't take all of it.
+//
+// The bandwidth is a token bucket holding a tenth of a second, at least a
+// packet. Small transfers may overdraw it by as much, so they go first
+// while bulk transfers wait for it to fill up again.
+func (tftp *TFTPServer) shape(cli *client, packet []byte) bool {
+	if tftp.Bandwidth <= 0 || !isPaced(cli, packet) {
+		return true
+	}
+	if tftp.inFair(cli) {
+		return false
+	}
+	tftp.refill(tftp.now())
+
+	weight := 1.0
+	if cli.policy != nil && cli.policy.Weight > 0 {
+		weight = float64(cli.policy.Weight)
+	}
+	if cli.vfinish > tftp.vtime {
+		cli.vstart = cli.vfinish
+	} else {
+		cli.vstart = tftp.vtime
+	}
+	cli.vfinish = cli.vstart + float64(len(packet))/weight
+
+	if (len(tftp.fair) == 0 || cli.small && !tftp.fair[0].small) && tftp.afford(cli, len(packet)) {
+		tftp.vtime = cli.vstart
+		return true
+	}
+	heap.Push(&tftp.fair, cli)
+	return false
+}
+
+func (tftp *TFTPServer) burst() float64 {
+	burst := float64(tftp.Bandwidth) / 10
+	if burst < 1<<16 {
+		burst = 1 << 16
+	}
+	return burst
+}
+
+func (tftp *TFTPServer) refill(now time.Time) {
+	tftp.tokens += now.Sub(tftp.tokensAt).Seconds() * float64(tftp.Bandwidth)
+	if burst := tftp.burst(); tftp.tokens > burst {
+		tftp.tokens = burst
+	}
+	tftp.tokensAt = now
+}
+
+// afford takes the tokens for n bytes if there are enough.
+func (tftp *TFTPServer) afford(cli *client, n int) bool {
+	need := float64(n)
+	if cli.small {
+		need -= tftp.burst()
+	}
+	if tftp.tokens < need {
+		return false
+	}
+	tftp.tokens -= float64(n)
+	return true
+}
+
+// releaseFair sends the packets of the fair queue the bandwidth allows by
+// now, in their order. fairDue is when the next one can go.
+func (tftp *TFTPServer) releaseFair(now time.Time) {
+	if len(tftp.fair) == 0 {
+		return
+	}
+	tftp.refill(now)
+	for len(tftp.fair) > 0 {
+		cli := tftp.fair[0]
+		n := len(cli.lastSent())
+		if tftp.Bandwidth > 0 && !tftp.afford(cli, n) {
+			need := float64(n) - tftp.tokens
+			if cli.small {
+				need -= tftp.burst()
+			}
+			tftp.fairDue = now.Add(time.Duration(need / float64(tftp.Bandwidth) * float64(time.Second)))
+			return
+		}
+		heap.Pop(&tftp.fair)
+		tftp.vtime = cli.vstart
+		tftp.sendPaced(cli)
+	}
+}
+
+func (tftp *TFTPServer) inFair(cli *client) bool {
+	return cli.fairIndex >= 0 && cli.fairIndex < len(tftp.fair) && tftp.fair[cli.fairIndex] == cli
+}
+
+// unqueue removes an ended session from the fair queue.
+func (tftp *TFTPServer) unqueue(cli *client) {
+	if tftp.inFair(cli) {
+		heap.Remove(&tftp.fair, cli.fairIndex)
+	}
+}
@@ -0,0 +1,242 @@
+package tftpd
+
+import (
+	"container/list"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultFileCacheTTL = 5 * time.Second
+
+// sharedFile is a file open for the downloads in flight of the same path,
+// which read it at their own offsets, so waves of clients fetching an image
+// don't use a descriptor each. With TFTPServer.FileCacheSize it's kept open
+// once idle.
+type sharedFile struct {
+	f    *os.File
+	fi   fs.FileInfo
+	name string
+	refs int
+	// last time the file was found unchanged, when it became idle and
+	// its place in the idle list
+	checked time.Time
+	used    time.Time
+	elem    *list.Element
+}
+
+// sharedFiles are the open regular files by path. The gzip compressor
+// reads from another goroutine.
+type sharedFiles struct {
+	mu    sync.Mutex
+	files map[string]*sharedFile
+	// idle files, the least recently used first, see FileCacheSize
+	idle  *list.List
+	size  int
+	ttl   time.Duration
+	clock Clock
+}
+
+// configure sets the size and TTL of the cache of idle files.
+func (s *sharedFiles) configure(size int, ttl time.Duration, clock Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size, s.ttl, s.clock = size, ttl, clock
+	for s.idle != nil && s.idle.Len() > s.size {
+		s.drop(s.idle.Front().Value.(*sharedFile))
+	}
+}
+
+// closeIdle closes the cached files when the server stops.
+func (s *sharedFiles) closeIdle() {
+	s.configure(0, s.ttl, s.clock)
+}
+
+// idleLen returns the number of cached files.
+func (s *sharedFiles) idleLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idle == nil {
+		return 0
+	}
+	return s.idle.Len()
+}
+
+func (s *sharedFiles) now() time.Time {
+	if s.clock != nil {
+		return s.clock.Now()
+	}
+	return time.Now()
+}
+
+// open returns the file open at name if it's still the same, or opens it.
+// Cached files are only checked with stat once their TTL expired.
+func (s *sharedFiles) open(name string) (*sharedFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.expire(now)
+	sf := s.files[name]
+	if sf != nil && s.size > 0 && now.Sub(sf.checked) < s.ttl {
+		s.acquire(sf)
+		return sf, nil
+	}
+
+	fi, err := os.Stat(name)
+	if err == nil && sf != nil && sameFile(sf.fi, fi) {
+		sf.checked = now
+		s.acquire(sf)
+		return sf, nil
+	}
+	if sf != nil {
+		s.drop(sf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	// the file may have been replaced since
+	fi, err = f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	sf = &sharedFile{f: f, fi: fi, name: name, refs: 1, checked: now}
+	if fi.Mode().IsRegular() {
+		if s.files == nil {
+			s.files = make(map[string]*sharedFile)
+		}
+		s.files[name] = sf
+	}
+	return sf, nil
+}
+
+func (s *sharedFiles) acquire(sf *sharedFile) {
+	if sf.elem != nil {
+		s.idle.Remove(sf.elem)
+		sf.elem = nil
+	}
+	sf.refs++
+}
+
+// release closes the file once no download reads it anymore, unless it's
+// kept in the cache.
+func (s *sharedFiles) release(sf *sharedFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sf.refs--; sf.refs > 0 {
+		return nil
+	}
+	if s.files[sf.name] != sf || s.size == 0 {
+		s.drop(sf)
+		return nil
+	}
+	if s.idle == nil {
+		s.idle = list.New()
+	}
+	sf.used = s.now()
+	sf.elem = s.idle.PushBack(sf)
+	for s.idle.Len() > s.size {
+		s.drop(s.idle.Front().Value.(*sharedFile))
+	}
+	return nil
+}
+
+// drop forgets the file, which is closed unless downloads still read it,
+// e.g. after it was replaced.
+func (s *sharedFiles) drop(sf *sharedFile) {
+	if s.files[sf.name] == sf {
+		delete(s.files, sf.name)
+	}
+	if sf.elem != nil {
+		s.idle.Remove(sf.elem)
+		sf.elem = nil
+	}
+	if sf.refs == 0 {
+		sf.f.Close()
+	}
+}
+
+// expire closes the files idle for longer than the TTL, so files deleted
+// meanwhile don't keep their space.
+func (s *sharedFiles) expire(now time.Time) {
+	for s.idle != nil && s.idle.Len() > 0 {
+		sf := s.idle.Front().Value.(*sharedFile)
+		if now.Sub(sf.used) < s.ttl {
+			return
+		}
+		s.drop(sf)
+	}
+}
+
+func sameFile(a, b fs.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// openRead opens the file of a download, regular files are shared.
+func (tftp *TFTPServer) openRead(cli *client, name string) error {
+	tftp.files.configure(tftp.FileCacheSize, tftp.fileCacheTTL(), tftp.Clock)
+	sf, err := tftp.files.open(name)
+	if err != nil {
+		return fsError(err)
+	}
+	if sf.fi.Mode().IsRegular() {
+		cli.reader = &sharedReader{files: &tftp.files, file: sf}
+	} else {
+		cli.reader = sf.f
+	}
+	cli.setSize(sf.fi.Size())
+	return nil
+}
+
+func (tftp *TFTPServer) fileCacheTTL() time.Duration {
+	if tftp.FileCacheTTL > 0 {
+		return tftp.FileCacheTTL
+	}
+	return defaultFileCacheTTL
+}
+
+// sharedReader reads a shared file at its own offset.
+type sharedReader struct {
+	files *sharedFiles
+	file  *sharedFile
+	off   int64
+}
+
+func (r *sharedReader) Read(p []byte) (int, error) {
+	n, err := r.file.f.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *sharedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.file.fi.Size()
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *sharedReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.files.release(r.file)
+	r.file = nil
+	return err
+}
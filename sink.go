@@ -0,0 +1,188 @@
+package tftpd
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// WriteRequest is passed to the OnWrite hook before an upload starts.
+type WriteRequest struct {
+	// Session is the ID of the session in the log and the audit records.
+	Session  string
+	Client   net.Addr
+	Options  wire.Options
+	Filename string
+	// Size is the size announced with the tsize option, -1 if unknown.
+	Size int64
+	// Writer, if set by the hook, gets the upload instead of a file, e.g.
+	// a pipe or an HTTP PUT. It's written in another goroutine and may
+	// block. It's closed after the last block and the upload only succeeds
+	// if Close does. Failed uploads are aborted with CloseWithError if the
+	// writer has it (like io.PipeWriter), otherwise it's closed too.
+	// Errors wrapping an *Error are sent to the client as they are.
+	Writer io.WriteCloser
+}
+
+var errAborted = errors.New("Upload aborted.")
+
+// preWrite runs the OnWrite hook, an error rejects the upload.
+func (tftp *TFTPServer) preWrite(cli *client, req *request) error {
+	if tftp.OnWrite == nil {
+		return nil
+	}
+
+	wr := &WriteRequest{
+		Session:  cli.id,
+		Client:   cli.tid,
+		Options:  req.options,
+		Filename: req.filename,
+		Size:     -1,
+	}
+	if tsize, ok := cli.oack.Get("tsize"); ok {
+		wr.Size, _ = strconv.ParseInt(tsize, 10, 64)
+	}
+	err := tftp.OnWrite(wr)
+	if err != nil {
+		var tftpErr *Error
+		if !errors.As(err, &tftpErr) {
+			cli.logf("Write of '%v' rejected: '%v'\n", req.filename, err)
+			tftpErr = ErrAccessViolation
+		}
+		return tftpErr
+	}
+
+	if wr.Writer != nil {
+		s := newSinkWriter(wr.Writer, 2*cli.blockSize)
+		if err := tftp.spawn(s.drain); err != nil {
+			s.abortDst(errAborted)
+			return err
+		}
+		cli.sink = s
+		// the sink has nothing to resume from
+		if cli.resume {
+			cli.offset = 0
+			cli.oack.Set(ResumeOption, "0")
+		}
+	}
+	return nil
+}
+
+// sinkWriter passes an upload to the Writer of the OnWrite hook in another
+// goroutine, running drain, so the server never blocks on it. The ACKs of
+// blocks are held back while more than limit bytes are waiting.
+type sinkWriter struct {
+	dst   io.WriteCloser
+	limit int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      []byte
+	err      error
+	finished bool
+	aborted  bool
+	done     bool
+}
+
+func newSinkWriter(dst io.WriteCloser, limit int) *sinkWriter {
+	s := &sinkWriter{dst: dst, limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *sinkWriter) drain() {
+	for {
+		s.mu.Lock()
+		for len(s.buf) == 0 && !s.finished && !s.aborted {
+			s.cond.Wait()
+		}
+		if s.aborted {
+			s.mu.Unlock()
+			s.abortDst(errAborted)
+			return
+		}
+		if len(s.buf) == 0 {
+			s.mu.Unlock()
+			err := s.dst.Close()
+			s.stop(err)
+			return
+		}
+		data := s.buf
+		s.buf = nil
+		s.mu.Unlock()
+
+		if _, err := s.dst.Write(data); err != nil {
+			s.abortDst(err)
+			s.stop(err)
+			return
+		}
+		s.cond.Broadcast()
+	}
+}
+
+func (s *sinkWriter) stop(err error) {
+	s.mu.Lock()
+	s.err, s.done = err, true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *sinkWriter) abortDst(err error) {
+	if c, ok := s.dst.(interface{ CloseWithError(error) error }); ok {
+		c.CloseWithError(err)
+		return
+	}
+	s.dst.Close()
+}
+
+// Write queues the block, it never blocks.
+func (s *sinkWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.buf = append(s.buf, p...)
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+// ready reports whether the next block can be acknowledged, after the last
+// one only once the writer is closed.
+func (s *sinkWriter) ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return s.done
+	}
+	return len(s.buf) < s.limit || s.err != nil
+}
+
+// failure returns the error of the writer, if any.
+func (s *sinkWriter) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// finish closes the writer once everything is written.
+func (s *sinkWriter) finish() {
+	s.mu.Lock()
+	s.finished = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// abort stops an upload which didn't complete.
+func (s *sinkWriter) abort() {
+	s.mu.Lock()
+	if !s.done && !s.finished {
+		s.aborted = true
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
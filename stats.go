@@ -0,0 +1,60 @@
+package tftpd
+
+import "sync/atomic"
+
+// Stats is a snapshot of the counters of a server since it was created.
+type Stats struct {
+	SessionsStarted   uint64
+	SessionsCompleted uint64
+	SessionsFailed    uint64
+	// BytesReceived and BytesSent count file data, retransmissions
+	// aren't included.
+	BytesReceived uint64
+	BytesSent     uint64
+	Retransmits   uint64
+	// Blocks counts the clients blocked for protocol violations, Dropped
+	// the packets of blocked clients and the ones dropped by the Filter.
+	Blocks  uint64
+	Dropped uint64
+	// Rejected counts the requests refused because the server was
+	// saturated, see TFTPServer.RejectWhenFull and Workers.
+	Rejected uint64
+	// Errors counts the ERROR packets sent, by code.
+	Errors         map[ErrorCode]uint64
+	ActiveSessions int
+}
+
+// counters are updated by the packet loop and read by Stats from any
+// goroutine.
+type counters struct {
+	started, completed, failed  atomic.Uint64
+	received, sent, retransmits atomic.Uint64
+	blocked, dropped, rejected  atomic.Uint64
+	errors                      [len(errorMessages)]atomic.Uint64
+	active                      atomic.Int64
+}
+
+// Stats returns the current counters, it's safe to call while the server
+// is running.
+func (tftp *TFTPServer) Stats() Stats {
+	c := &tftp.counters
+	stats := Stats{
+		SessionsStarted:   c.started.Load(),
+		SessionsCompleted: c.completed.Load(),
+		SessionsFailed:    c.failed.Load(),
+		BytesReceived:     c.received.Load(),
+		BytesSent:         c.sent.Load(),
+		Retransmits:       c.retransmits.Load(),
+		Blocks:            c.blocked.Load(),
+		Dropped:           c.dropped.Load(),
+		Rejected:          c.rejected.Load(),
+		Errors:            make(map[ErrorCode]uint64),
+		ActiveSessions:    int(c.active.Load()),
+	}
+	for code := range c.errors {
+		if n := c.errors[code].Load(); n > 0 {
+			stats.Errors[ErrorCode(code)] = n
+		}
+	}
+	return stats
+}
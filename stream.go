@@ -0,0 +1,200 @@
+package tftpd
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// Interval in which sessions waiting for a stream or a sink check it again.
+const streamPoll = 10 * time.Millisecond
+
+var errStalled = NewError(CodeNotDefined, "Transfer stalled.")
+
+// aheadReader is a source read ahead, e.g. a streamReader.
+type aheadReader interface {
+	io.ReadCloser
+	// ready reports whether n bytes can be read without blocking, wait
+	// blocks until they can.
+	ready(n int) bool
+	wait(n int)
+}
+
+// streamReader reads a source of unknown length, e.g. a pipe, ahead in
+// another goroutine running fill, so the server never blocks on it.
+type streamReader struct {
+	src   io.Reader
+	limit int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	err    error
+	closed bool
+}
+
+func newStreamReader(src io.Reader, limit int) *streamReader {
+	s := &streamReader{src: src, limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *streamReader) fill() {
+	chunk := make([]byte, s.limit)
+	for {
+		s.mu.Lock()
+		for len(s.buf) >= s.limit && !s.closed {
+			s.cond.Wait()
+		}
+		closed, free := s.closed, s.limit-len(s.buf)
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+
+		n, err := s.src.Read(chunk[:free])
+		s.mu.Lock()
+		s.buf = append(s.buf, chunk[:n]...)
+		s.err = err
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ready reports whether n bytes can be read without blocking.
+func (s *streamReader) ready(n int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buf) >= n || s.err != nil
+}
+
+// wait blocks until n bytes can be read without blocking.
+func (s *streamReader) wait(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.buf) < n && s.err == nil {
+		s.cond.Wait()
+	}
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.buf) == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if len(s.buf) == 0 {
+		return 0, s.err
+	}
+	n := copy(p, s.buf)
+	s.buf = append(s.buf[:0], s.buf[n:]...)
+	s.cond.Broadcast()
+	return n, nil
+}
+
+// Close stops reading ahead and closes the source, which unblocks a
+// pending read of pipes and the like.
+func (s *streamReader) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if c, ok := s.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// readAhead reads a download ahead through io_uring or another goroutine,
+// if enabled.
+func (tftp *TFTPServer) readAhead(cli *client) error {
+	if tftp.IOUring && tftp.readWithRing(cli) {
+		return nil
+	}
+	if tftp.Prefetch > 0 {
+		return tftp.prefetch(cli, tftp.Prefetch)
+	}
+	return nil
+}
+
+// prefetch reads files ahead in another goroutine, so reading the next
+// blocks overlaps with the round trip to the client, see
+// TFTPServer.Prefetch. Other sources are in memory or read ahead already.
+func (tftp *TFTPServer) prefetch(cli *client, blocks int) error {
+	switch cli.reader.(type) {
+	case *sharedReader, *headReader, *os.File:
+	default:
+		return nil
+	}
+	if cli.windowSize > blocks {
+		blocks = cli.windowSize
+	}
+	s := newStreamReader(cli.reader, blocks*cli.blockSize)
+	cli.reader = s
+	if err := tftp.spawn(s.fill); err != nil {
+		return err
+	}
+	// the first block isn't delayed by polling, unless the job may wait
+	// for a worker
+	if tftp.Workers <= 0 {
+		s.wait(cli.blockSize)
+	}
+	return nil
+}
+
+// waitForData reports whether the next DATA of a stream has to wait for
+// the source, or the ACK of an upload for the sink. The session is polled
+// by retransmit then.
+func (tftp *TFTPServer) waitForData(cli *client, req *request) bool {
+	ready := true
+	if s, ok := cli.reader.(aheadReader); ok && (req.opcode == wire.OpRRQ || req.opcode == wire.OpACK) {
+		ready = s.ready(cli.blockSize)
+	}
+	if cli.sink != nil && req.opcode == wire.OpDATA {
+		ready = cli.sink.ready()
+	}
+	if ready {
+		cli.waiting = false
+		return false
+	}
+
+	now := tftp.now()
+	if !cli.waiting {
+		cli.waiting, cli.waitSince = true, now
+	}
+	cli.waitBlock = req.number
+	cli.deadline = now.Add(streamPoll)
+	return true
+}
+
+// pollStream sends the DATA (or ACK) a session is waiting for once the
+// source (or sink) is ready, sessions whose source or sink stalls for as
+// long as the client may are ended.
+func (tftp *TFTPServer) pollStream(cli *client, now time.Time) {
+	req := &request{opcode: wire.OpACK, number: cli.waitBlock}
+	if cli.opcode == wire.OpWRQ {
+		req.opcode = wire.OpDATA
+	}
+	if tftp.waitForData(cli, req) {
+		if now.Sub(cli.waitSince) > tftp.timeout(cli)*time.Duration(tftp.retries(cli)) {
+			cli.logf("Transfer of '%v' stalled\n", cli.filename)
+			tftp.handleError(cli, errStalled)
+		}
+		return
+	}
+	var err error
+	if cli.windowSize > 1 && cli.opcode == wire.OpRRQ {
+		err = tftp.fillWindow(cli)
+	} else {
+		err = tftp.sendData(cli, req)
+	}
+	if err != nil {
+		tftp.handleError(cli, err)
+	}
+}
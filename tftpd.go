@@ -2,21 +2,285 @@ package tftpd
 
 import (
 	"bytes"
+	"container/list"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+	"golang.org/x/net/ipv4"
 )
 
 type TFTPServer struct {
+	// Strict rejects packets with trailing bytes after a well-formed packet.
+	Strict bool
+	// Lenient tolerates requests of buggy clients: garbage or NUL padding
+	// after the mode and the mode in any case. Strict takes precedence.
+	Lenient bool
+	// Timeout is the retransmission timeout unless the client negotiates
+	// one, Retries the number of retransmissions before giving up.
+	Timeout time.Duration
+	Retries int
+	// Backoff, if greater than 1, multiplies the timeout with every
+	// retransmission of the same packet up to MaxTimeout (a minute by
+	// default). Jitter varies every timeout randomly by up to that
+	// fraction, e.g. 0.1 for ±10%, so clients which hit loss at the same
+	// moment don't retransmit in lockstep.
+	Backoff    float64
+	MaxTimeout time.Duration
+	Jitter     float64
+	// Clock, if set, replaces the system clock, e.g. with a fake one in
+	// tests. It must be set before the server is started.
+	Clock Clock
+	// MaxBlockSize limits the negotiated blksize, zero means as big as
+	// the server buffers allow.
+	MaxBlockSize int
+	// MaxDatagramSize is the size of the packet buffers, which bounds the
+	// blksize, up to 65468 bytes, e.g. for jumbo frames. Zero means 2048
+	// bytes, or enough for MaxBlockSize if that's bigger. It must be set
+	// before the server is started.
+	MaxDatagramSize int
+	// MTU is the MTU of the path to the clients, the blksize is lowered so
+	// DATA packets aren't fragmented, which many PXE stacks can't
+	// reassemble. Zero uses the MTU of the interface the client is reached
+	// through, setting it overrides that, e.g. for jumbo frames. Negative
+	// disables the limit.
+	MTU int
+	// ACL, if set, restricts which clients may read or write which paths.
+	ACL ACL
+	// Allowlist, if set, only allows downloads of the files listed.
+	Allowlist *Allowlist
+	// ReadOnly rejects all uploads.
+	ReadOnly bool
+	// MaxWindowSize limits the negotiated windowsize (RFC 7440), the
+	// number of blocks sent without waiting for an ACK, zero means 64.
+	MaxWindowSize int
+	// Root, if set, is the directory files are served from and uploaded
+	// to, e.g. to serve different content on different addresses.
+	// Otherwise names are relative to the working directory.
+	Root string
+	// OnConflict decides what happens to uploads of files which exist,
+	// they're rejected by default.
+	OnConflict ConflictPolicy
+	// Policies override limits for files below some paths, e.g. to allow
+	// big blocks for images and restrict the size of configs.
+	Policies Policies
+	// Journal, if set, records uploads in progress so they can be resumed
+	// (see Resume) after a restart from the last offset known to be on
+	// disk, and plain retries of the client overwrite them instead of
+	// being a conflict.
+	Journal *Journal
+	// RemovePartialUploads deletes the files of uploads which failed, e.g.
+	// because the client sent an ERROR or timed out. They're kept by
+	// default.
+	RemovePartialUploads bool
+	// MaxSessions limits the number of concurrent sessions, the least
+	// recently active ones are ended to make room for new ones. Zero means
+	// 10000. RejectWhenFull rejects new sessions then instead, like while
+	// file descriptors run out.
+	MaxSessions    int
+	RejectWhenFull bool
+	// Workers, if set, runs the background work of sessions on that many
+	// goroutines instead of one per session, e.g. reading streams of the
+	// OnRead hook ahead, Prefetch and writing to the Writer of the OnWrite
+	// hook, which bounds memory on small devices. Up to WorkQueue (by
+	// default Workers) sessions wait for a worker, further ones are
+	// rejected with an ERROR, or ignored with DropWhenBusy so clients
+	// retry them after their timeout, like all requests refused while
+	// the server is saturated.
+	Workers      int
+	WorkQueue    int
+	DropWhenBusy bool
+	// MaxViolations, if set, blocks clients (by IP) which sent that many
+	// malformed packets or packets with an unknown TID within
+	// BlockDuration: their packets are dropped for BlockDuration, twice as
+	// long with every repeat up to an hour. BlockDuration defaults to a
+	// minute.
+	MaxViolations int
+	BlockDuration time.Duration
+	// MaxTransfers, if set, stops the server after that many successful
+	// transfers, sessions still in flight are ended.
+	MaxTransfers int
+	// ServeFile, if set, is served for every download whatever the name
+	// requested, uploads are rejected. It's relative to the Root unless
+	// it's absolute.
+	ServeFile string
+	// TokenKey, if set, only allows downloads of filenames signed with
+	// SignFilename, the token is stripped before serving.
+	TokenKey []byte
+	// Filter, if set, is called with every datagram received before it's
+	// parsed and drops it by returning false, e.g. for custom flood
+	// heuristics. It runs on the server goroutine, mustn't block and
+	// mustn't keep the packet.
+	Filter func(addr net.Addr, packet []byte) bool
+	// OnRead, if set, is called before every download and can reject it,
+	// serve another file or supply the content. It runs on the server
+	// goroutine and mustn't block.
+	OnRead func(*ReadRequest) error
+	// OnWrite, if set, is called before every upload and can reject it or
+	// stream it somewhere else than to a file. It runs on the server
+	// goroutine and mustn't block.
+	OnWrite func(*WriteRequest) error
+	// Scan, if set, is called before every upload and returns a writer
+	// getting a copy of every block as it's written. An error from Scan,
+	// Write or from Close after the last block rejects the upload with an
+	// access violation and removes the file. Close is called for aborted
+	// uploads too. The writer is called on the server goroutine.
+	Scan func(client net.Addr, filename string) (io.WriteCloser, error)
+	// Checksums are the algorithms (md5, sha1, sha256, sha512) computed
+	// while receiving uploads, they're passed to OnUpload and, with
+	// ChecksumSidecar, written next to the file as file.sha256 etc.
+	Checksums       []string
+	ChecksumSidecar bool
+	// Digest enables the x-sha256 option (DigestOption): the digest of
+	// downloads is sent in the OACK and uploads are verified against the
+	// digest declared by the client.
+	Digest bool
+	// PreSharedKey enables the experimental x-psk option (PSKOption)
+	// which encrypts the DATA payloads of transfers with a key derived
+	// from it, for clients of this package with the same key. RequirePSK
+	// rejects transfers in the clear.
+	PreSharedKey []byte
+	RequirePSK   bool
+	// Gzip serves file.gz decompressed if file is requested but doesn't
+	// exist, and enables the x-gzip option (GzipOption) with which clients
+	// get file.gz, or file compressed on the fly. The allowlist has to list
+	// the files as they're stored.
+	Gzip bool
+	// DirList serves the names of the files starting with prefix, one per
+	// line, for downloads of .dirlist/prefix (DirListName), so scripts can
+	// discover images. Only files the client may download are listed.
+	DirList bool
+	// ServerInfo serves the version, supported options and limits of the
+	// server for downloads of .server-info (ServerInfoName), to debug
+	// negotiation problems.
+	ServerInfo bool
+	// Resume enables the x-offset option (ResumeOption) with which
+	// interrupted transfers are resumed. Uploads are only resumed from
+	// the Journal, by the client which started them.
+	Resume bool
+	// Append enables the x-append option (AppendOption) with which uploads
+	// append to existing files.
+	Append bool
+	// FirstBlockCache keeps the first 64 KiB of the 64 files downloaded
+	// last in memory, so bursts of PXE clients fetching the same boot
+	// loader are served without opening and reading it for every session.
+	// The files are checked for changes with stat once a second.
+	FirstBlockCache bool
+	// FileCacheSize is the number of files kept open after their last
+	// download, so a small set of popular files is served without
+	// opening them again. Their stat results are trusted for FileCacheTTL
+	// (5s by default), files idle for longer are closed.
+	FileCacheSize int
+	FileCacheTTL  time.Duration
+	// Prefetch is the number of blocks of a download read ahead in
+	// another goroutine while waiting for the ACK, at least the window,
+	// so slow storage doesn't add to every round trip.
+	Prefetch int
+	// Bandwidth, if set, limits the DATA of all transfers together (and
+	// the ACKs of uploads) to that many bytes per second, on top of the
+	// limits of the policies. Transfers of up to SmallTransfer bytes
+	// (1 MiB by default), e.g. configuration files, go first so they stay
+	// quick while images are downloaded, bulk transfers get the rest.
+	Bandwidth     int64
+	SmallTransfer int64
+	// IOUring reads the files of downloads ahead and writes the ones of
+	// uploads through io_uring on Linux, with buffers registered once and
+	// the operations of all sessions submitted together, which saves system
+	// calls when many sessions stream large files. Blocks of uploads are
+	// acknowledged once their writes are queued, a failed write fails the
+	// upload with the next block, and the last one is only acknowledged
+	// once everything is written. Appending uploads are written directly.
+	// It's ignored where io_uring is unavailable.
+	IOUring bool
+	// OnUpload, if set, is called in a new goroutine after every
+	// completed upload, e.g. with UploadCommand.
+	OnUpload func(UploadInfo)
+	// Watchdog, if set, is called from the packet loop every
+	// WatchdogInterval, so a wedged loop can be detected, e.g. by systemd.
+	Watchdog         func()
+	WatchdogInterval time.Duration
+	// Audit, if set, gets a record of every completed or failed transfer.
+	Audit *AuditLog
+	// OnTransfer, if set, is called with the audit record of every
+	// completed or failed transfer, e.g. Webhook.Notify. It runs on the
+	// server goroutine and mustn't block.
+	OnTransfer func(AuditRecord)
+	// Events, if set, gets an event when a transfer starts and ends, e.g.
+	// a BrokerPublisher or a Webhook.
+	Events EventPublisher
+	// ErrorMessages replaces the text of ERROR packets with the given code,
+	// e.g. to point users to a support page. The codes are never changed.
+	ErrorMessages map[ErrorCode]string
+	// SecurityLog, if set, gets access denials and protocol violations,
+	// e.g. for fail2ban.
+	SecurityLog *SecurityLog
+	// Capture, if set, records all packets sent and received. CaptureDir,
+	// if set, gets a pcap file of every session.
+	Capture    *PcapWriter
+	CaptureDir string
+
+	// Relisten, if set, binds a new socket once reading from the current
+	// one keeps failing, e.g. because it was closed behind the server's
+	// back. By default UDP sockets are bound to their address again. The
+	// attempts back off from 100ms to 30s, ListenAndServe gives up after
+	// RelistenRetries (10 by default).
+	Relisten        func() (net.PacketConn, error)
+	RelistenRetries int
+
+	// TraceMode, changed with SetTrace
+	trace    atomic.Int32
+	closed   atomic.Bool
+	nextPing time.Time
+
+	// changes from Reconfigure waiting for the packet loop, which is
+	// running, and the last failed transfers
+	mu          sync.Mutex
+	reconfigure []func(*TFTPServer)
+	running     bool
+	failures    []AuditRecord
+
+	counters counters
+	// clients with protocol violations, see MaxViolations
+	offenders map[string]*offender
+	// see FirstBlockCache, by path
+	heads map[string]*head
+	// open files of downloads
+	files sharedFiles
+	// see IOUring, created on first use
+	ring       *ioRing
+	ringFailed bool
+	// see Workers, created on first use
+	workers *workerPool
+	// token bucket of Bandwidth and the sessions waiting for it, see shape
+	tokens   float64
+	tokensAt time.Time
+	fair     fairQueue
+	fairDue  time.Time
+	vtime    float64
+
 	listener    net.PacketConn
+	batch       batchConn
+	dscp        int
+	outgoing    []ipv4.Message
+	outBufs     []*[]byte
+	bufferSize  int
 	connections map[string]*client
+	// sessions from the most to the least recently active one
+	lru *list.List
 }
 
 func NewTFTPServer(port string) (*TFTPServer, error) {
@@ -25,63 +289,218 @@ func NewTFTPServer(port string) (*TFTPServer, error) {
 		return nil, err
 	}
 
+	return NewTFTPServerConn(listener), nil
+}
+
+// NewTFTPServerConn returns a server using an already bound connection,
+// e.g. an in-memory one from the tftptest package.
+func NewTFTPServerConn(listener net.PacketConn) *TFTPServer {
 	return &TFTPServer{
 		listener:    listener,
+		batch:       newBatchConn(listener),
 		connections: make(map[string]*client),
-	}, nil
+		lru:         list.New(),
+	}
 }
 
+// Close stops the server, ListenAndServe closes the open files on its way out.
 func (tftp *TFTPServer) Close() {
+	tftp.closed.Store(true)
+	tftp.mu.Lock()
+	defer tftp.mu.Unlock()
+	tftp.listener.Close()
+}
+
+func (tftp *TFTPServer) closeSessions() {
 	for _, v := range tftp.connections {
-		v.file.Close()
+		// finished uploads only wait for retransmissions
+		if v.failure == nil && !(v.lastPkt && v.opcode == wire.OpWRQ) {
+			v.failure = errServerClosed
+		}
+		tftp.endSession(v)
 	}
-	tftp.listener.Close()
+	tftp.closeRing()
+	tftp.closeWorkers()
+	tftp.files.closeIdle()
 }
 
-func (tftp *TFTPServer) ListenAndServe() {
-	const bodyMaxSize = 2048
+// endSession forgets the client and closes its file.
+func (tftp *TFTPServer) endSession(cli *client) {
+	tftp.audit(cli)
+	if !cli.start.IsZero() {
+		if cli.failure == nil {
+			tftp.counters.completed.Add(1)
+		} else {
+			tftp.counters.failed.Add(1)
+		}
+	}
+	cli.start = time.Time{}
 
-	body := make([]byte, bodyMaxSize)
+	tftp.journalEnd(cli)
+	tftp.unqueue(cli)
+	if tftp.RemovePartialUploads && cli.failure != nil && cli.inited && cli.opcode == wire.OpWRQ {
+		err := cli.discardUpload()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			cli.logf("error while removing partial upload: '%v'\n", err)
+		}
+	}
+	cli.closeFile()
+	if cli.captureFile != nil {
+		cli.captureFile.Close()
+		cli.capture, cli.captureFile = nil, nil
+	}
+	// the last packet may still wait in the send queue
+	tftp.outBufs = append(tftp.outBufs, cli.sentBuf)
+	cli.sentBuf, cli.sent = nil, nil
+	for _, p := range cli.unacked {
+		tftp.outBufs = append(tftp.outBufs, p.buf)
+	}
+	cli.unacked = nil
+
+	tftp.unregister(cli)
+}
+
+// ListenAndServe handles packets until the server is closed, it returns
+// nil then. A socket which keeps failing is rebuilt (see Relisten), the
+// error is returned if that fails too.
+func (tftp *TFTPServer) ListenAndServe() error {
+	msgs := newMessages(batchSize, tftp.datagramSize())
+	failures := 0
+	tftp.startLoop()
+	defer tftp.stopLoop()
 	for {
-		numRead, addr, err := tftp.listener.ReadFrom(body)
-		if err != nil {
+		tftp.ping(tftp.now())
+		tftp.listener.SetReadDeadline(tftp.socketDeadline(tftp.readDeadline()))
+		if tftp.pending() {
+			tftp.listener.SetReadDeadline(time.Now())
+		}
+		n, err := tftp.batch.ReadBatch(msgs, 0)
+		if errors.Is(err, net.ErrClosed) && tftp.closed.Load() {
+			tftp.closeSessions()
+			return nil
+		}
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
 			log.Printf("error while reading packet: '%v'\n", err)
+			// closed behind our back or failing for good, e.g. the
+			// interface went away
+			if failures++; errors.Is(err, net.ErrClosed) || failures >= maxReadErrors {
+				if err := tftp.relisten(err); err != nil {
+					tftp.closeSessions()
+					return err
+				}
+				failures = 0
+			}
 			continue
 		}
+		failures = 0
+		if err != nil {
+			// woken up for retransmissions, the batch may report -1
+			n = 0
+		}
+		tftp.applyReconfigure()
+
+		for _, msg := range msgs[:n] {
+			tftp.handleConnection(msg.Addr, msg.N, msg.Buffers[0])
+		}
+		tftp.retransmit(tftp.now())
+		tftp.submitRing()
 
-		tftp.handleConnection(addr, numRead, body)
+		err = tftp.flush()
+		if err != nil {
+			log.Printf("error while sending packets: '%v'\n", err)
+		}
+
+		if completed := tftp.counters.completed.Load(); tftp.MaxTransfers > 0 && completed >= uint64(tftp.MaxTransfers) {
+			log.Printf("Served %d transfers, stopping.\n", completed)
+			tftp.Close()
+			tftp.closeSessions()
+			return nil
+		}
 	}
 }
 
 func (tftp *TFTPServer) handleConnection(addr net.Addr, numRead int, body []byte) {
+	if tftp.Filter != nil && !tftp.Filter(addr, body[:numRead]) {
+		tftp.counters.dropped.Add(1)
+		return
+	}
+	if tftp.blocked(addr, tftp.now()) {
+		tftp.counters.dropped.Add(1)
+		return
+	}
+	tftp.tracePacket("recv", addr, body[:numRead])
+
 	cli, ok := tftp.connections[addr.String()]
-	if !ok {
+	if ok {
+		tftp.touch(cli)
+	} else {
 		cli = newClient(addr)
-		tftp.connections[cli.tid.String()] = cli
 	}
+	tftp.capture(cli, body[:numRead], true)
+
+	// a bug triggered by one client only ends its session
+	defer func() {
+		if r := recover(); r != nil {
+			cli.logf("Session of '%v' panicked: %v\n%s", addr, r, debug.Stack())
+			tftp.handleError(cli, fmt.Errorf("panic: %v", r))
+		}
+	}()
 
 	err := func() error {
-		req, err := newRequest(numRead, body)
+		req, err := newRequest(numRead, body, tftp.Strict, tftp.Lenient)
 		if err != nil {
 			return err
 		}
 
+		// only well-formed requests start a session, everything else
+		// from an unknown address is answered without keeping any state
+		if !ok && (req.opcode == wire.OpRRQ || req.opcode == wire.OpWRQ) {
+			if err := tftp.admission(); err != nil {
+				return err
+			}
+			tftp.register(cli)
+			cli.opcode, cli.filename, cli.start = req.opcode, req.filename, tftp.now()
+			tftp.startCapture(cli, body[:numRead])
+		}
+
 		err = tftp.handleRequest(cli, req)
 		if err != nil {
 			return err
 		}
+		if !ok && cli.inited {
+			tftp.started(cli)
+		}
 
-		resp := newResponse(cli, req)
-		err = tftp.handleResponse(cli, resp)
-		if err != nil {
+		// options are acknowledged instead of the first ACK or DATA
+		if (req.opcode == wire.OpRRQ || req.opcode == wire.OpWRQ) && len(cli.oack) > 0 {
+			_, err = tftp.sendPacket(cli, &wire.OptionAck{Options: cli.oack})
 			return err
 		}
 
-		_, err = tftp.sendResponse(cli, resp)
-		return err
+		if cli.windowSize > 1 && req.opcode == wire.OpACK {
+			return tftp.fillWindow(cli)
+		}
+		if tftp.waitForData(cli, req) {
+			return nil
+		}
+		return tftp.sendData(cli, req)
 	}()
 
-	if err != nil && err != endOfSession {
+	if err == errBusy || err == errDropped {
+		tftp.counters.rejected.Add(1)
+	}
+	switch {
+	case err == endOfSession:
+		tftp.endSession(cli)
+	case err == errIgnored:
+	case err == errDropped:
+		cli.failure = err
+		tftp.endSession(cli)
+	case err != nil:
+		tftp.securityError(cli, err)
+		if isViolation(err) {
+			tftp.violation(addr, tftp.now())
+		}
 		tftp.handleError(cli, err)
 	}
 }
@@ -92,288 +511,667 @@ func (tftp *TFTPServer) handleRequest(cli *client, req *request) error {
 	// no such user ?
 
 	// checking for illegal operations
-	if req.opcode < opRRQ || req.opcode > opERROR {
-		return newTFTPError(ecILL)
+	if req.opcode < wire.OpRRQ || req.opcode > wire.OpERROR {
+		return ErrIllegalOperation
 	}
 
-	// checking for the last ack
-	if req.opcode == opACK && cli.inited && cli.lastPkt {
-		delete(tftp.connections, cli.tid.String())
-		return endOfSession
+	// checking for unknown client, errors are never answered to avoid loops
+	if !cli.inited && req.opcode == wire.OpERROR {
+		return errIgnored
 	}
-
-	// checking for unknown client
-	if !cli.inited && req.opcode != opRRQ && req.opcode != opWRQ {
-		return newTFTPError(ecUTID)
+	if !cli.inited && req.opcode != wire.OpRRQ && req.opcode != wire.OpWRQ {
+		return ErrUnknownTID
 	}
 
 	if !cli.inited {
-		log.Printf("Got new client: %v\n", cli.tid.String())
+		cli.logf("Got new client: %v\n", cli.tid.String())
 
-		err := cli.prepareFromRequest(req)
+		cli.root, cli.policy = tftp.Root, tftp.Policies.Match(req.filename)
+		err := tftp.negotiate(cli, req)
 		if err != nil {
 			return err
 		}
-	}
 
-	// TODO: handle this properly (probably will need to close 'connection')
-	if req.opcode == opERROR {
-		log.Printf("Got error from client: '%s' (%v)\n", req.errorMessage, req.number)
+		err = tftp.admit(cli, req)
+		if err != nil {
+			return err
+		}
+
+		// the OnRead hook may have supplied the content already
+		if req.opcode == wire.OpRRQ && cli.reader == nil {
+			if tftp.FirstBlockCache {
+				err = tftp.openHead(cli, req)
+			} else {
+				err = tftp.openRead(cli, cli.path(req.filename))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		err = cli.prepareFromRequest(req)
+		if err != nil {
+			return err
+		}
+		if req.opcode == wire.OpRRQ {
+			if err := tftp.readAhead(cli); err != nil {
+				return err
+			}
+		}
+		if req.opcode == wire.OpWRQ {
+			tftp.forgetHead(cli)
+			cli.checksums = newChecksums(tftp.Checksums)
+			if tftp.IOUring {
+				tftp.writeWithRing(cli)
+			}
+			tftp.journal(cli, true)
+		}
+		cli.small = tftp.isSmall(cli)
+		if req.opcode == wire.OpRRQ && cli.bytesLeft >= 0 {
+			return cli.checkSize(cli.offset + cli.bytesLeft)
+		}
 		return nil
 	}
 
-	// TODO: last data packet, close the client!
-	if req.opcode == opDATA {
-		_, err := io.Copy(cli.file, bytes.NewReader(req.body))
+	switch req.opcode {
+	case wire.OpRRQ, wire.OpWRQ:
+		// the request was retransmitted, our reply got lost
+		tftp.resend(cli)
+		return errIgnored
+
+	case wire.OpERROR:
+		cli.logf("Got error from client: '%s' (%v)\n", req.errorMessage, req.number)
+		cli.failure = &Error{Code: ErrorCode(req.number), Message: req.errorMessage}
+		return endOfSession
+
+	case wire.OpACK:
+		if cli.opcode != wire.OpRRQ {
+			return ErrIllegalOperation
+		}
+		// duplicate ACKs aren't answered, otherwise every delayed packet
+		// doubles the traffic (Sorcerer's Apprentice Syndrome)
+		if cli.windowSize > 1 {
+			return tftp.slideWindow(cli, req.number)
+		}
+		if req.number != cli.block {
+			return errIgnored
+		}
+		if cli.lastPkt {
+			return endOfSession
+		}
+
+	case wire.OpDATA:
+		if cli.opcode != wire.OpWRQ {
+			return ErrIllegalOperation
+		}
+		// our ACK got lost, repeat it without writing the block again
+		if int(cli.block-req.number) < cli.window() {
+			return tftp.ackReceived(cli, true)
+		}
+		if req.number != cli.block+1 || cli.lastPkt {
+			return tftp.ackReceived(cli, false)
+		}
+		if cli.psk != nil {
+			body, err := cli.psk.Open(req.body[:0], req.body, cli.bytes)
+			if err != nil {
+				return errPSKAuth
+			}
+			req.body = body
+		}
+
+		if err := cli.checkSize(cli.offset + cli.bytes + int64(len(req.body))); err != nil {
+			return err
+		}
+		var w io.Writer = cli.file
+		if cli.sink != nil {
+			w = cli.sink
+		} else if cli.ringWriter != nil {
+			w = cli.ringWriter
+		}
+		n, err := io.Copy(w, bytes.NewReader(req.body))
+		cli.bytes += n
+		tftp.counters.received.Add(uint64(n))
 		if err != nil {
-			if errors.Is(err, syscall.ENOSPC) {
-				err = newTFTPError(ecDSK)
+			return fsError(err)
+		}
+		// the ACK may wait for the sink, retransmissions aren't written again
+		cli.block, cli.gap = req.number, false
+		tftp.journal(cli, false)
+		for _, c := range cli.checksums {
+			c.hash.Write(req.body)
+		}
+		if cli.digest != nil {
+			cli.digest.Write(req.body)
+		}
+
+		// a block shorter than the block size ends the transfer, the session
+		// is kept for a timeout to repeat the last ACK if it gets lost
+		last := len(req.body) < cli.dataSize()
+		if last {
+			// the upload is only complete once it's written
+			if err := cli.flushWrites(); err != nil {
+				return fsError(err)
+			}
+			err = cli.verifyDigest()
+			if err != nil {
+				return err
 			}
+		}
+		err = cli.scan(req.body, last)
+		if err != nil {
 			return err
 		}
+		if last && cli.sink != nil {
+			// it's complete once the sink is closed, see handleResponse
+			cli.lastPkt = true
+			cli.sink.finish()
+		} else if last {
+			cli.logf("Client '%v' has sent a file.\n", cli.tid.String())
+			cli.closeFile()
+			cli.lastPkt = true
+			tftp.uploaded(cli)
+		}
+		if !cli.windowEnd() {
+			// the client is still sending the window
+			cli.tries, cli.deadline = 0, tftp.retryDeadline(cli, tftp.now())
+			return errIgnored
+		}
 	}
 
 	return nil
 }
 
+// admit runs the access checks and hooks of a new request.
+func (tftp *TFTPServer) admit(cli *client, req *request) error {
+	if req.opcode == wire.OpWRQ {
+		if err := tftp.checkACL(cli, req); err != nil {
+			return err
+		}
+		if err := tftp.preWrite(cli, req); err != nil {
+			return err
+		}
+		tftp.checkJournal(cli, req)
+		tftp.checkResume(cli, req)
+		if err := tftp.resolveConflict(cli, req); err != nil {
+			return err
+		}
+		return tftp.startScan(cli, req)
+	}
+
+	if err := tftp.verifyToken(cli, req); err != nil {
+		return err
+	}
+	if ok, err := tftp.dirList(cli, req); ok {
+		return err
+	}
+	if tftp.serverInfo(cli, req) {
+		return nil
+	}
+	if err := tftp.checkACL(cli, req); err != nil {
+		return err
+	}
+	if tftp.ServeFile != "" {
+		// the name is the operator's, an absolute one is opened as is
+		// instead of below the root
+		req.filename = tftp.ServeFile
+		if filepath.IsAbs(tftp.ServeFile) {
+			cli.root, req.filename = filepath.Split(tftp.ServeFile)
+		}
+	}
+	tftp.gzipVariant(cli, req)
+	if err := tftp.checkAllowlist(cli, req); err != nil {
+		return err
+	}
+	return tftp.preRead(cli, req)
+}
+
+// sendData sends the next DATA of a download or the ACK of an upload.
+func (tftp *TFTPServer) sendData(cli *client, req *request) error {
+	resp := newResponse(cli, req)
+	defer resp.release()
+
+	err := tftp.handleResponse(cli, resp)
+	if err != nil {
+		return err
+	}
+
+	_, err = tftp.sendResponse(cli, resp)
+	return err
+}
+
 func (tftp *TFTPServer) handleResponse(cli *client, resp *response) error {
-	if resp.opcode == opDATA {
-		n, err := cli.file.Read(resp.body)
-		if err != nil && err != io.EOF {
+	if resp.opcode == wire.OpACK && cli.sink != nil {
+		if err := cli.sink.failure(); err != nil {
+			cli.logf("Upload of '%v' failed: '%v'\n", cli.filename, err)
+			return fsError(err)
+		}
+		if cli.lastPkt {
+			cli.logf("Client '%v' has sent a file.\n", cli.tid.String())
+			tftp.uploaded(cli)
+		}
+	}
+	if resp.opcode == wire.OpDATA {
+		offset := cli.bytes
+		n, err := io.ReadFull(cli.reader, resp.body[:cli.dataSize()])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		resp.body = resp.body[:n]
+		if cli.psk != nil {
+			resp.body = cli.psk.Seal(resp.body[:0], resp.body, offset)
+		}
+		if cli.bytesLeft >= 0 {
+			cli.bytesLeft -= int64(n)
+		}
+		cli.bytes += int64(n)
+		if err := cli.checkSize(cli.offset + cli.bytes); err != nil {
 			return err
 		}
-		if cli.bytesLeft <= 0 {
-			log.Printf("Client '%v' has received a file.\n", cli.tid.String())
-			cli.file.Close()
+		tftp.counters.sent.Add(uint64(n))
+
+		// a block shorter than the block size ends the transfer
+		if n < cli.dataSize() {
+			cli.logf("Client '%v' has received a file.\n", cli.tid.String())
+			cli.closeFile()
 			cli.lastPkt = true
 		}
-		resp.body = resp.body[:n]
-		cli.bytesLeft -= int64(n)
 	}
 
 	return nil
 }
 
 func (tftp *TFTPServer) handleError(cli *client, err error) {
-	tftpErr, ok := err.(*tftpError)
-	if !ok {
-		log.Printf("Got unexpected error: %v\n", err)
-		tftpErr = newTFTPError(ecNDEF, "Unexpected error.")
+	var tftpErr *Error
+	if !errors.As(err, &tftpErr) {
+		cli.logf("Got unexpected error: %v\n", err)
+		tftpErr = NewError(CodeNotDefined, "Unexpected error.")
 	}
-	cli.inited = true
-	cli.lastPkt = true
-	_, err = tftp.sendError(cli, tftpErr)
-	if err != nil {
-		panic(err)
+	cli.failure = tftpErr
+	// malformed packets are only reported in the security log, a flood of
+	// them would fill the log
+	var malformed *malformedError
+	if !errors.As(err, &malformed) {
+		cli.logf("%v\n", tftpErr)
+	}
+	// the session ends anyway, the client times out if it misses the error
+	if _, err := tftp.sendError(cli, tftpErr); err != nil {
+		cli.logf("error while sending error: '%v'\n", err)
+	}
+	tftp.endSession(cli)
+}
+
+func (tftp *TFTPServer) sendError(cli *client, err *Error) (int, error) {
+	if int(err.Code) < len(tftp.counters.errors) {
+		tftp.counters.errors[err.Code].Add(1)
 	}
 
+	msg := err.Message
+	if custom, ok := tftp.ErrorMessages[err.Code]; ok {
+		msg = custom
+	}
+	return tftp.sendPacket(cli, &wire.Error{Code: uint16(err.Code), Message: msg})
 }
 
-func (tftp *TFTPServer) sendError(cli *client, err *tftpError) (int, error) {
-	log.Println(err)
-	return tftp.sendResponse(cli, &response{opERROR, uint16(err.code), toCString(err.message.Error())})
+// sendPacket encodes and queues a packet that isn't built in place.
+func (tftp *TFTPServer) sendPacket(cli *client, pkt wire.Packet) (int, error) {
+	buf := getBuffer(tftp.datagramSize())
+	packet, err := pkt.AppendBinary((*buf)[:0])
+	if err != nil {
+		putBuffer(buf)
+		return 0, err
+	}
+	tftp.queue(cli, buf, packet)
+	return len(packet), nil
 }
 
+// sendResponse queues the packet, it's written on the next flush.
+// The header is written in front of the body in place, the pooled
+// buffer is owned by the send queue afterwards.
 func (tftp *TFTPServer) sendResponse(cli *client, resp *response) (int, error) {
-	header := []byte{0x0, byte(resp.opcode), 0x0, 0x0}
-	binary.BigEndian.PutUint16(header[2:], resp.number)
-	return tftp.listener.WriteTo(append(header, resp.body...), cli.tid)
+	if resp.buf == nil {
+		// ad-hoc packets (e.g. acks) aren't backed by a pooled buffer yet
+		resp.buf = getBuffer(wire.HeaderSize + len(resp.body))
+		resp.body = append((*resp.buf)[wire.HeaderSize:wire.HeaderSize], resp.body...)
+	}
+
+	packet := (*resp.buf)[:wire.HeaderSize+len(resp.body)]
+	binary.BigEndian.PutUint16(packet[0:], uint16(resp.opcode))
+	binary.BigEndian.PutUint16(packet[2:], resp.number)
+	tftp.queue(cli, resp.buf, packet)
+	resp.buf, resp.body = nil, nil
+
+	return len(packet), nil
+}
+
+// queue adds the packet to the send queue. Sessions keep their last packet
+// for retransmission, other buffers are released after the flush.
+func (tftp *TFTPServer) queue(cli *client, buf *[]byte, packet []byte) {
+	if tftp.connections[cli.tid.String()] == cli {
+		tftp.outBufs = append(tftp.outBufs, cli.sentBuf)
+		cli.sentBuf, cli.sent = buf, packet
+		if cli.windowSize > 1 && wire.Opcode(binary.BigEndian.Uint16(packet)) == wire.OpDATA {
+			// kept until the client acknowledges it, see slideWindow
+			cli.unacked = append(cli.unacked, sentPacket{packet, buf})
+			cli.sentBuf, cli.sent = nil, nil
+		}
+		cli.tries = 0
+		if due := tftp.paceUntil(cli, packet); !due.IsZero() {
+			// sent by retransmit once it's due
+			cli.held, cli.deadline = true, due
+			return
+		}
+		if !tftp.shape(cli, packet) {
+			// sent by releaseFair
+			cli.held, cli.deadline = true, time.Time{}
+			return
+		}
+		cli.deadline = tftp.retryDeadline(cli, tftp.now())
+	} else {
+		tftp.outBufs = append(tftp.outBufs, buf)
+	}
+	tftp.capture(cli, packet, false)
+
+	tftp.outgoing = append(tftp.outgoing, ipv4.Message{
+		Buffers: [][]byte{packet},
+		Addr:    cli.tid,
+	})
 }
 
 type client struct {
-	tid       net.Addr
-	file      *os.File
-	inited    bool
-	lastPkt   bool
+	tid net.Addr
+	// id and lru are set for registered sessions only
+	id  string
+	lru *list.Element
+	// file of an upload, reader of a download
+	file *os.File
+	sink *sinkWriter
+	// writes the file through io_uring, see TFTPServer.IOUring
+	ringWriter *uringWriter
+	// of an upload found in the journal, and the offset last recorded
+	partial   *JournalEntry
+	journaled int64
+	reader    io.Reader
+	scanner   io.WriteCloser
+	// of an upload, see TFTPServer.Checksums and Digest
+	checksums  []checksum
+	digest     hash.Hash
+	wantDigest string
+	inited     bool
+	lastPkt    bool
+	opcode     wire.Opcode
+	// of an appending upload (AppendOption) or a resumed transfer
+	// (ResumeOption), offset is where the data of the session starts
+	append bool
+	resume bool
+	offset int64
+	// of a download served from or as gzip, see GzipOption
+	gzip int
+	// root directory and policy matching the file, see TFTPServer
+	root   string
+	policy *Policy
+	// last block sent (RRQ) or received (WRQ)
+	block uint16
+	// negotiated windowsize (RFC 7440), the DATA of a download which isn't
+	// acknowledged yet and the last block acknowledged of an upload
+	windowSize int
+	unacked    []sentPacket
+	acked      uint16
+	// window of a download adapted to loss, and the last block sent when
+	// it last shrank, see shrinkWindow
+	cwnd    int
+	recover uint16
+	// a block out of order was answered since the last one written
+	gap       bool
 	blockSize int
 	bytesLeft int64
+	timeout   time.Duration
+	// negotiated options, sent as OACK
+	oack wire.Options
+
+	// last sent packet and its pooled buffer, kept for retransmission
+	sent     []byte
+	sentBuf  *[]byte
+	deadline time.Time
+	tries    int
+	// sent is held back by the bandwidth limit of the policy or the server
+	// until deadline
+	held bool
+	// prioritized by the bandwidth limit of the server, see SmallTransfer,
+	// and its place in the fair queue with the virtual times its packet
+	// starts and ends at
+	small           bool
+	fairIndex       int
+	vstart, vfinish float64
+	// the DATA after (or ACK of) waitBlock waits for a stream (or sink),
+	// see waitForData
+	waiting   bool
+	waitBlock uint16
+	waitSince time.Time
+
+	// encrypts the payloads, see PSKOption
+	psk *PSKCipher
+
+	// for the audit log, start is set for registered sessions only
+	filename    string
+	start       time.Time
+	bytes       int64
+	retransmits int
+	failure     error
+
+	// pcap file of the session, see CaptureDir
+	capture     *PcapWriter
+	captureFile *os.File
 }
 
 func newClient(tid net.Addr) *client {
 	return &client{
-		tid: tid,
+		tid:       tid,
+		blockSize: defaultBlockSize,
 	}
 }
 
 func (cli *client) prepareFromRequest(req *request) error {
-	const defaultBlockSize = 512
+	// the OnWrite hook may have supplied a sink already
+	if req.opcode == wire.OpWRQ && cli.sink == nil {
+		err := cli.openFile(req)
+		if err != nil {
+			return err
+		}
+	}
+	if req.opcode == wire.OpRRQ {
+		err := cli.wrapGzip()
+		if err != nil {
+			return err
+		}
+		err = cli.fillDigest()
+		if err != nil {
+			return err
+		}
+		err = cli.skip()
+		if err != nil {
+			return err
+		}
+	}
+
+	cli.opcode = req.opcode
+	cli.inited = true
 
+	return nil
+}
+
+func (cli *client) openFile(req *request) error {
 	var err error
 	var f *os.File
 
-	// TODO: clean path to filename
-	if req.opcode == opRRQ {
-		f, err = os.Open(req.filename)
+	name := cli.path(req.filename)
+	if cli.resume {
+		f, err = cli.openResume(name)
+	} else if cli.append {
+		f, err = cli.openAppend(name)
 	} else {
-		if _, err := os.Stat(req.filename); !errors.Is(err, fs.ErrNotExist) {
-			return newTFTPError(ecFEX)
+		// an interrupted upload (see Journal) is started again
+		if _, err := os.Stat(name); !errors.Is(err, fs.ErrNotExist) && cli.partial == nil {
+			return ErrFileExists
 		}
-		f, err = os.Create(req.filename)
+		f, err = os.Create(name)
 	}
 	if err != nil {
-		switch {
-		case errors.Is(err, fs.ErrNotExist):
-			err = newTFTPError(ecFNF)
-		case errors.Is(err, fs.ErrPermission):
-			err = newTFTPError(ecACV)
-		case errors.Is(err, syscall.ENOSPC):
-			err = newTFTPError(ecDSK)
-		}
-		return err
+		return fsError(err)
 	}
+	cli.file = f
+	return nil
+}
 
-	stat, err := f.Stat()
-	if err != nil {
-		return err
+// path returns the name of the file on disk below the root, it's the name
+// the ACL and the allowlist decided on, so ".." can't leave the root.
+func (cli *client) path(filename string) string {
+	root := cli.root
+	if root == "" {
+		root = "."
 	}
+	return filepath.Join(root, filepath.FromSlash(cleanName(filename)))
+}
 
-	cli.file = f
-	cli.bytesLeft = stat.Size()
-	cli.blockSize = defaultBlockSize
-	cli.inited = true
+// setSize announces the size of a download if the client asked for it
+// with the tsize option, unknown sizes (-1) aren't acknowledged.
+func (cli *client) setSize(size int64) {
+	cli.bytesLeft = size
+	if _, ok := cli.oack.Get("tsize"); !ok {
+		return
+	}
+	if size < 0 {
+		cli.oack.Del("tsize")
+		return
+	}
+	cli.oack.Set("tsize", strconv.FormatInt(size, 10))
+}
 
-	return nil
+// closeFile closes the file of an upload or the reader of a download.
+func (cli *client) closeFile() {
+	if cli.ringWriter != nil {
+		cli.flushWrites()
+		cli.ringWriter = nil
+	}
+	if cli.file != nil {
+		cli.file.Close()
+		cli.file = nil
+	}
+	if cli.sink != nil {
+		cli.sink.abort()
+	}
+	if c, ok := cli.reader.(io.Closer); ok {
+		c.Close()
+	}
+	cli.reader = nil
+	// the upload didn't complete, the verdict doesn't matter
+	if cli.scanner != nil {
+		cli.scanner.Close()
+		cli.scanner = nil
+	}
 }
 
 type request struct {
-	numRead int
-	body    []byte
+	body []byte
 
-	opcode operation
+	opcode wire.Opcode
 	// depend on opcode
 	number       uint16
 	filename     string
 	mode         string
+	options      wire.Options
 	errorMessage string
 }
 
-func newRequest(numRead int, body []byte) (*request, error) {
-	const hdrsize = 4
+// malformedError is a packet which couldn't be decoded, it's answered as an
+// illegal operation.
+type malformedError struct {
+	err error
+}
 
-	var n int
-	var err error
-	req := &request{
-		numRead: numRead,
-		body:    body,
-	}
+func (err *malformedError) Error() string {
+	return fmt.Sprintf("Malformed packet: %v", err.err)
+}
 
-	// TODO: operation BigEndian
-	req.opcode, req.body = operation(req.body[1]), req.body[2:]
-	switch req.opcode {
-	case opRRQ, opWRQ:
-		n, req.filename, err = readCString(req.body)
-		if err != nil {
-			return nil, err
-		}
-		req.body = req.body[n:]
+func (err *malformedError) Unwrap() error {
+	return ErrIllegalOperation
+}
 
-		n, req.mode, err = readCString(req.body)
-		if err != nil {
-			return nil, err
-		}
-		if req.mode != "octet" {
-			return nil, newTFTPError(ecNDEF, fmt.Sprintf("Incorrect mode '%v'. This server supports only 'octet' mode.", req.mode))
-		}
+func newRequest(numRead int, body []byte, strict, lenient bool) (*request, error) {
+	if numRead > len(body) {
+		numRead = len(body)
+	}
+	if numRead < 0 {
+		numRead = 0
+	}
 
-		req.body = req.body[n:]
+	unmarshal := wire.Unmarshal
+	if strict {
+		unmarshal = wire.UnmarshalStrict
+	} else if lenient {
+		unmarshal = wire.UnmarshalLenient
+	}
 
-	case opDATA, opACK:
-		req.number, req.body = binary.BigEndian.Uint16(req.body[:2]), req.body[2:]
-		req.body = req.body[:req.numRead-hdrsize]
+	pkt, err := unmarshal(body[:numRead])
+	if err != nil {
+		// the packet is untrusted input, any decoding failure is an illegal
+		// operation, it's reported in the security log and not logged here
+		return nil, &malformedError{err}
+	}
 
-	case opERROR:
-		req.number, req.body = binary.BigEndian.Uint16(req.body[:2]), req.body[2:]
-		n, req.errorMessage, err = readCString(req.body)
-		if err != nil {
-			return nil, err
-		}
-		req.body = req.body[n:]
+	req := &request{
+		opcode: pkt.Opcode(),
+	}
+	switch pkt := pkt.(type) {
+	case *wire.ReadRequest:
+		req.filename, req.mode, req.options = pkt.Filename, pkt.Mode, pkt.Options
+	case *wire.WriteRequest:
+		req.filename, req.mode, req.options = pkt.Filename, pkt.Mode, pkt.Options
+	case *wire.Data:
+		req.number, req.body = pkt.Block, pkt.Payload
+	case *wire.Ack:
+		req.number = pkt.Block
+	case *wire.Error:
+		req.number, req.errorMessage = pkt.Code, pkt.Message
+	}
+
+	if lenient && !strict && strings.EqualFold(req.mode, "octet") {
+		req.mode = "octet"
+	}
+	if (req.opcode == wire.OpRRQ || req.opcode == wire.OpWRQ) && req.mode != "octet" {
+		return nil, NewError(CodeNotDefined, fmt.Sprintf("Incorrect mode '%v'. This server supports only 'octet' mode.", req.mode))
 	}
 
 	return req, nil
 }
 
 type response struct {
-	opcode operation
+	opcode wire.Opcode
 	number uint16
 	body   []byte
+	// pooled buffer holding the header followed by body, if any
+	buf *[]byte
 }
 
 func newResponse(cli *client, req *request) *response {
 	resp := &response{}
 
 	switch req.opcode {
-	case opRRQ, opACK:
-		resp.body = make([]byte, cli.blockSize)
-		resp.opcode = opDATA
+	case wire.OpRRQ, wire.OpACK:
+		cli.block = req.number + 1
+		resp.buf = getBuffer(wire.HeaderSize + cli.blockSize)
+		resp.body = (*resp.buf)[wire.HeaderSize : wire.HeaderSize+cli.blockSize]
+		resp.opcode = wire.OpDATA
 		resp.number = req.number + 1
 
-	case opWRQ, opDATA:
-		resp.opcode = opACK
+	case wire.OpWRQ, wire.OpDATA:
+		cli.block, cli.acked = req.number, req.number
+		resp.opcode = wire.OpACK
 		resp.number = req.number
 	}
 
 	return resp
 }
 
-type tftpError struct {
-	code    errorCode
-	message error
-}
-
-func newTFTPError(code errorCode, clientMessage ...string) *tftpError {
-	if code > ecNOUS {
-		code = ecNDEF
-	}
-
-	message := tftpErrors[code]
-	if code == ecNDEF {
-		message = errors.New(strings.Join(clientMessage, " "))
-	}
-
-	return &tftpError{
-		code:    code,
-		message: message,
-	}
-}
-
-func (err *tftpError) Error() string {
-	return fmt.Sprintf("TFTP Error (%v): %v", err.code, err.message)
+func (resp *response) release() {
+	putBuffer(resp.buf)
+	resp.buf, resp.body = nil, nil
 }
-
-type errorCode uint16
-
-const (
-	ecNDEF errorCode = iota
-	ecFNF
-	ecACV
-	ecDSK
-	ecILL
-	ecUTID
-	ecFEX
-	ecNOUS
-)
-
-var tftpErrors = [...]error{
-	ecNDEF: errors.New(""),
-	ecFNF:  errors.New("File not found."),
-	ecACV:  errors.New("Access violation."),
-	ecDSK:  errors.New("Disk full or allocation exceeded."),
-	ecILL:  errors.New("Illegal TFTP operation."),
-	ecUTID: errors.New("Unknown transfer ID."),
-	ecFEX:  errors.New("File already exists."),
-	ecNOUS: errors.New("No such user."),
-}
-
-var endOfSession = errors.New("End of session.")
-
-type operation byte
-
-const (
-	opUNK operation = iota
-	opRRQ
-	opWRQ
-	opDATA
-	opACK
-	opERROR
-)
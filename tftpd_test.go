@@ -1,44 +1,3593 @@
 package tftpd
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/tftptest"
+	"git.scarlet.house/oss/go-tftpd/wire"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
-var cStringTestData = []struct {
-	str     string
-	cString []byte
-}{
-	{"hello world!", []byte{104, 101, 108, 108, 111, 32, 119, 111, 114, 108, 100, 33, 0}},
-	{"", []byte{0}},
+func TestNewRequest(t *testing.T) {
+	raw := []byte{0, 1, 'f', 0, 'o', 'c', 't', 'e', 't', 0, 'b', 'l', 'k', 's', 'i', 'z', 'e', 0, '8', 0}
+	req, err := newRequest(len(raw), raw, false, false)
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	if req.opcode != wire.OpRRQ || req.filename != "f" || req.mode != "octet" {
+		t.Fatalf("Incorrect request: %+v\n", req)
+	}
+	if v, _ := req.options.Get("BLKSIZE"); v != "8" {
+		t.Fatalf("Incorrect blksize option '%v'\n", v)
+	}
+
+	raw = []byte{0, 1, 'f', 0, 'n', 'e', 't', 'a', 's', 'c', 'i', 'i', 0}
+	_, err = newRequest(len(raw), raw, false, false)
+	if tftpErr := (*Error)(nil); !errors.As(err, &tftpErr) {
+		t.Fatalf("Should be a tftp error, got: %v\n", err)
+	}
+
+	for _, raw := range [][]byte{{0, 9, 0, 0}, {1}, {0, 3, 0}, {0, 1, 'f', 0}} {
+		_, err = newRequest(len(raw), raw, false, false)
+		if !errors.Is(err, ErrIllegalOperation) {
+			t.Fatalf("Should be an illegal operation error for %v, got: %v\n", raw, err)
+		}
+	}
+}
+
+func TestNewRequestStrict(t *testing.T) {
+	for _, raw := range [][]byte{{0, 4, 0, 1, 0}, {0, 5, 0, 1, 'x', 0, 'y'}} {
+		_, err := newRequest(len(raw), raw, false, false)
+		if err != nil {
+			t.Fatalf("Error should be nil for %v, got: %v\n", raw, err)
+		}
+
+		_, err = newRequest(len(raw), raw, true, false)
+		if !errors.Is(err, ErrIllegalOperation) {
+			t.Fatalf("Should be an illegal operation error for %v, got: %v\n", raw, err)
+		}
+	}
+}
+
+func TestNewRequestLenient(t *testing.T) {
+	for _, raw := range []string{
+		"\x00\x01f\x00OCTET\x00",
+		"\x00\x02f\x00Octet\x00",
+		"\x00\x01f\x00octet\x00\x00\x00\x00",
+		"\x00\x01f\x00octet",
+		"\x00\x01f\x00octet\x00blksize\x00512\x00\xff\xfe",
+	} {
+		req, err := newRequest(len(raw), []byte(raw), false, true)
+		if err != nil {
+			t.Fatalf("Error should be nil for %q, got: %v\n", raw, err)
+		}
+		if req.filename != "f" || req.mode != "octet" {
+			t.Fatalf("Incorrect request for %q: %+v\n", raw, req)
+		}
+
+		for _, strict := range []bool{false, true} {
+			if _, err := newRequest(len(raw), []byte(raw), strict, strict); err == nil {
+				t.Fatalf("Error should not be nil for %q with strict %v\n", raw, strict)
+			}
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	err := fmt.Errorf("opening file: %w", NewError(CodeFileNotFound, "No firmware for this device."))
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("Should match ErrFileNotFound: %v\n", err)
+	}
+	if errors.Is(err, ErrAccessViolation) {
+		t.Fatalf("Shouldn't match ErrAccessViolation: %v\n", err)
+	}
+
+	var tftpErr *Error
+	if !errors.As(err, &tftpErr) || tftpErr.Message != "No firmware for this device." {
+		t.Fatalf("Incorrect error: %v\n", tftpErr)
+	}
+
+	if err := NewError(42); err.Code != CodeNotDefined {
+		t.Fatalf("Unknown codes should become CodeNotDefined, got %v\n", err.Code)
+	}
+	if err := NewError(CodeDiskFull); err.Message != "Disk full or allocation exceeded." {
+		t.Fatalf("Incorrect default message '%v'\n", err.Message)
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	tftp := &TFTPServer{
+		ErrorMessages: map[ErrorCode]string{
+			CodeFileNotFound: "File not found, see https://example.com/tftp.",
+		},
+	}
+	cli := newClient(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234})
+	tftp.sendError(cli, ErrFileNotFound)
+	tftp.sendError(cli, ErrAccessViolation)
+
+	for i, want := range []string{"File not found, see https://example.com/tftp.", "Access violation."} {
+		pkt, err := wire.Unmarshal(tftp.outgoing[i].Buffers[0])
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if msg := pkt.(*wire.Error).Message; msg != want {
+			t.Fatalf("Incorrect message '%v', should be '%v'\n", msg, want)
+		}
+	}
+}
+
+func TestFsError(t *testing.T) {
+	for _, v := range []struct {
+		err    error
+		expect error
+	}{
+		{&fs.PathError{Op: "open", Path: "f", Err: fs.ErrNotExist}, ErrFileNotFound},
+		{&fs.PathError{Op: "open", Path: "f", Err: fs.ErrPermission}, ErrAccessViolation},
+		{&fs.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC}, ErrDiskFull},
+		{io.ErrShortWrite, io.ErrShortWrite},
+	} {
+		if err := fsError(v.err); err != v.expect {
+			t.Fatalf("Incorrect error for '%v': %v, should be %v\n", v.err, err, v.expect)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tftp := &TFTPServer{MaxBlockSize: 1024}
+	for _, v := range []struct {
+		options wire.Options
+		oack    wire.Options
+	}{
+		{wire.Options{{Name: "blksize", Value: "1000"}}, wire.Options{{Name: "blksize", Value: "1000"}}},
+		{wire.Options{{Name: "BLKSIZE", Value: "1428"}, {Name: "timeout", Value: "3"}}, wire.Options{{Name: "BLKSIZE", Value: "1024"}, {Name: "timeout", Value: "3"}}},
+		{wire.Options{{Name: "tsize", Value: "0"}, {Name: "unknown", Value: "x"}}, wire.Options{{Name: "tsize", Value: "0"}}},
+		{wire.Options{{Name: "utimeout", Value: "50000"}, {Name: "timeout", Value: "1"}}, wire.Options{{Name: "utimeout", Value: "50000"}, {Name: "timeout", Value: "1"}}},
+		{wire.Options{{Name: "windowsize", Value: "1000"}}, wire.Options{{Name: "windowsize", Value: "64"}}},
+	} {
+		cli := newClient(nil)
+		err := tftp.negotiate(cli, &request{opcode: wire.OpRRQ, options: v.options})
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if !reflect.DeepEqual(cli.oack, v.oack) {
+			t.Fatalf("Incorrect OACK options %v, should be %v\n", cli.oack, v.oack)
+		}
+		if _, ok := v.options.Get("utimeout"); ok && tftp.timeout(cli) != 50*time.Millisecond {
+			t.Fatalf("Incorrect timeout %v, should be 50ms\n", tftp.timeout(cli))
+		}
+	}
+
+	for _, opt := range []wire.Option{{Name: "blksize", Value: "4"}, {Name: "blksize", Value: "65465"}, {Name: "blksize", Value: "x"}, {Name: "timeout", Value: "0"}, {Name: "utimeout", Value: "9999"}, {Name: "windowsize", Value: "0"}, {Name: "tsize", Value: "-1"}} {
+		err := tftp.negotiate(newClient(nil), &request{opcode: wire.OpWRQ, options: wire.Options{opt}})
+		if !errors.Is(err, ErrOptionNegotiation) {
+			t.Fatalf("Option %v should fail the negotiation, got: %v\n", opt, err)
+		}
+	}
 }
 
-func TestToCString(t *testing.T) {
-	for _, v := range cStringTestData {
-		converted := toCString(v.str)
-		if !reflect.DeepEqual(converted, v.cString) {
-			t.Fatalf("C strings are not equal. %v and %v\n", converted, v.cString)
+func TestPSK(t *testing.T) {
+	nonce := NewPSKNonce()
+	tftp := &TFTPServer{PreSharedKey: []byte("key")}
+	for _, v := range []struct {
+		options wire.Options
+		err     error
+	}{
+		{wire.Options{{Name: "x-psk", Value: nonce}}, nil},
+		{wire.Options{{Name: "blksize", Value: "16"}, {Name: "x-psk", Value: nonce}}, ErrOptionNegotiation},
+		{wire.Options{{Name: "x-psk", Value: "00"}}, ErrOptionNegotiation},
+	} {
+		cli := newClient(nil)
+		err := tftp.negotiate(cli, &request{opcode: wire.OpRRQ, options: v.options})
+		if !errors.Is(err, v.err) {
+			t.Fatalf("Error should be %v for %v, got: %v\n", v.err, v.options, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		// both ends derive the same key, blocks only open at their offset
+		reply, _ := cli.oack.Get(PSKOption)
+		c, err := NewPSKCipher([]byte("key"), nonce, reply)
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		sealed := c.Seal(nil, []byte("block"), 512)
+		if b, err := cli.psk.Open(nil, sealed, 512); err != nil || string(b) != "block" {
+			t.Fatalf("Incorrect block '%s': %v\n", b, err)
 		}
+		if _, err := cli.psk.Open(nil, sealed, 1024); err == nil {
+			t.Fatalf("Block at another offset should fail\n")
+		}
+	}
+
+	tftp.RequirePSK = true
+	if err := tftp.negotiate(newClient(nil), &request{opcode: wire.OpRRQ}); !errors.Is(err, ErrAccessViolation) {
+		t.Fatalf("Transfer in the clear should fail, got: %v\n", err)
 	}
 }
 
-func TestReadCString(t *testing.T) {
-	for _, v := range cStringTestData {
-		n, correctStr, err := readCString(v.cString)
+func TestMTU(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1024}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1024}
+	for _, v := range []struct {
+		mtu, maxBlockSize int
+		client            net.Addr
+		want              string
+	}{
+		{1500, 0, v4, "1468"},
+		{1500, 0, v6, "1448"},
+		{1500, 1024, v4, "1024"},
+		{9000, 0, v4, "2000"},
+		{500, 0, v4, "512"},
+		{-1, 0, v4, "2000"},
+		// the MTU of other networks isn't known
+		{1500, 0, tftptest.Addr("a"), "2000"},
+	} {
+		tftp := &TFTPServer{MTU: v.mtu, MaxBlockSize: v.maxBlockSize}
+		cli := newClient(v.client)
+		err := tftp.negotiate(cli, &request{opcode: wire.OpRRQ, options: wire.Options{{Name: "blksize", Value: "2000"}}})
 		if err != nil {
 			t.Fatalf("Error should be nil, got: %v\n", err)
 		}
-		if n != len(v.cString) {
-			t.Fatalf("Incorrect number of read bytes. Got %v, should be %v\n", n, len(v.cString))
+		if got, _ := cli.oack.Get("blksize"); got != v.want {
+			t.Fatalf("Incorrect blksize %v with MTU %v to %v, should be %v\n", got, v.mtu, v.client, v.want)
+		}
+	}
+}
+
+func TestDatagramSize(t *testing.T) {
+	for _, v := range []struct {
+		maxDatagramSize, maxBlockSize int
+		want                          int
+	}{
+		{0, 0, bodyMaxSize},
+		{0, 1024, bodyMaxSize},
+		{0, 8192, 8196},
+		{9000, 0, 9000},
+		{9000, 1024, 9000},
+		{100000, 0, 65468},
+		{0, 100000, 65468},
+	} {
+		tftp := &TFTPServer{MaxDatagramSize: v.maxDatagramSize, MaxBlockSize: v.maxBlockSize}
+		if got := tftp.datagramSize(); got != v.want {
+			t.Fatalf("Incorrect datagram size %v with %v and blksize %v, should be %v\n", got, v.maxDatagramSize, v.maxBlockSize, v.want)
+		}
+	}
+
+	// uploads with jumbo blocks arrive in one piece
+	dir := t.TempDir()
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	conn, _ := network.ListenPacket("client")
+	server := NewTFTPServerConn(listener)
+	server.Root = dir
+	server.MTU = -1
+	server.MaxDatagramSize = 9000
+	go server.ListenAndServe()
+	defer server.Close()
+
+	block := bytes.Repeat([]byte("x"), 8192)
+	mock := tftptest.NewMockClient(conn, tftptest.Addr("server"))
+	err := mock.Run(
+		tftptest.Step{
+			Send:   &wire.WriteRequest{Filename: "f", Mode: "octet", Options: wire.Options{{Name: "blksize", Value: "8192"}}},
+			Expect: &wire.OptionAck{Options: wire.Options{{Name: "blksize", Value: "8192"}}},
+		},
+		tftptest.Step{Send: &wire.Data{Block: 1, Payload: block}, Expect: &wire.Ack{Block: 1}},
+		tftptest.Step{Send: &wire.Data{Block: 2, Payload: []byte("abc")}, Expect: &wire.Ack{Block: 2}},
+	)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "f"))
+	if !bytes.Equal(got, append(block, "abc"...)) {
+		t.Fatalf("Incorrect upload of %v bytes\n", len(got))
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+	tftp := NewTFTPServerConn(a)
+
+	rrq, _ := wire.Marshal(&wire.ReadRequest{Filename: "missing", Mode: "octet"})
+	for _, mode := range []TraceMode{TraceOff, TraceSummary, TraceHexdump} {
+		tftp.SetTrace(mode)
+		tftp.handleConnection(peer.LocalAddr(), len(rrq), rrq)
+		tftp.flush()
+	}
+
+	addr := peer.LocalAddr().String()
+	for _, v := range []struct {
+		line  string
+		count int
+	}{
+		{"recv " + addr + ": RRQ 'missing' octet\n", 2},
+		{"send " + addr + ": ERROR 1 'File not found.'\n", 2},
+		{"00000000  00 01 6d 69 73 73 69 6e  67 00 6f 63 74 65 74 00  |..missing.octet.|", 1},
+	} {
+		if n := strings.Count(logs.String(), v.line); n != v.count {
+			t.Fatalf("'%v' should be logged %v times, got %v:\n%v\n", v.line, v.count, n, logs.String())
+		}
+	}
+}
+
+func TestPcapWriter(t *testing.T) {
+	payload, _ := wire.Marshal(&wire.Ack{Block: 7})
+	for _, v := range []struct {
+		src, dst net.Addr
+		ipSize   int
+	}{
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 69}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1234}, 20},
+		{&net.UDPAddr{IP: net.IPv6unspecified, Port: 69}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1234}, 20},
+		{&net.UDPAddr{IP: net.IPv6loopback, Port: 69}, &net.UDPAddr{IP: net.IPv6loopback, Port: 1234}, 40},
+	} {
+		var buf bytes.Buffer
+		w, _ := NewPcapWriter(&buf)
+		w.WritePacket(time.Unix(1700000000, 5000), v.src, v.dst, payload)
+
+		records := readPcap(t, buf.Bytes())
+		if len(records) != 1 || len(records[0]) != v.ipSize+8+len(payload) {
+			t.Fatalf("Incorrect capture of %v to %v: %v\n", v.src, v.dst, records)
+		}
+		ip, udp := records[0][:v.ipSize], records[0][v.ipSize:]
+		if v.ipSize == 20 && sum16(0, ip) != 0xffff {
+			t.Fatalf("Incorrect IPv4 header checksum: %v\n", ip)
+		}
+		// the addresses end the IP header in both versions
+		addrs := ip[12:]
+		if v.ipSize == 40 {
+			addrs = ip[8:]
+		}
+		if sum16(sum16(0, addrs)+17+uint32(len(udp)), udp) != 0xffff {
+			t.Fatalf("Incorrect UDP checksum: %v\n", udp)
+		}
+		if !bytes.Equal(udp[8:], payload) || binary.BigEndian.Uint16(udp) != 69 || binary.BigEndian.Uint16(udp[2:]) != 1234 {
+			t.Fatalf("Incorrect UDP datagram: %v\n", udp)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	var buf bytes.Buffer
+	tftp := NewTFTPServerConn(a)
+	tftp.Capture, _ = NewPcapWriter(&buf)
+	tftp.CaptureDir = t.TempDir()
+
+	rrq, _ := wire.Marshal(&wire.ReadRequest{Filename: "missing", Mode: "octet"})
+	ack, _ := wire.Marshal(&wire.Ack{Block: 1})
+	tftp.handleConnection(peer.LocalAddr(), len(ack), ack)
+	tftp.handleConnection(peer.LocalAddr(), len(rrq), rrq)
+	tftp.flush()
+
+	if records := readPcap(t, buf.Bytes()); len(records) != 4 {
+		t.Fatalf("All packets should be captured, got %v\n", len(records))
+	}
+
+	// only the session of the RRQ gets a file
+	files, _ := filepath.Glob(filepath.Join(tftp.CaptureDir, "*.pcap"))
+	if len(files) != 1 {
+		t.Fatalf("Incorrect session captures: %v\n", files)
+	}
+	session, _ := os.ReadFile(files[0])
+	records := readPcap(t, session)
+	if len(records) != 2 || !bytes.HasSuffix(records[0], rrq) {
+		t.Fatalf("Incorrect session capture: %v\n", records)
+	}
+}
+
+// readPcap returns the packets of a capture.
+func readPcap(t *testing.T, b []byte) [][]byte {
+	if len(b) < 24 || binary.LittleEndian.Uint32(b) != pcapMagic || binary.LittleEndian.Uint32(b[20:]) != pcapLinkRaw {
+		t.Fatalf("Incorrect pcap header: %v\n", b)
+	}
+
+	var records [][]byte
+	for b = b[24:]; len(b) >= 16; {
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		records = append(records, b[16:16+n])
+		b = b[16+n:]
+	}
+	return records
+}
+
+func TestAudit(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", []byte("abc"), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	var buf bytes.Buffer
+	tftp := NewTFTPServerConn(a)
+	tftp.Audit = NewAuditLog(&buf)
+
+	for _, pkt := range []wire.Packet{
+		&wire.ReadRequest{Filename: "f", Mode: "octet", Options: wire.Options{{Name: "blksize", Value: "1024"}}},
+		&wire.Ack{Block: 0},
+		&wire.Ack{Block: 1},
+		&wire.ReadRequest{Filename: "missing", Mode: "octet"},
+		&wire.WriteRequest{Filename: "g", Mode: "octet"},
+		&wire.Error{Code: uint16(CodeDiskFull), Message: "Disk full."},
+		// an unknown TID isn't a transfer
+		&wire.Ack{Block: 1},
+	} {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	}
+
+	var records []AuditRecord
+	sessions := map[string]bool{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec AuditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if rec.Session == "" || sessions[rec.Session] {
+			t.Fatalf("Session ID '%v' should be unique\n", rec.Session)
+		}
+		sessions[rec.Session] = true
+		rec.Time, rec.Duration, rec.Session = time.Time{}, 0, ""
+		records = append(records, rec)
+	}
+
+	addr := peer.LocalAddr().String()
+	want := []AuditRecord{
+		{Client: addr, Filename: "f", Direction: "read", Bytes: 3, Result: "ok", Options: map[string]string{"blksize": "1024"}},
+		{Client: addr, Filename: "missing", Direction: "read", Result: "error", ErrorCode: CodeFileNotFound, Error: "File not found."},
+		{Client: addr, Filename: "g", Direction: "write", Result: "error", ErrorCode: CodeDiskFull, Error: "Disk full."},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("Incorrect audit records %+v, should be %+v\n", records, want)
+	}
+}
+
+const sha256abc = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+
+func TestRetransmit(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", []byte("abc"), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	var buf bytes.Buffer
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(a)
+	tftp.Clock = clock
+	tftp.Timeout, tftp.Retries = time.Second, 2
+	tftp.Audit = NewAuditLog(&buf)
+
+	raw, _ := wire.Marshal(&wire.ReadRequest{Filename: "f", Mode: "octet"})
+	tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	tftp.flush()
+
+	for i, v := range []struct {
+		advance time.Duration
+		resent  bool
+	}{
+		{0, false},
+		{999 * time.Millisecond, false},
+		{time.Millisecond, true},
+		{time.Second, true},
+		// out of retries
+		{time.Second, false},
+	} {
+		clock.Advance(v.advance)
+		tftp.retransmit(clock.Now())
+		if resent := len(tftp.outgoing) > 0; resent != v.resent {
+			t.Fatalf("Step %v: resent should be %v\n", i, v.resent)
+		}
+		tftp.flush()
+	}
+
+	if len(tftp.connections) != 0 {
+		t.Fatalf("Session should have timed out\n")
+	}
+	if stats := tftp.Stats(); stats.Retransmits != 2 || stats.SessionsFailed != 1 {
+		t.Fatalf("Incorrect stats %+v\n", stats)
+	}
+	var rec AuditRecord
+	json.Unmarshal(buf.Bytes(), &rec)
+	if rec.Duration != 3*time.Second || !rec.Time.Equal(clock.Now()) || rec.Error != "Transfer timed out." {
+		t.Fatalf("Incorrect audit record %+v\n", rec)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", []byte("abc"), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(a)
+	tftp.Clock = clock
+	tftp.Timeout, tftp.Retries = time.Second, 3
+	tftp.Backoff, tftp.MaxTimeout = 2, 3*time.Second
+
+	raw, _ := wire.Marshal(&wire.ReadRequest{Filename: "f", Mode: "octet"})
+	tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	tftp.flush()
+
+	for i, v := range []struct {
+		advance time.Duration
+		resent  bool
+	}{
+		{time.Second, true},
+		{2*time.Second - time.Millisecond, false},
+		{time.Millisecond, true},
+		// limited by MaxTimeout
+		{3 * time.Second, true},
+		{3 * time.Second, false},
+	} {
+		clock.Advance(v.advance)
+		tftp.retransmit(clock.Now())
+		if resent := len(tftp.outgoing) > 0; resent != v.resent {
+			t.Fatalf("Step %v: resent should be %v\n", i, v.resent)
+		}
+		tftp.flush()
+	}
+	if len(tftp.connections) != 0 {
+		t.Fatalf("Session should have timed out\n")
+	}
+
+	// jitter stays within its fraction of the timeout
+	tftp.Backoff, tftp.Jitter = 0, 0.1
+	now := clock.Now()
+	for i := 0; i < 100; i++ {
+		d := tftp.retryDeadline(newClient(peer.LocalAddr()), now).Sub(now)
+		if d < 900*time.Millisecond || d > 1100*time.Millisecond {
+			t.Fatalf("Incorrect timeout %v with jitter\n", d)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	data := make([]byte, 5*512+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	os.WriteFile("f", data, 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	tftp := NewTFTPServerConn(a)
+	blocks := func() []uint16 {
+		var blocks []uint16
+		for _, msg := range tftp.outgoing {
+			// the OACK isn't numbered
+			if op := wire.Opcode(binary.BigEndian.Uint16(msg.Buffers[0])); op == wire.OpDATA || op == wire.OpACK {
+				blocks = append(blocks, binary.BigEndian.Uint16(msg.Buffers[0][2:]))
+			}
+		}
+		return blocks
+	}
+	window := wire.Options{{Name: "windowsize", Value: "4"}}
+
+	for i, v := range []struct {
+		packet wire.Packet
+		blocks []uint16
+	}{
+		{&wire.ReadRequest{Filename: "f", Mode: "octet", Options: window}, nil},
+		{&wire.Ack{Block: 0}, []uint16{1, 2, 3, 4}},
+		// block 3 got lost, only 3 and 4 are sent again and the window
+		// shrinks to 2
+		{&wire.Ack{Block: 2}, []uint16{3, 4}},
+		{&wire.Ack{Block: 2}, nil},
+		// it grows to 3 once a window goes through
+		{&wire.Ack{Block: 4}, []uint16{5, 6}},
+		{&wire.Ack{Block: 5}, []uint16{6}},
+		{&wire.Ack{Block: 6}, nil},
+	} {
+		raw, _ := wire.Marshal(v.packet)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		if blocks := blocks(); !reflect.DeepEqual(blocks, v.blocks) {
+			t.Fatalf("Step %v: sent blocks %v, should be %v\n", i, blocks, v.blocks)
+		}
+		tftp.flush()
+	}
+	if len(tftp.connections) != 0 || tftp.Stats().Retransmits != 3 {
+		t.Fatalf("Download should have completed with 3 retransmits: %+v\n", tftp.Stats())
+	}
+
+	block := func(n uint16) wire.Packet {
+		end := int(n) * 512
+		if end > len(data) {
+			end = len(data)
+		}
+		return &wire.Data{Block: n, Payload: data[int(n-1)*512 : end]}
+	}
+	window = wire.Options{{Name: "windowsize", Value: "3"}}
+	for i, v := range []struct {
+		packet wire.Packet
+		blocks []uint16
+	}{
+		{&wire.WriteRequest{Filename: "g", Mode: "octet", Options: window}, nil},
+		{block(1), nil},
+		{block(2), nil},
+		{block(3), []uint16{3}},
+		// block 4 got lost, the gap is answered once
+		{block(5), []uint16{3}},
+		{block(6), nil},
+		{block(4), nil},
+		{block(5), nil},
+		{block(6), []uint16{6}},
+	} {
+		raw, _ := wire.Marshal(v.packet)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		if blocks := blocks(); !reflect.DeepEqual(blocks, v.blocks) {
+			t.Fatalf("Upload step %v: sent ACKs %v, should be %v\n", i, blocks, v.blocks)
+		}
+		tftp.flush()
+	}
+	if got, _ := os.ReadFile("g"); !bytes.Equal(got, data) {
+		t.Fatalf("Uploaded file differs\n")
+	}
+
+	// loss of blocks sent before the window shrank doesn't shrink it again
+	cli := newClient(nil)
+	cli.windowSize, cli.cwnd, cli.block = 8, 8, 10
+	for i, v := range []struct {
+		acked uint16
+		cwnd  int
+	}{
+		{5, 4},
+		{7, 4},
+		{10, 2},
+		{10, 1},
+	} {
+		cli.shrinkWindow(v.acked)
+		if cli.cwnd != v.cwnd {
+			t.Fatalf("Step %v: window should be %v, got %v\n", i, v.cwnd, cli.cwnd)
+		}
+	}
+}
+
+func TestPartialUploads(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("existing", []byte("abc"), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	for _, v := range []struct {
+		remove   bool
+		filename string
+		exists   bool
+	}{
+		{false, "kept", true},
+		{true, "removed", false},
+		// a rejected upload never touches the file
+		{true, "existing", true},
+	} {
+		tftp := NewTFTPServerConn(a)
+		tftp.RemovePartialUploads = v.remove
+
+		for _, pkt := range []wire.Packet{
+			&wire.WriteRequest{Filename: v.filename, Mode: "octet"},
+			&wire.Data{Block: 1, Payload: make([]byte, 512)},
+			&wire.Error{Code: uint16(CodeNotDefined), Message: "Cancelled."},
+		} {
+			raw, _ := wire.Marshal(pkt)
+			tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		}
+
+		if len(tftp.connections) != 0 {
+			t.Fatalf("Session of '%v' should have ended\n", v.filename)
+		}
+		if _, err := os.Stat(v.filename); (err == nil) != v.exists {
+			t.Fatalf("'%v' should exist: %v, got: %v\n", v.filename, v.exists, err)
+		}
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", make([]byte, 1024), 0644)
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+
+	tftp := NewTFTPServerConn(listener)
+	tftp.MaxSessions = 2
+
+	// the retransmitted request of a makes b the least recently active
+	raw, _ := wire.Marshal(&wire.ReadRequest{Filename: "f", Mode: "octet"})
+	for _, client := range []string{"a", "b", "a", "c"} {
+		tftp.handleConnection(tftptest.Addr(client), len(raw), raw)
+	}
+	tftp.flush()
+
+	var sessions []string
+	for _, cli := range tftp.connections {
+		sessions = append(sessions, cli.tid.String())
+	}
+	sort.Strings(sessions)
+	if !reflect.DeepEqual(sessions, []string{"a", "c"}) {
+		t.Fatalf("Incorrect sessions %v\n", sessions)
+	}
+	if stats := tftp.Stats(); stats.SessionsFailed != 1 || stats.ActiveSessions != 2 {
+		t.Fatalf("Incorrect stats %+v\n", stats)
+	}
+}
+
+func TestRejectWhenFull(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", make([]byte, 1024), 0644)
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+
+	tftp := NewTFTPServerConn(listener)
+	tftp.MaxSessions = 2
+	tftp.RejectWhenFull = true
+
+	raw, _ := wire.Marshal(&wire.ReadRequest{Filename: "f", Mode: "octet"})
+	busy := &wire.Error{Code: uint16(CodeNotDefined), Message: "Server busy, try again later."}
+	for i, v := range []struct {
+		client string
+		drop   bool
+		reply  wire.Packet
+	}{
+		{"a", false, &wire.Data{Block: 1, Payload: make([]byte, 512)}},
+		{"b", false, &wire.Data{Block: 1, Payload: make([]byte, 512)}},
+		// the sessions in flight are kept
+		{"c", false, busy},
+		{"d", true, nil},
+		// packets of sessions in flight are still answered
+		{"a", false, &wire.Data{Block: 1, Payload: make([]byte, 512)}},
+	} {
+		tftp.DropWhenBusy = v.drop
+		tftp.handleConnection(tftptest.Addr(v.client), len(raw), raw)
+		var got wire.Packet
+		if len(tftp.outgoing) > 0 {
+			got, _ = wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		}
+		tftp.flush()
+		if !reflect.DeepEqual(got, v.reply) {
+			t.Fatalf("%v: Incorrect reply %v, should be %v\n", i, got, v.reply)
+		}
+	}
+	if stats := tftp.Stats(); stats.ActiveSessions != 2 || stats.SessionsStarted != 2 || stats.Rejected != 2 {
+		t.Fatalf("Incorrect stats %+v\n", stats)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(a)
+	tftp.Clock = clock
+	tftp.MaxViolations = 3
+
+	stale, _ := wire.Marshal(&wire.Ack{Block: 1})
+	rrq, _ := wire.Marshal(&wire.ReadRequest{Filename: "missing", Mode: "octet"})
+	for i, v := range []struct {
+		advance  time.Duration
+		packet   []byte
+		answered bool
+	}{
+		{0, stale, true},
+		{0, stale, true},
+		{0, stale, true},
+		// blocked for a minute
+		{0, rrq, false},
+		{59 * time.Second, rrq, false},
+		{2 * time.Second, rrq, true},
+		{0, stale, true},
+		{0, stale, true},
+		{0, stale, true},
+		// blocked for two minutes
+		{61 * time.Second, rrq, false},
+		{60 * time.Second, rrq, true},
+	} {
+		clock.Advance(v.advance)
+		tftp.handleConnection(peer.LocalAddr(), len(v.packet), v.packet)
+		if answered := len(tftp.outgoing) > 0; answered != v.answered {
+			t.Fatalf("Step %v: answered should be %v\n", i, v.answered)
+		}
+		tftp.flush()
+	}
+
+	if stats := tftp.Stats(); stats.Blocks != 2 || stats.Dropped != 3 {
+		t.Fatalf("Incorrect stats %+v\n", stats)
+	}
+}
+
+func TestSecurityLog(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", []byte("abc"), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	var buf bytes.Buffer
+	tftp := NewTFTPServerConn(a)
+	tftp.Clock = tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp.SecurityLog = NewSecurityLog(&buf)
+	tftp.ReadOnly = true
+	tftp.MaxViolations = 1
+
+	for _, pkt := range []wire.Packet{
+		&wire.ReadRequest{Filename: "f", Mode: "octet"},
+		&wire.Ack{Block: 1},
+		&wire.WriteRequest{Filename: "g", Mode: "octet"},
+		&wire.Ack{Block: 2},
+	} {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	}
+	raw, _ := wire.Marshal(&wire.WriteRequest{Filename: "g", Mode: "octet"})
+	tftp.handleConnection(tftptest.Addr("other"), len(raw), raw)
+
+	want := fmt.Sprintf(`2023-11-14T22:13:20Z event=access-denied client=%[1]v port=0 filename="g" reason="Access violation."
+2023-11-14T22:13:20Z event=protocol-violation client=%[1]v port=0 filename="" reason="Unknown transfer ID."
+2023-11-14T22:13:20Z event=blocked client=%[1]v port=0 filename="" reason="Blocked for 1m0s."
+2023-11-14T22:13:20Z event=access-denied client=other port=0 filename="g" reason="Access violation."
+`, peer.LocalAddr())
+	if buf.String() != want {
+		t.Fatalf("Incorrect security log %q, should be %q\n", buf.String(), want)
+	}
+}
+
+func TestMalformedPackets(t *testing.T) {
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	var buf, logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	tftp := NewTFTPServerConn(a)
+	tftp.Clock = tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp.SecurityLog = NewSecurityLog(&buf)
+
+	var want string
+	for _, raw := range [][]byte{{1}, {0, 3, 0}, {0, 1, 'f', 0}} {
+		_, err := wire.Unmarshal(raw)
+		want += fmt.Sprintf("2023-11-14T22:13:20Z event=protocol-violation client=%v port=0 filename=\"\" reason=%q\n", peer.LocalAddr(), "Malformed packet: "+err.Error())
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	}
+	if buf.String() != want {
+		t.Fatalf("Incorrect security log %q, should be %q\n", buf.String(), want)
+	}
+	if n := tftp.Stats().Errors[CodeIllegalOperation]; n != 3 {
+		t.Fatalf("Illegal operations should be 3, got %v\n", n)
+	}
+	if logged.Len() > 0 {
+		t.Fatalf("Malformed packets shouldn't be logged, got %q\n", logged.String())
+	}
+}
+
+func TestFilter(t *testing.T) {
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	var seen []string
+	tftp := NewTFTPServerConn(a)
+	tftp.Filter = func(addr net.Addr, packet []byte) bool {
+		seen = append(seen, fmt.Sprintf("%v %x", addr, packet))
+		return len(packet) < 8
+	}
+
+	for _, v := range []struct {
+		packet   []byte
+		answered bool
+	}{
+		{[]byte{0, 4, 0, 1}, true},
+		{[]byte{0, 4, 0, 1, 0, 0, 0, 0}, false},
+	} {
+		tftp.handleConnection(peer.LocalAddr(), len(v.packet), v.packet)
+		if answered := len(tftp.outgoing) > 0; answered != v.answered {
+			t.Fatalf("Packet %x: answered should be %v\n", v.packet, v.answered)
+		}
+		tftp.flush()
+	}
+
+	want := []string{"b 00040001", "b 0004000100000000"}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("Incorrect packets seen %v, should be %v\n", seen, want)
+	}
+	if stats := tftp.Stats(); stats.Dropped != 1 {
+		t.Fatalf("Incorrect stats %+v\n", stats)
+	}
+}
+
+func TestOnConflict(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	for _, v := range []struct {
+		policy ConflictPolicy
+		want   []string
+	}{
+		{RejectConflicts, []string{"backup"}},
+		{NumberConflicts, []string{"backup", "backup.1", "backup.2"}},
+		{TimestampConflicts, []string{"backup", "backup.20231114-221320", "backup.20231114-221320.1"}},
+	} {
+		os.Chdir(t.TempDir())
+		os.WriteFile("backup", []byte("old"), 0644)
+
+		tftp := NewTFTPServerConn(a)
+		tftp.Clock = tftptest.NewClock(time.Unix(1700000000, 0))
+		tftp.OnConflict = v.policy
+		for i := 0; i < 2; i++ {
+			for _, pkt := range []wire.Packet{
+				&wire.WriteRequest{Filename: "backup", Mode: "octet"},
+				&wire.Data{Block: 1, Payload: []byte("new")},
+			} {
+				raw, _ := wire.Marshal(pkt)
+				tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+			}
+			tftp.closeSessions()
+		}
+
+		entries, _ := os.ReadDir(".")
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if !reflect.DeepEqual(names, v.want) {
+			t.Fatalf("Incorrect files %v, should be %v\n", names, v.want)
 		}
-		if correctStr != v.str {
-			t.Fatalf("Incorrect reading of C string %v. Got '%v', should be '%v'\n", v.cString, correctStr, v.str)
+		if b, _ := os.ReadFile("backup"); string(b) != "old" {
+			t.Fatalf("Existing file was overwritten\n")
 		}
 	}
+}
+
+func TestRoot(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.Mkdir("vlan10", 0755)
+	os.WriteFile("secret", []byte("secret"), 0644)
+	os.WriteFile("vlan10/f", []byte("vlan10"), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	for _, v := range []struct {
+		packet wire.Packet
+		reply  wire.Packet
+		file   string
+	}{
+		{&wire.ReadRequest{Filename: "f", Mode: "octet"}, &wire.Data{Block: 1, Payload: []byte("vlan10")}, ""},
+		{&wire.ReadRequest{Filename: "../secret", Mode: "octet"}, &wire.Error{Code: uint16(CodeFileNotFound), Message: "File not found."}, ""},
+		{&wire.WriteRequest{Filename: "/new", Mode: "octet"}, &wire.Ack{Block: 0}, "vlan10/new"},
+	} {
+		tftp := NewTFTPServerConn(a)
+		tftp.Root = "vlan10"
+		raw, _ := wire.Marshal(v.packet)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+
+		reply, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		if !reflect.DeepEqual(reply, v.reply) {
+			t.Fatalf("Incorrect reply %v, should be %v\n", reply, v.reply)
+		}
+		tftp.flush()
+		tftp.closeSessions()
+		if _, err := os.Stat(v.file); v.file != "" && err != nil {
+			t.Fatalf("Upload should be written to %v: %v\n", v.file, err)
+		}
+	}
+}
+
+func TestTraversal(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.Mkdir("srv", 0755)
+	os.Mkdir("srv/pub", 0755)
+	os.WriteFile("secret", []byte("outside"), 0644)
+	os.WriteFile("srv/secret", []byte("inside"), 0644)
+	os.Chdir("srv")
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	everything := ACL{{Path: "**", Read: true, Write: true}}
+	public := ACL{{Path: "pub/**", Read: true, Write: true}}
+	denied := &wire.Error{Code: uint16(CodeAccessViolation), Message: "Access violation."}
+	for _, v := range []struct {
+		acl    ACL
+		packet wire.Packet
+		reply  wire.Packet
+		file   string
+	}{
+		{everything, &wire.ReadRequest{Filename: "../secret", Mode: "octet"}, &wire.Data{Block: 1, Payload: []byte("inside")}, ""},
+		{everything, &wire.ReadRequest{Filename: "../../../../etc/hostname", Mode: "octet"}, &wire.Error{Code: uint16(CodeFileNotFound), Message: "File not found."}, ""},
+		{everything, &wire.WriteRequest{Filename: "../new", Mode: "octet"}, &wire.Ack{Block: 0}, "new"},
+		{public, &wire.ReadRequest{Filename: "pub/../secret", Mode: "octet"}, denied, ""},
+		{public, &wire.WriteRequest{Filename: "pub/../../new2", Mode: "octet"}, denied, ""},
+	} {
+		tftp := NewTFTPServerConn(a)
+		tftp.ACL = v.acl
+		raw, _ := wire.Marshal(v.packet)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
 
-	incorrect := cStringTestData[0].cString[:len(cStringTestData[0].cString)-1]
-	_, _, err := readCString(incorrect)
-	if err == nil {
-		t.Fatalf("Error shouldn't be nil\n")
+		reply, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		if !reflect.DeepEqual(reply, v.reply) {
+			t.Fatalf("Incorrect reply to %v: %v, should be %v\n", v.packet, reply, v.reply)
+		}
+		tftp.flush()
+		tftp.closeSessions()
+		if _, err := os.Stat(v.file); v.file != "" && err != nil {
+			t.Fatalf("Upload should be written to %v: %v\n", v.file, err)
+		}
+	}
+	for _, name := range []string{"../new", "../new2", "../../new2"} {
+		if _, err := os.Stat(name); err == nil {
+			t.Fatalf("Upload shouldn't be written to %v\n", name)
+		}
 	}
 }
+
+func TestPolicies(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.Mkdir("images", 0755)
+	os.Mkdir("configs", 0755)
+	os.WriteFile("images/big", make([]byte, 4096), 0644)
+	os.WriteFile("configs/big", make([]byte, 10), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	tooBig := &wire.Error{Code: uint16(CodeDiskFull), Message: "File exceeds the size limit."}
+	for _, v := range []struct {
+		packets []wire.Packet
+		reply   wire.Packet
+	}{
+		{
+			[]wire.Packet{&wire.ReadRequest{Filename: "images/big", Mode: "octet", Options: wire.Options{{Name: "blksize", Value: "2000"}}}},
+			&wire.OptionAck{Options: wire.Options{{Name: "blksize", Value: "1024"}}},
+		},
+		{
+			[]wire.Packet{&wire.ReadRequest{Filename: "images/../configs/big", Mode: "octet"}},
+			tooBig,
+		},
+		{
+			[]wire.Packet{&wire.WriteRequest{Filename: "configs/new", Mode: "octet", Options: wire.Options{{Name: "tsize", Value: "10"}}}},
+			tooBig,
+		},
+		{
+			[]wire.Packet{
+				&wire.WriteRequest{Filename: "configs/new", Mode: "octet"},
+				&wire.Data{Block: 1, Payload: []byte("12345")},
+			},
+			tooBig,
+		},
+		{
+			[]wire.Packet{
+				&wire.WriteRequest{Filename: "configs/new", Mode: "octet"},
+				&wire.Data{Block: 1, Payload: []byte("1234")},
+			},
+			&wire.Ack{Block: 1},
+		},
+		{
+			[]wire.Packet{&wire.WriteRequest{Filename: "configs/new", Mode: "octet"}},
+			&wire.Ack{Block: 0},
+		},
+	} {
+		numbered := NumberConflicts
+		tftp := NewTFTPServerConn(a)
+		tftp.MaxBlockSize = 512
+		tftp.Policies = Policies{
+			{Prefix: "images/", MaxBlockSize: 1024},
+			{Prefix: "configs/", MaxSize: 4, OnConflict: &numbered},
+		}
+		for _, pkt := range v.packets {
+			raw, _ := wire.Marshal(pkt)
+			tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		}
+
+		reply, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		if !reflect.DeepEqual(reply, v.reply) {
+			t.Fatalf("Incorrect reply %v, should be %v\n", reply, v.reply)
+		}
+		tftp.flush()
+		tftp.closeSessions()
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", make([]byte, 1000), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(a)
+	tftp.Clock = clock
+	tftp.Policies = Policies{{Bandwidth: 1024}}
+
+	for i, v := range []struct {
+		packet  wire.Packet
+		advance time.Duration
+		sent    bool
+	}{
+		// 512 bytes at 1 KiB/s are due after half a second
+		{&wire.ReadRequest{Filename: "f", Mode: "octet"}, 0, false},
+		{nil, 499 * time.Millisecond, false},
+		{nil, time.Millisecond, true},
+		{&wire.Ack{Block: 1}, 0, false},
+		{nil, 477 * time.Millisecond, true},
+		// the last block was sent, the session ends with its ACK
+		{&wire.Ack{Block: 2}, 0, false},
+	} {
+		if v.packet != nil {
+			raw, _ := wire.Marshal(v.packet)
+			tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		}
+		clock.Advance(v.advance)
+		tftp.retransmit(clock.Now())
+		if sent := len(tftp.outgoing) > 0; sent != v.sent {
+			t.Fatalf("Step %v: sent should be %v\n", i, v.sent)
+		}
+		tftp.flush()
+	}
+	if len(tftp.connections) != 0 || tftp.Stats().Retransmits != 0 {
+		t.Fatalf("Transfer should have completed without retransmits: %+v\n", tftp.Stats())
+	}
+}
+
+func TestServerBandwidth(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("image", make([]byte, 200<<10), 0644)
+	os.WriteFile("cfg", make([]byte, 600), 0644)
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(listener)
+	tftp.Clock = clock
+	tftp.Bandwidth = 100000
+	tftp.SmallTransfer = 1024
+	send := func(client string, pkt wire.Packet) bool {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(tftptest.Addr(client), len(raw), raw)
+		sent := len(tftp.outgoing) > 0
+		tftp.flush()
+		return sent
+	}
+
+	// the image uses up the burst of 64 KiB at once
+	send("bulk", &wire.ReadRequest{Filename: "image", Mode: "octet"})
+	block := uint16(1)
+	for ; send("bulk", &wire.Ack{Block: block}); block++ {
+	}
+	if block != 127 {
+		t.Fatalf("Image should be held after 64 KiB, not %v blocks\n", block)
+	}
+	// the configuration file goes first
+	if !send("small", &wire.ReadRequest{Filename: "cfg", Mode: "octet"}) {
+		t.Fatalf("Small transfer should be sent at once\n")
+	}
+	// the image waits until its block and the overdraft are paid off
+	for i, v := range []struct {
+		advance time.Duration
+		sent    bool
+	}{
+		{0, false},
+		{10 * time.Millisecond, false},
+		{time.Millisecond, true},
+	} {
+		clock.Advance(v.advance)
+		tftp.retransmit(clock.Now())
+		if sent := len(tftp.outgoing) > 0; sent != v.sent {
+			t.Fatalf("Step %v: sent should be %v\n", i, v.sent)
+		}
+		tftp.flush()
+	}
+	if tftp.Stats().Retransmits != 0 {
+		t.Fatalf("Held blocks aren't retransmissions\n")
+	}
+}
+
+func TestFairBandwidth(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("image", make([]byte, 200<<10), 0644)
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(listener)
+	tftp.Clock = clock
+	tftp.Bandwidth = 100000
+	tftp.SmallTransfer = 1024
+	// the clients the packets sent go to
+	sent := func() []string {
+		var clients []string
+		for _, msg := range tftp.outgoing {
+			clients = append(clients, msg.Addr.String())
+		}
+		tftp.flush()
+		return clients
+	}
+	send := func(client string, pkt wire.Packet) []string {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(tftptest.Addr(client), len(raw), raw)
+		return sent()
+	}
+
+	// the fast client uses up the burst
+	send("fast", &wire.ReadRequest{Filename: "image", Mode: "octet"})
+	block := uint16(1)
+	for ; len(send("fast", &wire.Ack{Block: block})) > 0; block++ {
+	}
+	// the other one waited less, so it's served first and then they take
+	// turns
+	if got := send("other", &wire.ReadRequest{Filename: "image", Mode: "octet"}); len(got) != 0 {
+		t.Fatalf("Other client should wait, %v sent\n", got)
+	}
+	var order []string
+	for len(order) < 4 {
+		clock.Advance(6 * time.Millisecond)
+		tftp.retransmit(clock.Now())
+		for _, client := range sent() {
+			order = append(order, client)
+			if client == "fast" {
+				block++
+			}
+			ack := &wire.Ack{Block: 1}
+			if client == "fast" {
+				ack.Block = block
+			}
+			send(client, ack)
+		}
+	}
+	if !reflect.DeepEqual(order, []string{"other", "fast", "other", "fast"}) {
+		t.Fatalf("Incorrect order %v\n", order)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	a, _ := tftptest.Pipe()
+	defer a.Close()
+
+	device := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1024}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1024}
+	// entries are aged by the wall clock when the journal is opened
+	start := time.Now()
+	resume := wire.Options{{Name: ResumeOption, Value: "1000"}}
+	for i, v := range []struct {
+		client  net.Addr
+		packets []wire.Packet
+		reply   wire.Packet
+	}{
+		// interrupted by a restart after the first block
+		{device, []wire.Packet{&wire.WriteRequest{Filename: "f", Mode: "octet"}, &wire.Data{Block: 1, Payload: make([]byte, 512)}}, &wire.Ack{Block: 1}},
+		// resumed from the journal, not from what's on disk
+		{device, []wire.Packet{&wire.WriteRequest{Filename: "f", Mode: "octet", Options: resume}}, &wire.OptionAck{Options: wire.Options{{Name: ResumeOption, Value: "512"}}}},
+		// a plain retry starts again, others still get a conflict
+		{other, []wire.Packet{&wire.WriteRequest{Filename: "f", Mode: "octet"}}, &wire.Error{Code: uint16(CodeFileExists), Message: "File already exists."}},
+		{device, []wire.Packet{&wire.WriteRequest{Filename: "f", Mode: "octet"}, &wire.Data{Block: 1, Payload: []byte("abc")}}, &wire.Ack{Block: 1}},
+	} {
+		journal, err := OpenJournal("journal", time.Hour)
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		tftp := NewTFTPServerConn(a)
+		tftp.Clock = tftptest.NewClock(start)
+		tftp.Journal, tftp.Resume = journal, true
+		for _, pkt := range v.packets {
+			raw, _ := wire.Marshal(pkt)
+			tftp.handleConnection(v.client, len(raw), raw)
+		}
+		reply, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		if !reflect.DeepEqual(reply, v.reply) {
+			t.Fatalf("Step %v: incorrect reply %v, should be %v\n", i, reply, v.reply)
+		}
+		tftp.outgoing = nil
+		tftp.closeSessions()
+		journal.Close()
+
+		if i == 0 {
+			// written after the last record, it mustn't be trusted
+			f, _ := os.OpenFile("f", os.O_WRONLY|os.O_APPEND, 0)
+			f.Write(make([]byte, 100))
+			f.Close()
+		}
+	}
+
+	// completed uploads are dropped
+	journal, _ := OpenJournal("journal", time.Hour)
+	if entries := journal.Entries(); len(entries) != 0 {
+		t.Fatalf("Journal should be empty, got %+v\n", entries)
+	}
+	if b, _ := os.ReadFile("f"); string(b) != "abc" {
+		t.Fatalf("Incorrect content %q\n", b)
+	}
+	// and so are stale ones
+	journal.record(JournalEntry{Client: addrIP(device), Path: "f", Offset: 3, Time: start.Add(-2 * time.Hour)}, nil, false)
+	journal.Close()
+	journal, _ = OpenJournal("journal", time.Hour)
+	defer journal.Close()
+	if entries := journal.Entries(); len(entries) != 0 {
+		t.Fatalf("Stale entries should be dropped, got %+v\n", entries)
+	}
+}
+
+func TestJournalLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	client := netip.MustParseAddr("192.0.2.1")
+	now := time.Now().UTC()
+	lines := []journalLine{
+		{JournalEntry: JournalEntry{Client: client, Path: "f", Offset: 1, Time: now}},
+		{JournalEntry: JournalEntry{Client: client, Path: "g", Offset: 2, Time: now}},
+		// a removed upload stays removed
+		{JournalEntry: JournalEntry{Client: client, Path: "f", Time: now}, Removed: true},
+	}
+	var b []byte
+	for _, l := range lines {
+		line, _ := json.Marshal(l)
+		b = append(append(b, line...), '\n')
+	}
+	os.WriteFile(path, append(b, `{"client":"192.0.2.1","pa`...), 0644)
+
+	journal, err := OpenJournal(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	if entries := journal.Entries(); !reflect.DeepEqual(entries, []JournalEntry{lines[1].JournalEntry}) {
+		t.Fatalf("Incorrect entries %+v\n", entries)
+	}
+	for i := 0; i < 1000; i++ {
+		journal.record(JournalEntry{Client: client, Path: "g", Offset: int64(i), Time: now}, nil, false)
+	}
+	journal.Close()
+
+	// outdated lines are compacted away
+	if b, _ := os.ReadFile(path); bytes.Count(b, []byte("\n")) > 2+journalSlack {
+		t.Fatalf("Journal should be compacted, got %d lines\n", bytes.Count(b, []byte("\n")))
+	}
+	journal, _ = OpenJournal(path, time.Hour)
+	defer journal.Close()
+	if e, ok := journal.lookup(client, "g"); !ok || e.Offset != 999 {
+		t.Fatalf("Incorrect entry %+v\n", e)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	appendOpt := wire.Options{{Name: AppendOption, Value: "1"}}
+	for _, v := range []struct {
+		enabled bool
+		packets []wire.Packet
+		reply   wire.Packet
+		want    string
+	}{
+		{
+			false,
+			[]wire.Packet{&wire.WriteRequest{Filename: "log", Mode: "octet", Options: appendOpt}},
+			&wire.Error{Code: uint16(CodeFileExists), Message: "File already exists."},
+			"one\n",
+		},
+		{
+			true,
+			[]wire.Packet{&wire.WriteRequest{Filename: "log", Mode: "octet", Options: appendOpt}},
+			&wire.OptionAck{Options: appendOpt},
+			"one\n",
+		},
+		{
+			true,
+			[]wire.Packet{
+				&wire.WriteRequest{Filename: "log", Mode: "octet", Options: appendOpt},
+				&wire.Data{Block: 1, Payload: []byte("two\n")},
+			},
+			&wire.Ack{Block: 1},
+			"one\ntwo\n",
+		},
+		// a failed upload only removes what it appended
+		{
+			true,
+			[]wire.Packet{
+				&wire.WriteRequest{Filename: "log", Mode: "octet", Options: appendOpt},
+				&wire.Data{Block: 1, Payload: make([]byte, 512)},
+				&wire.Error{Code: uint16(CodeNotDefined), Message: "Cancelled."},
+			},
+			&wire.Ack{Block: 1},
+			"one\n",
+		},
+	} {
+		os.WriteFile("log", []byte("one\n"), 0644)
+
+		tftp := NewTFTPServerConn(a)
+		tftp.Append = v.enabled
+		tftp.RemovePartialUploads = true
+		for _, pkt := range v.packets {
+			raw, _ := wire.Marshal(pkt)
+			tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		}
+
+		reply, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		if !reflect.DeepEqual(reply, v.reply) {
+			t.Fatalf("Incorrect reply %v, should be %v\n", reply, v.reply)
+		}
+		tftp.flush()
+		tftp.closeSessions()
+		if b, _ := os.ReadFile("log"); string(b) != v.want {
+			t.Fatalf("Incorrect content %q, should be %q\n", b, v.want)
+		}
+	}
+
+	// the file which was written is truncated, not the one with its name
+	os.WriteFile("log", []byte("one\n"), 0644)
+	tftp := NewTFTPServerConn(a)
+	tftp.Append = true
+	tftp.RemovePartialUploads = true
+	for i, pkt := range []wire.Packet{
+		&wire.WriteRequest{Filename: "log", Mode: "octet", Options: appendOpt},
+		&wire.Data{Block: 1, Payload: make([]byte, 512)},
+		&wire.Error{Code: uint16(CodeNotDefined), Message: "Cancelled."},
+	} {
+		if i == 2 {
+			os.Rename("log", "log.1")
+			os.WriteFile("log", []byte("new\n"), 0644)
+		}
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	}
+	tftp.flush()
+	tftp.closeSessions()
+	if b, _ := os.ReadFile("log.1"); string(b) != "one\n" {
+		t.Fatalf("Incorrect content of the written file %q, should be %q\n", b, "one\n")
+	}
+	if b, _ := os.ReadFile("log"); string(b) != "new\n" {
+		t.Fatalf("Incorrect content of the new file %q, should be %q\n", b, "new\n")
+	}
+}
+
+func TestLargeFile(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	// sparse, nothing is written but the last bytes
+	const size = 5<<30 + 100
+	f, _ := os.Create("disk.img")
+	_, err := f.WriteAt([]byte("end"), size-3)
+	f.Close()
+	if err != nil {
+		t.Skipf("Can't create a sparse file: %v\n", err)
+	}
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	tftp := NewTFTPServerConn(a)
+	tftp.Resume = true
+	opts := wire.Options{{Name: "tsize", Value: "0"}, {Name: ResumeOption, Value: strconv.FormatInt(size-5, 10)}}
+	for i, v := range []struct {
+		send, expect wire.Packet
+	}{
+		{
+			&wire.ReadRequest{Filename: "disk.img", Mode: "octet", Options: opts},
+			&wire.OptionAck{Options: wire.Options{{Name: "tsize", Value: "5368709220"}, {Name: ResumeOption, Value: "5368709215"}}},
+		},
+		{&wire.Ack{Block: 0}, &wire.Data{Block: 1, Payload: []byte("\x00\x00end")}},
+	} {
+		raw, _ := wire.Marshal(v.send)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		reply, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		if !reflect.DeepEqual(reply, v.expect) {
+			t.Fatalf("Step %v: incorrect reply %v, should be %v\n", i, reply, v.expect)
+		}
+		tftp.flush()
+	}
+	tftp.closeSessions()
+
+	// block numbers roll over after 65535 blocks
+	opts = wire.Options{{Name: "blksize", Value: "8"}, {Name: "tsize", Value: "5368709220"}}
+	raw, _ := wire.Marshal(&wire.WriteRequest{Filename: "up", Mode: "octet", Options: opts})
+	tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	payload := []byte("01234567")
+	const blocks = 1<<16 + 2
+	for i := 1; i <= blocks; i++ {
+		if i == blocks {
+			payload = payload[:1]
+		}
+		raw, _ := wire.Marshal(&wire.Data{Block: uint16(i), Payload: payload})
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		tftp.flush()
+	}
+	if fi, err := os.Stat("up"); err != nil || fi.Size() != 8*(blocks-1)+1 {
+		t.Fatalf("Upload should have completed across the rollover: %v\n", err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", []byte("0123456789"), 0644)
+	os.WriteFile("g", []byte("0123456789"), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	journal, err := OpenJournal("journal", time.Hour)
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	defer journal.Close()
+	journal.record(JournalEntry{Client: addrIP(peer.LocalAddr()), Path: "f", Offset: 8, Time: time.Now()}, nil, false)
+
+	tftp := NewTFTPServerConn(a)
+	tftp.Resume, tftp.Journal = true, journal
+	offset := func(v string) wire.Options { return wire.Options{{Name: ResumeOption, Value: v}} }
+	for _, v := range []struct {
+		request wire.Packet
+		oack    wire.Packet
+		next    wire.Packet
+		reply   wire.Packet
+	}{
+		{
+			&wire.ReadRequest{Filename: "f", Mode: "octet", Options: offset("7")},
+			&wire.OptionAck{Options: offset("7")},
+			&wire.Ack{Block: 0},
+			&wire.Data{Block: 1, Payload: []byte("789")},
+		},
+		{
+			&wire.ReadRequest{Filename: "f", Mode: "octet", Options: offset("11")},
+			&wire.Error{Code: uint16(CodeOptionNegotiation), Message: "Incorrect value '11' of option 'x-offset'."},
+			nil, nil,
+		},
+		// the journal has less than the client could skip, the rest is cut
+		{
+			&wire.WriteRequest{Filename: "f", Mode: "octet", Options: offset("20")},
+			&wire.OptionAck{Options: offset("8")},
+			&wire.Data{Block: 1, Payload: []byte("abc")},
+			&wire.Ack{Block: 1},
+		},
+		// without a record uploads can't overwrite files, or continue them
+		{
+			&wire.WriteRequest{Filename: "f", Mode: "octet", Options: offset("5")},
+			&wire.Error{Code: uint16(CodeFileExists), Message: "File already exists."},
+			nil, nil,
+		},
+		{
+			&wire.WriteRequest{Filename: "g", Mode: "octet", Options: offset("5")},
+			&wire.Error{Code: uint16(CodeFileExists), Message: "File already exists."},
+			nil, nil,
+		},
+		{
+			&wire.WriteRequest{Filename: "h", Mode: "octet", Options: offset("5")},
+			&wire.OptionAck{Options: offset("0")},
+			&wire.Data{Block: 1, Payload: []byte("new")},
+			&wire.Ack{Block: 1},
+		},
+	} {
+		for _, step := range []struct{ send, expect wire.Packet }{{v.request, v.oack}, {v.next, v.reply}} {
+			if step.send == nil {
+				break
+			}
+			raw, _ := wire.Marshal(step.send)
+			tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+			got, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+			if !reflect.DeepEqual(got, step.expect) {
+				t.Fatalf("Incorrect reply to %v: %v, should be %v\n", step.send, got, step.expect)
+			}
+			tftp.flush()
+		}
+		tftp.closeSessions()
+	}
+
+	for name, want := range map[string]string{"f": "01234567abc", "g": "0123456789", "h": "new"} {
+		if b, _ := os.ReadFile(name); string(b) != want {
+			t.Fatalf("Incorrect content of %v %q, should be %q\n", name, b, want)
+		}
+	}
+}
+
+func TestGzip(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("kernel"))
+	zw.Close()
+	os.WriteFile("vmlinuz.gz", compressed.Bytes(), 0644)
+	os.WriteFile("initrd", []byte("initrd"), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	tftp := NewTFTPServerConn(a)
+	tftp.Gzip = true
+	gzipOpt := wire.Options{{Name: GzipOption, Value: "1"}}
+	gunzip := func(b []byte) string {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return err.Error()
+		}
+		b, _ = io.ReadAll(zr)
+		return string(b)
+	}
+	for _, v := range []struct {
+		filename string
+		options  wire.Options
+		want     string
+	}{
+		{"vmlinuz", nil, "kernel"},
+		{"vmlinuz", gzipOpt, "kernel"},
+		{"initrd", nil, "initrd"},
+		{"initrd", gzipOpt, "initrd"},
+	} {
+		packets := []wire.Packet{&wire.ReadRequest{Filename: v.filename, Mode: "octet", Options: v.options}}
+		if v.options != nil {
+			packets = append(packets, &wire.Ack{Block: 0})
+		}
+		for _, pkt := range packets {
+			raw, _ := wire.Marshal(pkt)
+			tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		}
+
+		got, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		data, ok := got.(*wire.Data)
+		if !ok {
+			t.Fatalf("Should be DATA, got: %v\n", got)
+		}
+		content := string(data.Payload)
+		if v.options != nil {
+			content = gunzip(data.Payload)
+		}
+		if content != v.want {
+			t.Fatalf("Incorrect content of '%v' %v: %q, should be %q\n", v.filename, v.options, content, v.want)
+		}
+		tftp.flush()
+		tftp.closeSessions()
+	}
+}
+
+func TestUploadHook(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	uploads := make(chan UploadInfo, 1)
+	tftp := NewTFTPServerConn(a)
+	tftp.OnUpload = func(info UploadInfo) { uploads <- info }
+	tftp.Checksums = []string{"sha256", "md5"}
+	tftp.ChecksumSidecar = true
+
+	for _, pkt := range []wire.Packet{
+		&wire.WriteRequest{Filename: "f", Mode: "octet"},
+		&wire.Data{Block: 1, Payload: []byte("abc")},
+		// the retransmitted last block doesn't complete it again
+		&wire.Data{Block: 1, Payload: []byte("abc")},
+	} {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	}
+
+	select {
+	case info := <-uploads:
+		if info.Path != "f" || info.Bytes != 3 || info.Client != peer.LocalAddr() {
+			t.Fatalf("Incorrect upload %+v\n", info)
+		}
+		if info.Checksums["sha256"] != sha256abc || info.Checksums["md5"] != "900150983cd24fb0d6963f7d28e17f72" {
+			t.Fatalf("Incorrect checksums %v\n", info.Checksums)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Upload hook should be called\n")
+	}
+	select {
+	case info := <-uploads:
+		t.Fatalf("Upload hook should be called once, got %+v\n", info)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	sidecar, _ := os.ReadFile("f.sha256")
+	if string(sidecar) != sha256abc+"  f\n" {
+		t.Fatalf("Incorrect checksum sidecar '%s'\n", sidecar)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", []byte("abc"), 0644)
+
+	var mu sync.Mutex
+	var events []Event
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// the first delivery is retried
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if r.Header.Get("X-TFTP-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Incorrect signature '%v'\n", r.Header.Get("X-TFTP-Signature"))
+		}
+		var ev Event
+		json.Unmarshal(body, &ev)
+		if r.Header.Get("X-TFTP-Event") != ev.Type {
+			t.Errorf("Incorrect event header '%v' for %v\n", r.Header.Get("X-TFTP-Event"), ev.Type)
+		}
+		events = append(events, ev)
+	}))
+	defer srv.Close()
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	hook := NewWebhook([]string{srv.URL}, []byte("secret"))
+	hook.Backoff = time.Millisecond
+	tftp := NewTFTPServerConn(a)
+	tftp.OnTransfer = hook.Notify
+	for _, pkt := range []wire.Packet{
+		&wire.ReadRequest{Filename: "f", Mode: "octet"},
+		&wire.Ack{Block: 1},
+	} {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	}
+	hook.Notify(AuditRecord{Session: "s", Filename: "g", Result: "error", Error: "Timeout."})
+	hook.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 || len(events) != 2 {
+		t.Fatalf("Incorrect deliveries %v %+v\n", attempts, events)
+	}
+	if ev := events[0]; ev.Type != "transfer.completed" || ev.Filename != "f" || ev.Direction != "read" || ev.Bytes != 3 {
+		t.Fatalf("Incorrect event %+v\n", ev)
+	}
+	if ev := events[1]; ev.Type != "transfer.failed" || ev.Session != "s" || ev.Error != "Timeout." {
+		t.Fatalf("Incorrect event %+v\n", ev)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", []byte("abc"), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	var topics []string
+	var events []Event
+	broker := NewBrokerPublisher(func(topic string, payload []byte) error {
+		var ev Event
+		if err := json.Unmarshal(payload, &ev); err != nil {
+			t.Errorf("Incorrect payload '%s'\n", payload)
+		}
+		topics, events = append(topics, topic), append(events, ev)
+		return nil
+	}, "tftpd")
+	tftp := NewTFTPServerConn(a)
+	tftp.Events = broker
+	for _, pkt := range []wire.Packet{
+		&wire.ReadRequest{Filename: "f", Mode: "octet"},
+		&wire.Ack{Block: 1},
+		// rejected requests only fail
+		&wire.ReadRequest{Filename: "missing", Mode: "octet"},
+	} {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	}
+	broker.Close()
+
+	if !reflect.DeepEqual(topics, []string{"tftpd.transfer.started", "tftpd.transfer.completed", "tftpd.transfer.failed"}) {
+		t.Fatalf("Incorrect topics %v\n", topics)
+	}
+	if ev := events[0]; ev.Type != "transfer.started" || ev.Filename != "f" || ev.Result != "" || ev.Session != events[1].Session {
+		t.Fatalf("Incorrect start event %+v\n", ev)
+	}
+	if ev := events[1]; ev.Bytes != 3 || ev.Result != "ok" {
+		t.Fatalf("Incorrect completion event %+v\n", ev)
+	}
+	if ev := events[2]; ev.Filename != "missing" || ev.ErrorCode != CodeFileNotFound {
+		t.Fatalf("Incorrect failure event %+v\n", ev)
+	}
+}
+
+func TestFirstBlockCache(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	big := bytes.Repeat([]byte("0123456789"), 7000)
+	os.WriteFile("big", big, 0644)
+	os.WriteFile("small", []byte("abc"), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(a)
+	tftp.Clock = clock
+	tftp.FirstBlockCache = true
+	// get downloads the file, or the message of the ERROR
+	get := func(name string) string {
+		var got []byte
+		var pkt wire.Packet = &wire.ReadRequest{Filename: name, Mode: "octet", Options: wire.Options{{Name: "blksize", Value: "8192"}}}
+		blockSize := 512
+		for {
+			raw, _ := wire.Marshal(pkt)
+			tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+			reply, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+			tftp.flush()
+			switch reply := reply.(type) {
+			case *wire.OptionAck:
+				v, _ := reply.Options.Get("blksize")
+				blockSize, _ = strconv.Atoi(v)
+				pkt = &wire.Ack{Block: 0}
+			case *wire.Data:
+				got = append(got, reply.Payload...)
+				if len(reply.Payload) < blockSize {
+					raw, _ := wire.Marshal(&wire.Ack{Block: reply.Block})
+					tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+					return string(got)
+				}
+				pkt = &wire.Ack{Block: reply.Block}
+			case *wire.Error:
+				return reply.Message
+			}
+		}
+	}
+
+	for i, v := range []struct {
+		change  func()
+		advance time.Duration
+		file    string
+		expect  string
+	}{
+		{nil, 0, "big", string(big)},
+		{nil, 0, "small", "abc"},
+		// served from memory until the file is checked again
+		{func() { os.Remove("small") }, 0, "small", "abc"},
+		{nil, time.Second, "small", "File not found."},
+		// the rest of larger files is read from the file
+		{nil, 0, "big", string(big)},
+		{func() {
+			os.WriteFile("big", bytes.Repeat([]byte("x"), len(big)), 0644)
+			os.Chtimes("big", time.Now(), time.Now().Add(time.Hour))
+		}, 0, "big", "File changed during transfer."},
+		{nil, time.Second, "big", strings.Repeat("x", len(big))},
+	} {
+		if v.change != nil {
+			v.change()
+		}
+		clock.Advance(v.advance)
+		if got := get(v.file); got != v.expect {
+			t.Fatalf("Step %v: incorrect download of %v '%.40v' (%v bytes), should be '%.40v'\n", i, v.file, got, len(got), v.expect)
+		}
+	}
+
+	// uploads aren't hidden by the cache
+	for _, pkt := range []wire.Packet{
+		&wire.WriteRequest{Filename: "small", Mode: "octet"},
+		&wire.Data{Block: 1, Payload: []byte("new")},
+	} {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		tftp.flush()
+	}
+	tftp.closeSessions()
+	if got := get("small"); got != "new" {
+		t.Fatalf("Incorrect download after an upload '%v'\n", got)
+	}
+}
+
+func TestSharedFiles(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", bytes.Repeat([]byte("a"), 600), 0644)
+
+	a, _ := tftptest.Pipe()
+	defer a.Close()
+
+	tftp := NewTFTPServerConn(a)
+	// send returns the reply of the server
+	send := func(client string, pkt wire.Packet) *wire.Data {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(tftptest.Addr(client), len(raw), raw)
+		reply, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		tftp.flush()
+		data, ok := reply.(*wire.Data)
+		if !ok {
+			t.Fatalf("Incorrect reply %v\n", reply)
+		}
+		return data
+	}
+
+	send("c1", &wire.ReadRequest{Filename: "f", Mode: "octet"})
+	send("c2", &wire.ReadRequest{Filename: "f", Mode: "octet"})
+	old := tftp.files.files["f"]
+	if len(tftp.files.files) != 1 || old.refs != 2 {
+		t.Fatalf("Downloads should share the file: %+v\n", tftp.files.files)
+	}
+
+	// replaced files aren't shared with new downloads
+	os.WriteFile("g", bytes.Repeat([]byte("b"), 600), 0644)
+	os.Rename("g", "f")
+	if data := send("c3", &wire.ReadRequest{Filename: "f", Mode: "octet"}); data.Payload[0] != 'b' {
+		t.Fatalf("Incorrect content of the new file '%s'\n", data.Payload)
+	}
+	if len(tftp.files.files) != 1 || tftp.files.files["f"] == old {
+		t.Fatalf("New file should be open: %+v\n", tftp.files.files)
+	}
+	if data := send("c1", &wire.Ack{Block: 1}); string(data.Payload) != strings.Repeat("a", 88) {
+		t.Fatalf("Incorrect end of the old file '%s'\n", data.Payload)
+	}
+	// ended when the last block was sent
+	if old.refs != 1 {
+		t.Fatalf("Incorrect references %v\n", old.refs)
+	}
+
+	tftp.closeSessions()
+	if len(tftp.files.files) != 0 || old.refs != 0 {
+		t.Fatalf("Files should be closed: %+v\n", tftp.files.files)
+	}
+	if _, err := old.f.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Old file should be closed: %v\n", err)
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", []byte("old"), 0644)
+	os.WriteFile("g", []byte("g"), 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(a)
+	tftp.Clock = clock
+	tftp.FileCacheSize = 1
+	tftp.FileCacheTTL = 5 * time.Second
+	// get downloads a file of a single block
+	get := func(name string) string {
+		raw, _ := wire.Marshal(&wire.ReadRequest{Filename: name, Mode: "octet"})
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		reply, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		tftp.flush()
+		raw, _ = wire.Marshal(&wire.Ack{Block: 1})
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		if data, ok := reply.(*wire.Data); ok {
+			return string(data.Payload)
+		}
+		return fmt.Sprint(reply)
+	}
+
+	if got := get("f"); got != "old" {
+		t.Fatalf("Incorrect download '%v'\n", got)
+	}
+	old := tftp.files.files["f"]
+	if old == nil || old.refs != 0 {
+		t.Fatalf("File should be kept open: %+v\n", tftp.files.files)
+	}
+	// stat results are trusted for the TTL
+	os.WriteFile("new", []byte("new"), 0644)
+	os.Rename("new", "f")
+	clock.Advance(4 * time.Second)
+	if got := get("f"); got != "old" || tftp.files.files["f"] != old {
+		t.Fatalf("Cached file should be served, got '%v'\n", got)
+	}
+	clock.Advance(5 * time.Second)
+	if got := get("f"); got != "new" {
+		t.Fatalf("Changed file should be served, got '%v'\n", got)
+	}
+	if _, err := old.f.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Changed file should be closed: %v\n", err)
+	}
+
+	// the least recently used file is closed
+	current := tftp.files.files["f"]
+	if got := get("g"); got != "g" {
+		t.Fatalf("Incorrect download '%v'\n", got)
+	}
+	if _, err := current.f.Stat(); !errors.Is(err, os.ErrClosed) || len(tftp.files.files) != 1 {
+		t.Fatalf("Least recently used file should be closed: %v %+v\n", err, tftp.files.files)
+	}
+	tftp.closeSessions()
+	if len(tftp.files.files) != 0 {
+		t.Fatalf("Files should be closed: %+v\n", tftp.files.files)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	content := make([]byte, 10*512+100)
+	for i := range content {
+		content[i] = byte(i / 512)
+	}
+	os.WriteFile("f", content, 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(a)
+	tftp.Clock = clock
+	tftp.Prefetch = 4
+	send := func(pkt wire.Packet) {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	}
+	// polls the session until the block was read
+	reply := func() *wire.Data {
+		for i := 0; len(tftp.outgoing) == 0 && i < 1000; i++ {
+			time.Sleep(time.Millisecond)
+			clock.Advance(streamPoll)
+			tftp.retransmit(clock.Now())
+		}
+		pkt, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		tftp.flush()
+		data, _ := pkt.(*wire.Data)
+		return data
+	}
+
+	send(&wire.ReadRequest{Filename: "f", Mode: "octet"})
+	// the first block is sent at once
+	if len(tftp.outgoing) != 1 {
+		t.Fatalf("First block should be sent at once\n")
+	}
+	var got []byte
+	got = append(got, reply().Payload...)
+	s, ok := tftp.connections[peer.LocalAddr().String()].reader.(*streamReader)
+	if !ok {
+		t.Fatalf("Download should be read ahead\n")
+	}
+	// the next blocks are read while waiting for the ACK
+	s.wait(4 * 512)
+	for block := uint16(1); ; block++ {
+		send(&wire.Ack{Block: block})
+		data := reply()
+		if data.Block != block+1 {
+			t.Fatalf("Incorrect block %v, should be %v\n", data.Block, block+1)
+		}
+		got = append(got, data.Payload...)
+		if len(data.Payload) < 512 {
+			send(&wire.Ack{Block: data.Block})
+			break
+		}
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("Incorrect content\n")
+	}
+	if len(tftp.connections) != 0 || len(tftp.files.files) != 0 {
+		t.Fatalf("Session should have ended and closed the file\n")
+	}
+}
+
+func TestIOUring(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	// more than a slot
+	content := make([]byte, 3*ringSlotSize+100)
+	for i := range content {
+		content[i] = byte(i / 512)
+	}
+	os.WriteFile("f", content, 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(a)
+	tftp.Clock = clock
+	tftp.IOUring = true
+	send := func(pkt wire.Packet) {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	}
+	// polls the session like the packet loop until the block was read
+	reply := func() *wire.Data {
+		for i := 0; len(tftp.outgoing) == 0 && i < 1000; i++ {
+			tftp.submitRing()
+			time.Sleep(time.Millisecond)
+			clock.Advance(streamPoll)
+			tftp.retransmit(clock.Now())
+		}
+		pkt, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		tftp.flush()
+		data, _ := pkt.(*wire.Data)
+		return data
+	}
+
+	send(&wire.ReadRequest{Filename: "f", Mode: "octet"})
+	if tftp.ring == nil {
+		tftp.closeSessions()
+		t.Skip("io_uring unavailable")
+	}
+	if len(tftp.outgoing) != 1 {
+		t.Fatalf("First block should be sent at once\n")
+	}
+	if _, ok := tftp.connections[peer.LocalAddr().String()].reader.(aheadReader); !ok {
+		t.Fatalf("Download should be read through the ring\n")
+	}
+	got := append([]byte(nil), reply().Payload...)
+	for block := uint16(1); ; block++ {
+		send(&wire.Ack{Block: block})
+		data := reply()
+		if data.Block != block+1 {
+			t.Fatalf("Incorrect block %v, should be %v\n", data.Block, block+1)
+		}
+		got = append(got, data.Payload...)
+		if len(data.Payload) < 512 {
+			send(&wire.Ack{Block: data.Block})
+			break
+		}
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("Incorrect content\n")
+	}
+	if len(tftp.connections) != 0 || len(tftp.files.files) != 0 {
+		t.Fatalf("Session should have ended and closed the file\n")
+	}
+	tftp.closeSessions()
+	if tftp.ring != nil {
+		t.Fatalf("Ring should be closed with the sessions\n")
+	}
+}
+
+func TestIOUringUpload(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	// more blocks than slots
+	content := make([]byte, 100*512+100)
+	for i := range content {
+		content[i] = byte(i / 512)
+	}
+	os.WriteFile("ro", nil, 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	tftp := NewTFTPServerConn(a)
+	tftp.IOUring = true
+	upload := func(name string, fail bool) wire.Packet {
+		raw, _ := wire.Marshal(&wire.WriteRequest{Filename: name, Mode: "octet"})
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		cli := tftp.connections[peer.LocalAddr().String()]
+		if tftp.ring == nil {
+			tftp.closeSessions()
+			t.Skip("io_uring unavailable")
+		}
+		if cli.ringWriter == nil {
+			t.Fatalf("Upload should be written through the ring\n")
+		}
+		tftp.flush()
+		if fail {
+			// the writes fail like on a full disk
+			f, _ := os.Open("ro")
+			cli.ringWriter = tftp.ring.writer(f, 0)
+			defer f.Close()
+		}
+		var reply wire.Packet
+		for block := 1; (block-1)*512 <= len(content); block++ {
+			end := block * 512
+			if end > len(content) {
+				end = len(content)
+			}
+			raw, _ := wire.Marshal(&wire.Data{Block: uint16(block), Payload: content[(block-1)*512 : end]})
+			tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+			tftp.submitRing()
+			reply, _ = wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+			tftp.flush()
+			if _, ok := reply.(*wire.Error); ok {
+				break
+			}
+		}
+		return reply
+	}
+
+	if reply := upload("f", false); !reflect.DeepEqual(reply, &wire.Ack{Block: 101}) {
+		t.Fatalf("Incorrect reply %v to the last block\n", reply)
+	}
+	if b, _ := os.ReadFile("f"); !bytes.Equal(b, content) {
+		t.Fatalf("Incorrect content of the upload\n")
+	}
+	tftp.closeSessions()
+	if reply, ok := upload("g", true).(*wire.Error); !ok || reply.Code != uint16(CodeNotDefined) && reply.Code != uint16(CodeDiskFull) {
+		t.Fatalf("Failed writes should fail the upload, got %v\n", reply)
+	}
+	tftp.closeSessions()
+}
+
+func TestIOUringFallback(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	content := bytes.Repeat([]byte("0123456789abcdef"), 40)
+	os.WriteFile("f", content, 0644)
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	tftp := NewTFTPServerConn(a)
+	tftp.IOUring = true
+	// as if io_uring_setup failed, e.g. on kernels without it
+	tftp.ringFailed = true
+	for _, v := range []struct {
+		send, expect wire.Packet
+	}{
+		{&wire.ReadRequest{Filename: "f", Mode: "octet"}, &wire.Data{Block: 1, Payload: content[:512]}},
+		{&wire.Ack{Block: 1}, &wire.Data{Block: 2, Payload: content[512:]}},
+	} {
+		raw, _ := wire.Marshal(v.send)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		if cli := tftp.connections[peer.LocalAddr().String()]; cli != nil {
+			if _, ok := cli.reader.(aheadReader); ok {
+				t.Fatalf("Download shouldn't be read through the ring\n")
+			}
+		}
+		reply, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		if !reflect.DeepEqual(reply, v.expect) {
+			t.Fatalf("Incorrect reply %v, should be %v\n", reply, v.expect)
+		}
+		tftp.flush()
+	}
+	tftp.closeSessions()
+	if tftp.ring != nil {
+		t.Fatalf("Ring shouldn't be set up after it failed\n")
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(listener)
+	tftp.Clock = clock
+	tftp.Workers = 1
+	tftp.WorkQueue = 1
+	pipes := map[string]*io.PipeWriter{}
+	tftp.OnRead = func(req *ReadRequest) error {
+		pr, pw := io.Pipe()
+		pipes[req.Client.String()] = pw
+		req.Reader = pr
+		return nil
+	}
+	raw, _ := wire.Marshal(&wire.ReadRequest{Filename: "stream", Mode: "octet"})
+	// the reply to the client, after polling it while it waits
+	reply := func(client string) wire.Packet {
+		for i := 0; i < 1000; i++ {
+			for _, msg := range tftp.outgoing {
+				if msg.Addr.String() == client {
+					pkt, _ := wire.Unmarshal(msg.Buffers[0])
+					tftp.flush()
+					return pkt
+				}
+			}
+			time.Sleep(time.Millisecond)
+			clock.Advance(streamPoll)
+			tftp.retransmit(clock.Now())
+		}
+		return nil
+	}
+
+	// a is read by the worker, b waits for it and c is rejected
+	for _, client := range []string{"a", "b", "c"} {
+		tftp.handleConnection(tftptest.Addr(client), len(raw), raw)
+	}
+	if got := reply("c"); !reflect.DeepEqual(got, &wire.Error{Code: uint16(CodeNotDefined), Message: "Server busy, try again later."}) {
+		t.Fatalf("Incorrect reply %v, should be busy\n", got)
+	}
+	tftp.DropWhenBusy = true
+	tftp.handleConnection(tftptest.Addr("d"), len(raw), raw)
+	if len(tftp.outgoing) != 0 || len(tftp.connections) != 2 {
+		t.Fatalf("Request should have been dropped\n")
+	}
+
+	for _, client := range []string{"a", "b"} {
+		go pipes[client].Close()
+		if got := reply(client); !reflect.DeepEqual(got, &wire.Data{Block: 1, Payload: []byte{}}) {
+			t.Fatalf("Incorrect reply %v to %v\n", got, client)
+		}
+		ack, _ := wire.Marshal(&wire.Ack{Block: 1})
+		tftp.handleConnection(tftptest.Addr(client), len(ack), ack)
+	}
+	if stats := tftp.Stats(); stats.SessionsCompleted != 2 || stats.SessionsFailed != 2 || stats.Rejected != 2 {
+		t.Fatalf("Incorrect stats %+v\n", stats)
+	}
+	tftp.closeSessions()
+}
+
+func TestReadHook(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", []byte("abc"), 0644)
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+
+	tftp := NewTFTPServerConn(listener)
+	tftp.OnRead = func(req *ReadRequest) error {
+		switch req.Filename {
+		case "secret":
+			return errors.New("not for you")
+		case "unknown-device":
+			return NewError(CodeFileNotFound, "No such device.")
+		case "alias":
+			req.Filename = "f"
+		case "generated", "stream":
+			req.Reader = strings.NewReader("generated")
+			if req.Filename == "generated" {
+				req.Size = 9
+			}
+		}
+		return nil
+	}
+
+	for _, v := range []struct {
+		filename string
+		expect   wire.Packet
+	}{
+		{"secret", &wire.Error{Code: uint16(CodeAccessViolation), Message: "Access violation."}},
+		{"unknown-device", &wire.Error{Code: uint16(CodeFileNotFound), Message: "No such device."}},
+		{"alias", &wire.OptionAck{Options: wire.Options{{Name: "tsize", Value: "3"}}}},
+		{"generated", &wire.OptionAck{Options: wire.Options{{Name: "tsize", Value: "9"}}}},
+		// an unknown size isn't acknowledged
+		{"stream", &wire.Data{Block: 1, Payload: []byte("generated")}},
+	} {
+		conn, _ := network.ListenPacket("")
+		defer conn.Close()
+
+		raw, _ := wire.Marshal(&wire.ReadRequest{Filename: v.filename, Mode: "octet", Options: wire.Options{{Name: "tsize", Value: "0"}}})
+		tftp.handleConnection(conn.LocalAddr(), len(raw), raw)
+		// streams are read ahead in another goroutine
+		for i := 0; len(tftp.outgoing) == 0 && i < 100; i++ {
+			time.Sleep(streamPoll)
+			tftp.retransmit(tftp.now())
+		}
+		tftp.flush()
+
+		buf := make([]byte, bodyMaxSize)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		got, _ := wire.Unmarshal(buf[:n])
+		if !reflect.DeepEqual(got, v.expect) {
+			t.Fatalf("Incorrect reply to '%v': %v, should be %v\n", v.filename, got, v.expect)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	var pw *io.PipeWriter
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	tftp := NewTFTPServerConn(a)
+	tftp.Clock = clock
+	tftp.OnRead = func(req *ReadRequest) error {
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		req.Reader = pr
+		return nil
+	}
+	send := func(pkt wire.Packet) {
+		raw, _ := wire.Marshal(pkt)
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	}
+	// polls the session until the source has the block
+	reply := func() wire.Packet {
+		for i := 0; len(tftp.outgoing) == 0 && i < 1000; i++ {
+			time.Sleep(time.Millisecond)
+			clock.Advance(streamPoll)
+			tftp.retransmit(clock.Now())
+		}
+		if len(tftp.outgoing) == 0 {
+			return nil
+		}
+		pkt, _ := wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+		tftp.flush()
+		return pkt
+	}
+
+	// the size isn't acknowledged and blocks are sent as the source has them
+	send(&wire.ReadRequest{Filename: "stream", Mode: "octet", Options: wire.Options{{Name: "tsize", Value: "0"}}})
+	if len(tftp.outgoing) != 0 {
+		t.Fatalf("Nothing should be sent before the source has a block\n")
+	}
+	go pw.Write(make([]byte, 512))
+	if got := reply(); !reflect.DeepEqual(got, &wire.Data{Block: 1, Payload: make([]byte, 512)}) {
+		t.Fatalf("Incorrect reply %v\n", got)
+	}
+	send(&wire.Ack{Block: 1})
+	go pw.Close()
+	if got := reply(); !reflect.DeepEqual(got, &wire.Data{Block: 2, Payload: []byte{}}) {
+		t.Fatalf("Incorrect reply %v, should be the last block\n", got)
+	}
+	send(&wire.Ack{Block: 2})
+	if len(tftp.connections) != 0 {
+		t.Fatalf("Session should have ended\n")
+	}
+
+	// a source which never delivers ends the session like a silent client
+	send(&wire.ReadRequest{Filename: "stalled", Mode: "octet"})
+	clock.Advance(defaultTimeout*defaultRetries + time.Second)
+	tftp.retransmit(clock.Now())
+	if got := reply(); !reflect.DeepEqual(got, &wire.Error{Code: uint16(CodeNotDefined), Message: "Transfer stalled."}) {
+		t.Fatalf("Incorrect reply %v, should be an error\n", got)
+	}
+	if len(tftp.connections) != 0 {
+		t.Fatalf("Session should have ended\n")
+	}
+}
+
+type testSink struct {
+	buf      bytes.Buffer
+	writeErr error
+	closeErr error
+	aborted  error
+}
+
+func (s *testSink) Write(b []byte) (int, error) {
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
+	return s.buf.Write(b)
+}
+
+func (s *testSink) Close() error { return s.closeErr }
+
+func (s *testSink) CloseWithError(err error) error {
+	s.aborted = err
+	return nil
+}
+
+func TestWriteHook(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	quota := NewError(CodeDiskFull, "Quota exceeded.")
+	for _, v := range []struct {
+		filename string
+		sink     *testSink
+		packets  []wire.Packet
+		reply    wire.Packet
+		want     string
+	}{
+		{"denied", nil, nil, &wire.Error{Code: uint16(CodeAccessViolation), Message: "Access violation."}, ""},
+		{"f", &testSink{}, []wire.Packet{&wire.Data{Block: 1, Payload: make([]byte, 512)}, &wire.Data{Block: 2, Payload: []byte("abc")}}, &wire.Ack{Block: 2}, strings.Repeat("\x00", 512) + "abc"},
+		// errors of the sink are passed on mid-transfer
+		{"f", &testSink{writeErr: quota}, []wire.Packet{&wire.Data{Block: 1, Payload: make([]byte, 512)}, &wire.Data{Block: 2, Payload: []byte("abc")}}, &wire.Error{Code: uint16(CodeDiskFull), Message: "Quota exceeded."}, ""},
+		// the upload only succeeds if the sink is closed successfully
+		{"f", &testSink{closeErr: quota}, []wire.Packet{&wire.Data{Block: 1, Payload: []byte("abc")}}, &wire.Error{Code: uint16(CodeDiskFull), Message: "Quota exceeded."}, "abc"},
+	} {
+		uploaded := make(chan UploadInfo, 1)
+		clock := tftptest.NewClock(time.Unix(1700000000, 0))
+		tftp := NewTFTPServerConn(a)
+		tftp.Clock = clock
+		tftp.OnUpload = func(info UploadInfo) { uploaded <- info }
+		tftp.OnWrite = func(req *WriteRequest) error {
+			if req.Filename == "denied" {
+				return errors.New("not for you")
+			}
+			req.Writer = v.sink
+			return nil
+		}
+
+		var reply wire.Packet
+		for _, pkt := range append([]wire.Packet{&wire.WriteRequest{Filename: v.filename, Mode: "octet"}}, v.packets...) {
+			raw, _ := wire.Marshal(pkt)
+			tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+			// the sink is written in another goroutine
+			for i := 0; len(tftp.outgoing) == 0 && i < 1000; i++ {
+				time.Sleep(time.Millisecond)
+				clock.Advance(streamPoll)
+				tftp.retransmit(clock.Now())
+			}
+			reply, _ = wire.Unmarshal(tftp.outgoing[len(tftp.outgoing)-1].Buffers[0])
+			tftp.flush()
+			if cli := tftp.connections[peer.LocalAddr().String()]; cli != nil && v.sink != nil && v.sink.writeErr != nil {
+				for i := 0; cli.sink.failure() == nil && i < 1000; i++ {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}
+		tftp.closeSessions()
+
+		if !reflect.DeepEqual(reply, v.reply) {
+			t.Fatalf("Incorrect reply %v, should be %v\n", reply, v.reply)
+		}
+		if v.sink != nil && v.sink.buf.String() != v.want {
+			t.Fatalf("Incorrect content %q, should be %q\n", v.sink.buf.String(), v.want)
+		}
+		if _, err := os.Stat(v.filename); err == nil {
+			t.Fatalf("Upload to a sink shouldn't create a file\n")
+		}
+		if _, ok := v.reply.(*wire.Ack); ok {
+			if info := <-uploaded; info.Path != "" || info.Bytes != int64(len(v.want)) {
+				t.Fatalf("Incorrect upload info %+v\n", info)
+			}
+		} else if len(uploaded) != 0 {
+			t.Fatalf("Only completed uploads should be reported\n")
+		}
+	}
+}
+
+// unreachableConn fails sending to one address like a socket without a
+// route to it.
+type unreachableConn struct {
+	net.PacketConn
+	unreachable string
+}
+
+func (c unreachableConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if addr.String() == c.unreachable {
+		return 0, syscall.ENETUNREACH
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestSessionFailures(t *testing.T) {
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+
+	tftp := NewTFTPServerConn(unreachableConn{listener, "unreachable"})
+	tftp.OnRead = func(req *ReadRequest) error {
+		switch req.Filename {
+		case "panic":
+			panic("bug")
+		case "unencodable":
+			return NewError(CodeNotDefined, "NUL\x00")
+		}
+		return ErrFileNotFound
+	}
+
+	for _, v := range []struct {
+		client   string
+		filename string
+		expect   wire.Packet
+	}{
+		{"a", "panic", &wire.Error{Code: uint16(CodeNotDefined), Message: "Unexpected error."}},
+		{"b", "unencodable", nil},
+		{"unreachable", "f", nil},
+		{"c", "f", &wire.Error{Code: uint16(CodeFileNotFound), Message: "File not found."}},
+	} {
+		conn, _ := network.ListenPacket(v.client)
+		defer conn.Close()
+
+		raw, _ := wire.Marshal(&wire.ReadRequest{Filename: v.filename, Mode: "octet"})
+		tftp.handleConnection(conn.LocalAddr(), len(raw), raw)
+		if err := tftp.flush(); err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if len(tftp.connections) != 0 {
+			t.Fatalf("Session of '%v' should have ended\n", v.client)
+		}
+
+		buf := make([]byte, bodyMaxSize)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if v.expect == nil {
+			if err == nil {
+				t.Fatalf("'%v' shouldn't get a reply\n", v.client)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		got, _ := wire.Unmarshal(buf[:n])
+		if !reflect.DeepEqual(got, v.expect) {
+			t.Fatalf("Incorrect reply to '%v': %v, should be %v\n", v.client, got, v.expect)
+		}
+	}
+}
+
+// virusScanner rejects uploads containing "virus" once they're complete.
+type virusScanner struct {
+	bytes.Buffer
+	closed *int
+}
+
+func (s *virusScanner) Close() error {
+	*s.closed++
+	if strings.Contains(s.String(), "virus") {
+		return errors.New("virus found")
+	}
+	return nil
+}
+
+func TestScan(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+
+	closed := 0
+	tftp := NewTFTPServerConn(listener)
+	tftp.Scan = func(client net.Addr, filename string) (io.WriteCloser, error) {
+		if filename == "forbidden" {
+			return nil, errors.New("no scanner for this file")
+		}
+		return &virusScanner{closed: &closed}, nil
+	}
+
+	for _, v := range []struct {
+		filename string
+		content  string
+		expect   wire.Packet
+	}{
+		{"clean", "hello", &wire.Ack{Block: 1}},
+		{"infected", "a virus", &wire.Error{Code: uint16(CodeAccessViolation), Message: "Access violation."}},
+		{"forbidden", "", &wire.Error{Code: uint16(CodeAccessViolation), Message: "Access violation."}},
+	} {
+		conn, _ := network.ListenPacket("")
+		defer conn.Close()
+
+		var got wire.Packet
+		buf := make([]byte, bodyMaxSize)
+		for _, pkt := range []wire.Packet{
+			&wire.WriteRequest{Filename: v.filename, Mode: "octet"},
+			&wire.Data{Block: 1, Payload: []byte(v.content)},
+		} {
+			raw, _ := wire.Marshal(pkt)
+			tftp.handleConnection(conn.LocalAddr(), len(raw), raw)
+			tftp.flush()
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, _ := conn.ReadFrom(buf)
+			got, _ = wire.Unmarshal(buf[:n])
+			if _, ok := got.(*wire.Error); ok {
+				break
+			}
+		}
+		if !reflect.DeepEqual(got, v.expect) {
+			t.Fatalf("Incorrect reply to '%v': %v, should be %v\n", v.filename, got, v.expect)
+		}
+
+		_, err := os.Stat(v.filename)
+		if _, ok := v.expect.(*wire.Ack); ok == (err != nil) {
+			t.Fatalf("Only accepted uploads should be kept, '%v': %v\n", v.filename, err)
+		}
+	}
+	if closed != 2 {
+		t.Fatalf("Scanners should be closed, got %v of 2\n", closed)
+	}
+}
+
+func TestFilenameToken(t *testing.T) {
+	key := []byte("secret")
+	now := time.Unix(1700000000, 0)
+	signed := SignFilename(key, "boot/pxelinux.0", now.Add(time.Hour))
+
+	path, err := VerifyFilename(key, signed, now)
+	if err != nil || path != "boot/pxelinux.0" {
+		t.Fatalf("Incorrect verification of '%v': '%v', %v\n", signed, path, err)
+	}
+
+	for _, v := range []struct {
+		key      string
+		filename string
+		now      time.Time
+		err      error
+	}{
+		{"secret", signed, now.Add(2 * time.Hour), ErrTokenExpired},
+		{"other", signed, now, ErrTokenInvalid},
+		{"secret", strings.Replace(signed, "pxelinux", "grubx64", 1), now, ErrTokenInvalid},
+		{"secret", "boot/pxelinux.0", now, ErrTokenInvalid},
+		{"secret", "pxelinux.0", now, ErrTokenInvalid},
+	} {
+		if _, err := VerifyFilename([]byte(v.key), v.filename, v.now); err != v.err {
+			t.Fatalf("Verification of '%v' should fail with %v, got: %v\n", v.filename, v.err, err)
+		}
+	}
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+	tftp := NewTFTPServerConn(a)
+	tftp.TokenKey = key
+
+	raw, _ := wire.Marshal(&wire.ReadRequest{Filename: "boot/pxelinux.0", Mode: "octet"})
+	tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+	pkt, _ := wire.Unmarshal(tftp.outgoing[0].Buffers[0])
+	if pkt, ok := pkt.(*wire.Error); !ok || pkt.Code != uint16(CodeAccessViolation) {
+		t.Fatalf("Unsigned filename should be rejected, got %v\n", pkt)
+	}
+}
+
+func TestACL(t *testing.T) {
+	var acl ACL
+	err := json.Unmarshal([]byte(`[
+		{"path": "configs/**", "clients": ["10.0.0.0/24", "fd00::/64"], "read": true, "write": true},
+		{"path": "configs/**"},
+		{"path": "firmware/**", "read": true},
+		{"path": "*.txt", "read": true}
+	]`), &acl)
+	if err != nil || acl.Validate() != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+
+	management := &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 1234}
+	other := &net.UDPAddr{IP: net.ParseIP("192.168.1.5"), Port: 1234}
+	for _, v := range []struct {
+		client   net.Addr
+		filename string
+		write    bool
+		allowed  bool
+	}{
+		{other, "firmware/a/b/image.bin", false, true},
+		{other, "/firmware/image.bin", false, true},
+		{other, "firmware/image.bin", true, false},
+		{other, "firmware/../configs/switch.cfg", false, false},
+		{other, "configs/switch.cfg", false, false},
+		{management, "configs/switch.cfg", false, true},
+		{management, "configs/switch.cfg", true, true},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.7")}, "configs/a/switch.cfg", false, true},
+		{&net.UDPAddr{IP: net.ParseIP("fd00::7")}, "configs/switch.cfg", true, true},
+		{other, "readme.txt", false, true},
+		{other, "docs/readme.txt", false, false},
+		{other, "unknown.bin", false, false},
+	} {
+		if allowed := acl.Allowed(v.client, v.filename, v.write); allowed != v.allowed {
+			t.Fatalf("Access of %v to '%v' (write %v) should be %v\n", v.client, v.filename, v.write, v.allowed)
+		}
+	}
+
+	if err := (ACL{{Path: "firmware/[a"}}).Validate(); err == nil {
+		t.Fatalf("Incorrect pattern should fail the validation\n")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+	conn, _ := network.ListenPacket("client")
+	defer conn.Close()
+
+	tftp := NewTFTPServerConn(listener)
+	tftp.ReadOnly = true
+	raw, _ := wire.Marshal(&wire.WriteRequest{Filename: "file", Mode: "octet"})
+	tftp.handleConnection(conn.LocalAddr(), len(raw), raw)
+	tftp.flush()
+
+	buf := make([]byte, bodyMaxSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, _ := conn.ReadFrom(buf)
+	pkt, _ := wire.Unmarshal(buf[:n])
+	if e, ok := pkt.(*wire.Error); !ok || e.Code != uint16(CodeAccessViolation) {
+		t.Fatalf("Upload should be rejected, got: %v\n", pkt)
+	}
+	if _, err := os.Stat("file"); err == nil {
+		t.Fatalf("File shouldn't be created\n")
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("image.bin", []byte("image"), 0o644)
+	abs := filepath.Join(t.TempDir(), "other.bin")
+	os.WriteFile(abs, []byte("other"), 0o644)
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+
+	tftp := NewTFTPServerConn(listener)
+	buf := make([]byte, bodyMaxSize)
+	for _, v := range []struct {
+		file   string
+		req    wire.Packet
+		expect wire.Packet
+	}{
+		{"image.bin", &wire.ReadRequest{Filename: "pxelinux.0", Mode: "octet"}, &wire.Data{Block: 1, Payload: []byte("image")}},
+		{"image.bin", &wire.ReadRequest{Filename: "image.bin", Mode: "octet"}, &wire.Data{Block: 1, Payload: []byte("image")}},
+		{"image.bin", &wire.WriteRequest{Filename: "image.bin", Mode: "octet"}, &wire.Error{Code: uint16(CodeAccessViolation), Message: "Access violation."}},
+		// absolute files are outside of the root
+		{abs, &wire.ReadRequest{Filename: "pxelinux.0", Mode: "octet"}, &wire.Data{Block: 1, Payload: []byte("other")}},
+	} {
+		tftp.ServeFile = v.file
+		conn, _ := network.ListenPacket("")
+		defer conn.Close()
+
+		raw, _ := wire.Marshal(v.req)
+		tftp.handleConnection(conn.LocalAddr(), len(raw), raw)
+		tftp.flush()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, _ := conn.ReadFrom(buf)
+		if got, _ := wire.Unmarshal(buf[:n]); !reflect.DeepEqual(got, v.expect) {
+			t.Fatalf("Incorrect reply to %v with %v: %v, should be %v\n", v.req, v.file, got, v.expect)
+		}
+	}
+}
+
+func TestDirList(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.MkdirAll("images/sub", 0o755)
+	os.Mkdir("configs", 0o755)
+	for _, name := range []string{"images/a.img", "images/b.img", "images/sub/c.img", "configs/x.cfg"} {
+		os.WriteFile(name, []byte("x"), 0o644)
+	}
+	// an unreadable directory is skipped, root reads it anyway
+	if os.Getuid() != 0 {
+		os.Mkdir("images/locked", 0o000)
+		defer os.Chmod("images/locked", 0o755)
+	}
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+
+	tftp := NewTFTPServerConn(listener)
+	tftp.DirList = true
+	tftp.ACL = ACL{{Path: "images/**", Read: true}}
+	buf := make([]byte, bodyMaxSize)
+	for _, v := range []struct {
+		filename string
+		expect   wire.Packet
+	}{
+		{".dirlist/images/", &wire.Data{Block: 1, Payload: []byte("images/a.img\nimages/b.img\nimages/sub/c.img\n")}},
+		// configs aren't readable
+		{".dirlist", &wire.Data{Block: 1, Payload: []byte("images/a.img\nimages/b.img\nimages/sub/c.img\n")}},
+		{".dirlist/images/a", &wire.Data{Block: 1, Payload: []byte("images/a.img\n")}},
+		{".dirlist/missing/", &wire.Error{Code: uint16(CodeFileNotFound), Message: "File not found."}},
+	} {
+		conn, _ := network.ListenPacket("")
+		defer conn.Close()
+
+		raw, _ := wire.Marshal(&wire.ReadRequest{Filename: v.filename, Mode: "octet"})
+		tftp.handleConnection(conn.LocalAddr(), len(raw), raw)
+		tftp.flush()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, _ := conn.ReadFrom(buf)
+		if got, _ := wire.Unmarshal(buf[:n]); !reflect.DeepEqual(got, v.expect) {
+			t.Fatalf("Incorrect reply to %v: %v, should be %v\n", v.filename, got, v.expect)
+		}
+	}
+}
+
+func TestServerInfo(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	tftp := NewTFTPServerConn(a)
+	tftp.Resume, tftp.MaxBlockSize, tftp.MTU = true, 1024, -1
+	for _, enabled := range []bool{false, true} {
+		tftp.ServerInfo = enabled
+		raw, _ := wire.Marshal(&wire.ReadRequest{Filename: ServerInfoName, Mode: "octet"})
+		tftp.handleConnection(peer.LocalAddr(), len(raw), raw)
+		reply, _ := wire.Unmarshal(tftp.outgoing[0].Buffers[0])
+		tftp.flush()
+		tftp.closeSessions()
+
+		data, ok := reply.(*wire.Data)
+		if ok != enabled {
+			t.Fatalf("Incorrect reply %v with ServerInfo %v\n", reply, enabled)
+		}
+		if !enabled {
+			continue
+		}
+		for _, line := range []string{"options: blksize tsize timeout utimeout windowsize x-offset\n", "blksize max: 1024\n", "read only: false\n"} {
+			if !strings.Contains(string(data.Payload), line) {
+				t.Fatalf("Server info should contain %q:\n%s\n", line, data.Payload)
+			}
+		}
+	}
+}
+
+func TestMaxTransfers(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("file", []byte("hello"), 0o644)
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	conn, _ := network.ListenPacket("client")
+	defer conn.Close()
+
+	tftp := NewTFTPServerConn(listener)
+	tftp.MaxTransfers = 1
+	done := make(chan struct{})
+	go func() {
+		tftp.ListenAndServe()
+		close(done)
+	}()
+
+	buf := make([]byte, bodyMaxSize)
+	for _, pkt := range []wire.Packet{
+		&wire.ReadRequest{Filename: "file", Mode: "octet"},
+		&wire.Ack{Block: 1},
+	} {
+		raw, _ := wire.Marshal(pkt)
+		conn.WriteTo(raw, listener.LocalAddr())
+		if _, ok := pkt.(*wire.ReadRequest); ok {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			conn.ReadFrom(buf)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		tftp.Close()
+		t.Fatalf("Server should stop after the transfer\n")
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("abc", []byte("abc"), 0o644)
+	os.WriteFile("tampered", []byte("abd"), 0o644)
+	os.WriteFile("unhashed", []byte("xyz"), 0o644)
+	os.WriteFile("unlisted", []byte("xyz"), 0o644)
+
+	list, err := ReadAllowlist(strings.NewReader("# vetted\n" +
+		sha256abc + "  abc\n" +
+		"/tampered " + sha256abc + "\n" +
+		"unhashed\n" +
+		"missing\n"))
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	if _, err := ReadAllowlist(strings.NewReader("a b c\n")); err == nil {
+		t.Fatalf("Incorrect line should fail\n")
+	}
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+
+	tftp := NewTFTPServerConn(listener)
+	tftp.Allowlist = list
+	buf := make([]byte, bodyMaxSize)
+	for _, v := range []struct {
+		filename string
+		expect   wire.Packet
+	}{
+		{"abc", &wire.Data{Block: 1, Payload: []byte("abc")}},
+		{"./abc", &wire.Data{Block: 1, Payload: []byte("abc")}},
+		{"unhashed", &wire.Data{Block: 1, Payload: []byte("xyz")}},
+		{"tampered", &wire.Error{Code: uint16(CodeAccessViolation), Message: "Access violation."}},
+		{"unlisted", &wire.Error{Code: uint16(CodeAccessViolation), Message: "Access violation."}},
+		{"missing", &wire.Error{Code: uint16(CodeFileNotFound), Message: "File not found."}},
+	} {
+		conn, _ := network.ListenPacket("")
+		defer conn.Close()
+
+		raw, _ := wire.Marshal(&wire.ReadRequest{Filename: v.filename, Mode: "octet"})
+		tftp.handleConnection(conn.LocalAddr(), len(raw), raw)
+		tftp.flush()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, _ := conn.ReadFrom(buf)
+		if got, _ := wire.Unmarshal(buf[:n]); !reflect.DeepEqual(got, v.expect) {
+			t.Fatalf("Incorrect reply to '%v': %v, should be %v\n", v.filename, got, v.expect)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("file", []byte("hello"), 0o644)
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	defer listener.Close()
+	conn, _ := network.ListenPacket("client")
+	defer conn.Close()
+	unknown, _ := network.ListenPacket("unknown")
+	defer unknown.Close()
+
+	tftp := NewTFTPServerConn(listener)
+	for _, v := range []struct {
+		from net.PacketConn
+		pkt  wire.Packet
+	}{
+		{conn, &wire.ReadRequest{Filename: "file", Mode: "octet"}},
+		{conn, &wire.Ack{Block: 1}},
+		{conn, &wire.ReadRequest{Filename: "missing", Mode: "octet"}},
+		{unknown, &wire.Ack{Block: 1}},
+		{conn, &wire.WriteRequest{Filename: "upload", Mode: "octet"}},
+		{conn, &wire.Data{Block: 1, Payload: []byte("abc")}},
+	} {
+		raw, _ := wire.Marshal(v.pkt)
+		tftp.handleConnection(v.from.LocalAddr(), len(raw), raw)
+	}
+	tftp.resend(tftp.connections["client"])
+	tftp.flush()
+
+	expect := Stats{
+		SessionsStarted:   3,
+		SessionsCompleted: 1,
+		SessionsFailed:    1,
+		BytesReceived:     3,
+		BytesSent:         5,
+		Retransmits:       1,
+		Errors:            map[ErrorCode]uint64{CodeFileNotFound: 1, CodeUnknownTID: 1},
+		ActiveSessions:    1,
+	}
+	if stats := tftp.Stats(); !reflect.DeepEqual(stats, expect) {
+		t.Fatalf("Incorrect stats: %+v, should be %+v\n", stats, expect)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	a, peer := tftptest.Pipe()
+	defer peer.Close()
+
+	pings := make(chan struct{}, 10)
+	tftp := NewTFTPServerConn(a)
+	tftp.WatchdogInterval = 10 * time.Millisecond
+	tftp.Watchdog = func() {
+		select {
+		case pings <- struct{}{}:
+		default:
+		}
+	}
+	go tftp.ListenAndServe()
+	defer tftp.Close()
+
+	// the idle loop wakes up for the pings
+	for i := 0; i < 3; i++ {
+		select {
+		case <-pings:
+		case <-time.After(time.Second):
+			t.Fatalf("Watchdog should be called, got %v calls\n", i)
+		}
+	}
+}
+
+func TestSetDSCP(t *testing.T) {
+	for _, v := range []struct {
+		network, addr string
+	}{
+		{"udp4", "127.0.0.1:0"},
+		{"udp6", "[::1]:0"},
+	} {
+		conn, err := net.ListenPacket(v.network, v.addr)
+		if err != nil {
+			t.Logf("Skipping %v: %v\n", v.network, err)
+			continue
+		}
+		defer conn.Close()
+
+		tftp := NewTFTPServerConn(conn)
+		if err := tftp.SetDSCP(46); err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		var tos int
+		if v.network == "udp4" {
+			tos, err = ipv4.NewPacketConn(conn).TOS()
+		} else {
+			tos, err = ipv6.NewPacketConn(conn).TrafficClass()
+		}
+		if err != nil || tos != 46<<2 {
+			t.Fatalf("Incorrect TOS of %v %#x, should be %#x: %v\n", v.network, tos, 46<<2, err)
+		}
+		if err := tftp.SetDSCP(64); err == nil {
+			t.Fatalf("DSCP 64 should be refused\n")
+		}
+	}
+
+	// 0 leaves the ToS of a socket alone unless a DSCP was set before
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	defer conn.Close()
+	ipv4.NewPacketConn(conn).SetTOS(0x20)
+	tftp := NewTFTPServerConn(conn)
+	for _, v := range []struct {
+		dscp, tos int
+	}{
+		{0, 0x20},
+		{46, 46 << 2},
+		{0, 0},
+	} {
+		if err := tftp.SetDSCP(v.dscp); err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if tos, err := ipv4.NewPacketConn(conn).TOS(); err != nil || tos != v.tos {
+			t.Fatalf("Incorrect TOS %#x after DSCP %v, should be %#x: %v\n", tos, v.dscp, v.tos, err)
+		}
+	}
+
+	a, _ := tftptest.Pipe()
+	defer a.Close()
+	if err := NewTFTPServerConn(a).SetDSCP(46); err == nil {
+		t.Fatalf("DSCP should be refused without a socket\n")
+	}
+}
+
+func TestRelisten(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("f", []byte("abc"), 0644)
+
+	a, _ := tftptest.Pipe()
+	b, peer := tftptest.Pipe()
+	defer peer.Close()
+
+	tftp := NewTFTPServerConn(a)
+	tftp.Relisten = func() (net.PacketConn, error) { return b, nil }
+	done := make(chan error, 1)
+	go func() { done <- tftp.ListenAndServe() }()
+
+	// closed behind the server's back, it carries on on the new socket
+	a.Close()
+	raw, _ := wire.Marshal(&wire.ReadRequest{Filename: "f", Mode: "octet"})
+	peer.WriteTo(raw, b.LocalAddr())
+	buf := make([]byte, 512)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := peer.ReadFrom(buf)
+	if got, _ := wire.Unmarshal(buf[:n]); err != nil || !reflect.DeepEqual(got, &wire.Data{Block: 1, Payload: []byte("abc")}) {
+		t.Fatalf("Incorrect reply on the new socket %v: %v\n", got, err)
+	}
+	tftp.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+
+	// the error is returned once the retries are exhausted
+	c, _ := tftptest.Pipe()
+	tftp = NewTFTPServerConn(c)
+	tftp.Relisten = func() (net.PacketConn, error) { return nil, errors.New("no such device") }
+	tftp.RelistenRetries = 2
+	go func() { done <- tftp.ListenAndServe() }()
+	c.Close()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "no such device") {
+			t.Fatalf("Incorrect error %v\n", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ListenAndServe should give up\n")
+	}
+
+	// the DSCP is set on the new socket
+	old, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("No IPv4 loopback: %v\n", err)
+	}
+	rebuilt, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	defer rebuilt.Close()
+	tftp = NewTFTPServerConn(old)
+	tftp.SetDSCP(46)
+	tftp.Relisten = func() (net.PacketConn, error) { return rebuilt, nil }
+	go func() { done <- tftp.ListenAndServe() }()
+	old.Close()
+	udp, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	defer udp.Close()
+	udp.WriteTo(raw, rebuilt.LocalAddr())
+	udp.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := udp.ReadFrom(buf); err != nil {
+		t.Fatalf("No reply on the new socket: %v\n", err)
+	}
+	if tos, err := ipv4.NewPacketConn(rebuilt).TOS(); err != nil || tos != 46<<2 {
+		t.Fatalf("Incorrect TOS %#x of the new socket: %v\n", tos, err)
+	}
+	tftp.Close()
+	<-done
+
+	// the backoff follows the clock
+	clock := tftptest.NewClock(time.Unix(1700000000, 0))
+	var attempts atomic.Int32
+	d, _ := tftptest.Pipe()
+	e, _ := tftptest.Pipe()
+	tftp = NewTFTPServerConn(d)
+	tftp.Clock = clock
+	tftp.Relisten = func() (net.PacketConn, error) {
+		if attempts.Add(1) == 1 {
+			return nil, errors.New("no such device")
+		}
+		return e, nil
+	}
+	go func() { done <- tftp.ListenAndServe() }()
+	d.Close()
+	waitFor := func(n int32) bool {
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+			if attempts.Load() == n {
+				return true
+			}
+		}
+		return false
+	}
+	if !waitFor(1) {
+		t.Fatalf("Socket should be rebuilt\n")
+	}
+	// longer than the first delay of the wall clock
+	time.Sleep(2 * minRelistenDelay)
+	if n := attempts.Load(); n != 1 {
+		t.Fatalf("Retry should wait for the clock, got %v attempts\n", n)
+	}
+	clock.Advance(minRelistenDelay)
+	if !waitFor(2) {
+		t.Fatalf("Socket should be rebuilt once the clock moved\n")
+	}
+	tftp.Close()
+	<-done
+}
+
+func TestSessions(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("file", make([]byte, 1000), 0o644)
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	tftp := NewTFTPServerConn(listener)
+	done := make(chan struct{})
+	go func() {
+		tftp.ListenAndServe()
+		close(done)
+	}()
+	defer func() {
+		tftp.Close()
+		<-done
+	}()
+
+	buf := make([]byte, bodyMaxSize)
+	conn, _ := network.ListenPacket("client")
+	defer conn.Close()
+	for _, filename := range []string{"missing", "file"} {
+		raw, _ := wire.Marshal(&wire.ReadRequest{Filename: filename, Mode: "octet"})
+		conn.WriteTo(raw, listener.LocalAddr())
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+	}
+
+	// the loop waits for packets, Sessions has to wake it up
+	sessions := tftp.Sessions()
+	if len(sessions) != 1 || sessions[0].Filename != "file" || sessions[0].Size != 1000 || sessions[0].Bytes != 512 {
+		t.Fatalf("Incorrect sessions %+v\n", sessions)
+	}
+	if failures := tftp.RecentFailures(); len(failures) != 1 || failures[0].Filename != "missing" {
+		t.Fatalf("Incorrect failures %+v\n", failures)
+	}
+
+	if tftp.CancelSession("unknown") || !tftp.CancelSession(sessions[0].ID) {
+		t.Fatalf("Only the session in flight should be cancelled\n")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, _ := conn.ReadFrom(buf)
+	if pkt, err := wire.Unmarshal(buf[:n]); err != nil || !reflect.DeepEqual(pkt, &wire.Error{Code: uint16(CodeNotDefined), Message: "Transfer cancelled."}) {
+		t.Fatalf("Client should get an error, got: %v\n", pkt)
+	}
+	if len(tftp.Sessions()) != 0 || len(tftp.RecentFailures()) != 2 {
+		t.Fatalf("Cancelled session should have failed\n")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	os.WriteFile("file", []byte("hello"), 0o644)
+
+	network := tftptest.NewNetwork()
+	listener, _ := network.ListenPacket("server")
+	tftp := NewTFTPServerConn(listener)
+	tftp.ACL = ACL{}
+	done := make(chan struct{})
+	go func() {
+		tftp.ListenAndServe()
+		close(done)
+	}()
+	defer func() {
+		tftp.Close()
+		<-done
+	}()
+
+	buf := make([]byte, bodyMaxSize)
+	request := func(client string) wire.Packet {
+		conn, _ := network.ListenPacket(client)
+		defer conn.Close()
+
+		raw, _ := wire.Marshal(&wire.ReadRequest{Filename: "file", Mode: "octet"})
+		conn.WriteTo(raw, listener.LocalAddr())
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		pkt, _ := wire.Unmarshal(buf[:n])
+		return pkt
+	}
+
+	if pkt, ok := request("a").(*wire.Error); !ok || pkt.Code != uint16(CodeAccessViolation) {
+		t.Fatalf("Request should be denied, got: %v\n", pkt)
+	}
+	tftp.Reconfigure(func(tftp *TFTPServer) {
+		tftp.ACL = ACL{{Path: "*", Read: true}}
+	})
+	if pkt, ok := request("b").(*wire.Data); !ok || string(pkt.Payload) != "hello" {
+		t.Fatalf("Request should be allowed after reconfiguration, got: %v\n", pkt)
+	}
+}
+
+func FuzzNewRequest(f *testing.F) {
+	for _, pkt := range []wire.Packet{
+		&wire.ReadRequest{Filename: "f", Mode: "octet", Options: wire.Options{{Name: "blksize", Value: "1428"}}},
+		&wire.WriteRequest{Filename: "f", Mode: "netascii"},
+		&wire.Data{Block: 1, Payload: []byte("abc")},
+		&wire.Ack{Block: 1},
+		&wire.Error{Code: 1, Message: "File not found."},
+		&wire.OptionAck{Options: wire.Options{{Name: "tsize", Value: "0"}}},
+	} {
+		raw, _ := wire.Marshal(pkt)
+		f.Add(raw, len(raw), false)
+	}
+	f.Add([]byte{0, 1, 'f', 0}, 4, true)
+	f.Add([]byte{0, 4, 0}, 10, true)
+	f.Add([]byte{}, 0, false)
+
+	f.Fuzz(func(t *testing.T, body []byte, numRead int, strict bool) {
+		req, err := newRequest(numRead, body, strict, false)
+		if err != nil {
+			var tftpErr *Error
+			if !errors.As(err, &tftpErr) {
+				t.Fatalf("Error should be a TFTP error, got: %v\n", err)
+			}
+			return
+		}
+		if req.opcode < wire.OpRRQ || req.opcode > wire.OpOACK {
+			t.Fatalf("Incorrect opcode %v\n", req.opcode)
+		}
+		if (req.opcode == wire.OpRRQ || req.opcode == wire.OpWRQ) && req.mode != "octet" {
+			t.Fatalf("Mode '%v' should be rejected\n", req.mode)
+		}
+	})
+}
+
+func BenchmarkNewRequest(b *testing.B) {
+	raw, _ := wire.Marshal(&wire.ReadRequest{Filename: "pxelinux.0", Mode: "octet", Options: wire.Options{{Name: "blksize", Value: "1428"}, {Name: "tsize", Value: "0"}}})
+	ack, _ := wire.Marshal(&wire.Ack{Block: 1})
+
+	b.Run("RRQ", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			newRequest(len(raw), raw, false, false)
+		}
+	})
+	b.Run("ACK", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			newRequest(len(ack), ack, false, false)
+		}
+	})
+}
+
+func BenchmarkSendResponse(b *testing.B) {
+	a, peer := tftptest.Pipe()
+	defer a.Close()
+	defer peer.Close()
+
+	tftp := NewTFTPServerConn(a)
+	cli := newClient(peer.LocalAddr())
+	tftp.connections[cli.tid.String()] = cli
+
+	b.ReportAllocs()
+	b.SetBytes(defaultBlockSize)
+	for i := 0; i < b.N; i++ {
+		resp := newResponse(cli, &request{opcode: wire.OpACK, number: uint16(i)})
+		tftp.sendResponse(cli, resp)
+		resp.release()
+		// the peer isn't reading, full queues drop the packets
+		tftp.flush()
+	}
+}
+
+// BenchmarkRRQ downloads a 100 MB file through the in-memory network.
+func BenchmarkRRQ(b *testing.B) {
+	const size = 100 << 20
+	dir := b.TempDir()
+	f, err := os.Create(filepath.Join(dir, "big.bin"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	f.Truncate(size)
+	f.Close()
+
+	conn := newTestServer(b, dir, time.Minute)
+	rrq, _ := wire.Marshal(&wire.ReadRequest{Filename: "big.bin", Mode: "octet"})
+	ack := make([]byte, wire.HeaderSize)
+	binary.BigEndian.PutUint16(ack, uint16(wire.OpACK))
+	buf := make([]byte, bodyMaxSize)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	blocks := 0
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// the final ACK ends the session, so the transfer ID can be reused
+		conn.WriteTo(rrq, tftptest.Addr("server"))
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if binary.BigEndian.Uint16(buf) != uint16(wire.OpDATA) {
+				b.Fatalf("Unexpected packet %v\n", buf[:n])
+			}
+			blocks++
+
+			copy(ack[2:], buf[2:wire.HeaderSize])
+			conn.WriteTo(ack, addr)
+			if n < wire.HeaderSize+defaultBlockSize {
+				break
+			}
+		}
+	}
+	b.StopTimer()
+
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(blocks), "allocs/block")
+}
@@ -0,0 +1,125 @@
+package tftptest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults describes what happens to packets written to a FaultyConn.
+// Probabilities are between 0 and 1.
+type Faults struct {
+	// Loss is the probability of dropping a packet.
+	Loss float64
+	// Duplicate is the probability of sending a packet twice.
+	Duplicate float64
+	// Reorder is the probability of holding a packet back until after
+	// the next one was sent.
+	Reorder float64
+	// Truncate is the probability of cutting a packet short at a random
+	// length.
+	Truncate float64
+	// Delay is added to every packet, with up to Jitter more at random,
+	// which reorders packets too.
+	Delay  time.Duration
+	Jitter time.Duration
+	// Seed makes the faults reproducible, zero uses a fixed seed.
+	Seed int64
+}
+
+// FaultyConn injects faults into the packets written to a connection. It works
+// with any net.PacketConn, in-memory ones for tests or UDP sockets for soak
+// runs. Wrap both ends to affect both directions.
+type FaultyConn struct {
+	net.PacketConn
+	faults Faults
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	held *heldPacket
+	// counters of the injected faults
+	dropped, duplicated, reordered, truncated int
+}
+
+type heldPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+func NewFaultyConn(conn net.PacketConn, faults Faults) *FaultyConn {
+	seed := faults.Seed
+	if seed == 0 {
+		seed = 1
+	}
+	return &FaultyConn{
+		PacketConn: conn,
+		faults:     faults,
+		rand:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (c *FaultyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(b)
+	if c.chance(c.faults.Loss) {
+		c.dropped++
+		return len(b), nil
+	}
+
+	if len(b) > 0 && c.chance(c.faults.Truncate) {
+		c.truncated++
+		b = b[:c.rand.Intn(len(b))]
+	}
+
+	copies := 1
+	if c.chance(c.faults.Duplicate) {
+		c.duplicated++
+		copies++
+	}
+
+	for i := 0; i < copies; i++ {
+		p := &heldPacket{append([]byte(nil), b...), addr}
+		if c.held == nil && c.chance(c.faults.Reorder) {
+			c.reordered++
+			c.held = p
+			continue
+		}
+
+		c.send(p)
+		if c.held != nil {
+			c.send(c.held)
+			c.held = nil
+		}
+	}
+	return n, nil
+}
+
+// Stats returns the number of dropped, duplicated, reordered and truncated
+// packets.
+func (c *FaultyConn) Stats() (dropped, duplicated, reordered, truncated int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped, c.duplicated, c.reordered, c.truncated
+}
+
+func (c *FaultyConn) chance(p float64) bool {
+	return p > 0 && c.rand.Float64() < p
+}
+
+func (c *FaultyConn) send(p *heldPacket) {
+	delay := c.faults.Delay
+	if c.faults.Jitter > 0 {
+		delay += time.Duration(c.rand.Int63n(int64(c.faults.Jitter)))
+	}
+
+	if delay <= 0 {
+		c.PacketConn.WriteTo(p.data, p.addr)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		c.PacketConn.WriteTo(p.data, p.addr)
+	})
+}
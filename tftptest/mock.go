@@ -0,0 +1,138 @@
+package tftptest
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// Step is a single exchange of a MockClient script: it sends a packet, or
+// Raw bytes for malformed ones, and checks the reply. A nil Expect means
+// the server must stay silent, a step without anything to send only
+// waits for a reply, e.g. a retransmission.
+type Step struct {
+	Send   wire.Packet
+	Raw    []byte
+	Expect wire.Packet
+}
+
+// MockClient is a scriptable client for protocol tests of servers, it
+// sends any packets in any order, deliberately wrong ones included, and
+// checks the replies. Only the codes of ERROR packets are compared, the
+// messages are free text.
+type MockClient struct {
+	Conn net.PacketConn
+	// Server is where packets go until the server replied, its transfer
+	// ID after that.
+	Server net.Addr
+	// Timeout is how long a reply is waited for, Silence how long the
+	// server must not reply.
+	Timeout time.Duration
+	Silence time.Duration
+
+	tid net.Addr
+	buf []byte
+}
+
+// NewMockClient returns a mock client sending from conn to the server.
+func NewMockClient(conn net.PacketConn, server net.Addr) *MockClient {
+	return &MockClient{
+		Conn:    conn,
+		Server:  server,
+		Timeout: time.Second,
+		Silence: 50 * time.Millisecond,
+		buf:     make([]byte, 65536),
+	}
+}
+
+// Run runs the steps in order and stops at the first one failing.
+func (c *MockClient) Run(steps ...Step) error {
+	for i, s := range steps {
+		if err := c.Step(s); err != nil {
+			return fmt.Errorf("step %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Step runs a single step.
+func (c *MockClient) Step(s Step) error {
+	switch {
+	case s.Send != nil:
+		if err := c.Send(s.Send); err != nil {
+			return err
+		}
+	case s.Raw != nil:
+		if err := c.SendRaw(s.Raw); err != nil {
+			return err
+		}
+	}
+	if s.Expect == nil {
+		return c.ExpectSilence()
+	}
+	return c.Expect(s.Expect)
+}
+
+// Send sends a packet to the server.
+func (c *MockClient) Send(pkt wire.Packet) error {
+	raw, err := wire.Marshal(pkt)
+	if err != nil {
+		return err
+	}
+	return c.SendRaw(raw)
+}
+
+// SendRaw sends bytes as they are to the server.
+func (c *MockClient) SendRaw(b []byte) error {
+	addr := c.tid
+	if addr == nil {
+		addr = c.Server
+	}
+	_, err := c.Conn.WriteTo(b, addr)
+	return err
+}
+
+// Receive waits for the next packet of the server, the first one fixes
+// its transfer ID.
+func (c *MockClient) Receive(timeout time.Duration) (wire.Packet, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := c.Conn.ReadFrom(c.buf)
+	if err != nil {
+		return nil, err
+	}
+	if c.tid == nil {
+		c.tid = addr
+	}
+	return wire.Unmarshal(c.buf[:n])
+}
+
+// Expect checks the next packet of the server.
+func (c *MockClient) Expect(want wire.Packet) error {
+	got, err := c.Receive(c.Timeout)
+	if err != nil {
+		return fmt.Errorf("no reply, expected %v", want)
+	}
+	if wantErr, ok := want.(*wire.Error); ok {
+		if got, ok := got.(*wire.Error); ok && got.Code == wantErr.Code {
+			return nil
+		}
+	} else if reflect.DeepEqual(got, want) {
+		return nil
+	}
+	return fmt.Errorf("got %v, expected %v", got, want)
+}
+
+// ExpectSilence checks that the server doesn't send anything.
+func (c *MockClient) ExpectSilence() error {
+	got, err := c.Receive(c.Silence)
+	if err == nil {
+		return fmt.Errorf("unexpected %v", got)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	return err
+}
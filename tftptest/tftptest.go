@@ -0,0 +1,198 @@
+// Package tftptest provides an in-memory datagram network, so servers and
+// clients can be tested end-to-end without binding UDP ports, and a mock
+// client for packet by packet protocol tests of servers.
+package tftptest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Packets queued for a connection above this are dropped, like a full
+// socket buffer would.
+const queueSize = 1024
+
+// Addr is the address of a connection on a Network.
+type Addr string
+
+func (a Addr) Network() string { return "mem" }
+func (a Addr) String() string  { return string(a) }
+
+// Network connects in-memory packet connections by address.
+type Network struct {
+	mu    sync.Mutex
+	conns map[Addr]*Conn
+	next  int
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		conns: make(map[Addr]*Conn),
+	}
+}
+
+// Pipe returns two connections which can send packets to each other.
+func Pipe() (*Conn, *Conn) {
+	n := NewNetwork()
+	a, _ := n.ListenPacket("a")
+	b, _ := n.ListenPacket("b")
+	return a, b
+}
+
+// ListenPacket returns a connection bound to addr, an empty addr picks an
+// unused one.
+func (n *Network) ListenPacket(addr string) (*Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if addr == "" {
+		n.next++
+		addr = fmt.Sprintf("conn-%d", n.next)
+	}
+	if _, ok := n.conns[Addr(addr)]; ok {
+		return nil, fmt.Errorf("Address '%v' is already in use", addr)
+	}
+
+	c := &Conn{
+		network: n,
+		addr:    Addr(addr),
+		queue:   make(chan packet, queueSize),
+		closed:  make(chan struct{}),
+		wake:    make(chan struct{}),
+	}
+	n.conns[c.addr] = c
+	return c, nil
+}
+
+func (n *Network) lookup(addr net.Addr) *Conn {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.conns[Addr(addr.String())]
+}
+
+func (n *Network) remove(c *Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.conns, c.addr)
+}
+
+type packet struct {
+	data []byte
+	from Addr
+}
+
+// Conn is an in-memory net.PacketConn. Like UDP it silently drops packets
+// to unknown addresses or when the receiver's queue is full.
+type Conn struct {
+	network *Network
+	addr    Addr
+	queue   chan packet
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	// closed and replaced when the read deadline changes
+	wake chan struct{}
+}
+
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, wake := c.readDeadline, c.wake
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		n, from, woken, err := c.read(b, timeout, wake)
+		if timer != nil {
+			timer.Stop()
+		}
+		if !woken {
+			return n, from, err
+		}
+	}
+}
+
+// read waits for a packet, woken reports a changed deadline.
+func (c *Conn) read(b []byte, timeout <-chan time.Time, wake chan struct{}) (int, net.Addr, bool, error) {
+	select {
+	case p := <-c.queue:
+		return copy(b, p.data), p.from, false, nil
+	case <-c.closed:
+		return 0, nil, false, c.opError("read", net.ErrClosed)
+	case <-timeout:
+		return 0, nil, false, c.opError("read", os.ErrDeadlineExceeded)
+	case <-wake:
+		return 0, nil, true, nil
+	}
+}
+
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+
+	dst := c.network.lookup(addr)
+	if dst == nil {
+		return len(b), nil
+	}
+
+	p := packet{append([]byte(nil), b...), c.addr}
+	select {
+	case dst.queue <- p:
+	default:
+	}
+	return len(b), nil
+}
+
+func (c *Conn) Close() error {
+	err := c.opError("close", net.ErrClosed)
+	c.closeOnce.Do(func() {
+		c.network.remove(c)
+		close(c.closed)
+		err = nil
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr { return c.addr }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes never block.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "mem", Addr: c.addr, Err: err}
+}
+
+var _ net.PacketConn = (*Conn)(nil)
@@ -0,0 +1,187 @@
+package tftptest
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	_, err := a.WriteTo([]byte("hello"), b.LocalAddr())
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+
+	buf := make([]byte, 16)
+	n, from, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+	if string(buf[:n]) != "hello" || from != a.LocalAddr() {
+		t.Fatalf("Incorrect packet '%s' from %v\n", buf[:n], from)
+	}
+
+	// packets to unknown addresses are dropped like with UDP
+	_, err = a.WriteTo([]byte("lost"), Addr("nowhere"))
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err := b.ReadFrom(make([]byte, 16))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Should be a timeout, got: %v\n", err)
+	}
+
+	// extending the deadline wakes blocked readers
+	b.SetReadDeadline(time.Now().Add(time.Hour))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.SetReadDeadline(time.Now())
+	}()
+	_, _, err = b.ReadFrom(make([]byte, 16))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Should be a timeout, got: %v\n", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	n := NewNetwork()
+	a, _ := n.ListenPacket("a")
+	if _, err := n.ListenPacket("a"); err == nil {
+		t.Fatalf("Error shouldn't be nil\n")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.Close()
+	}()
+	_, _, err := a.ReadFrom(make([]byte, 16))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Should be net.ErrClosed, got: %v\n", err)
+	}
+
+	// the address can be reused after closing
+	if _, err := n.ListenPacket("a"); err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+}
+
+func TestFaultyConn(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	lossy := NewFaultyConn(a, Faults{Loss: 1})
+	lossy.WriteTo([]byte("lost"), b.LocalAddr())
+	if dropped, _, _, _ := lossy.Stats(); dropped != 1 {
+		t.Fatalf("Packet should be dropped\n")
+	}
+
+	dup := NewFaultyConn(a, Faults{Duplicate: 1})
+	dup.WriteTo([]byte("twice"), b.LocalAddr())
+
+	reorder := NewFaultyConn(a, Faults{Reorder: 1})
+	for _, p := range []string{"1", "2", "3", "4"} {
+		reorder.WriteTo([]byte(p), b.LocalAddr())
+	}
+
+	truncate := NewFaultyConn(a, Faults{Truncate: 1})
+	if n, _ := truncate.WriteTo([]byte("truncated"), b.LocalAddr()); n != 9 {
+		t.Fatalf("Whole packet should be reported as written, got: %v\n", n)
+	}
+
+	var got []string
+	buf := make([]byte, 16)
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	for {
+		n, _, err := b.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		got = append(got, string(buf[:n]))
+	}
+
+	if len(got) < 2 || got[0] != "twice" || got[1] != "twice" {
+		t.Fatalf("Packet should be duplicated, got: %v\n", got)
+	}
+	if len(got) != 7 || !reflect.DeepEqual(got[2:6], []string{"2", "1", "4", "3"}) {
+		t.Fatalf("Packets should be reordered, got: %v\n", got[2:])
+	}
+	if len(got[6]) >= 9 || !strings.HasPrefix("truncated", got[6]) {
+		t.Fatalf("Packet should be truncated, got: %v\n", got[6])
+	}
+}
+
+func TestMockClient(t *testing.T) {
+	n := NewNetwork()
+	server, _ := n.ListenPacket("server")
+	tid, _ := n.ListenPacket("tid")
+	conn, _ := n.ListenPacket("client")
+	defer server.Close()
+	defer tid.Close()
+	defer conn.Close()
+
+	// the server answers requests from a transfer ID of its own, which
+	// acknowledges every block
+	go func() {
+		buf := make([]byte, 1024)
+		if _, addr, err := server.ReadFrom(buf); err == nil {
+			raw, _ := wire.Marshal(&wire.Ack{Block: 0})
+			tid.WriteTo(raw, addr)
+		}
+		for {
+			n, addr, err := tid.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if pkt, err := wire.Unmarshal(buf[:n]); err == nil {
+				if data, ok := pkt.(*wire.Data); ok && data.Block != 3 {
+					raw, _ := wire.Marshal(&wire.Ack{Block: data.Block})
+					tid.WriteTo(raw, addr)
+					continue
+				}
+			}
+			raw, _ := wire.Marshal(&wire.Error{Code: 4, Message: "Illegal TFTP operation."})
+			tid.WriteTo(raw, addr)
+		}
+	}()
+
+	mock := NewMockClient(conn, server.LocalAddr())
+	err := mock.Run(
+		Step{Send: &wire.WriteRequest{Filename: "f", Mode: "octet"}, Expect: &wire.Ack{Block: 0}},
+		Step{Send: &wire.Data{Block: 1, Payload: []byte("abc")}, Expect: &wire.Ack{Block: 1}},
+		Step{Raw: []byte{0, 9}, Expect: &wire.Error{Code: 4}},
+	)
+	if err != nil {
+		t.Fatalf("Error should be nil, got: %v\n", err)
+	}
+
+	for _, s := range []Step{
+		{Send: &wire.Data{Block: 2}, Expect: &wire.Ack{Block: 1}},
+		{Send: &wire.Data{Block: 2}},
+		{Send: &wire.Data{Block: 3}, Expect: &wire.Ack{Block: 3}},
+	} {
+		if err := mock.Step(s); err == nil {
+			t.Fatalf("Step %v should fail\n", s)
+		}
+		// the reply of a failed step mustn't be left for the next one
+		mock.ExpectSilence()
+	}
+}
@@ -0,0 +1,74 @@
+package tftpd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Length of the hex encoded MAC in tokens, 128 bits keep filenames short
+// for firmware with small buffers.
+const tokenMACSize = 32
+
+var (
+	ErrTokenInvalid = errors.New("Invalid filename token.")
+	ErrTokenExpired = errors.New("Filename token expired.")
+)
+
+// SignFilename returns path with an appended token "/expiry.mac" which is
+// valid until expires, for servers with TokenKey set to key.
+func SignFilename(key []byte, path string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return path + "/" + expiry + "." + tokenMAC(key, path, expiry)
+}
+
+// VerifyFilename checks the token of a filename signed with SignFilename
+// and returns the path without it.
+func VerifyFilename(key []byte, filename string, now time.Time) (string, error) {
+	i := strings.LastIndexByte(filename, '/')
+	if i < 0 {
+		return "", ErrTokenInvalid
+	}
+	path, token := filename[:i], filename[i+1:]
+
+	expiry, mac, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(tokenMAC(key, path, expiry))) {
+		return "", ErrTokenInvalid
+	}
+	secs, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", ErrTokenInvalid
+	}
+	if now.Unix() > secs {
+		return "", ErrTokenExpired
+	}
+	return path, nil
+}
+
+func tokenMAC(key []byte, path, expiry string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write([]byte(expiry))
+	return hex.EncodeToString(h.Sum(nil))[:tokenMACSize]
+}
+
+// verifyToken strips the token from the filename of a download, see TokenKey.
+func (tftp *TFTPServer) verifyToken(cli *client, req *request) error {
+	if tftp.TokenKey == nil {
+		return nil
+	}
+
+	path, err := VerifyFilename(tftp.TokenKey, req.filename, tftp.now())
+	if err != nil {
+		cli.logf("Read of '%v' rejected: '%v'\n", req.filename, err)
+		return ErrAccessViolation
+	}
+	// the token isn't logged or audited any further
+	req.filename, cli.filename = path, path
+	return nil
+}
@@ -0,0 +1,50 @@
+package tftpd
+
+import (
+	"encoding/hex"
+	"log"
+	"net"
+
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// TraceMode selects what is logged about every packet sent and received.
+type TraceMode int32
+
+const (
+	TraceOff TraceMode = iota
+	// TraceSummary logs a decoded one-line summary of every packet.
+	TraceSummary
+	// TraceHexdump logs the summary followed by a hexdump of the packet.
+	TraceHexdump
+)
+
+// SetTrace changes the packet trace mode, it's safe to call while the
+// server is running, e.g. from a signal handler.
+func (tftp *TFTPServer) SetTrace(mode TraceMode) {
+	tftp.trace.Store(int32(mode))
+}
+
+func (tftp *TFTPServer) tracePacket(dir string, addr net.Addr, b []byte) {
+	mode := TraceMode(tftp.trace.Load())
+	if mode == TraceOff {
+		return
+	}
+
+	// packets of sessions carry their ID, the last ones of a session
+	// which already ended don't
+	prefix := ""
+	if cli, ok := tftp.connections[addr.String()]; ok && cli.id != "" {
+		prefix = "[" + cli.id + "] "
+	}
+
+	pkt, err := wire.Unmarshal(b)
+	if err != nil {
+		log.Printf("%v%v %v: malformed packet of %v bytes: '%v'\n", prefix, dir, addr, len(b), err)
+	} else {
+		log.Printf("%v%v %v: %v\n", prefix, dir, addr, pkt)
+	}
+	if mode == TraceHexdump {
+		log.Print(hex.Dump(b))
+	}
+}
@@ -0,0 +1,229 @@
+package tftpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The server and the client carry the datagrams of the protocol over a
+// net.PacketConn, which is the transport: a UDP socket by default, but any
+// other works the same, e.g. net.ListenPacket("unixgram", path) for local
+// tests or the in-memory network of tftptest. What needs UDP sockets is
+// skipped for the others: batched reads and writes, the MTU of the path,
+// DSCP and rebuilding the socket unless Relisten is set. ListenerTransport
+// and ConnTransport adapt connection oriented transports, like DTLS or
+// userspace tunnels.
+
+// ListenerTransport adapts a listener of datagram connections, where every
+// Read returns a single datagram (e.g. DTLS or "unixpacket" sockets), to a
+// transport for NewTFTPServerConn. Every connection is a client, told
+// apart by its remote address, or by a numbered one if that's ambiguous
+// (e.g. unnamed Unix sockets). Connections are closed when their client
+// closes them or with the transport, which closes the listener too.
+func ListenerTransport(l net.Listener) net.PacketConn {
+	t := &listenerTransport{
+		listener: l,
+		packets:  make(chan received, 64),
+		closed:   make(chan struct{}),
+		wake:     make(chan struct{}),
+		conns:    make(map[string]net.Conn),
+	}
+	go t.accept()
+	return t
+}
+
+// received is a datagram of a connection of a ListenerTransport.
+type received struct {
+	data []byte
+	from net.Addr
+}
+
+// connAddr numbers connections without a distinct remote address.
+type connAddr struct {
+	net.Addr
+	n uint64
+}
+
+func (a connAddr) String() string { return fmt.Sprintf("%v#%d", a.Addr, a.n) }
+
+type listenerTransport struct {
+	listener  net.Listener
+	packets   chan received
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu    sync.Mutex
+	conns map[string]net.Conn
+	next  uint64
+	// closed and replaced when the read deadline changes
+	readDeadline time.Time
+	wake         chan struct{}
+}
+
+func (t *listenerTransport) accept() {
+	for {
+		c, err := t.listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		t.mu.Lock()
+		addr := c.RemoteAddr()
+		if addr == nil || addr.String() == "" || addr.String() == "@" || t.conns[addr.String()] != nil {
+			t.next++
+			addr = connAddr{t.listener.Addr(), t.next}
+		}
+		t.conns[addr.String()] = c
+		t.mu.Unlock()
+		go t.read(c, addr)
+	}
+}
+
+func (t *listenerTransport) read(c net.Conn, addr net.Addr) {
+	defer func() {
+		t.mu.Lock()
+		delete(t.conns, addr.String())
+		t.mu.Unlock()
+		c.Close()
+	}()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case t.packets <- received{append([]byte(nil), buf[:n]...), addr}:
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+func (t *listenerTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		t.mu.Lock()
+		deadline, wake := t.readDeadline, t.wake
+		t.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, t.opError("read", os.ErrDeadlineExceeded)
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		var p received
+		var err error
+		select {
+		case p = <-t.packets:
+		case <-t.closed:
+			err = t.opError("read", net.ErrClosed)
+		case <-timeout:
+			err = t.opError("read", os.ErrDeadlineExceeded)
+		case <-wake:
+			// the deadline changed
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return copy(b, p.data), p.from, nil
+	}
+}
+
+// WriteTo sends a datagram on the connection of addr, datagrams to
+// connections which are gone are dropped like UDP would.
+func (t *listenerTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, t.opError("write", net.ErrClosed)
+	default:
+	}
+	t.mu.Lock()
+	c := t.conns[addr.String()]
+	t.mu.Unlock()
+	if c == nil {
+		return len(b), nil
+	}
+	return c.Write(b)
+}
+
+func (t *listenerTransport) Close() error {
+	err := t.opError("close", net.ErrClosed)
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		err = t.listener.Close()
+		t.mu.Lock()
+		for _, c := range t.conns {
+			c.Close()
+		}
+		t.mu.Unlock()
+	})
+	return err
+}
+
+func (t *listenerTransport) LocalAddr() net.Addr { return t.listener.Addr() }
+
+func (t *listenerTransport) SetDeadline(d time.Time) error {
+	return t.SetReadDeadline(d)
+}
+
+func (t *listenerTransport) SetReadDeadline(d time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.readDeadline = d
+	close(t.wake)
+	t.wake = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes go to many connections.
+func (t *listenerTransport) SetWriteDeadline(d time.Time) error {
+	return nil
+}
+
+func (t *listenerTransport) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: t.listener.Addr().Network(), Addr: t.listener.Addr(), Err: err}
+}
+
+// ConnTransport adapts a datagram connection to a server (e.g. DTLS) to a
+// transport for the client, e.g. returned by its ListenPacket. Everything
+// read comes from the remote address, everything written goes there.
+func ConnTransport(c net.Conn) net.PacketConn {
+	return connTransport{c}
+}
+
+type connTransport struct {
+	net.Conn
+}
+
+func (c connTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, c.RemoteAddr(), nil
+}
+
+func (c connTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
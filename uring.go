@@ -0,0 +1,87 @@
+package tftpd
+
+import (
+	"log"
+)
+
+// Reads and writes through io_uring in flight are limited to ringSlots of
+// ringSlotSize each, which is also the most a single one transfers.
+const (
+	ringSlots    = 64
+	ringSlotSize = 64 << 10
+)
+
+// readWithRing reads a download ahead through io_uring, see
+// TFTPServer.IOUring. Other sources than regular files aren't.
+func (tftp *TFTPServer) readWithRing(cli *client) bool {
+	src, ok := cli.reader.(*sharedReader)
+	if !ok {
+		return false
+	}
+	if !tftp.setupRing() {
+		return false
+	}
+	limit := ringSlotSize
+	if n := tftp.Prefetch * cli.blockSize; n > limit {
+		limit = n
+	}
+	if n := cli.windowSize * cli.blockSize; n > limit {
+		limit = n
+	}
+	r := tftp.ring.reader(src, limit)
+	// the first block isn't delayed by polling
+	if a, ok := r.(aheadReader); ok {
+		a.wait(cli.blockSize)
+	}
+	cli.reader = r
+	return true
+}
+
+// writeWithRing writes an upload through io_uring, see TFTPServer.IOUring.
+// Appending uploads aren't, the writes complete in any order.
+func (tftp *TFTPServer) writeWithRing(cli *client) {
+	if cli.file == nil || cli.append || !tftp.setupRing() {
+		return
+	}
+	cli.ringWriter = tftp.ring.writer(cli.file, cli.offset)
+}
+
+// setupRing creates the ring on first use and reports whether there's one.
+func (tftp *TFTPServer) setupRing() bool {
+	if tftp.ring == nil && !tftp.ringFailed {
+		var err error
+		if tftp.ring, err = newRing(); err != nil {
+			log.Printf("io_uring unavailable, using files directly: '%v'\n", err)
+			tftp.ringFailed = true
+		}
+	}
+	return tftp.ring != nil
+}
+
+// flushWrites waits for the writes of an upload through the ring, before
+// the file is synced, truncated or closed.
+func (cli *client) flushWrites() error {
+	if cli.ringWriter == nil {
+		return nil
+	}
+	return cli.ringWriter.flush()
+}
+
+// submitRing passes the reads and writes queued by the sessions in this
+// iteration of the packet loop to the kernel at once.
+func (tftp *TFTPServer) submitRing() {
+	if tftp.ring == nil {
+		return
+	}
+	if err := tftp.ring.submit(); err != nil {
+		log.Printf("error while submitting to io_uring: '%v'\n", err)
+	}
+}
+
+// closeRing waits for the reads and writes in flight and closes the ring.
+func (tftp *TFTPServer) closeRing() {
+	if tftp.ring != nil {
+		tftp.ring.Close()
+		tftp.ring = nil
+	}
+}
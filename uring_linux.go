@@ -0,0 +1,411 @@
+//go:build linux
+
+package tftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// not in x/sys/unix yet
+const (
+	ioringOffSQRing       = 0
+	ioringOffSQEs         = 0x10000000
+	ioringFeatSingleMmap  = 1 << 0
+	ioringEnterGetEvents  = 1 << 0
+	ioringRegisterBuffers = 0
+	ioringOpReadFixed     = 4
+	ioringOpWriteFixed    = 5
+	ioringOpRead          = 22
+	ioringOpWrite         = 23
+)
+
+// struct io_uring_params and the structs it contains
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSQOffsets
+	cqOff                                                                  uringCQOffsets
+}
+
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// ioRing reads the files of downloads and writes the ones of uploads
+// through io_uring with buffers registered with the kernel once, the
+// operations queued by all sessions are submitted with a single system call
+// per loop iteration. It's only used by the server goroutine.
+type ioRing struct {
+	fd      int
+	rings   []byte
+	sqesMem []byte
+	sqes    []uringSQE
+	arena   []byte
+	// the arena isn't registered if the memlock limit is too low, it's
+	// read into with plain reads then
+	fixed bool
+
+	sqHead, sqTail *uint32
+	sqMask         uint32
+	sqArray        []uint32
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           []uringCQE
+
+	queued   uint32
+	inflight int
+	free     []int
+	owners   [ringSlots]ringOwner
+	lens     [ringSlots]int
+}
+
+// ringOwner is the reader or writer of a slot, which gets the result once
+// the operation completed.
+type ringOwner interface {
+	complete(data []byte, res int32)
+}
+
+func newRing() (*ioRing, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, ringSlots, uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	r := &ioRing{fd: int(fd)}
+	if p.features&ioringFeatSingleMmap == 0 {
+		r.Close()
+		return nil, errors.New("kernel too old")
+	}
+
+	size := p.sqOff.array + p.sqEntries*4
+	if cqSize := p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(uringCQE{})); cqSize > size {
+		size = cqSize
+	}
+	var err error
+	r.rings, err = unix.Mmap(r.fd, ioringOffSQRing, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.sqesMem, err = unix.Mmap(r.fd, ioringOffSQEs, int(p.sqEntries)*int(unsafe.Sizeof(uringSQE{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&r.sqesMem[0])), p.sqEntries)
+	r.sqHead = r.word(p.sqOff.head)
+	r.sqTail = r.word(p.sqOff.tail)
+	r.sqMask = *r.word(p.sqOff.ringMask)
+	r.sqArray = unsafe.Slice(r.word(p.sqOff.array), p.sqEntries)
+	r.cqHead = r.word(p.cqOff.head)
+	r.cqTail = r.word(p.cqOff.tail)
+	r.cqMask = *r.word(p.cqOff.ringMask)
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&r.rings[p.cqOff.cqes])), p.cqEntries)
+
+	r.arena, err = unix.Mmap(-1, 0, ringSlots*ringSlotSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	iovecs := make([]unix.Iovec, ringSlots)
+	for i := range iovecs {
+		iovecs[i].Base = &r.slot(i)[0]
+		iovecs[i].SetLen(ringSlotSize)
+	}
+	_, _, errno = unix.Syscall6(unix.SYS_IO_URING_REGISTER, fd, ioringRegisterBuffers, uintptr(unsafe.Pointer(&iovecs[0])), ringSlots, 0, 0)
+	r.fixed = errno == 0
+	for i := ringSlots - 1; i >= 0; i-- {
+		r.free = append(r.free, i)
+	}
+	return r, nil
+}
+
+func (r *ioRing) word(off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&r.rings[off]))
+}
+
+func (r *ioRing) slot(i int) []byte {
+	return r.arena[i*ringSlotSize : (i+1)*ringSlotSize]
+}
+
+// read queues a read of up to n bytes at off for the reader, unless all
+// slots are in use.
+func (r *ioRing) read(reader *uringReader, fd int, off int64, n int) bool {
+	if n > ringSlotSize {
+		n = ringSlotSize
+	}
+	slot, ok := r.take(reader, n)
+	if ok {
+		r.queue(ioringOpRead, ioringOpReadFixed, slot, fd, off, n)
+	}
+	return ok
+}
+
+// write queues a write of data at off for the writer, at most a slot of
+// it, unless all slots are in use. The data is copied.
+func (r *ioRing) write(writer *uringWriter, fd int, off int64, data []byte) (int, bool) {
+	n := len(data)
+	if n > ringSlotSize {
+		n = ringSlotSize
+	}
+	slot, ok := r.take(writer, n)
+	if ok {
+		copy(r.slot(slot), data[:n])
+		r.queue(ioringOpWrite, ioringOpWriteFixed, slot, fd, off, n)
+	}
+	return n, ok
+}
+
+func (r *ioRing) take(owner ringOwner, n int) (int, bool) {
+	if len(r.free) == 0 {
+		return 0, false
+	}
+	slot := r.free[len(r.free)-1]
+	r.free = r.free[:len(r.free)-1]
+	r.owners[slot], r.lens[slot] = owner, n
+	r.inflight++
+	return slot, true
+}
+
+func (r *ioRing) queue(op, fixedOp uint8, slot, fd int, off int64, n int) {
+	// there are more entries than slots, so the queue is never full
+	tail := *r.sqTail
+	i := tail & r.sqMask
+	sqe := uringSQE{opcode: op, fd: int32(fd), off: uint64(off), addr: uint64(uintptr(unsafe.Pointer(&r.slot(slot)[0]))), len: uint32(n), userData: uint64(slot)}
+	if r.fixed {
+		sqe.opcode, sqe.bufIndex = fixedOp, uint16(slot)
+	}
+	r.sqes[i] = sqe
+	r.sqArray[i] = i
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.queued++
+}
+
+// submit passes the queued operations to the kernel.
+func (r *ioRing) submit() error {
+	return r.enter(0, 0)
+}
+
+// wait submits the queued operations and waits for one to complete.
+func (r *ioRing) wait() error {
+	err := r.enter(1, ioringEnterGetEvents)
+	r.reap()
+	return err
+}
+
+func (r *ioRing) enter(min, flags uintptr) error {
+	for r.queued > 0 || min > 0 {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(r.queued), min, flags, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		r.queued -= uint32(n)
+		min = 0
+	}
+	return nil
+}
+
+// reap passes the completed operations to their readers and writers.
+func (r *ioRing) reap() {
+	head := *r.cqHead
+	for tail := atomic.LoadUint32(r.cqTail); head != tail; head++ {
+		cqe := r.cqes[head&r.cqMask]
+		slot := int(cqe.userData)
+		owner := r.owners[slot]
+		r.owners[slot] = nil
+		owner.complete(r.slot(slot)[:r.lens[slot]], cqe.res)
+		r.free = append(r.free, slot)
+		r.inflight--
+	}
+	atomic.StoreUint32(r.cqHead, head)
+}
+
+// Close waits for the operations in flight, the kernel uses the arena
+// until they completed.
+func (r *ioRing) Close() error {
+	for r.inflight > 0 {
+		if err := r.wait(); err != nil {
+			break
+		}
+	}
+	if r.arena != nil {
+		unix.Munmap(r.arena)
+	}
+	if r.sqesMem != nil {
+		unix.Munmap(r.sqesMem)
+	}
+	if r.rings != nil {
+		unix.Munmap(r.rings)
+	}
+	return unix.Close(r.fd)
+}
+
+// uringReader reads a shared file ahead through the ring, at most limit
+// bytes.
+type uringReader struct {
+	ring  *ioRing
+	src   *sharedReader
+	fd    int
+	limit int
+
+	buf    []byte
+	off    int64
+	busy   bool
+	err    error
+	closed bool
+}
+
+func (r *ioRing) reader(src *sharedReader, limit int) io.ReadCloser {
+	return &uringReader{ring: r, src: src, fd: int(src.file.f.Fd()), limit: limit, off: src.off}
+}
+
+func (u *uringReader) fill() {
+	if !u.busy && u.err == nil && len(u.buf) < u.limit {
+		u.busy = u.ring.read(u, u.fd, u.off, u.limit-len(u.buf))
+	}
+}
+
+func (u *uringReader) complete(data []byte, res int32) {
+	u.busy = false
+	switch {
+	case res < 0:
+		u.err = syscall.Errno(-res)
+	case res == 0:
+		u.err = io.EOF
+	default:
+		u.buf = append(u.buf, data[:res]...)
+		u.off += int64(res)
+	}
+	if u.closed {
+		u.src.Close()
+	}
+}
+
+// ready reports whether n bytes can be read without blocking, and queues
+// the next read.
+func (u *uringReader) ready(n int) bool {
+	u.ring.reap()
+	u.fill()
+	return len(u.buf) >= n || u.err != nil
+}
+
+// wait blocks until n bytes can be read without blocking.
+func (u *uringReader) wait(n int) {
+	for !u.ready(n) {
+		if err := u.ring.wait(); err != nil && u.err == nil {
+			u.err = err
+		}
+	}
+}
+
+func (u *uringReader) Read(p []byte) (int, error) {
+	u.wait(1)
+	if len(u.buf) == 0 {
+		return 0, u.err
+	}
+	n := copy(p, u.buf)
+	u.buf = append(u.buf[:0], u.buf[n:]...)
+	return n, nil
+}
+
+// Close releases the file once no read is in flight anymore.
+func (u *uringReader) Close() error {
+	u.closed = true
+	if u.busy {
+		return nil
+	}
+	return u.src.Close()
+}
+
+// uringWriter writes an upload through the ring at increasing offsets. The
+// writes complete in any order, a failed one is returned by the next Write
+// or flush.
+type uringWriter struct {
+	ring     *ioRing
+	fd       int
+	off      int64
+	inflight int
+	err      error
+}
+
+func (r *ioRing) writer(f *os.File, off int64) *uringWriter {
+	return &uringWriter{ring: r, fd: int(f.Fd()), off: off}
+}
+
+func (w *uringWriter) Write(p []byte) (int, error) {
+	w.ring.reap()
+	written := 0
+	for written < len(p) && w.err == nil {
+		n, ok := w.ring.write(w, w.fd, w.off, p[written:])
+		if !ok {
+			// every slot is in use
+			if err := w.ring.wait(); err != nil {
+				return written, err
+			}
+			continue
+		}
+		w.inflight++
+		w.off += int64(n)
+		written += n
+	}
+	return written, w.err
+}
+
+func (w *uringWriter) complete(data []byte, res int32) {
+	w.inflight--
+	switch {
+	case res < 0 && w.err == nil:
+		w.err = syscall.Errno(-res)
+	case int(res) < len(data) && w.err == nil:
+		w.err = io.ErrShortWrite
+	}
+}
+
+// flush waits for the writes in flight.
+func (w *uringWriter) flush() error {
+	for w.inflight > 0 {
+		if err := w.ring.wait(); err != nil {
+			return err
+		}
+	}
+	return w.err
+}
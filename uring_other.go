@@ -0,0 +1,39 @@
+//go:build !linux
+
+package tftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+type ioRing struct{}
+
+func newRing() (*ioRing, error) {
+	return nil, errors.New("only available on Linux")
+}
+
+func (r *ioRing) reader(src *sharedReader, limit int) io.ReadCloser {
+	return src
+}
+
+func (r *ioRing) submit() error {
+	return nil
+}
+
+func (r *ioRing) Close() error {
+	return nil
+}
+
+type uringWriter struct {
+	io.Writer
+}
+
+func (r *ioRing) writer(f *os.File, off int64) *uringWriter {
+	return &uringWriter{f}
+}
+
+func (w *uringWriter) flush() error {
+	return nil
+}
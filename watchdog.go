@@ -0,0 +1,22 @@
+package tftpd
+
+import "time"
+
+// ping calls the watchdog if it's due.
+func (tftp *TFTPServer) ping(now time.Time) {
+	if tftp.Watchdog == nil || now.Before(tftp.nextPing) {
+		return
+	}
+	tftp.Watchdog()
+	tftp.nextPing = now.Add(tftp.WatchdogInterval)
+}
+
+// readDeadline returns when the packet loop has to wake up at the latest,
+// for retransmissions or the watchdog. Zero means never.
+func (tftp *TFTPServer) readDeadline() time.Time {
+	next := tftp.nextDeadline()
+	if tftp.Watchdog != nil && (next.IsZero() || tftp.nextPing.Before(next)) {
+		next = tftp.nextPing
+	}
+	return next
+}
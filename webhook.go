@@ -0,0 +1,135 @@
+package tftpd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Notifications waiting for a slow endpoint beyond webhookQueue are
+// dropped.
+const (
+	webhookQueue      = 256
+	webhookRetries    = 5
+	webhookTimeout    = 10 * time.Second
+	webhookMaxBackoff = time.Minute
+)
+
+// Webhook POSTs events as JSON to every URL, the end of each transfer as
+// the OnTransfer hook, or all events as an EventPublisher. Failed
+// deliveries are retried with a backoff, a dead endpoint doesn't delay the
+// others.
+//
+// With a secret, the X-TFTP-Signature header is "sha256=" and the hex
+// encoded HMAC-SHA256 of the body, so receivers can authenticate it.
+type Webhook struct {
+	secret []byte
+	// Client sends the requests, it can be replaced before the first
+	// notification.
+	Client *http.Client
+	// Backoff is the delay before the first retry, doubled for every
+	// other one up to a minute, one second by default.
+	Backoff time.Duration
+
+	queues []chan Event
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+func NewWebhook(urls []string, secret []byte) *Webhook {
+	w := &Webhook{secret: secret, Client: &http.Client{Timeout: webhookTimeout}, Backoff: time.Second}
+	for _, url := range urls {
+		queue := make(chan Event, webhookQueue)
+		w.queues = append(w.queues, queue)
+		w.wg.Add(1)
+		go w.deliver(url, queue)
+	}
+	return w
+}
+
+// Notify queues the record for delivery without blocking, it's meant to
+// be the OnTransfer hook.
+func (w *Webhook) Notify(rec AuditRecord) {
+	w.Publish(Event{Type: eventType(rec), AuditRecord: rec})
+}
+
+// Publish queues the event for delivery without blocking.
+func (w *Webhook) Publish(ev Event) error {
+	for _, queue := range w.queues {
+		select {
+		case queue <- ev:
+		default:
+			log.Printf("[%v] Webhook queue full, notification dropped\n", ev.Session)
+		}
+	}
+	return nil
+}
+
+// Close delivers the queued notifications and stops. Notify mustn't be
+// called anymore.
+func (w *Webhook) Close() error {
+	w.once.Do(func() {
+		for _, queue := range w.queues {
+			close(queue)
+		}
+	})
+	w.wg.Wait()
+	return nil
+}
+
+func (w *Webhook) deliver(url string, queue chan Event) {
+	defer w.wg.Done()
+	for ev := range queue {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("error while encoding webhook event: '%v'\n", err)
+			continue
+		}
+		backoff := w.Backoff
+		for attempt := 0; ; attempt++ {
+			retry, err := w.post(url, ev.Type, body)
+			if err == nil {
+				break
+			}
+			if !retry || attempt == webhookRetries {
+				log.Printf("[%v] Webhook '%v' failed: '%v'\n", ev.Session, url, err)
+				break
+			}
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		}
+	}
+}
+
+// post sends the event once, client errors other than 429 aren't retried.
+func (w *Webhook) post(url, event string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-TFTP-Event", event)
+	if w.secret != nil {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set("X-TFTP-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, errors.New(resp.Status)
+}
@@ -0,0 +1,154 @@
+package tftpd
+
+import (
+	"git.scarlet.house/oss/go-tftpd/wire"
+)
+
+// windowsize option (RFC 7440), defaultMaxWindowSize limits the buffers a
+// download keeps for retransmission.
+const (
+	maxWindowSize        = 65535
+	defaultMaxWindowSize = 64
+)
+
+// sentPacket is a DATA of a window and its pooled buffer.
+type sentPacket struct {
+	packet []byte
+	buf    *[]byte
+}
+
+func (tftp *TFTPServer) maxWindowSize() int {
+	if tftp.MaxWindowSize > 0 {
+		return tftp.MaxWindowSize
+	}
+	return defaultMaxWindowSize
+}
+
+// window returns the number of blocks sent (or received) per ACK.
+func (cli *client) window() int {
+	if cli.windowSize > 1 {
+		return cli.windowSize
+	}
+	return 1
+}
+
+// sendWindow returns the number of blocks a download may have in flight,
+// the window adapted to the loss seen so far.
+func (cli *client) sendWindow() int {
+	if cli.cwnd > 0 {
+		return cli.cwnd
+	}
+	return cli.window()
+}
+
+// shrinkWindow halves the window of a download on loss, once per window of
+// blocks in flight when it happened (like TCP's fast recovery), so a burst
+// of loss isn't punished several times.
+func (cli *client) shrinkWindow(n uint16) {
+	if cli.windowSize <= 1 || int16(n-cli.recover) < 0 {
+		return
+	}
+	cli.cwnd /= 2
+	if cli.cwnd < 1 {
+		cli.cwnd = 1
+	}
+	cli.recover = cli.block
+}
+
+// growWindow widens the window of a download by a block after a window
+// went through without loss, up to the negotiated windowsize.
+func (cli *client) growWindow() {
+	if cli.cwnd < cli.windowSize {
+		cli.cwnd++
+	}
+}
+
+// lastSent returns the last packet queued for the session.
+func (cli *client) lastSent() []byte {
+	if len(cli.unacked) > 0 {
+		return cli.unacked[len(cli.unacked)-1].packet
+	}
+	return cli.sent
+}
+
+// slideWindow drops the blocks of a download acknowledged by the ACK of
+// block n. An ACK short of the last block sent means the client missed the
+// next one, only the blocks from there are sent again instead of the whole
+// window, and the window shrinks. It grows again with every window
+// acknowledged completely (AIMD).
+func (tftp *TFTPServer) slideWindow(cli *client, n uint16) error {
+	if len(cli.unacked) == 0 {
+		// the ACK of the OACK, or a duplicate
+		if n != cli.block {
+			return errIgnored
+		}
+		return nil
+	}
+	acked := int(n - (cli.block - uint16(len(cli.unacked))))
+	if acked == 0 || acked > len(cli.unacked) {
+		// duplicate ACKs aren't answered, see handleRequest
+		return errIgnored
+	}
+	for _, p := range cli.unacked[:acked] {
+		tftp.outBufs = append(tftp.outBufs, p.buf)
+	}
+	cli.unacked = cli.unacked[:copy(cli.unacked, cli.unacked[acked:])]
+	cli.tries = 0
+
+	if len(cli.unacked) == 0 && cli.lastPkt {
+		return endOfSession
+	}
+	if len(cli.unacked) == 0 {
+		cli.growWindow()
+	} else {
+		cli.shrinkWindow(n)
+		cli.logf("Client '%v' missed block %d, sending %d blocks again\n", cli.tid.String(), n+1, len(cli.unacked))
+		tftp.resend(cli)
+	}
+	return nil
+}
+
+// fillWindow sends DATA until the window of a download is full.
+func (tftp *TFTPServer) fillWindow(cli *client) error {
+	for !cli.lastPkt && !cli.held && len(cli.unacked) < cli.sendWindow() {
+		req := &request{opcode: wire.OpACK, number: cli.block}
+		if tftp.waitForData(cli, req) {
+			return nil
+		}
+		if err := tftp.sendData(cli, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// windowEnd reports whether the DATA just written completes the window of
+// an upload, only then (or at its end) it's acknowledged.
+func (cli *client) windowEnd() bool {
+	return cli.lastPkt || int(cli.block-cli.acked) >= cli.window()
+}
+
+// ackReceived acknowledges what's written of an upload when the client
+// sends a block again (dup) or a block after a gap. Without a window the
+// last ACK is repeated for duplicates only, with one it's sent once until
+// the next block is written, retransmit repeats it if it gets lost.
+func (tftp *TFTPServer) ackReceived(cli *client, dup bool) error {
+	if cli.windowSize <= 1 || cli.waiting {
+		if dup {
+			tftp.resend(cli)
+		}
+		return errIgnored
+	}
+	if cli.gap {
+		return errIgnored
+	}
+	cli.gap = true
+	if cli.acked == cli.block {
+		tftp.resend(cli)
+		return errIgnored
+	}
+	if err := tftp.sendData(cli, &request{opcode: wire.OpDATA, number: cli.block}); err != nil {
+		return err
+	}
+	return errIgnored
+}
@@ -1,4 +1,4 @@
-package tftpd
+package wire
 
 import "fmt"
 
@@ -6,6 +6,10 @@ func toCString(src string) []byte {
 	return append([]byte(src), 0x0)
 }
 
+func appendCString(dst []byte, src string) []byte {
+	return append(append(dst, src...), 0x0)
+}
+
 func readCString(src []byte) (int, string, error) {
 	end := 0
 	for ; end < len(src) && src[end] != 0; end++ {
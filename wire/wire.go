@@ -0,0 +1,484 @@
+// Package wire implements encoding and decoding of TFTP packets as
+// described in RFC 1350, including the option extension (RFC 2347).
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// HeaderSize is the size of the opcode and block number (or error code)
+// header of DATA, ACK and ERROR packets.
+const HeaderSize = 4
+
+// Opcode is the type of a TFTP packet.
+type Opcode uint16
+
+const (
+	OpRRQ Opcode = iota + 1
+	OpWRQ
+	OpDATA
+	OpACK
+	OpERROR
+	OpOACK
+)
+
+var opcodeNames = [...]string{
+	OpRRQ:   "RRQ",
+	OpWRQ:   "WRQ",
+	OpDATA:  "DATA",
+	OpACK:   "ACK",
+	OpERROR: "ERROR",
+	OpOACK:  "OACK",
+}
+
+func (op Opcode) String() string {
+	if op < OpRRQ || op > OpOACK {
+		return fmt.Sprintf("Opcode(%d)", uint16(op))
+	}
+	return opcodeNames[op]
+}
+
+var (
+	ErrMalformed     = errors.New("malformed packet")
+	ErrUnknownOpcode = errors.New("unknown opcode")
+)
+
+// Packet is implemented by all TFTP packet types.
+type Packet interface {
+	Opcode() Opcode
+	// AppendBinary appends the encoded packet to b.
+	AppendBinary(b []byte) ([]byte, error)
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary(b []byte) error
+	// String returns a one-line summary, e.g. for packet traces.
+	String() string
+}
+
+// Marshal encodes a packet.
+func Marshal(p Packet) ([]byte, error) {
+	return p.AppendBinary(nil)
+}
+
+// Unmarshal decodes a packet. DATA payloads reference b and aren't copied.
+// The opcode is a big-endian uint16, zero and values past OACK are rejected
+// with ErrUnknownOpcode. Bytes after the ACK block number or the ERROR message
+// are ignored, use UnmarshalStrict to reject them.
+func Unmarshal(b []byte) (Packet, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("%w: packet too short", ErrMalformed)
+	}
+
+	var p Packet
+	switch op := Opcode(binary.BigEndian.Uint16(b)); op {
+	case OpRRQ:
+		p = &ReadRequest{}
+	case OpWRQ:
+		p = &WriteRequest{}
+	case OpDATA:
+		p = &Data{}
+	case OpACK:
+		p = &Ack{}
+	case OpERROR:
+		p = &Error{}
+	case OpOACK:
+		p = &OptionAck{}
+	default:
+		return nil, fmt.Errorf("%w %d", ErrUnknownOpcode, uint16(op))
+	}
+
+	if err := p.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// UnmarshalStrict decodes a packet like Unmarshal, but also rejects
+// trailing bytes after a well-formed packet.
+func UnmarshalStrict(b []byte) (Packet, error) {
+	p, err := Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var n int
+	switch p := p.(type) {
+	case *Ack:
+		n = HeaderSize
+	case *Error:
+		n = HeaderSize + len(p.Message) + 1
+	default:
+		// requests and OACKs must consist of options till the end and
+		// DATA payload takes the whole packet
+		return p, nil
+	}
+
+	if len(b) > n {
+		return nil, fmt.Errorf("%w: %d trailing bytes after %v", ErrMalformed, len(b)-n, p.Opcode())
+	}
+	return p, nil
+}
+
+// UnmarshalLenient decodes a packet like Unmarshal, but tolerates requests
+// of buggy clients: garbage or NUL padding after the mode or the options
+// is dropped, as is a missing NUL after the mode at the end.
+func UnmarshalLenient(b []byte) (Packet, error) {
+	if len(b) >= 2 {
+		switch op := Opcode(binary.BigEndian.Uint16(b)); op {
+		case OpRRQ:
+			r := &ReadRequest{}
+			if err := (*request)(r).unmarshal(b, op, true); err != nil {
+				return nil, err
+			}
+			return r, nil
+		case OpWRQ:
+			r := &WriteRequest{}
+			if err := (*request)(r).unmarshal(b, op, true); err != nil {
+				return nil, err
+			}
+			return r, nil
+		}
+	}
+	return Unmarshal(b)
+}
+
+// Option is a single RFC 2347 option.
+type Option struct {
+	Name  string
+	Value string
+}
+
+// Options keeps the options in the order they were sent.
+type Options []Option
+
+// Get returns the value of the named option, names are case insensitive.
+func (o Options) Get(name string) (string, bool) {
+	for _, opt := range o {
+		if strings.EqualFold(opt.Name, name) {
+			return opt.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set replaces the value of the named option or adds it.
+func (o *Options) Set(name, value string) {
+	for i, opt := range *o {
+		if strings.EqualFold(opt.Name, name) {
+			(*o)[i].Value = value
+			return
+		}
+	}
+	*o = append(*o, Option{name, value})
+}
+
+// String formats the options as name=value pairs.
+func (o Options) String() string {
+	var sb strings.Builder
+	for i, opt := range o {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(opt.Name)
+		sb.WriteByte('=')
+		sb.WriteString(opt.Value)
+	}
+	return sb.String()
+}
+
+// Del removes the named option.
+func (o *Options) Del(name string) {
+	opts := (*o)[:0]
+	for _, opt := range *o {
+		if !strings.EqualFold(opt.Name, name) {
+			opts = append(opts, opt)
+		}
+	}
+	*o = opts
+}
+
+func (o Options) appendTo(b []byte) ([]byte, error) {
+	for _, opt := range o {
+		if opt.Name == "" {
+			return nil, errors.New("empty option name")
+		}
+		if err := checkCString(opt.Name, opt.Value); err != nil {
+			return nil, err
+		}
+		b = appendCString(appendCString(b, opt.Name), opt.Value)
+	}
+	return b, nil
+}
+
+// readOptions returns the options, with an error also those before it.
+func readOptions(b []byte) (Options, error) {
+	var opts Options
+	for len(b) > 0 {
+		n, name, err := readCString(b)
+		if err != nil {
+			return opts, fmt.Errorf("%w: option name: %v", ErrMalformed, err)
+		}
+		b = b[n:]
+
+		n, value, err := readCString(b)
+		if err != nil {
+			return opts, fmt.Errorf("%w: option '%v' value: %v", ErrMalformed, name, err)
+		}
+		b = b[n:]
+
+		opts = append(opts, Option{name, value})
+	}
+	return opts, nil
+}
+
+func checkCString(strs ...string) error {
+	for _, s := range strs {
+		if strings.IndexByte(s, 0) >= 0 {
+			return fmt.Errorf("string '%v' contains NUL", s)
+		}
+	}
+	return nil
+}
+
+func checkOpcode(b []byte, op Opcode) error {
+	if len(b) < 2 {
+		return fmt.Errorf("%w: packet too short", ErrMalformed)
+	}
+	if got := Opcode(binary.BigEndian.Uint16(b)); got != op {
+		return fmt.Errorf("%w: expected %v, got %v", ErrMalformed, op, got)
+	}
+	return nil
+}
+
+func appendOpcode(b []byte, op Opcode) []byte {
+	return binary.BigEndian.AppendUint16(b, uint16(op))
+}
+
+// request is the shared encoding of RRQ and WRQ.
+type request struct {
+	Filename string
+	Mode     string
+	Options  Options
+}
+
+func (r *request) append(b []byte, op Opcode) ([]byte, error) {
+	if err := checkCString(r.Filename, r.Mode); err != nil {
+		return nil, err
+	}
+	b = appendOpcode(b, op)
+	b = appendCString(appendCString(b, r.Filename), r.Mode)
+	return r.Options.appendTo(b)
+}
+
+func (r *request) string(op Opcode) string {
+	s := fmt.Sprintf("%v '%v' %v", op, r.Filename, r.Mode)
+	if len(r.Options) > 0 {
+		s += " " + r.Options.String()
+	}
+	return s
+}
+
+func (r *request) unmarshal(b []byte, op Opcode, lenient bool) error {
+	if err := checkOpcode(b, op); err != nil {
+		return err
+	}
+	b = b[2:]
+
+	n, filename, err := readCString(b)
+	if err != nil {
+		return fmt.Errorf("%w: filename: %v", ErrMalformed, err)
+	}
+	b = b[n:]
+
+	n, mode, err := readCString(b)
+	if err != nil && lenient && len(b) > 0 {
+		n, mode, err = len(b), string(b), nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: mode: %v", ErrMalformed, err)
+	}
+	b = b[n:]
+
+	opts, err := readOptions(b)
+	if lenient {
+		// NUL padding reads as options without a name
+		valid := opts[:0]
+		for _, opt := range opts {
+			if opt.Name != "" {
+				valid = append(valid, opt)
+			}
+		}
+		opts, err = valid, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	*r = request{filename, mode, opts}
+	return nil
+}
+
+// ReadRequest is a RRQ packet.
+type ReadRequest request
+
+func (r *ReadRequest) Opcode() Opcode { return OpRRQ }
+
+func (r *ReadRequest) AppendBinary(b []byte) ([]byte, error) {
+	return (*request)(r).append(b, OpRRQ)
+}
+
+func (r *ReadRequest) MarshalBinary() ([]byte, error) { return r.AppendBinary(nil) }
+
+func (r *ReadRequest) UnmarshalBinary(b []byte) error {
+	return (*request)(r).unmarshal(b, OpRRQ, false)
+}
+
+func (r *ReadRequest) String() string { return (*request)(r).string(OpRRQ) }
+
+// WriteRequest is a WRQ packet.
+type WriteRequest request
+
+func (r *WriteRequest) Opcode() Opcode { return OpWRQ }
+
+func (r *WriteRequest) AppendBinary(b []byte) ([]byte, error) {
+	return (*request)(r).append(b, OpWRQ)
+}
+
+func (r *WriteRequest) MarshalBinary() ([]byte, error) { return r.AppendBinary(nil) }
+
+func (r *WriteRequest) UnmarshalBinary(b []byte) error {
+	return (*request)(r).unmarshal(b, OpWRQ, false)
+}
+
+func (r *WriteRequest) String() string { return (*request)(r).string(OpWRQ) }
+
+// Data is a DATA packet.
+type Data struct {
+	Block   uint16
+	Payload []byte
+}
+
+func (d *Data) Opcode() Opcode { return OpDATA }
+
+func (d *Data) AppendBinary(b []byte) ([]byte, error) {
+	b = appendOpcode(b, OpDATA)
+	b = binary.BigEndian.AppendUint16(b, d.Block)
+	return append(b, d.Payload...), nil
+}
+
+func (d *Data) MarshalBinary() ([]byte, error) { return d.AppendBinary(nil) }
+
+// UnmarshalBinary decodes a DATA packet, Payload references b.
+func (d *Data) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(b, OpDATA); err != nil {
+		return err
+	}
+	if len(b) < HeaderSize {
+		return fmt.Errorf("%w: DATA without block number", ErrMalformed)
+	}
+
+	d.Block = binary.BigEndian.Uint16(b[2:])
+	d.Payload = b[HeaderSize:]
+	return nil
+}
+
+func (d *Data) String() string {
+	return fmt.Sprintf("DATA %v (%v bytes)", d.Block, len(d.Payload))
+}
+
+// Ack is an ACK packet.
+type Ack struct {
+	Block uint16
+}
+
+func (a *Ack) Opcode() Opcode { return OpACK }
+
+func (a *Ack) AppendBinary(b []byte) ([]byte, error) {
+	b = appendOpcode(b, OpACK)
+	return binary.BigEndian.AppendUint16(b, a.Block), nil
+}
+
+func (a *Ack) MarshalBinary() ([]byte, error) { return a.AppendBinary(nil) }
+
+func (a *Ack) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(b, OpACK); err != nil {
+		return err
+	}
+	if len(b) < HeaderSize {
+		return fmt.Errorf("%w: ACK without block number", ErrMalformed)
+	}
+
+	a.Block = binary.BigEndian.Uint16(b[2:])
+	return nil
+}
+
+func (a *Ack) String() string { return fmt.Sprintf("ACK %v", a.Block) }
+
+// Error is an ERROR packet.
+type Error struct {
+	Code    uint16
+	Message string
+}
+
+func (e *Error) Opcode() Opcode { return OpERROR }
+
+func (e *Error) AppendBinary(b []byte) ([]byte, error) {
+	if err := checkCString(e.Message); err != nil {
+		return nil, err
+	}
+	b = appendOpcode(b, OpERROR)
+	b = binary.BigEndian.AppendUint16(b, e.Code)
+	return appendCString(b, e.Message), nil
+}
+
+func (e *Error) MarshalBinary() ([]byte, error) { return e.AppendBinary(nil) }
+
+func (e *Error) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(b, OpERROR); err != nil {
+		return err
+	}
+	if len(b) < HeaderSize {
+		return fmt.Errorf("%w: ERROR without error code", ErrMalformed)
+	}
+
+	_, message, err := readCString(b[HeaderSize:])
+	if err != nil {
+		return fmt.Errorf("%w: error message: %v", ErrMalformed, err)
+	}
+
+	e.Code = binary.BigEndian.Uint16(b[2:])
+	e.Message = message
+	return nil
+}
+
+func (e *Error) String() string { return fmt.Sprintf("ERROR %v '%v'", e.Code, e.Message) }
+
+// OptionAck is an OACK packet (RFC 2347).
+type OptionAck struct {
+	Options Options
+}
+
+func (o *OptionAck) Opcode() Opcode { return OpOACK }
+
+func (o *OptionAck) AppendBinary(b []byte) ([]byte, error) {
+	return o.Options.appendTo(appendOpcode(b, OpOACK))
+}
+
+func (o *OptionAck) MarshalBinary() ([]byte, error) { return o.AppendBinary(nil) }
+
+func (o *OptionAck) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(b, OpOACK); err != nil {
+		return err
+	}
+
+	opts, err := readOptions(b[2:])
+	if err != nil {
+		return err
+	}
+	o.Options = opts
+	return nil
+}
+
+func (o *OptionAck) String() string { return "OACK " + o.Options.String() }
@@ -0,0 +1,234 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var cStringTestData = []struct {
+	str     string
+	cString []byte
+}{
+	{"hello world!", []byte{104, 101, 108, 108, 111, 32, 119, 111, 114, 108, 100, 33, 0}},
+	{"", []byte{0}},
+}
+
+func TestToCString(t *testing.T) {
+	for _, v := range cStringTestData {
+		converted := toCString(v.str)
+		if !reflect.DeepEqual(converted, v.cString) {
+			t.Fatalf("C strings are not equal. %v and %v\n", converted, v.cString)
+		}
+	}
+}
+
+func TestReadCString(t *testing.T) {
+	for _, v := range cStringTestData {
+		n, correctStr, err := readCString(v.cString)
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if n != len(v.cString) {
+			t.Fatalf("Incorrect number of read bytes. Got %v, should be %v\n", n, len(v.cString))
+		}
+		if correctStr != v.str {
+			t.Fatalf("Incorrect reading of C string %v. Got '%v', should be '%v'\n", v.cString, correctStr, v.str)
+		}
+	}
+
+	incorrect := cStringTestData[0].cString[:len(cStringTestData[0].cString)-1]
+	_, _, err := readCString(incorrect)
+	if err == nil {
+		t.Fatalf("Error shouldn't be nil\n")
+	}
+}
+
+var packetTestData = []struct {
+	packet Packet
+	raw    []byte
+}{
+	{&ReadRequest{Filename: "a", Mode: "octet"}, []byte{0, 1, 'a', 0, 'o', 'c', 't', 'e', 't', 0}},
+	{&WriteRequest{Filename: "a", Mode: "octet", Options: Options{{"blksize", "1428"}}},
+		append([]byte{0, 2, 'a', 0, 'o', 'c', 't', 'e', 't', 0}, "blksize\x001428\x00"...)},
+	{&Data{Block: 258, Payload: []byte{1, 2, 3}}, []byte{0, 3, 1, 2, 1, 2, 3}},
+	{&Ack{Block: 65535}, []byte{0, 4, 255, 255}},
+	{&Error{Code: 1, Message: "File not found."}, append([]byte{0, 5, 0, 1}, "File not found.\x00"...)},
+	{&OptionAck{Options: Options{{"tsize", "0"}}}, append([]byte{0, 6}, "tsize\x000\x00"...)},
+}
+
+func TestMarshal(t *testing.T) {
+	for _, v := range packetTestData {
+		raw, err := Marshal(v.packet)
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if !reflect.DeepEqual(raw, v.raw) {
+			t.Fatalf("Incorrect encoding of %v. Got %v, should be %v\n", v.packet.Opcode(), raw, v.raw)
+		}
+	}
+
+	_, err := Marshal(&ReadRequest{Filename: "a\x00b", Mode: "octet"})
+	if err == nil {
+		t.Fatalf("Error shouldn't be nil\n")
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	for _, v := range packetTestData {
+		packet, err := Unmarshal(v.raw)
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+		if !reflect.DeepEqual(packet, v.packet) {
+			t.Fatalf("Incorrect decoding of %v. Got %+v, should be %+v\n", v.raw, packet, v.packet)
+		}
+	}
+}
+
+var malformedTestData = [][]byte{
+	{},
+	{0},
+	{0, 1},
+	{0, 1, 'a'},
+	{0, 1, 'a', 0},
+	{0, 1, 'a', 0, 'o', 'c', 't', 'e', 't'},
+	{0, 2, 'a', 0, 'o', 0, 'b', 'l', 'k'},
+	{0, 2, 'a', 0, 'o', 0, 'b', 0, '8'},
+	{0, 3, 0},
+	{0, 4},
+	{0, 4, 1},
+	{0, 5, 0},
+	{0, 5, 0, 1},
+	{0, 5, 0, 1, 'x'},
+	{0, 6, 'x'},
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	for _, v := range malformedTestData {
+		_, err := Unmarshal(v)
+		if !errors.Is(err, ErrMalformed) {
+			t.Fatalf("Decoding %v should fail with ErrMalformed, got: %v\n", v, err)
+		}
+	}
+
+	_, err := Unmarshal([]byte{0xff, 0x01, 'a', 0, 'o', 0})
+	if !errors.Is(err, ErrUnknownOpcode) {
+		t.Fatalf("Decoding should fail with ErrUnknownOpcode, got: %v\n", err)
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	for _, v := range packetTestData {
+		_, err := UnmarshalStrict(v.raw)
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+	}
+
+	for _, raw := range [][]byte{{0, 4, 0, 1, 0}, {0, 5, 0, 1, 'x', 0, 'y'}} {
+		if _, err := Unmarshal(raw); err != nil {
+			t.Fatalf("Error should be nil for %v, got: %v\n", raw, err)
+		}
+		if _, err := UnmarshalStrict(raw); !errors.Is(err, ErrMalformed) {
+			t.Fatalf("Decoding %v should fail with ErrMalformed, got: %v\n", raw, err)
+		}
+	}
+
+	for _, raw := range [][]byte{{0, 0, 0, 1}, {0, 7, 0, 1}, {0xff, 0x01, 'a', 0, 'o', 0}} {
+		if _, err := UnmarshalStrict(raw); !errors.Is(err, ErrUnknownOpcode) {
+			t.Fatalf("Decoding %v should fail with ErrUnknownOpcode, got: %v\n", raw, err)
+		}
+	}
+}
+
+func TestUnmarshalLenient(t *testing.T) {
+	for _, v := range packetTestData {
+		_, err := UnmarshalLenient(v.raw)
+		if err != nil {
+			t.Fatalf("Error should be nil, got: %v\n", err)
+		}
+	}
+
+	for _, v := range []struct {
+		raw  string
+		want string
+	}{
+		// garbage after the mode
+		{"\x00\x01f\x00octet\x00\xff\xfe", "RRQ 'f' octet"},
+		// NUL padding
+		{"\x00\x01f\x00octet\x00\x00\x00\x00", "RRQ 'f' octet"},
+		{"\x00\x02f\x00octet\x00blksize\x001428\x00\x00\x00\x00", "WRQ 'f' octet blksize=1428"},
+		// no NUL after the mode
+		{"\x00\x01f\x00OCTET", "RRQ 'f' OCTET"},
+	} {
+		if _, err := Unmarshal([]byte(v.raw)); err == nil {
+			t.Fatalf("Decoding %q should fail\n", v.raw)
+		}
+		p, err := UnmarshalLenient([]byte(v.raw))
+		if err != nil || p.String() != v.want {
+			t.Fatalf("Incorrect packet %v for %q: %v\n", p, v.raw, err)
+		}
+	}
+
+	for _, raw := range [][]byte{{0, 1, 'f'}, {0, 1, 'f', 0}, {0, 4, 0}} {
+		if _, err := UnmarshalLenient(raw); !errors.Is(err, ErrMalformed) {
+			t.Fatalf("Decoding %v should fail with ErrMalformed, got: %v\n", raw, err)
+		}
+	}
+}
+
+func FuzzReadCString(f *testing.F) {
+	for _, v := range cStringTestData {
+		f.Add(v.cString)
+	}
+	f.Add([]byte("no terminator"))
+	f.Add([]byte{0, 0, 'a'})
+
+	f.Fuzz(func(t *testing.T, src []byte) {
+		n, str, err := readCString(src)
+		if err != nil {
+			if bytes.IndexByte(src, 0) >= 0 {
+				t.Fatalf("C string %v should be read, got: %v\n", src, err)
+			}
+			return
+		}
+		if n < 1 || n > len(src) || src[n-1] != 0 || str != string(src[:n-1]) || strings.IndexByte(str, 0) >= 0 {
+			t.Fatalf("Incorrect reading of C string %v. Got %v bytes, '%v'\n", src, n, str)
+		}
+	})
+}
+
+func FuzzOptionParsing(f *testing.F) {
+	f.Add([]byte("blksize\x001428\x00tsize\x000\x00"))
+	f.Add([]byte("timeout\x00"))
+	f.Add([]byte("\x00\x00"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		opts, err := readOptions(b)
+		if err != nil {
+			if !errors.Is(err, ErrMalformed) {
+				t.Fatalf("Error should be ErrMalformed, got: %v\n", err)
+			}
+			return
+		}
+
+		for _, opt := range opts {
+			if _, ok := opts.Get(opt.Name); !ok {
+				t.Fatalf("Option '%v' should be found in %v\n", opt.Name, opts)
+			}
+			if opt.Name == "" {
+				// empty names are read, but never sent
+				return
+			}
+		}
+
+		encoded, err := opts.appendTo(nil)
+		if err != nil || !bytes.Equal(encoded, b) {
+			t.Fatalf("Options %v should encode to %v, got %v (%v)\n", opts, b, encoded, err)
+		}
+	})
+}
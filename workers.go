@@ -0,0 +1,84 @@
+package tftpd
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// workerPool runs the background work of sessions on a fixed number of
+// goroutines, see TFTPServer.Workers. Jobs beyond the queue are refused.
+type workerPool struct {
+	jobs chan func()
+	// jobs running or queued, at most limit
+	load  atomic.Int32
+	limit int32
+}
+
+func newWorkerPool(workers, queue int) *workerPool {
+	p := &workerPool{jobs: make(chan func(), workers+queue), limit: int32(workers + queue)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for job := range p.jobs {
+		p.run(job)
+		p.load.Add(-1)
+	}
+}
+
+// run recovers from panics so a bug doesn't cost the pool a worker.
+func (p *workerPool) run(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Background job panicked: %v\n", r)
+		}
+	}()
+	job()
+}
+
+// submit queues the job unless the queue is full.
+func (p *workerPool) submit(job func()) bool {
+	if p.load.Add(1) > p.limit {
+		p.load.Add(-1)
+		return false
+	}
+	p.jobs <- job
+	return true
+}
+
+// close stops the workers once they ran the queued jobs.
+func (p *workerPool) close() {
+	close(p.jobs)
+}
+
+// spawn runs background work of a session, e.g. reading a stream ahead,
+// in a goroutine of its own or on the worker pool. Sessions are refused
+// while the pool is saturated.
+func (tftp *TFTPServer) spawn(job func()) error {
+	if tftp.Workers <= 0 {
+		go job()
+		return nil
+	}
+	if tftp.workers == nil {
+		queue := tftp.WorkQueue
+		if queue <= 0 {
+			queue = tftp.Workers
+		}
+		tftp.workers = newWorkerPool(tftp.Workers, queue)
+	}
+	if tftp.workers.submit(job) {
+		return nil
+	}
+	return tftp.busy()
+}
+
+// closeWorkers stops the pool, the jobs of the ended sessions return soon.
+func (tftp *TFTPServer) closeWorkers() {
+	if tftp.workers != nil {
+		tftp.workers.close()
+		tftp.workers = nil
+	}
+}